@@ -1,65 +1,417 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
-	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"qiuxs.com/stable-diffusion-webui-mcp/internal"
+	"qiuxs.com/stable-diffusion-webui-mcp/sdwebui"
 )
 
 type ApiHandler struct {
-	fileService *internal.FileService
+	config         *internal.ConfigStore
+	sdwebuiService *sdwebui.SdwebuiService
+	fileService    *internal.FileService
+	auditLog       *internal.AuditLog
+	moderator      *internal.Moderator
 }
 
-func NewApiHandler(fileService *internal.FileService) *ApiHandler {
+func NewApiHandler(config *internal.ConfigStore, sdwebuiService *sdwebui.SdwebuiService, fileService *internal.FileService, auditLog *internal.AuditLog, moderator *internal.Moderator) *ApiHandler {
 	return &ApiHandler{
-		fileService: fileService,
+		config:         config,
+		sdwebuiService: sdwebuiService,
+		fileService:    fileService,
+		auditLog:       auditLog,
+		moderator:      moderator,
 	}
 }
 
+// healthz 存活检查，进程能处理请求即返回 200
+func (h *ApiHandler) healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": StatusOK})
+}
+
+// readyz 就绪检查，至少一个 WebUI 后端可以访问且存储可写时返回 200，否则返回 503
+func (h *ApiHandler) readyz(c *gin.Context) {
+	ctx := c.Request.Context()
+	checks := gin.H{}
+	ready := true
+
+	if err := h.fileService.CheckStorage(ctx); err != nil {
+		ready = false
+		checks["storage"] = err.Error()
+	} else {
+		checks["storage"] = StatusOK
+	}
+	if backends, err := h.sdwebuiService.Ready(ctx); err != nil {
+		ready = false
+		checks["backends"] = err.Error()
+	} else {
+		checks["backends"] = backends
+	}
+
+	if !ready {
+		internal.Logger(ctx).WithField("checks", checks).Warn("就绪检查失败")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": StatusUnavailable, "checks": checks})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": StatusOK, "checks": checks})
+}
+
+// 审计日志查询每次返回的记录数
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// queryAudit 按条件查询审计日志，只有 admin 可以访问
+func (h *ApiHandler) queryAudit(c *gin.Context) {
+	var req AuditQueryRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("参数错误: %v", err)})
+		return
+	}
+	from, err := parseDate(req.DateFrom, false)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "date_from " + err.Error()})
+		return
+	}
+	to, err := parseDate(req.DateTo, true)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "date_to " + err.Error()})
+		return
+	}
+	if req.Limit <= 0 {
+		req.Limit = defaultAuditLimit
+	}
+	req.Limit = min(req.Limit, maxAuditLimit)
+
+	entries, err := h.auditLog.Query(internal.AuditQuery{
+		From:      from,
+		To:        to,
+		Principal: req.Principal,
+		Tool:      req.Tool,
+		Action:    req.Action,
+		Outcome:   req.Outcome,
+		ImageID:   req.ImageID,
+		JobID:     req.JobID,
+		Prompt:    req.Prompt,
+		AdminOnly: req.Admin,
+		Limit:     req.Limit,
+	})
+	if err != nil {
+		internal.Logger(c.Request.Context()).WithError(err).Error("查询审计日志失败")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询审计日志失败"})
+		return
+	}
+	if entries == nil {
+		entries = []*internal.AuditEntry{}
+	}
+	c.JSON(http.StatusOK, AuditQueryResponse{Entries: entries, Count: len(entries)})
+}
+
+// status 返回存储和每个后端的状态，?backend= 只检查指定后端
+func (h *ApiHandler) status(c *gin.Context) {
+	response, err := serverStatus(c.Request.Context(), h.config.Get(), h.sdwebuiService, h.fileService, c.Query("backend"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
 func (h *ApiHandler) readFile(c *gin.Context) {
+	kind := "original"
+	defer func() {
+		internal.RecordFileRequest(kind, c.Writer.Status())
+	}()
+
 	// 获取路径参数，去除开头的斜杠
-	filePath := c.Param("filePath")
-	if len(filePath) > 0 && filePath[0] == '/' {
-		filePath = filePath[1:]
-	}
+	filePath := strings.TrimPrefix(c.Param("filePath"), "/")
 
 	// 安全检查：防止路径遍历攻击
-	// 1. 检查是否包含 .. 或 ..\（Windows路径遍历）
-	if strings.Contains(filePath, "..") {
+	if err := internal.ValidateKey(filePath); err != nil {
 		c.String(http.StatusBadRequest, "非法的文件路径")
 		return
 	}
-
-	// 2. 清理路径并检查是否包含绝对路径或危险字符
-	cleanedPath := filepath.Clean(filePath)
-	// 如果清理后的路径包含 ..，说明原路径试图越界
-	if strings.Contains(cleanedPath, "..") {
-		c.String(http.StatusBadRequest, "非法的文件路径")
+	// 与查看图片元数据一致，不区分其他调用方的图片和不存在的图片
+	if !canReadFile(h.fileService, internal.PrincipalFromContext(c.Request.Context()), filePath) {
+		c.String(http.StatusNotFound, "文件不存在")
 		return
 	}
 
-	// 3. 检查是否以斜杠开头（绝对路径）
-	if filepath.IsAbs(cleanedPath) {
-		c.String(http.StatusBadRequest, "非法的文件路径")
+	// 请求缩放图片（如 ?w=256&fit=cover&fmt=webp）时返回缓存中的缩放图片
+	variant, err := internal.ParseVariantOptions(c.Request.URL.Query())
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if variant != nil {
+		kind = "variant"
+		file, info, err := h.fileService.ReadVariant(c.Request.Context(), filePath, variant)
+		switch {
+		case errors.Is(err, internal.ErrObjectNotFound):
+			c.String(http.StatusNotFound, "文件不存在")
+		case errors.Is(err, internal.ErrInvalidVariant):
+			c.String(http.StatusBadRequest, err.Error())
+		case err != nil:
+			internal.Logger(c.Request.Context()).WithError(err).Errorf("生成缩放图片失败: %s", filePath)
+			c.String(http.StatusInternalServerError, "读取文件失败")
+		default:
+			defer file.Close()
+			h.serveFile(c, filePath, file, info)
+		}
 		return
 	}
 
-	// 使用清理后的路径
-	file, err := h.fileService.ReadFile(cleanedPath)
+	// 存储支持直接访问时（如 S3 预签名地址）重定向，图片不再经由本服务转发
+	directUrl, err := h.fileService.DirectURL(c.Request.Context(), filePath)
 	if err != nil {
-		c.String(http.StatusNotFound, "文件不存在")
+		internal.Logger(c.Request.Context()).WithError(err).Errorf("生成图片直接访问地址失败: %s", filePath)
+		c.String(http.StatusInternalServerError, "读取文件失败")
+		return
+	}
+	if directUrl != "" {
+		kind = "redirect"
+		c.Redirect(http.StatusFound, directUrl)
 		return
 	}
 
-	fileData, err := io.ReadAll(file)
+	file, info, err := h.fileService.ReadFile(c.Request.Context(), filePath)
+	if errors.Is(err, internal.ErrObjectNotFound) {
+		c.String(http.StatusNotFound, "文件不存在")
+		return
+	}
 	if err != nil {
+		internal.Logger(c.Request.Context()).WithError(err).Errorf("读取文件失败: %s", filePath)
 		c.String(http.StatusInternalServerError, "读取文件失败")
 		return
 	}
+	defer file.Close()
+
+	h.serveFile(c, filePath, file, info)
+}
+
+// serveFile 按 http.ServeContent 的语义返回图片，支持 If-None-Match/If-Modified-Since 条件请求（304）和 Range 请求
+func (h *ApiHandler) serveFile(c *gin.Context, filePath string, file io.ReadSeeker, info *internal.ObjectInfo) {
+	header := c.Writer.Header()
+	header.Set("Content-Type", info.ContentType)
+	if info.ETag != "" {
+		header.Set("ETag", info.ETag)
+	}
+
+	// 携带 API Key 的响应只允许客户端缓存，签名链接和匿名访问的响应可以由 CDN 缓存
+	visibility := "public"
+	if c.GetHeader("Authorization") != "" {
+		visibility = "private"
+	}
+	if h.fileService.ContentAddressed(filePath) {
+		// 图片路径对应的内容不会变化，缩放图片的缓存也按内容摘要区分
+		header.Set("Cache-Control", visibility+", max-age=31536000, immutable")
+	} else {
+		header.Set("Cache-Control", visibility+", no-cache")
+	}
 
-	c.Data(http.StatusOK, "image/png", fileData)
+	http.ServeContent(c.Writer, c.Request, "", info.ModTime, file)
+}
+
+func (h *ApiHandler) listImages(c *gin.Context) {
+	var req SearchImagesRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("参数错误: %v", err)})
+		return
+	}
+
+	response, err := searchImages(h.fileService, internal.PrincipalFromContext(c.Request.Context()), req)
+	if errors.Is(err, errForeignImage) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func (h *ApiHandler) getImage(c *gin.Context) {
+	response, err := imageDetail(h.fileService, internal.PrincipalFromContext(c.Request.Context()), c.Param("id"))
+	if errors.Is(err, internal.ErrImageNotFound) || errors.Is(err, errForeignImage) {
+		// 不区分不存在和无权查看，避免泄露其他调用方的图片 ID
+		c.JSON(http.StatusNotFound, gin.H{"error": internal.ErrImageNotFound.Error()})
+		return
+	}
+	if err != nil {
+		internal.Logger(c.Request.Context()).WithError(err).WithField(internal.LogFieldImageID, c.Param("id")).Error("获取图片记录失败")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取图片记录失败"})
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// pinImage POST 置顶图片，DELETE 取消置顶
+func (h *ApiHandler) pinImage(c *gin.Context) {
+	pinned := c.Request.Method != http.MethodDelete
+	record, err := pinImage(h.fileService, internal.PrincipalFromContext(c.Request.Context()), PinImageRequest{
+		ID:     c.Param("id"),
+		Pinned: &pinned,
+	})
+	if errors.Is(err, internal.ErrImageNotFound) || errors.Is(err, errForeignImage) {
+		c.JSON(http.StatusNotFound, gin.H{"error": internal.ErrImageNotFound.Error()})
+		return
+	}
+	if err != nil {
+		internal.Logger(c.Request.Context()).WithError(err).WithField(internal.LogFieldImageID, c.Param("id")).Error("设置图片置顶失败")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "设置图片置顶失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": record.ID, "pinned": record.Pinned})
+}
+
+// exportImages 将选择的图片和清单打包为 ZIP 流式返回，GET 使用查询参数，POST 使用 JSON 请求体
+func (h *ApiHandler) exportImages(c *gin.Context) {
+	var req ExportImagesRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("参数错误: %v", err)})
+		return
+	}
+	// 查询参数中的 ids 也可以使用逗号分隔
+	if len(req.IDs) == 1 && strings.Contains(req.IDs[0], ",") {
+		req.IDs = strings.Split(req.IDs[0], ",")
+	}
+
+	principal := internal.PrincipalFromContext(c.Request.Context())
+	records, err := selectExportImages(h.fileService, principal, req, h.config.Get().Limits.MaxExportImages)
+	if errors.Is(err, errForeignImage) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	fileName := fmt.Sprintf("images-%s.zip", time.Now().Format("20060102-150405"))
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, fileName))
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+
+	// 响应已经开始，出错时只能中断连接
+	if err := writeExportArchive(c.Request.Context(), c.Writer, h.fileService, records, req.Manifest); err != nil {
+		internal.Logger(c.Request.Context()).WithError(err).Error("导出图片失败")
+		abortConnection(c)
+		return
+	}
+	internal.Logger(c.Request.Context()).Infof("导出了 %d 张图片", len(records))
+}
+
+// maxProvenanceUploadBytes 溯源验证接口上传图片的大小上限
+const maxProvenanceUploadBytes = 32 << 20
+
+// verifyProvenance 验证图片的溯源清单，支持 multipart 上传（file 为图片，可选 manifest 为旁路清单）
+// 或 JSON 请求体（与 verify_provenance 工具参数一致）
+func (h *ApiHandler) verifyProvenance(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxProvenanceUploadBytes)
+
+	var req VerifyProvenanceRequest
+	var report *internal.ProvenanceReport
+	var err error
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		var image, manifest []byte
+		if image, err = readFormFile(c, "file"); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("读取上传的图片失败: %v", err)})
+			return
+		}
+		if manifest, err = readFormFile(c, "manifest"); err != nil && !errors.Is(err, http.ErrMissingFile) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("读取上传的清单失败: %v", err)})
+			return
+		}
+		report, err = h.fileService.VerifyProvenanceData(image, manifest)
+	} else {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("参数错误: %v", err)})
+			return
+		}
+		report, err = verifyProvenance(c.Request.Context(), h.fileService, internal.PrincipalFromContext(c.Request.Context()), req)
+	}
+	if errors.Is(err, internal.ErrImageNotFound) || errors.Is(err, errForeignImage) || errors.Is(err, internal.ErrObjectNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": internal.ErrImageNotFound.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// readFormFile 读取 multipart 表单中的文件，字段不存在时返回 http.ErrMissingFile
+func readFormFile(c *gin.Context, name string) ([]byte, error) {
+	header, err := c.FormFile(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// queryModeration 查询命中内容审核规则的记录，供管理员复核，只有 admin 可以访问
+func (h *ApiHandler) queryModeration(c *gin.Context) {
+	var req ModerationQueryRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("参数错误: %v", err)})
+		return
+	}
+	if req.Limit <= 0 {
+		req.Limit = defaultAuditLimit
+	}
+	req.Limit = min(req.Limit, maxAuditLimit)
+
+	events, err := h.moderator.Events(internal.ModerationQuery{
+		Principal:    req.Principal,
+		Policy:       req.Policy,
+		RejectedOnly: req.Rejected,
+		Limit:        req.Limit,
+	})
+	if err != nil {
+		internal.Logger(c.Request.Context()).WithError(err).Error("查询内容审核记录失败")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询内容审核记录失败"})
+		return
+	}
+	if events == nil {
+		events = []*internal.ModerationEvent{}
+	}
+	c.JSON(http.StatusOK, ModerationQueryResponse{Events: events, Count: len(events)})
+}
+
+// abortConnection 在响应已经开始后中断连接，使客户端收到传输错误，而不是把被截断的响应当作成功；
+// 不支持 Hijack 时（如 HTTP/2）通过 http.ErrAbortHandler 让 net/http 重置流
+func abortConnection(c *gin.Context) {
+	c.Abort()
+	// gin 的 ResponseWriter 在写入响应后拒绝 Hijack，直接使用 net/http 的 ResponseWriter
+	var w http.ResponseWriter = c.Writer
+	for {
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		w = unwrapper.Unwrap()
+	}
+	if hijacker, ok := w.(http.Hijacker); ok {
+		if conn, _, err := hijacker.Hijack(); err == nil {
+			conn.Close()
+			return
+		}
+	}
+	panic(http.ErrAbortHandler)
 }
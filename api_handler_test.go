@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"qiuxs.com/stable-diffusion-webui-mcp/internal"
+)
+
+func TestReadFileOwnership(t *testing.T) {
+	app := newTestApp(t, nil, nil)
+	record := app.saveImage(t, "alice", 1)
+	target := "/api/v1/read/file/" + record.Key
+	// 没有元数据记录的文件
+	data := []byte("legacy")
+	if err := app.storage.Put(context.Background(), "legacy/old.png", bytes.NewReader(data), int64(len(data)), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		token  string
+		want   int
+	}{
+		{"所有者", target, "alice-key", http.StatusOK},
+		{"所有者读取缩放图片", target + "?w=32", "alice-key", http.StatusOK},
+		{"其他调用方", target, "bob-key", http.StatusNotFound},
+		{"其他调用方读取缩放图片", target + "?w=32", "bob-key", http.StatusNotFound},
+		{"admin", target, "admin-key", http.StatusOK},
+		{"没有元数据记录的文件", "/api/v1/read/file/legacy/old.png", "alice-key", http.StatusNotFound},
+		{"admin 读取没有元数据记录的文件", "/api/v1/read/file/legacy/old.png", "admin-key", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := app.do(http.MethodGet, tt.target, tt.token, nil); w.Code != tt.want {
+				t.Errorf("GET %s = %d, want %d", tt.target, w.Code, tt.want)
+			}
+		})
+	}
+
+	// 签名链接不检查图片归属
+	signed := internal.NewURLSigner(app.config).FileURL(record.Key)
+	if w := app.do(http.MethodGet, signed, "", nil); w.Code != http.StatusOK {
+		t.Errorf("签名链接 GET %s = %d", signed, w.Code)
+	}
+}
+
+func TestReadFileConditionalAndRange(t *testing.T) {
+	app := newTestApp(t, nil, nil)
+	record := app.saveImage(t, "alice", 1)
+	target := "/api/v1/read/file/" + record.Key
+	etag := `"` + record.SHA256 + `"`
+
+	w := app.do(http.MethodGet, target, "alice-key", nil)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != etag {
+		t.Fatalf("GET = %d, ETag = %s, want %s", w.Code, w.Header().Get("ETag"), etag)
+	}
+	full := w.Body.Bytes()
+	if int64(len(full)) != record.Size {
+		t.Errorf("body = %d 字节, want %d", len(full), record.Size)
+	}
+	// 携带 API Key 的响应只允许客户端缓存，内容不变的图片可以长期缓存
+	if got := w.Header().Get("Cache-Control"); got != "private, max-age=31536000, immutable" {
+		t.Errorf("Cache-Control = %q", got)
+	}
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   int
+		body   []byte
+	}{
+		{"ETag 一致", http.Header{"If-None-Match": {etag}}, http.StatusNotModified, nil},
+		{"ETag 列表中包含", http.Header{"If-None-Match": {`"other", ` + etag}}, http.StatusNotModified, nil},
+		{"ETag 不一致", http.Header{"If-None-Match": {`"other"`}}, http.StatusOK, full},
+		{"Range", http.Header{"Range": {"bytes=0-9"}}, http.StatusPartialContent, full[:10]},
+		{"后缀 Range", http.Header{"Range": {"bytes=-5"}}, http.StatusPartialContent, full[len(full)-5:]},
+		{"If-Range 一致", http.Header{"Range": {"bytes=0-9"}, "If-Range": {etag}}, http.StatusPartialContent, full[:10]},
+		{"If-Range 不一致时返回完整内容", http.Header{"Range": {"bytes=0-9"}, "If-Range": {`"other"`}}, http.StatusOK, full},
+		{"无法满足的 Range", http.Header{"Range": {"bytes=100000000-"}}, http.StatusRequestedRangeNotSatisfiable, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := app.do(http.MethodGet, target, "alice-key", tt.header)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.body != nil && !bytes.Equal(w.Body.Bytes(), tt.body) {
+				t.Errorf("body = %d 字节, want %d", w.Body.Len(), len(tt.body))
+			}
+			if tt.want == http.StatusNotModified && (w.Body.Len() != 0 || w.Header().Get("ETag") != etag) {
+				t.Errorf("304 body = %d 字节, ETag = %s", w.Body.Len(), w.Header().Get("ETag"))
+			}
+			if tt.want == http.StatusPartialContent && !strings.HasSuffix(w.Header().Get("Content-Range"), "/"+strconv.Itoa(len(full))) {
+				t.Errorf("Content-Range = %q", w.Header().Get("Content-Range"))
+			}
+		})
+	}
+
+	head := app.do(http.MethodHead, target, "alice-key", nil)
+	if head.Code != http.StatusOK || head.Body.Len() != 0 || head.Header().Get("Content-Length") != strconv.Itoa(len(full)) {
+		t.Errorf("HEAD = %d, body = %d, Content-Length = %s", head.Code, head.Body.Len(), head.Header().Get("Content-Length"))
+	}
+
+	// 缩放图片使用自己的 ETag
+	variant := app.do(http.MethodGet, target+"?w=32", "alice-key", nil)
+	variantETag := variant.Header().Get("ETag")
+	if variant.Code != http.StatusOK || variantETag == "" || variantETag == etag {
+		t.Fatalf("缩放图片 = %d, ETag = %s", variant.Code, variantETag)
+	}
+	if w := app.do(http.MethodGet, target+"?w=32", "alice-key", http.Header{"If-None-Match": {variantETag}}); w.Code != http.StatusNotModified {
+		t.Errorf("缩放图片 If-None-Match = %d", w.Code)
+	}
+
+	// 签名链接的响应可以由 CDN 缓存
+	signed := internal.NewURLSigner(app.config).FileURL(record.Key)
+	if got := app.do(http.MethodGet, signed, "", nil).Header().Get("Cache-Control"); got != "public, max-age=31536000, immutable" {
+		t.Errorf("签名链接 Cache-Control = %q", got)
+	}
+}
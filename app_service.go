@@ -11,17 +11,25 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
+	"qiuxs.com/stable-diffusion-webui-mcp/internal"
 	"qiuxs.com/stable-diffusion-webui-mcp/sdwebui"
 )
 
 type AppService struct {
+	config         *internal.ConfigStore
 	sdwebuiService *sdwebui.SdwebuiService
 	router         *gin.Engine
 	httpServer     *http.Server
 	mcpServer      *mcp.Server
 	mcpHandler     *McpHandler
 	apiHandler     *ApiHandler
+	oauthVerifier  *internal.OAuthVerifier
+	urlSigner      *internal.URLSigner
+	rateLimiter    *internal.RateLimiter
+	usageTracker   *internal.UsageTracker
+	auditLog       *internal.AuditLog
 }
 
 const BASE_MCP_PATH = "/mcp"
@@ -64,27 +72,62 @@ func (s *AppService) Start(port string) error {
 func setupRoutes(appService *AppService) *gin.Engine {
 	router := gin.New()
 
-	router.Use(gin.Logger())
+	router.Use(requestLogMiddleware())
 
-	router.Use(gin.Recovery())
+	// http.ErrAbortHandler 用于中断已经开始的响应（见 abortConnection），需要交给 net/http 处理
+	router.Use(gin.CustomRecovery(func(c *gin.Context, err any) {
+		if err == http.ErrAbortHandler {
+			panic(err)
+		}
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}))
+
+	router.GET(protectedResourceMetadataPath, protectedResourceMetadata(appService))
+	router.GET(protectedResourceMetadataPath+"/*resource", protectedResourceMetadata(appService))
+
+	// /mcp 和 /sse 只要求认证通过，具体工具的权限在调用时检查
+	mcpAuth := authMiddleware(appService, "")
 
-	setupStreamableHttpHandler(appService, router)
+	setupStreamableHttpHandler(appService, router, mcpAuth)
 
-	setupSseEndpoints(appService, router)
+	setupSseEndpoints(appService, router, mcpAuth)
 
 	setupApiV1(appService, router)
 
+	router.GET("/metrics", authMiddleware(appService, internal.ScopeMetrics), gin.WrapH(promhttp.Handler()))
+
+	// 供 Kubernetes 等探测使用，不需要认证
+	router.GET("/healthz", appService.apiHandler.healthz)
+	router.GET("/readyz", appService.apiHandler.readyz)
+
 	return router
 }
 
 func setupApiV1(appService *AppService, router *gin.Engine) {
 	apiV1Group := router.Group("/api/v1")
 	{
-		apiV1Group.GET("/read/file/*filePath", appService.apiHandler.readFile)
+		apiV1Group.GET("/read/file/*filePath", fileAuthMiddleware(appService), apiRateLimitMiddleware(appService), appService.apiHandler.readFile)
+		apiV1Group.HEAD("/read/file/*filePath", fileAuthMiddleware(appService), apiRateLimitMiddleware(appService), appService.apiHandler.readFile)
+
+		readFilesAuth := authMiddleware(appService, internal.ScopeReadFiles)
+		apiV1Group.GET("/images", readFilesAuth, apiRateLimitMiddleware(appService), appService.apiHandler.listImages)
+		apiV1Group.GET("/images/:id", readFilesAuth, apiRateLimitMiddleware(appService), appService.apiHandler.getImage)
+		apiV1Group.GET("/export", readFilesAuth, apiRateLimitMiddleware(appService), auditMiddleware(appService, internal.ScopeReadFiles), appService.apiHandler.exportImages)
+		apiV1Group.POST("/export", readFilesAuth, apiRateLimitMiddleware(appService), auditMiddleware(appService, internal.ScopeReadFiles), appService.apiHandler.exportImages)
+		apiV1Group.POST("/provenance/verify", readFilesAuth, apiRateLimitMiddleware(appService), appService.apiHandler.verifyProvenance)
+
+		generateAuth := authMiddleware(appService, internal.ScopeGenerate)
+		apiV1Group.POST("/images/:id/pin", generateAuth, apiRateLimitMiddleware(appService), auditMiddleware(appService, internal.ScopeGenerate), appService.apiHandler.pinImage)
+		apiV1Group.DELETE("/images/:id/pin", generateAuth, apiRateLimitMiddleware(appService), auditMiddleware(appService, internal.ScopeGenerate), appService.apiHandler.pinImage)
+		apiV1Group.GET("/status", generateAuth, apiRateLimitMiddleware(appService), appService.apiHandler.status)
+
+		adminAuth := authMiddleware(appService, internal.ScopeAdmin)
+		apiV1Group.GET("/audit", adminAuth, apiRateLimitMiddleware(appService), auditMiddleware(appService, internal.ScopeAdmin), appService.apiHandler.queryAudit)
+		apiV1Group.GET("/moderation", adminAuth, apiRateLimitMiddleware(appService), auditMiddleware(appService, internal.ScopeAdmin), appService.apiHandler.queryModeration)
 	}
 }
 
-func setupStreamableHttpHandler(appService *AppService, router *gin.Engine) {
+func setupStreamableHttpHandler(appService *AppService, router *gin.Engine, authHandler gin.HandlerFunc) {
 	mcpHandler := mcp.NewStreamableHTTPHandler(
 		func(r *http.Request) *mcp.Server {
 			return appService.mcpServer
@@ -94,29 +137,44 @@ func setupStreamableHttpHandler(appService *AppService, router *gin.Engine) {
 		},
 	)
 
-	router.Any(BASE_MCP_PATH, gin.WrapH(mcpHandler))
-	router.Any(fmt.Sprintf("%s/*path", BASE_MCP_PATH), gin.WrapH(mcpHandler))
+	handler := gin.WrapH(withTokenInfo(mcpHandler))
+	router.Any(BASE_MCP_PATH, authHandler, handler)
+	router.Any(fmt.Sprintf("%s/*path", BASE_MCP_PATH), authHandler, handler)
 }
 
-func setupSseEndpoints(appService *AppService, router *gin.Engine) {
+func setupSseEndpoints(appService *AppService, router *gin.Engine, authHandler gin.HandlerFunc) {
 	sseMcpHandler := mcp.NewSSEHandler(
 		func(request *http.Request) *mcp.Server {
 			return appService.mcpServer
 		},
 		&mcp.SSEOptions{},
 	)
-	router.Any("/sse", gin.WrapH(sseMcpHandler))
-	router.Any("/sse/*path", gin.WrapH(sseMcpHandler))
+	handler := gin.WrapH(withSSESessionBinding(sseMcpHandler))
+	router.Any("/sse", authHandler, handler)
+	router.Any("/sse/*path", authHandler, handler)
 }
 
-func NewAppService(sdwebuiService *sdwebui.SdwebuiService, apiHandler *ApiHandler) *AppService {
+func NewAppService(config *internal.ConfigStore, sdwebuiService *sdwebui.SdwebuiService, mcpHandler *McpHandler, apiHandler *ApiHandler, urlSigner *internal.URLSigner, usageTracker *internal.UsageTracker, auditLog *internal.AuditLog) *AppService {
 	appService := &AppService{
+		config:         config,
 		sdwebuiService: sdwebuiService,
-		mcpHandler:     NewMcpHandler(sdwebuiService),
+		mcpHandler:     mcpHandler,
 		apiHandler:     apiHandler,
+		oauthVerifier:  internal.NewOAuthVerifier(),
+		urlSigner:      urlSigner,
+		rateLimiter:    internal.NewRateLimiter(),
+		usageTracker:   usageTracker,
+		auditLog:       auditLog,
 	}
 
 	appService.mcpServer = InitMCPServer(appService)
+	internal.RegisterSessionGauge(func() int {
+		count := 0
+		for range appService.mcpServer.Sessions() {
+			count++
+		}
+		return count
+	})
 
 	return appService
 }
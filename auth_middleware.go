@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/modelcontextprotocol/go-sdk/auth"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"github.com/modelcontextprotocol/go-sdk/oauthex"
+	"github.com/sirupsen/logrus"
+	"qiuxs.com/stable-diffusion-webui-mcp/internal"
+)
+
+const (
+	authRealm = "stable-diffusion-webui-mcp"
+
+	// API Key 本身没有过期时间，MCP SDK 要求 TokenInfo 必须带有过期时间
+	apiKeyTokenLifetime = 24 * time.Hour
+
+	protectedResourceMetadataPath = "/.well-known/oauth-protected-resource"
+)
+
+// authMiddleware 校验 Bearer Token（API Key 或 OAuth 访问令牌）并将调用方写入请求 context，
+// scope 为空时只要求认证通过
+func authMiddleware(appService *AppService, scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		config := appService.config.Get()
+
+		var principal *internal.Principal
+		if !config.Auth.Enabled {
+			principal = internal.AnonymousPrincipal()
+		} else {
+			token, ok := bearerToken(c.Request)
+			if !ok {
+				abortUnauthorized(c, config, "", "缺少 Authorization: Bearer 认证信息")
+				return
+			}
+
+			if config.Auth.OAuth.Enabled && internal.LooksLikeJWT(token) {
+				var err error
+				principal, err = appService.oauthVerifier.Verify(c.Request.Context(), &config.Auth.OAuth, token)
+				if err != nil {
+					internal.Logger(c.Request.Context()).WithError(err).WithField("client_ip", c.ClientIP()).Warnf("OAuth 访问令牌校验失败: %s %s", c.Request.Method, c.Request.URL.Path)
+					abortUnauthorized(c, config, "invalid_token", err.Error())
+					return
+				}
+			} else {
+				principal, ok = config.Auth.VerifyAPIKey(token)
+				if !ok {
+					internal.Logger(c.Request.Context()).WithField("client_ip", c.ClientIP()).Warnf("API Key 认证失败: %s %s", c.Request.Method, c.Request.URL.Path)
+					abortUnauthorized(c, config, "invalid_token", "无效的 API Key")
+					return
+				}
+			}
+		}
+
+		if !principal.HasScope(scope) {
+			c.Header("WWW-Authenticate", bearerChallenge(config, "insufficient_scope", fmt.Sprintf(`scope="%s"`, scope)))
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("权限不足，需要 %s 权限", scope)})
+			return
+		}
+
+		ctx := internal.WithLogFields(c.Request.Context(), logrus.Fields{internal.LogFieldPrincipal: principal.ID})
+		c.Request = c.Request.WithContext(internal.WithPrincipal(ctx, principal))
+		c.Next()
+	}
+}
+
+// fileAuthMiddleware 图片读取接口的认证：携带签名时只校验签名和有效期，否则要求 read-files 权限
+func fileAuthMiddleware(appService *AppService) gin.HandlerFunc {
+	tokenAuth := authMiddleware(appService, internal.ScopeReadFiles)
+
+	return func(c *gin.Context) {
+		config := appService.config.Get()
+
+		sig := c.Query("sig")
+		if sig == "" {
+			// 未启用认证时，签名是唯一的访问凭证
+			if config.Auth.SignedURLs.Enabled && !config.Auth.Enabled {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "缺少链接签名"})
+				return
+			}
+			tokenAuth(c)
+			return
+		}
+
+		relativePath := strings.TrimPrefix(c.Param("filePath"), "/")
+		if err := appService.urlSigner.Verify(relativePath, c.Query("exp"), sig); err != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Request = c.Request.WithContext(internal.WithPrincipal(c.Request.Context(), internal.SignedURLPrincipal()))
+		c.Next()
+	}
+}
+
+// apiRateLimitMiddleware HTTP 接口的限流，需位于认证中间件之后；
+// 使用 API Key 或 OAuth 认证的调用方按调用方限流，签名链接和匿名访问按客户端 IP 限流
+func apiRateLimitMiddleware(appService *AppService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := internal.PrincipalFromContext(c.Request.Context())
+
+		key := principal.ID
+		if principal.Kind == internal.PrincipalAnonymous || principal.Kind == internal.PrincipalSignedURL {
+			key = "ip:" + c.ClientIP()
+		}
+
+		if err := appService.rateLimiter.Allow("api:"+key, appService.config.Get().Limits.APIRateLimit); err != nil {
+			if retryAfter, ok := internal.RetryAfter(err); ok {
+				c.Header("Retry-After", strconv.FormatInt(internal.RetryAfterSeconds(retryAfter), 10))
+			}
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+			return
+		}
+		c.Next()
+	}
+}
+
+// auditMiddleware 将 HTTP 接口的调用写入审计日志，需位于认证中间件之后，scope 为接口要求的权限
+func auditMiddleware(appService *AppService, scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !appService.auditLog.Enabled() {
+			c.Next()
+			return
+		}
+
+		ctx := c.Request.Context()
+		query := c.Request.URL.Query()
+		query.Del("sig")
+		entry := &internal.AuditEntry{
+			Time:      time.Now(),
+			Action:    internal.AuditActionAPI,
+			Admin:     scope == internal.ScopeAdmin,
+			RequestID: internal.RequestIDFromContext(ctx),
+			ClientIP:  c.ClientIP(),
+			Method:    c.Request.Method,
+			Path:      c.Request.URL.Path,
+			Query:     query.Encode(),
+		}
+		if principal := internal.PrincipalFromContext(ctx); principal != nil {
+			entry.Principal = principal.ID
+			entry.Role = principal.Role
+		}
+		c.Request = c.Request.WithContext(internal.WithAuditEntry(ctx, entry))
+
+		c.Next()
+
+		entry.Status = c.Writer.Status()
+		entry.DurationMs = time.Since(entry.Time).Milliseconds()
+		entry.Outcome = internal.OutcomeSuccess
+		if entry.Status >= http.StatusBadRequest {
+			entry.Outcome = internal.OutcomeError
+			if len(c.Errors) > 0 {
+				entry.Error = c.Errors.String()
+			}
+		}
+		appService.auditLog.Write(entry)
+	}
+}
+
+func abortUnauthorized(c *gin.Context, config *internal.Config, errorCode string, message string) {
+	var extra []string
+	if errorCode != "" {
+		extra = append(extra, fmt.Sprintf(`error_description="%s"`, strings.ReplaceAll(message, `"`, `'`)))
+	}
+	c.Header("WWW-Authenticate", bearerChallenge(config, errorCode, extra...))
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": message})
+}
+
+// bearerChallenge 构造 WWW-Authenticate 响应头，启用 OAuth 时附带受保护资源元数据地址（RFC 9728）
+func bearerChallenge(config *internal.Config, errorCode string, extra ...string) string {
+	params := []string{fmt.Sprintf(`realm="%s"`, authRealm)}
+	if config.Auth.OAuth.Enabled {
+		params = append(params, fmt.Sprintf(`resource_metadata="%s"`, protectedResourceMetadataUrl(config)))
+	}
+	if errorCode != "" {
+		params = append(params, fmt.Sprintf(`error="%s"`, errorCode))
+	}
+	params = append(params, extra...)
+	return "Bearer " + strings.Join(params, ", ")
+}
+
+// protectedResourceMetadataUrl 按 RFC 9728 在资源地址的路径前插入 /.well-known/oauth-protected-resource
+func protectedResourceMetadataUrl(config *internal.Config) string {
+	resource, err := url.Parse(config.Auth.OAuth.Resource)
+	if err != nil {
+		return config.Server.PublicURL + protectedResourceMetadataPath
+	}
+	resource.Path = protectedResourceMetadataPath + strings.TrimSuffix(resource.Path, "/")
+	resource.RawQuery = ""
+	resource.Fragment = ""
+	return resource.String()
+}
+
+// protectedResourceMetadata 返回 OAuth 受保护资源元数据
+func protectedResourceMetadata(appService *AppService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		config := appService.config.Get()
+		oauthConfig := config.Auth.OAuth
+		if !config.Auth.Enabled || !oauthConfig.Enabled {
+			c.JSON(http.StatusNotFound, gin.H{"error": "未启用 OAuth"})
+			return
+		}
+		c.JSON(http.StatusOK, &oauthex.ProtectedResourceMetadata{
+			Resource:               oauthConfig.Resource,
+			AuthorizationServers:   oauthConfig.AuthorizationServers,
+			ScopesSupported:        oauthConfig.ScopesSupported(),
+			BearerMethodsSupported: []string{"header"},
+			ResourceName:           authRealm,
+		})
+	}
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// withTokenInfo 将 authMiddleware 认证得到的调用方转换为 MCP SDK 的 TokenInfo，
+// 使 Streamable HTTP 的每个请求都能在工具中通过 req.Extra.TokenInfo 获取调用方
+func withTokenInfo(next http.Handler) http.Handler {
+	bearer := auth.RequireBearerToken(func(ctx context.Context, _ string, _ *http.Request) (*auth.TokenInfo, error) {
+		principal := internal.PrincipalFromContext(ctx)
+		if principal == nil {
+			return nil, auth.ErrInvalidToken
+		}
+		expiration := principal.ExpiresAt
+		if expiration.IsZero() {
+			expiration = time.Now().Add(apiKeyTokenLifetime)
+		}
+		return &auth.TokenInfo{
+			Scopes:     principal.Scopes,
+			Expiration: expiration,
+			Extra:      map[string]any{"principal": principal},
+		}, nil
+	}, nil)(next)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := internal.PrincipalFromContext(r.Context())
+		if principal == nil || principal.Kind == internal.PrincipalAnonymous {
+			next.ServeHTTP(w, r)
+			return
+		}
+		bearer.ServeHTTP(w, r)
+	})
+}
+
+// sseSession SSE 会话绑定的调用方
+//
+// SSE 的工具调用 context 继承自建立连接的 GET 请求，无法获取发送消息的 POST 请求的认证信息。
+// 建立连接时记录调用方，之后每个 POST 请求都经过 authMiddleware 重新认证，
+// 调用方与建立连接时不一致的请求被拒绝，一致时用本次认证的结果更新会话的调用方，
+// 使 API Key 的权限和角色变更对已建立的会话生效。
+type sseSession struct {
+	mu        sync.Mutex
+	principal *internal.Principal
+}
+
+type sseSessionKey struct{}
+
+func (s *sseSession) get() *internal.Principal {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.principal
+}
+
+func (s *sseSession) set(principal *internal.Principal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.principal = principal
+}
+
+// sseSessionBinder 记录 SSE 会话 ID 与调用方的绑定关系
+type sseSessionBinder struct {
+	mu       sync.Mutex
+	sessions map[string]*sseSession
+}
+
+// withSSESessionBinding 需位于 authMiddleware 之后。GET 请求建立会话时从 endpoint 事件中获取 MCP SDK
+// 生成的会话 ID 并绑定调用方；POST 请求的调用方与会话绑定的调用方不一致时返回 403
+func withSSESessionBinding(next http.Handler) http.Handler {
+	binder := &sseSessionBinder{sessions: make(map[string]*sseSession)}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := internal.PrincipalFromContext(r.Context())
+
+		switch r.Method {
+		case http.MethodGet:
+			session := &sseSession{principal: principal}
+			writer := &sseEndpointWriter{ResponseWriter: w, binder: binder, session: session}
+			defer writer.unbind()
+			next.ServeHTTP(writer, r.WithContext(context.WithValue(r.Context(), sseSessionKey{}, session)))
+		case http.MethodPost:
+			binder.mu.Lock()
+			session := binder.sessions[r.URL.Query().Get("sessionid")]
+			binder.mu.Unlock()
+			if session != nil {
+				if bound := session.get(); principalId(bound) != principalId(principal) {
+					internal.Logger(r.Context()).WithField("session_principal", principalId(bound)).Warn("SSE 会话的调用方与建立连接时不一致")
+					http.Error(w, "调用方与建立 SSE 连接时不一致", http.StatusForbidden)
+					return
+				}
+				session.set(principal)
+			}
+			// 会话不存在时由 MCP SDK 返回 404
+			next.ServeHTTP(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func principalId(principal *internal.Principal) string {
+	if principal == nil {
+		return ""
+	}
+	return principal.ID
+}
+
+// sseEndpointWriter 从建立会话后写入的第一个 endpoint 事件（data: /sse?sessionid=xxx）中解析会话 ID
+type sseEndpointWriter struct {
+	http.ResponseWriter
+	binder    *sseSessionBinder
+	session   *sseSession
+	sessionId string
+}
+
+func (w *sseEndpointWriter) Write(data []byte) (int, error) {
+	if w.sessionId == "" {
+		w.bind(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *sseEndpointWriter) bind(data []byte) {
+	for _, line := range strings.Split(string(data), "\n") {
+		endpoint, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		endpointUrl, err := url.Parse(endpoint)
+		if err != nil {
+			return
+		}
+		if sessionId := endpointUrl.Query().Get("sessionid"); sessionId != "" {
+			w.sessionId = sessionId
+			w.binder.mu.Lock()
+			w.binder.sessions[sessionId] = w.session
+			w.binder.mu.Unlock()
+		}
+		return
+	}
+}
+
+func (w *sseEndpointWriter) unbind() {
+	if w.sessionId == "" {
+		return
+	}
+	w.binder.mu.Lock()
+	delete(w.binder.sessions, w.sessionId)
+	w.binder.mu.Unlock()
+}
+
+func (w *sseEndpointWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *sseEndpointWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// principalFromRequest 获取工具调用方
+//
+// Streamable HTTP 从每个请求的 TokenInfo 获取；SSE 从会话绑定的调用方获取（见 sseSession）。
+// 未启用认证时返回匿名调用方。
+func principalFromRequest(ctx context.Context, appService *AppService, req *mcp.CallToolRequest) *internal.Principal {
+	if req != nil && req.Extra != nil && req.Extra.TokenInfo != nil {
+		if principal, ok := req.Extra.TokenInfo.Extra["principal"].(*internal.Principal); ok {
+			return principal
+		}
+	}
+	if session, ok := ctx.Value(sseSessionKey{}).(*sseSession); ok {
+		ctx = internal.WithPrincipal(ctx, session.get())
+	}
+	authEnabled := appService.config.Get().Auth.Enabled
+	if principal := internal.PrincipalFromContext(ctx); principal != nil {
+		// 连接建立后才启用认证时，不再信任建立连接时的匿名调用方
+		if principal.Kind != internal.PrincipalAnonymous || !authEnabled {
+			return principal
+		}
+	}
+	if !authEnabled {
+		return internal.AnonymousPrincipal()
+	}
+	return nil
+}
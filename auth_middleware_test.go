@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"qiuxs.com/stable-diffusion-webui-mcp/internal"
+)
+
+const testIssuer = "https://auth.example.com"
+
+// withTestOAuth 启用 OAuth，使用写入临时文件的 JWKS，返回签发令牌的函数
+func withTestOAuth(t *testing.T) (func(*internal.Config), func(claims jwt.MapClaims) string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, _ := json.Marshal(map[string]any{"keys": []map[string]string{{
+		"kty": "EC",
+		"kid": "k1",
+		"use": "sig",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}}})
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksFile, jwks, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	modify := func(c *internal.Config) {
+		c.Auth.OAuth = internal.OAuthConfig{
+			Enabled:              true,
+			Issuer:               testIssuer,
+			AuthorizationServers: []string{testIssuer},
+			JWKSFile:             jwksFile,
+			ScopeMap:             map[string][]string{"images": {internal.ScopeGenerate, internal.ScopeReadFiles}, "view": {internal.ScopeReadFiles}},
+		}
+	}
+	sign := func(claims jwt.MapClaims) string {
+		base := jwt.MapClaims{
+			"iss": testIssuer,
+			"aud": "http://sdmcp.test/mcp",
+			"sub": "user-1",
+			"iat": time.Now().Unix(),
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		for name, value := range claims {
+			base[name] = value
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, base)
+		token.Header["kid"] = "k1"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	return modify, sign
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	modify, sign := withTestOAuth(t)
+	app := newTestApp(t, modify, nil)
+
+	// 返回认证得到的调用方
+	router := gin.New()
+	router.GET("/whoami", authMiddleware(app.appService, internal.ScopeGenerate), func(c *gin.Context) {
+		principal := internal.PrincipalFromContext(c.Request.Context())
+		c.JSON(http.StatusOK, gin.H{"id": principal.ID, "kind": principal.Kind})
+	})
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+		id    string
+		kind  string
+	}{
+		{"缺少认证信息", "", http.StatusUnauthorized, "", ""},
+		{"无效的 API Key", "wrong-key", http.StatusUnauthorized, "", ""},
+		{"API Key 权限不足", "reader-key", http.StatusForbidden, "", ""},
+		{"API Key", "alice-key", http.StatusOK, "api_key:alice", internal.PrincipalAPIKey},
+		{"admin 拥有全部权限", "admin-key", http.StatusOK, "api_key:admin", internal.PrincipalAPIKey},
+		{"OAuth 访问令牌", sign(jwt.MapClaims{"scope": "images"}), http.StatusOK, "oauth:user-1", internal.PrincipalOAuth},
+		{"OAuth 访问令牌权限不足", sign(jwt.MapClaims{"scope": "view"}), http.StatusForbidden, "", ""},
+		{"OAuth 访问令牌 aud 不属于本服务", sign(jwt.MapClaims{"scope": "images", "aud": "https://other.example.com"}), http.StatusUnauthorized, "", ""},
+		{"OAuth 访问令牌已过期", sign(jwt.MapClaims{"scope": "images", "exp": time.Now().Add(-time.Hour).Unix()}), http.StatusUnauthorized, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				if w.Header().Get("WWW-Authenticate") == "" {
+					t.Error("认证失败时应返回 WWW-Authenticate")
+				}
+				return
+			}
+			var got struct{ ID, Kind string }
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != tt.id || got.Kind != tt.kind {
+				t.Errorf("principal = %+v, want %s %s", got, tt.id, tt.kind)
+			}
+		})
+	}
+}
+
+func TestFileAuthMiddlewareSignedURL(t *testing.T) {
+	app := newTestApp(t, nil, nil)
+	record := app.saveImage(t, "alice", 1)
+	other := app.saveImage(t, "alice", 2)
+
+	signed, err := url.Parse(internal.NewURLSigner(app.config).FileURL(record.Key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := "?" + signed.RawQuery
+
+	tests := []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{"签名的路径", signed.Path + query, http.StatusOK},
+		{"签名的路径的缩放图片", signed.Path + query + "&w=32", http.StatusOK},
+		{"签名用于其他图片", "/api/v1/read/file/" + other.Key + query, http.StatusForbidden},
+		{"签名被篡改", signed.Path + strings.Replace(query, "sig=", "sig=0", 1), http.StatusForbidden},
+		{"缺少签名和认证信息", signed.Path, http.StatusUnauthorized},
+		// 签名只对图片读取接口有效，不能用于其他接口
+		{"签名用于其他接口", "/api/v1/images/" + record.ID + query, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := app.do(http.MethodGet, tt.target, "", nil); w.Code != tt.want {
+				t.Errorf("GET %s = %d, want %d", tt.target, w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestSSESessionBinding(t *testing.T) {
+	app := newTestApp(t, nil, nil)
+	server := httptest.NewServer(app.router)
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/sse", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer alice-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /sse = %d", resp.StatusCode)
+	}
+
+	// 第一个 endpoint 事件包含会话 ID
+	var endpoint string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			endpoint = data
+			break
+		}
+	}
+	if !strings.Contains(endpoint, "sessionid=") {
+		t.Fatalf("endpoint = %q", endpoint)
+	}
+
+	post := func(token string) int {
+		body := strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"ping"}`)
+		req, err := http.NewRequest(http.MethodPost, server.URL+endpoint, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := post(""); status != http.StatusUnauthorized {
+		t.Errorf("未认证的 POST = %d, want 401", status)
+	}
+	if status := post("bob-key"); status != http.StatusForbidden {
+		t.Errorf("其他调用方的 POST = %d, want 403", status)
+	}
+	if status := post("admin-key"); status != http.StatusForbidden {
+		t.Errorf("admin 的 POST = %d, want 403", status)
+	}
+	if status := post("alice-key"); status != http.StatusAccepted {
+		t.Errorf("建立连接的调用方的 POST = %d, want 202", status)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"qiuxs.com/stable-diffusion-webui-mcp/internal"
+)
+
+// runGC 按 retention 配置清理一次图片，需要在服务停止时运行（图片索引同一时间只能被一个进程打开）
+func runGC(args []string) {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	configPath := flags.String("config", os.Getenv(internal.EnvConfigPath), "配置文件路径（YAML），也可通过 SDMCP_CONFIG 指定")
+	dryRun := flags.Bool("dry-run", false, "只输出清理报告，不删除图片")
+	jsonOutput := flags.Bool("json", false, "以 JSON 格式输出清理报告")
+	_ = flags.Parse(args)
+
+	configStore, err := internal.NewConfigStore(*configPath, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "加载配置失败:\n%v\n", err)
+		os.Exit(1)
+	}
+	config := configStore.Get()
+
+	ctx := context.Background()
+	storage, err := internal.NewStorage(ctx, config.Storage)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "初始化图片存储失败: %v\n", err)
+		os.Exit(1)
+	}
+	imageIndex, err := internal.OpenImageIndex(config.Server.DataDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "初始化图片索引失败: %v\n", err)
+		os.Exit(1)
+	}
+	defer imageIndex.Close()
+
+	sweeper := internal.NewRetentionSweeper(configStore, storage, imageIndex)
+	report, err := sweeper.Sweep(ctx, config.Retention, *dryRun || config.Retention.DryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "清理失败: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(report)
+	} else {
+		printGCReport(report)
+	}
+	if len(report.Errors) > 0 {
+		os.Exit(1)
+	}
+}
+
+func printGCReport(report *internal.GCReport) {
+	action := "已删除"
+	if report.DryRun {
+		action = "将删除"
+	}
+	for _, item := range report.Deleted {
+		fmt.Printf("%s %s\t%s\t%s\t%s\n", action, item.Key, internal.ByteSize(item.Size), item.CreatedAt.Format("2006-01-02 15:04:05"), item.Reason)
+	}
+	for _, e := range report.Errors {
+		fmt.Printf("删除失败 %s\n", e)
+	}
+	fmt.Printf("\n扫描 %d 张图片（%s），置顶 %d 张，%s %d 张，释放 %s\n",
+		report.Scanned, internal.ByteSize(report.TotalBytes), report.Pinned,
+		action, len(report.Deleted)-len(report.Errors), internal.ByteSize(report.FreedBytes))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+	"qiuxs.com/stable-diffusion-webui-mcp/internal"
+)
+
+// runKeygen 生成新的 API Key，明文只输出一次，配置文件中只保存哈希值
+func runKeygen(args []string) {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	label := flags.String("label", "", "Key 标签，用于标识调用方（必填）")
+	scopes := flags.String("scopes", internal.ScopeGenerate+","+internal.ScopeReadFiles,
+		"逗号分隔的权限范围，可选值: "+strings.Join(internal.AllScopes, ", "))
+	_ = flags.Parse(args)
+
+	if *label == "" {
+		fmt.Fprintln(os.Stderr, "必须通过 -label 指定 Key 标签")
+		os.Exit(2)
+	}
+
+	var scopeList []string
+	for _, scope := range strings.Split(*scopes, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		if !slices.Contains(internal.AllScopes, scope) {
+			fmt.Fprintf(os.Stderr, "未知的权限范围: %s，可选值: %s\n", scope, strings.Join(internal.AllScopes, ", "))
+			os.Exit(2)
+		}
+		scopeList = append(scopeList, scope)
+	}
+
+	key, hash, err := internal.GenerateAPIKey()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "生成 API Key 失败: %v\n", err)
+		os.Exit(1)
+	}
+
+	snippet, err := yaml.Marshal([]internal.APIKeyConfig{{
+		Label:  *label,
+		Hash:   hash,
+		Scopes: scopeList,
+	}})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "生成配置失败: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("API Key（只显示一次，请妥善保存）:\n\n  %s\n\n", key)
+	fmt.Printf("将以下内容添加到配置文件的 auth.keys 中:\n\n%s", snippet)
+}
+
+// runProvenanceKeygen 生成溯源清单的 Ed25519 签名私钥，私钥写入文件，公钥输出到终端
+func runProvenanceKeygen(args []string) {
+	flags := flag.NewFlagSet("provenance-keygen", flag.ExitOnError)
+	out := flags.String("out", "provenance.pem", "私钥文件路径，文件已存在时不会覆盖")
+	_ = flags.Parse(args)
+
+	privateKey, publicKey, err := internal.GenerateProvenanceKey()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "生成溯源签名私钥失败: %v\n", err)
+		os.Exit(1)
+	}
+
+	file, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "写入私钥文件失败: %v\n", err)
+		os.Exit(1)
+	}
+	if _, err := file.Write(privateKey); err != nil {
+		file.Close()
+		fmt.Fprintf(os.Stderr, "写入私钥文件失败: %v\n", err)
+		os.Exit(1)
+	}
+	if err := file.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "写入私钥文件失败: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("私钥已写入 %s（请妥善保存，不要提交到版本库）\n\n", *out)
+	fmt.Printf("公钥（用于在其他服务的 provenance.trusted_keys 中信任本服务）:\n\n  %s\n\n", publicKey)
+	fmt.Printf("将以下内容添加到配置文件中:\n\nprovenance:\n  enabled: true\n  private_key_file: %s\n", *out)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"qiuxs.com/stable-diffusion-webui-mcp/internal"
+	"qiuxs.com/stable-diffusion-webui-mcp/sdwebui"
+)
+
+const testSigningSecret = "0123456789abcdef0123456789abcdef"
+
+// 测试使用的 API Key，key 即为 Bearer Token
+var testKeys = []struct {
+	key    string
+	label  string
+	scopes []string
+}{
+	{"alice-key", "alice", []string{internal.ScopeGenerate, internal.ScopeReadFiles}},
+	{"bob-key", "bob", []string{internal.ScopeGenerate, internal.ScopeReadFiles}},
+	{"reader-key", "reader", []string{internal.ScopeReadFiles}},
+	{"admin-key", "admin", []string{internal.ScopeAdmin}},
+}
+
+type testApp struct {
+	config      *internal.ConfigStore
+	fileService *internal.FileService
+	storage     internal.Storage
+	index       *internal.ImageIndex
+	appService  *AppService
+	router      *gin.Engine
+}
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newTestApp 创建启用 API Key 认证和签名链接的服务，wrapStorage 不为 nil 时用于包装存储以注入故障
+func newTestApp(t *testing.T, modify func(*internal.Config), wrapStorage func(internal.Storage) internal.Storage) *testApp {
+	t.Helper()
+	dir := t.TempDir()
+	config, err := internal.NewConfigStore("", func(c *internal.Config) {
+		c.Server.DataDir = dir
+		c.Server.PublicURL = "http://sdmcp.test"
+		c.Storage.Path = filepath.Join(dir, "images")
+		c.Auth.Enabled = true
+		c.Auth.SignedURLs = internal.SignedURLConfig{Enabled: true, Secret: testSigningSecret}
+		for _, key := range testKeys {
+			c.Auth.Keys = append(c.Auth.Keys, internal.APIKeyConfig{Label: key.label, Hash: internal.HashAPIKey(key.key), Scopes: key.scopes})
+		}
+		if modify != nil {
+			modify(c)
+		}
+	})
+	if err != nil {
+		t.Fatalf("NewConfigStore() error = %v", err)
+	}
+
+	var storage internal.Storage = internal.NewLocalStorage(config.Get().Storage.Path)
+	if wrapStorage != nil {
+		storage = wrapStorage(storage)
+	}
+	index, err := internal.OpenImageIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { index.Close() })
+	variants, err := internal.NewVariantCache(config, filepath.Join(dir, "variants"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	urlSigner := internal.NewURLSigner(config)
+	fileService := internal.NewFileService(storage, index, urlSigner, variants, internal.NewProvenanceSigner(config), internal.NewWatermarker(config), false)
+	usageTracker, err := internal.NewUsageTracker(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog := internal.NewAuditLog(config, dir)
+	t.Cleanup(func() { auditLog.Close() })
+	moderator := internal.NewModerator(config, dir)
+	sdwebuiService := sdwebui.NewSdwebuiService(config, fileService, moderator)
+
+	appService := NewAppService(config, sdwebuiService,
+		NewMcpHandler(config, sdwebuiService, fileService, urlSigner, usageTracker),
+		NewApiHandler(config, sdwebuiService, fileService, auditLog, moderator),
+		urlSigner, usageTracker, auditLog)
+	return &testApp{
+		config:      config,
+		fileService: fileService,
+		storage:     storage,
+		index:       index,
+		appService:  appService,
+		router:      setupRoutes(appService),
+	}
+}
+
+// saveImage 以 label 对应的 API Key 调用方身份保存一张测试图片
+func (a *testApp) saveImage(t *testing.T, label string, seed uint8) *internal.ImageRecord {
+	t.Helper()
+	var principal *internal.Principal
+	for _, key := range testKeys {
+		if key.label == label {
+			principal, _ = a.config.Get().Auth.VerifyAPIKey(key.key)
+		}
+	}
+	record := &internal.ImageRecord{}
+	ctx := internal.WithPrincipal(context.Background(), principal)
+	if _, err := a.fileService.SaveImage(ctx, testPNGBase64(t, seed), internal.OutputConfig{Format: internal.FormatPNG}, record); err != nil {
+		t.Fatalf("SaveImage() error = %v", err)
+	}
+	return record
+}
+
+// do 发送请求，token 为空时不携带 Authorization
+func (a *testApp) do(method string, target string, token string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	a.router.ServeHTTP(w, req)
+	return w
+}
+
+func testPNGBase64(t *testing.T, seed uint8) string {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := range 64 {
+		for x := range 64 {
+			img.Set(x, y, color.NRGBA{R: uint8(x*4) + seed, G: uint8(y*4) ^ seed, B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"qiuxs.com/stable-diffusion-webui-mcp/internal"
+)
+
+const (
+	manifestJSON = "json"
+	manifestCSV  = "csv"
+)
+
+// exportPageSize 按检索条件导出时每次从索引读取的数量
+const exportPageSize = 100
+
+// selectExportImages 选择要导出的图片，返回完整的元数据记录；非 admin 调用方只能导出自己生成的图片
+func selectExportImages(fileService *internal.FileService, principal *internal.Principal, req ExportImagesRequest, maxImages int) ([]*internal.ImageRecord, error) {
+	switch req.Manifest {
+	case "", manifestJSON, manifestCSV:
+	default:
+		return nil, fmt.Errorf("manifest 格式无效: %s，可选值为 json、csv", req.Manifest)
+	}
+
+	ids := req.IDs
+	if len(ids) == 0 {
+		query, err := imageQuery(principal, SearchImagesRequest{
+			Query:    req.Query,
+			Prompt:   req.Prompt,
+			Model:    req.Model,
+			Caller:   req.Caller,
+			Tags:     req.Tags,
+			DateFrom: req.DateFrom,
+			DateTo:   req.DateTo,
+			Pinned:   req.Pinned,
+		})
+		if err != nil {
+			return nil, err
+		}
+		query.Limit = exportPageSize
+		for {
+			records, total, err := fileService.SearchImages(query)
+			if err != nil {
+				return nil, err
+			}
+			if maxImages > 0 && total > maxImages {
+				return nil, fmt.Errorf("匹配 %d 张图片，超过单次导出上限 %d，请缩小检索范围", total, maxImages)
+			}
+			for _, record := range records {
+				ids = append(ids, record.ID)
+			}
+			query.Offset += len(records)
+			if len(records) == 0 || query.Offset >= total {
+				break
+			}
+		}
+	} else if maxImages > 0 && len(ids) > maxImages {
+		return nil, fmt.Errorf("指定了 %d 张图片，超过单次导出上限 %d", len(ids), maxImages)
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("没有符合条件的图片")
+	}
+
+	// 检索结果不包含请求参数和生成信息，按 ID 重新读取完整记录
+	records := make([]*internal.ImageRecord, 0, len(ids))
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		record, err := fileService.ImageByID(id)
+		if errors.Is(err, internal.ErrImageNotFound) {
+			return nil, fmt.Errorf("图片不存在: %s", id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !principal.HasScope(internal.ScopeAdmin) && record.Principal != principal.ID {
+			// 不区分不存在和无权查看，避免泄露其他调用方的图片 ID
+			return nil, fmt.Errorf("图片不存在: %s", id)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// writeExportArchive 将图片和清单写入 ZIP 压缩包，图片已经过压缩，按原样存储；
+// 无法打开的图片记录在清单的 error 字段中，不会中断导出；图片已部分写入压缩包后读取失败，
+// 或写出压缩包失败时返回错误，此时压缩包已不完整
+func writeExportArchive(ctx context.Context, w io.Writer, fileService *internal.FileService, records []*internal.ImageRecord, manifestFormat string) error {
+	archive := zip.NewWriter(w)
+
+	manifest := ExportManifest{
+		ExportedAt: time.Now(),
+		Count:      len(records),
+		Images:     make([]ExportManifestEntry, 0, len(records)),
+	}
+	for _, record := range records {
+		entry := ExportManifestEntry{
+			File:        path.Join("images", record.ID+path.Ext(record.Key)),
+			ImageRecord: record,
+		}
+		file, _, err := fileService.ReadFile(ctx, record.Key)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			entry.Error = err.Error()
+			manifest.Images = append(manifest.Images, entry)
+			continue
+		}
+		err = writeArchiveImage(archive, file, record, entry.File)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("写入图片 %s 失败: %v", record.ID, err)
+		}
+		internal.AuditImage(ctx, record.ID)
+		manifest.Images = append(manifest.Images, entry)
+	}
+
+	var err error
+	if manifestFormat == manifestCSV {
+		err = writeManifestCSV(archive, manifest)
+	} else {
+		err = writeManifestJSON(archive, manifest)
+	}
+	if err != nil {
+		return fmt.Errorf("写入导出清单失败: %v", err)
+	}
+	return archive.Close()
+}
+
+func writeArchiveImage(archive *zip.Writer, file io.Reader, record *internal.ImageRecord, name string) error {
+	writer, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: record.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, file)
+	return err
+}
+
+func writeManifestJSON(archive *zip.Writer, manifest ExportManifest) error {
+	writer, err := archive.CreateHeader(&zip.FileHeader{Name: "manifest.json", Method: zip.Deflate, Modified: manifest.ExportedAt})
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(manifest)
+}
+
+// writeManifestCSV 写入 manifest.csv，完整的生成参数和原始请求以 JSON 形式保存在 parameters 和 request 列
+func writeManifestCSV(archive *zip.Writer, manifest ExportManifest) error {
+	writer, err := archive.CreateHeader(&zip.FileHeader{Name: "manifest.csv", Method: zip.Deflate, Modified: manifest.ExportedAt})
+	if err != nil {
+		return err
+	}
+	// UTF-8 BOM，便于 Excel 正确识别中文
+	if _, err := writer.Write([]byte("\uFEFF")); err != nil {
+		return err
+	}
+
+	csvWriter := csv.NewWriter(writer)
+	header := []string{
+		"file", "error", "id", "created_at", "principal", "backend", "model", "model_hash",
+		"prompt", "negative_prompt", "seed", "width", "height", "steps", "sampler_name", "cfg_scale",
+		"tags", "pinned", "parent_id", "sha256", "infotext", "parameters", "request",
+	}
+	if err := csvWriter.Write(header); err != nil {
+		return err
+	}
+	for _, entry := range manifest.Images {
+		record := entry.ImageRecord
+		parameters, _ := json.Marshal(record.Parameters)
+		request, _ := json.Marshal(record.Request)
+		row := []string{
+			entry.File, entry.Error, record.ID, record.CreatedAt.Format(time.RFC3339), record.Principal, record.Backend, record.Model, record.ModelHash,
+			record.Prompt, record.NegativePrompt, strconv.FormatInt(record.Seed, 10), strconv.Itoa(record.Width), strconv.Itoa(record.Height),
+			strconv.Itoa(record.Steps), record.SamplerName, strconv.FormatFloat(record.CFGScale, 'f', -1, 64),
+			strings.Join(record.Tags, ";"), strconv.FormatBool(record.Pinned), record.ParentID, record.SHA256, record.Infotext(),
+			string(parameters), string(request),
+		}
+		if err := csvWriter.Write(row); err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
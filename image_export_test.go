@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"qiuxs.com/stable-diffusion-webui-mcp/internal"
+)
+
+// failingReadStorage 读取图片时先返回部分数据再返回错误，模拟存储在传输中途失败
+type failingReadStorage struct {
+	internal.Storage
+}
+
+func (s *failingReadStorage) Get(ctx context.Context, key string) (io.ReadSeekCloser, *internal.ObjectInfo, error) {
+	file, info, err := s.Storage.Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	file.Close()
+	return &failingReader{size: 64 << 10}, info, nil
+}
+
+// failingReader 返回 size 字节的数据后返回错误，支持回到开头以便探测内容类型
+type failingReader struct {
+	size int
+	read int
+}
+
+func (r *failingReader) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, errors.New("不支持的 Seek")
+	}
+	r.read = 0
+	return 0, nil
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.read == r.size {
+		return 0, errors.New("存储连接中断")
+	}
+	n := min(len(p), r.size-r.read)
+	clear(p[:n])
+	r.read += n
+	return n, nil
+}
+
+func (r *failingReader) Close() error {
+	return nil
+}
+
+func TestExportImages(t *testing.T) {
+	app := newTestApp(t, nil, nil)
+	record := app.saveImage(t, "alice", 1)
+	server := httptest.NewServer(app.router)
+	defer server.Close()
+
+	resp := getWithToken(t, server.URL+"/api/v1/export?ids="+record.ID, "alice-key")
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("export = %d, %v", resp.StatusCode, err)
+	}
+	if !strings.HasPrefix(string(body), "PK") {
+		t.Error("响应应为 ZIP 压缩包")
+	}
+}
+
+// 响应开始后读取图片失败时应中断连接，客户端不能把截断的压缩包当作成功的下载
+func TestExportImagesStorageFailure(t *testing.T) {
+	app := newTestApp(t, nil, func(storage internal.Storage) internal.Storage {
+		return &failingReadStorage{Storage: storage}
+	})
+	record := app.saveImage(t, "alice", 1)
+	server := httptest.NewServer(app.router)
+	defer server.Close()
+
+	resp := getWithToken(t, server.URL+"/api/v1/export?ids="+record.ID, "alice-key")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("export = %d", resp.StatusCode)
+	}
+	if _, err := io.ReadAll(resp.Body); err == nil {
+		t.Error("读取被中断的响应应返回错误")
+	}
+}
+
+func getWithToken(t *testing.T, url string, token string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
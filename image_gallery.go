@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"qiuxs.com/stable-diffusion-webui-mcp/internal"
+)
+
+var errForeignImage = errors.New("只能查看自己生成的图片")
+
+// searchImages 检索图片，非 admin 调用方只能检索自己生成的图片
+func searchImages(fileService *internal.FileService, principal *internal.Principal, req SearchImagesRequest) (*ImageListResponse, error) {
+	query, err := imageQuery(principal, req)
+	if err != nil {
+		return nil, err
+	}
+
+	records, total, err := fileService.SearchImages(query)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &ImageListResponse{
+		Total:  total,
+		Offset: req.Offset,
+		Images: make([]ImageSummary, 0, len(records)),
+	}
+	for _, record := range records {
+		response.Images = append(response.Images, ImageSummary{
+			ID:             record.ID,
+			Url:            fileService.ImageURL(record.Key),
+			ThumbnailUrl:   fileService.ThumbnailURL(record.Key),
+			CreatedAt:      record.CreatedAt,
+			Principal:      record.Principal,
+			Backend:        record.Backend,
+			Model:          record.Model,
+			Prompt:         record.Prompt,
+			NegativePrompt: record.NegativePrompt,
+			Seed:           record.Seed,
+			Width:          record.Width,
+			Height:         record.Height,
+			Steps:          record.Steps,
+			SamplerName:    record.SamplerName,
+			Tags:           record.Tags,
+			ParentID:       record.ParentID,
+			Pinned:         record.Pinned,
+		})
+	}
+	if next := req.Offset + len(records); len(records) > 0 && next < total {
+		response.NextOffset = next
+	}
+	return response, nil
+}
+
+// imageQuery 将检索参数转换为索引查询条件，非 admin 调用方只能检索自己生成的图片
+func imageQuery(principal *internal.Principal, req SearchImagesRequest) (internal.ImageQuery, error) {
+	query := internal.ImageQuery{
+		Model:     req.Model,
+		Prompt:    req.Prompt,
+		Text:      req.Query,
+		Seed:      req.Seed,
+		Principal: req.Caller,
+		Tags:      req.Tags,
+		Pinned:    req.Pinned,
+		Limit:     req.Limit,
+		Offset:    req.Offset,
+	}
+
+	if !principal.HasScope(internal.ScopeAdmin) {
+		if req.Caller != "" && req.Caller != principal.ID {
+			return query, errForeignImage
+		}
+		query.Principal = principal.ID
+	}
+
+	var err error
+	if query.From, err = parseDate(req.DateFrom, false); err != nil {
+		return query, fmt.Errorf("date_from 格式错误: %v", err)
+	}
+	if query.To, err = parseDate(req.DateTo, true); err != nil {
+		return query, fmt.Errorf("date_to 格式错误: %v", err)
+	}
+	return query, nil
+}
+
+// imageDetail 获取图片的完整元数据，非 admin 调用方只能查看自己生成的图片
+func imageDetail(fileService *internal.FileService, principal *internal.Principal, id string) (*ImageDetailResponse, error) {
+	record, err := fileService.ImageByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if !principal.HasScope(internal.ScopeAdmin) && record.Principal != principal.ID {
+		return nil, errForeignImage
+	}
+	return &ImageDetailResponse{ImageRecord: record, Url: fileService.ImageURL(record.Key)}, nil
+}
+
+// pinImage 置顶或取消置顶图片，非 admin 调用方只能操作自己生成的图片
+func pinImage(fileService *internal.FileService, principal *internal.Principal, req PinImageRequest) (*internal.ImageRecord, error) {
+	record, err := ownImage(fileService, principal, req.ID, req.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	pinned := req.Pinned == nil || *req.Pinned
+	return fileService.SetPinned(record.ID, pinned)
+}
+
+// ownImage 按 id 或 url 获取图片记录，非 admin 调用方只能获取自己生成的图片
+func ownImage(fileService *internal.FileService, principal *internal.Principal, id string, url string) (*internal.ImageRecord, error) {
+	var record *internal.ImageRecord
+	var err error
+	switch {
+	case id != "":
+		record, err = fileService.ImageByID(id)
+	case url != "":
+		var relativePath string
+		if relativePath, err = internal.RelativePathFromURL(url); err != nil {
+			return nil, err
+		}
+		record, err = fileService.ImageByPath(relativePath)
+	default:
+		return nil, errors.New("需要指定图片 id 或 url")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !principal.HasScope(internal.ScopeAdmin) && record.Principal != principal.ID {
+		return nil, errForeignImage
+	}
+	return record, nil
+}
+
+// decodeImageBase64 解码 base64 图片数据，兼容 data URL 形式
+func decodeImageBase64(value string) ([]byte, error) {
+	if _, after, ok := strings.Cut(value, ";base64,"); ok {
+		value = after
+	}
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("image_base64 解码失败: %v", err)
+	}
+	return data, nil
+}
+
+// parseDate 解析 YYYY-MM-DD（服务器本地时区）或 RFC3339 格式的时间，
+// endOfDay 为 true 时 YYYY-MM-DD 表示当天结束
+func parseDate(value string, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("需要 YYYY-MM-DD 或 RFC3339 格式: %s", value)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// canReadFile 判断调用方能否通过 /api/v1/read/file 读取文件：签名链接已限定了路径，admin 可以读取所有文件，
+// 其他调用方只能读取自己生成的图片（包括缩放图片和溯源旁路清单）；没有元数据记录的文件中，
+// 导出文件名为随机 UUID 且只返回给导出者，可以读取，其他文件（如去重存储的内容）只有 admin 可以读取
+func canReadFile(fileService *internal.FileService, principal *internal.Principal, filePath string) bool {
+	if principal.Kind == internal.PrincipalSignedURL || principal.HasScope(internal.ScopeAdmin) {
+		return true
+	}
+	record, err := fileService.ImageByPath(strings.TrimSuffix(filePath, internal.ProvenanceSuffix))
+	if err != nil {
+		return strings.HasPrefix(filePath, internal.ExportPrefix)
+	}
+	return record.Principal == principal.ID
+}
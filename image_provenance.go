@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"qiuxs.com/stable-diffusion-webui-mcp/internal"
+)
+
+// verifyProvenance 验证图片的溯源清单；按 id 或 url 验证已保存的图片时，非 admin 调用方只能验证自己生成的图片
+func verifyProvenance(ctx context.Context, fileService *internal.FileService, principal *internal.Principal, req VerifyProvenanceRequest) (*internal.ProvenanceReport, error) {
+	if req.ImageBase64 != "" {
+		image, err := decodeImageBase64(req.ImageBase64)
+		if err != nil {
+			return nil, err
+		}
+		return fileService.VerifyProvenanceData(image, []byte(req.Manifest))
+	}
+
+	record, err := ownImage(fileService, principal, req.ID, req.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Manifest != "" {
+		file, _, err := fileService.ReadFile(ctx, record.Key)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		image, err := io.ReadAll(file)
+		if err != nil {
+			return nil, fmt.Errorf("读取图片失败: %v", err)
+		}
+		return fileService.VerifyProvenanceData(image, []byte(req.Manifest))
+	}
+	return fileService.VerifyProvenance(ctx, record)
+}
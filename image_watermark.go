@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"qiuxs.com/stable-diffusion-webui-mcp/internal"
+)
+
+// detectWatermark 检测图片中的隐形水印；按 id 或 url 检测已保存的图片时，非 admin 调用方只能检测自己生成的图片。
+// 水印内容为图片 ID 时，只有调用方有权查看该图片才返回 image_id
+func detectWatermark(ctx context.Context, fileService *internal.FileService, principal *internal.Principal, req DetectWatermarkRequest) (*internal.WatermarkReport, error) {
+	var report *internal.WatermarkReport
+	if req.ImageBase64 != "" {
+		image, err := decodeImageBase64(req.ImageBase64)
+		if err != nil {
+			return nil, err
+		}
+		if report, err = fileService.DetectWatermarkData(image); err != nil {
+			return nil, err
+		}
+	} else {
+		record, err := ownImage(fileService, principal, req.ID, req.Url)
+		if err != nil {
+			return nil, err
+		}
+		if report, err = fileService.DetectWatermark(ctx, record); err != nil {
+			return nil, err
+		}
+	}
+
+	if report.Detected {
+		record, err := fileService.ImageByID(report.Payload)
+		if err != nil && !errors.Is(err, internal.ErrImageNotFound) {
+			return nil, err
+		}
+		if record != nil && (principal.HasScope(internal.ScopeAdmin) || record.Principal == principal.ID) {
+			report.ImageID = record.ID
+		}
+	}
+	return report, nil
+}
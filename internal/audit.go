@@ -0,0 +1,385 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	auditDirName     = "audit"
+	auditFileName    = "audit.jsonl"
+	auditFilePattern = "audit-*.jsonl"
+)
+
+// 审计事件类型
+const (
+	AuditActionTool = "tool"
+	AuditActionAPI  = "api"
+)
+
+// AuditConfig 审计日志，记录所有工具调用和管理操作，保存在 server.data_dir/audit 目录中
+type AuditConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// 以 sha256 哈希记录提示词，审计时可用相同提示词的哈希值检索
+	HashPrompts bool `yaml:"hash_prompts"`
+	// 单个文件的大小上限，超过后轮转为 audit-<时间>.jsonl，默认 100MB
+	MaxFileBytes ByteSize `yaml:"max_file_bytes"`
+	// 保留的轮转文件数，0 表示全部保留
+	MaxFiles int `yaml:"max_files"`
+}
+
+func (c *AuditConfig) normalize() {
+	if c.MaxFileBytes == 0 {
+		c.MaxFileBytes = 100 << 20
+	}
+}
+
+func (c *AuditConfig) validate() []error {
+	if c.MaxFileBytes < 0 || c.MaxFiles < 0 {
+		return []error{errors.New("audit 中的大小和文件数不能为负数")}
+	}
+	return nil
+}
+
+// AuditEntry 一条审计记录
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// 工具名，action 为 tool 时有效
+	Tool string `json:"tool,omitempty"`
+	// 需要 admin 权限的操作
+	Admin     bool   `json:"admin,omitempty"`
+	Principal string `json:"principal,omitempty"`
+	Role      string `json:"role,omitempty"`
+	Session   string `json:"session,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	JobID     string `json:"job_id,omitempty"`
+	ClientIP  string `json:"client_ip,omitempty"`
+	// HTTP 接口的请求方法、路径和查询参数
+	Method string `json:"method,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Query  string `json:"query,omitempty"`
+	Status int    `json:"status,omitempty"`
+	// 工具参数，启用 hash_prompts 时提示词记录为 sha256:<hex>
+	Args map[string]any `json:"args,omitempty"`
+	// success、error、denied、limited 或 panic
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+	// 生成或保存的图片
+	ImageIDs []string `json:"image_ids,omitempty"`
+	// 操作产生的其他结果，如写入 WebUI 的 options
+	Result     map[string]any `json:"result,omitempty"`
+	DurationMs int64          `json:"duration_ms"`
+
+	mu sync.Mutex
+}
+
+type auditEntryKey struct{}
+
+// WithAuditEntry 返回携带审计记录的 context，后续处理通过 AuditEntryFromContext 补充调用方、结果等信息
+func WithAuditEntry(ctx context.Context, entry *AuditEntry) context.Context {
+	return context.WithValue(ctx, auditEntryKey{}, entry)
+}
+
+// AuditEntryFromContext 返回 context 中的审计记录，没有时返回 nil
+func AuditEntryFromContext(ctx context.Context) *AuditEntry {
+	entry, _ := ctx.Value(auditEntryKey{}).(*AuditEntry)
+	return entry
+}
+
+// AuditImage 将保存的图片记入当前审计记录
+func AuditImage(ctx context.Context, imageId string) {
+	if entry := AuditEntryFromContext(ctx); entry != nil {
+		entry.mu.Lock()
+		defer entry.mu.Unlock()
+		entry.ImageIDs = append(entry.ImageIDs, imageId)
+	}
+}
+
+// AuditResult 将操作结果记入当前审计记录
+func AuditResult(ctx context.Context, key string, value any) {
+	if entry := AuditEntryFromContext(ctx); entry != nil {
+		entry.mu.Lock()
+		defer entry.mu.Unlock()
+		if entry.Result == nil {
+			entry.Result = make(map[string]any)
+		}
+		entry.Result[key] = value
+	}
+}
+
+// SetAuditOutcome 设置当前审计记录的结果，用于拒绝、限流等未执行工具的情况
+func SetAuditOutcome(ctx context.Context, outcome string, reason string) {
+	if entry := AuditEntryFromContext(ctx); entry != nil {
+		entry.mu.Lock()
+		defer entry.mu.Unlock()
+		entry.Outcome = outcome
+		entry.Error = reason
+	}
+}
+
+// SetAuditPrincipal 设置当前审计记录的调用方
+func SetAuditPrincipal(ctx context.Context, principal *Principal) {
+	if entry := AuditEntryFromContext(ctx); entry != nil && principal != nil {
+		entry.mu.Lock()
+		defer entry.mu.Unlock()
+		entry.Principal = principal.ID
+		entry.Role = principal.Role
+	}
+}
+
+// AuditLog 只追加写入的审计日志，按大小轮转
+type AuditLog struct {
+	config *ConfigStore
+	dir    string
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func NewAuditLog(config *ConfigStore, dataDir string) *AuditLog {
+	return &AuditLog{
+		config: config,
+		dir:    filepath.Join(dataDir, auditDirName),
+	}
+}
+
+// Enabled 是否启用审计日志
+func (l *AuditLog) Enabled() bool {
+	return l.config.Get().Audit.Enabled
+}
+
+// Write 追加一条审计记录，未启用时忽略；写入失败只记录日志，不影响请求
+func (l *AuditLog) Write(entry *AuditEntry) {
+	config := l.config.Get().Audit
+	if !config.Enabled {
+		return
+	}
+
+	entry.mu.Lock()
+	if config.HashPrompts {
+		entry.Args = hashPrompts(entry.Args)
+	}
+	data, err := json.Marshal(entry)
+	entry.mu.Unlock()
+	if err != nil {
+		logrus.Errorf("序列化审计记录失败: %v", err)
+		return
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.write(data, config); err != nil {
+		logrus.Errorf("写入审计日志失败: %v", err)
+	}
+}
+
+func (l *AuditLog) write(data []byte, config AuditConfig) error {
+	if l.file != nil && l.size+int64(len(data)) > int64(config.MaxFileBytes) && l.size > 0 {
+		if err := l.rotate(config); err != nil {
+			return err
+		}
+	}
+	if l.file == nil {
+		if err := os.MkdirAll(l.dir, 0700); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(filepath.Join(l.dir, auditFileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		l.file, l.size = file, info.Size()
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	return err
+}
+
+// rotate 将当前文件重命名为 audit-<时间>.jsonl，并按 max_files 删除最旧的轮转文件
+func (l *AuditLog) rotate(config AuditConfig) error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+	rotated := filepath.Join(l.dir, fmt.Sprintf("audit-%s.jsonl", time.Now().UTC().Format("20060102T150405.000000000")))
+	if err := os.Rename(filepath.Join(l.dir, auditFileName), rotated); err != nil {
+		return err
+	}
+
+	if config.MaxFiles > 0 {
+		files, err := filepath.Glob(filepath.Join(l.dir, auditFilePattern))
+		if err != nil {
+			return err
+		}
+		slices.Sort(files)
+		for len(files) > config.MaxFiles {
+			if err := os.Remove(files[0]); err != nil {
+				logrus.Warnf("删除审计日志 %s 失败: %v", files[0], err)
+			}
+			files = files[1:]
+		}
+	}
+	return nil
+}
+
+// Close 关闭当前的审计日志文件
+func (l *AuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// AuditQuery 审计日志查询条件，为空的条件不限制
+type AuditQuery struct {
+	From      time.Time
+	To        time.Time
+	Principal string
+	Tool      string
+	Action    string
+	Outcome   string
+	ImageID   string
+	JobID     string
+	// 提示词中包含的文本，启用 hash_prompts 时传入提示词原文会按哈希值匹配
+	Prompt string
+	// 只查询需要 admin 权限的操作
+	AdminOnly bool
+	Limit     int
+}
+
+// Query 按时间倒序返回符合条件的审计记录，最多 query.Limit 条
+func (l *AuditLog) Query(query AuditQuery) ([]*AuditEntry, error) {
+	files, err := filepath.Glob(filepath.Join(l.dir, auditFilePattern))
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(files)
+	files = append(files, filepath.Join(l.dir, auditFileName))
+
+	promptHash := ""
+	if query.Prompt != "" {
+		promptHash = hashPrompt(query.Prompt)
+	}
+
+	// 轮转文件按时间顺序排列，从最新的文件开始读取
+	var entries []*AuditEntry
+	for i := len(files) - 1; i >= 0 && len(entries) < query.Limit; i-- {
+		matched, err := l.queryFile(files[i], query, promptHash)
+		if err != nil {
+			return nil, err
+		}
+		for j := len(matched) - 1; j >= 0 && len(entries) < query.Limit; j-- {
+			entries = append(entries, matched[j])
+		}
+	}
+	return entries, nil
+}
+
+func (l *AuditLog) queryFile(path string, query AuditQuery, promptHash string) ([]*AuditEntry, error) {
+	// 读取时持有写锁，避免读到写了一半的记录
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var matched []*AuditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			logrus.Warnf("忽略无法解析的审计记录 (%s): %v", filepath.Base(path), err)
+			continue
+		}
+		if query.matches(&entry, promptHash) {
+			matched = append(matched, &entry)
+		}
+	}
+	return matched, scanner.Err()
+}
+
+func (q AuditQuery) matches(entry *AuditEntry, promptHash string) bool {
+	switch {
+	case !q.From.IsZero() && entry.Time.Before(q.From),
+		!q.To.IsZero() && !entry.Time.Before(q.To),
+		q.Principal != "" && entry.Principal != q.Principal,
+		q.Tool != "" && entry.Tool != q.Tool,
+		q.Action != "" && entry.Action != q.Action,
+		q.Outcome != "" && entry.Outcome != q.Outcome,
+		q.JobID != "" && entry.JobID != q.JobID,
+		q.AdminOnly && !entry.Admin,
+		q.ImageID != "" && !slices.Contains(entry.ImageIDs, q.ImageID):
+		return false
+	}
+	if q.Prompt != "" {
+		for _, key := range []string{"prompt", "negative_prompt"} {
+			value, _ := entry.Args[key].(string)
+			if value == promptHash || strings.Contains(strings.ToLower(value), strings.ToLower(q.Prompt)) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// auditArgKeepBytes 超过该长度的参数（如 base64 图片）只记录哈希值和长度
+const auditArgKeepBytes = 4096
+
+// AuditArgs 返回用于审计记录的工具参数，过长的参数只记录哈希值
+func AuditArgs(args map[string]any) map[string]any {
+	result := make(map[string]any, len(args))
+	for key, value := range args {
+		if s, ok := value.(string); ok && len(s) > auditArgKeepBytes {
+			sum := sha256.Sum256([]byte(s))
+			value = fmt.Sprintf("sha256:%s (%d 字节)", hex.EncodeToString(sum[:]), len(s))
+		}
+		result[key] = value
+	}
+	return result
+}
+
+func hashPrompts(args map[string]any) map[string]any {
+	for _, key := range []string{"prompt", "negative_prompt"} {
+		if value, ok := args[key].(string); ok && value != "" && !strings.HasPrefix(value, "sha256:") {
+			args[key] = hashPrompt(value)
+		}
+	}
+	return args
+}
+
+func hashPrompt(prompt string) string {
+	sum := sha256.Sum256([]byte(prompt))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// 权限范围
+const (
+	// ScopeGenerate 调用生成类工具
+	ScopeGenerate = "generate"
+	// ScopeReadFiles 读取生成的图片文件
+	ScopeReadFiles = "read-files"
+	// ScopeMetrics 读取 /metrics 监控指标
+	ScopeMetrics = "metrics"
+	// ScopeAdmin 管理操作（切换模型等），拥有全部权限
+	ScopeAdmin = "admin"
+)
+
+// AllScopes 全部权限范围
+var AllScopes = []string{ScopeGenerate, ScopeReadFiles, ScopeMetrics, ScopeAdmin}
+
+const (
+	apiKeyPrefix  = "sdmcp_"
+	apiKeyHashAlg = "sha256:"
+)
+
+// 调用方类型
+const (
+	PrincipalAnonymous = "anonymous"
+	PrincipalAPIKey    = "api_key"
+	PrincipalSignedURL = "signed_url"
+)
+
+// APIKeyConfig API Key 配置，只保存 Key 的哈希值
+type APIKeyConfig struct {
+	Label  string   `yaml:"label"`
+	Hash   string   `yaml:"hash"`
+	Scopes []string `yaml:"scopes"`
+	// 角色，为空时只按 scopes 控制权限
+	Role string `yaml:"role,omitempty"`
+	// 该 Key 生成的图片加的水印（watermark.profiles 中的名称），none 表示不加水印，优先于预设的设置
+	Watermark string `yaml:"watermark,omitempty"`
+	// 该 Key 使用的内容审核策略（moderation.policies 中的名称），none 表示不审核，优先于 moderation.default
+	Moderation string `yaml:"moderation,omitempty"`
+}
+
+// Principal 已认证的调用方
+type Principal struct {
+	// 调用方唯一标识，如 api_key:alice
+	ID     string   `json:"id"`
+	Label  string   `json:"label"`
+	Kind   string   `json:"kind"`
+	Scopes []string `json:"scopes"`
+	Role   string   `json:"role,omitempty"`
+	// 凭证过期时间，API Key 为零值
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// HasScope 判断调用方是否拥有指定权限，admin 拥有全部权限
+func (p *Principal) HasScope(scope string) bool {
+	if p == nil {
+		return false
+	}
+	return scope == "" || slices.Contains(p.Scopes, scope) || slices.Contains(p.Scopes, ScopeAdmin)
+}
+
+// AnonymousPrincipal 未启用认证时使用的调用方，拥有全部权限
+func AnonymousPrincipal() *Principal {
+	return &Principal{
+		ID:     PrincipalAnonymous,
+		Label:  PrincipalAnonymous,
+		Kind:   PrincipalAnonymous,
+		Scopes: AllScopes,
+	}
+}
+
+// SignedURLPrincipal 持有有效签名链接的调用方，只能读取链接指向的文件
+func SignedURLPrincipal() *Principal {
+	return &Principal{
+		ID:     PrincipalSignedURL,
+		Label:  PrincipalSignedURL,
+		Kind:   PrincipalSignedURL,
+		Scopes: []string{ScopeReadFiles},
+	}
+}
+
+type principalKey struct{}
+
+// WithPrincipal 将调用方保存到 context
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext 从 context 获取调用方，不存在时返回 nil
+func PrincipalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
+
+// GenerateAPIKey 生成新的 API Key，返回明文 Key 和用于配置文件的哈希值
+func GenerateAPIKey() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", fmt.Errorf("生成随机数失败: %v", err)
+	}
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(buf)
+	return key, HashAPIKey(key), nil
+}
+
+// HashAPIKey 计算 API Key 的哈希值
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return apiKeyHashAlg + hex.EncodeToString(sum[:])
+}
+
+// VerifyAPIKey 校验 API Key，成功时返回对应的调用方
+func (c *AuthConfig) VerifyAPIKey(key string) (*Principal, bool) {
+	hash := []byte(HashAPIKey(key))
+	for _, apiKey := range c.Keys {
+		if subtle.ConstantTimeCompare(hash, []byte(strings.ToLower(apiKey.Hash))) == 1 {
+			return &Principal{
+				ID:     PrincipalAPIKey + ":" + apiKey.Label,
+				Label:  apiKey.Label,
+				Kind:   PrincipalAPIKey,
+				Scopes: apiKey.Scopes,
+				Role:   apiKey.Role,
+			}, true
+		}
+	}
+	return nil, false
+}
+
+func (c *AuthConfig) validate() []error {
+	var errs []error
+	if c.Enabled && len(c.Keys) == 0 && !c.OAuth.Enabled {
+		errs = append(errs, fmt.Errorf("auth.enabled 为 true 时至少需要配置一个 auth.keys 或启用 auth.oauth"))
+	}
+	errs = append(errs, c.OAuth.validate()...)
+	errs = append(errs, c.SignedURLs.validate()...)
+	errs = append(errs, c.validateRoles()...)
+	labels := make(map[string]bool)
+	for i, key := range c.Keys {
+		if key.Label == "" {
+			errs = append(errs, fmt.Errorf("auth.keys[%d].label 不能为空", i))
+		} else if labels[key.Label] {
+			errs = append(errs, fmt.Errorf("auth.keys[%d].label 重复: %s", i, key.Label))
+		}
+		labels[key.Label] = true
+		digest, ok := strings.CutPrefix(strings.ToLower(key.Hash), apiKeyHashAlg)
+		if decoded, err := hex.DecodeString(digest); !ok || err != nil || len(decoded) != sha256.Size {
+			errs = append(errs, fmt.Errorf("auth.keys[%d].hash 格式无效，应为 sha256:<64位十六进制>，可使用 keygen 子命令生成", i))
+		}
+		for _, scope := range key.Scopes {
+			if !slices.Contains(AllScopes, scope) {
+				errs = append(errs, fmt.Errorf("auth.keys[%d].scopes 包含未知权限: %s，可选值: %s", i, scope, strings.Join(AllScopes, ", ")))
+			}
+		}
+	}
+	return errs
+}
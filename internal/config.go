@@ -0,0 +1,444 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-yaml"
+)
+
+// EnvPrefix 环境变量前缀，配置项 server.listen 对应 SDMCP_SERVER_LISTEN
+const EnvPrefix = "SDMCP_"
+
+// EnvConfigPath 指定配置文件路径的环境变量，不对应配置项
+const EnvConfigPath = EnvPrefix + "CONFIG"
+
+// Config 服务配置
+//
+// 优先级（由低到高）：内置默认值 < 配置文件 < SDMCP_* 环境变量 < 命令行参数
+type Config struct {
+	Server     ServerConfig            `yaml:"server"`
+	Backends   []BackendConfig         `yaml:"backends"`
+	Storage    StorageConfig           `yaml:"storage"`
+	Retention  RetentionConfig         `yaml:"retention"`
+	Output     OutputConfig            `yaml:"output"`
+	Variants   VariantsConfig          `yaml:"variants"`
+	Provenance ProvenanceConfig        `yaml:"provenance"`
+	Watermark  WatermarkConfig         `yaml:"watermark"`
+	Tracing    TracingConfig           `yaml:"tracing"`
+	Log        LogConfig               `yaml:"log"`
+	Audit      AuditConfig             `yaml:"audit"`
+	Moderation ModerationConfig        `yaml:"moderation"`
+	Auth       AuthConfig              `yaml:"auth"`
+	Limits     LimitsConfig            `yaml:"limits"`
+	Presets    map[string]PresetConfig `yaml:"presets"`
+}
+
+type ServerConfig struct {
+	// 监听地址，如 :18080
+	Listen string `yaml:"listen"`
+	// 对外访问MCP服务的url，用于拼接图片地址
+	PublicURL string `yaml:"public_url"`
+	// 运行数据（用量统计等）存储目录
+	DataDir string `yaml:"data_dir"`
+}
+
+func (c *ServerConfig) normalize() {
+	c.PublicURL = strings.TrimSuffix(c.PublicURL, "/")
+}
+
+type BackendConfig struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// 单次请求超时时间，图片生成可能需要较长时间
+	Timeout time.Duration `yaml:"timeout"`
+	// 同时发往该后端的生成请求上限，超出的请求排队等待，0 表示不限制
+	MaxConcurrent int `yaml:"max_concurrent"`
+}
+
+// UnmarshalYAML 允许直接使用url字符串声明后端，便于通过环境变量配置
+func (b *BackendConfig) UnmarshalYAML(unmarshal func(any) error) error {
+	var rawUrl string
+	if err := unmarshal(&rawUrl); err == nil {
+		*b = BackendConfig{URL: rawUrl}
+		return nil
+	}
+	type plain BackendConfig
+	return unmarshal((*plain)(b))
+}
+
+type StorageConfig struct {
+	// 存储类型: local（本地磁盘，默认）或 s3（S3 兼容对象存储）
+	Type string `yaml:"type"`
+	// 本地存储时生成的图片存储位置
+	Path string `yaml:"path"`
+	// 按 SHA-256 去重存储图片内容，相同内容只保存一份，图片路径作为指向内容的别名
+	Dedup bool            `yaml:"dedup"`
+	S3    S3StorageConfig `yaml:"s3"`
+}
+
+type AuthConfig struct {
+	// 启用后 /mcp、/sse 和 /api/v1 需要携带 Authorization: Bearer <key>
+	Enabled bool           `yaml:"enabled"`
+	Keys    []APIKeyConfig `yaml:"keys"`
+	// 角色定义，API Key 和 OAuth 调用方通过角色限制可调用的工具和参数
+	Roles map[string]RoleConfig `yaml:"roles"`
+	// 接受授权服务器签发的 JWT 访问令牌
+	OAuth OAuthConfig `yaml:"oauth"`
+	// 图片链接签名，持有有效签名链接的请求无需 API Key
+	SignedURLs SignedURLConfig `yaml:"signed_urls"`
+}
+
+// LimitsConfig 生成参数上限、限流和配额，0 表示不限制
+type LimitsConfig struct {
+	MaxWidth     int `yaml:"max_width"`
+	MaxHeight    int `yaml:"max_height"`
+	MaxSteps     int `yaml:"max_steps"`
+	MaxBatchSize int `yaml:"max_batch_size"`
+	MaxNIter     int `yaml:"max_n_iter"`
+	// 单次导出的最大图片数量
+	MaxExportImages int `yaml:"max_export_images"`
+	// 每个调用方的工具调用限流
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	// 每个调用方的 /api/v1 请求限流
+	APIRateLimit RateLimitConfig `yaml:"api_rate_limit"`
+	// 每个调用方的 GPU 用量配额
+	Quota QuotaConfig `yaml:"quota"`
+}
+
+// PresetConfig 生成参数预设，Params 中的键与 txt2img 请求字段一致，请求中显式传入的参数优先
+type PresetConfig struct {
+	Description string         `yaml:"description"`
+	Params      map[string]any `yaml:"params"`
+	// 使用该预设生成的图片加的水印（watermark.profiles 中的名称），none 表示不加水印
+	Watermark string `yaml:"watermark,omitempty"`
+}
+
+// DefaultConfig 返回内置默认配置
+func DefaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Listen:    ":18080",
+			PublicURL: "http://127.0.0.1:18080",
+			DataDir:   "./data",
+		},
+		Backends: []BackendConfig{
+			{Name: "default", URL: "http://127.0.0.1:7860"},
+		},
+		Storage: StorageConfig{
+			Type: StorageTypeLocal,
+			Path: "./images",
+		},
+		Limits: LimitsConfig{
+			MaxExportImages: 1000,
+		},
+		Log: LogConfig{
+			Redact: true,
+		},
+	}
+}
+
+// LoadConfig 依次加载默认值、配置文件（path 为空时跳过）和环境变量，结果需经过 Normalize 和 Validate
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("读取配置文件失败: %v", err)
+		}
+		if err := yaml.UnmarshalWithOptions(data, cfg, yaml.Strict()); err != nil {
+			return nil, fmt.Errorf("解析配置文件 %s 失败: %v", path, err)
+		}
+	}
+
+	if err := ApplyEnv(cfg, os.Environ()); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// ApplyEnv 使用 SDMCP_* 环境变量覆盖配置
+//
+// 变量名由 yaml 键路径转为大写并以下划线连接，如 limits.max_steps 对应 SDMCP_LIMITS_MAX_STEPS。
+// 列表可使用逗号分隔（SDMCP_BACKENDS=http://a:7860,http://b:7860），
+// 复杂结构可直接传入 YAML/JSON（SDMCP_PRESETS='{"anime": {"params": {"steps": 28}}}'）。
+// 不对应任何配置项的 SDMCP_* 变量（通常是拼写错误）视为错误，避免配置被静默忽略。
+func ApplyEnv(cfg *Config, environ []string) error {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		key, value, ok := strings.Cut(kv, "=")
+		if ok && strings.HasPrefix(key, EnvPrefix) && key != EnvConfigPath {
+			env[key] = value
+		}
+	}
+
+	var errs []error
+	prefix := strings.TrimSuffix(EnvPrefix, "_")
+	known := make(map[string]bool)
+	collectEnvNames(reflect.TypeOf(cfg).Elem(), prefix, known)
+	var unknown []string
+	for key := range env {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	slices.Sort(unknown)
+	for _, key := range unknown {
+		errs = append(errs, fmt.Errorf("未知的环境变量 %s，不对应任何配置项", key))
+	}
+
+	applyEnvToStruct(reflect.ValueOf(cfg).Elem(), prefix, env, &errs)
+	return errors.Join(errs...)
+}
+
+// collectEnvNames 收集所有配置项对应的环境变量名，与 applyEnvToStruct 的命名规则一致
+func collectEnvNames(t reflect.Type, prefix string, names map[string]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(tag)
+		names[name] = true
+		if field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(time.Time{}) {
+			collectEnvNames(field.Type, name, names)
+		}
+	}
+}
+
+func applyEnvToStruct(v reflect.Value, prefix string, env map[string]string, errs *[]error) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(tag)
+		fieldValue := v.Field(i)
+
+		if raw, ok := env[name]; ok {
+			if err := setFromEnv(fieldValue, raw); err != nil {
+				*errs = append(*errs, fmt.Errorf("环境变量 %s 无效: %v", name, err))
+			}
+			continue
+		}
+
+		if fieldValue.Kind() == reflect.Struct && fieldValue.Type() != reflect.TypeOf(time.Time{}) {
+			applyEnvToStruct(fieldValue, name, env, errs)
+		}
+	}
+}
+
+func setFromEnv(v reflect.Value, raw string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+		return nil
+	case reflect.Slice:
+		trimmed := strings.TrimSpace(raw)
+		if trimmed == "" {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		if strings.HasPrefix(trimmed, "[") {
+			break
+		}
+		// 逗号分隔的列表，逐个元素解析
+		items := strings.Split(trimmed, ",")
+		slice := reflect.MakeSlice(v.Type(), 0, len(items))
+		for _, item := range items {
+			elem := reflect.New(v.Type().Elem())
+			if err := setFromEnv(elem.Elem(), strings.TrimSpace(item)); err != nil {
+				return err
+			}
+			slice = reflect.Append(slice, elem.Elem())
+		}
+		v.Set(slice)
+		return nil
+	}
+
+	target := reflect.New(v.Type())
+	if err := yaml.UnmarshalWithOptions([]byte(raw), target.Interface(), yaml.Strict()); err != nil {
+		return err
+	}
+	v.Set(target.Elem())
+	return nil
+}
+
+// Validate 校验配置，返回所有发现的问题
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.Server.Listen == "" {
+		errs = append(errs, errors.New("server.listen 不能为空"))
+	}
+	if err := validateHttpUrl(c.Server.PublicURL); err != nil {
+		errs = append(errs, fmt.Errorf("server.public_url 无效: %v", err))
+	}
+
+	if len(c.Backends) == 0 {
+		errs = append(errs, errors.New("backends 至少需要配置一个 Stable Diffusion WebUI 后端"))
+	}
+	names := make(map[string]bool)
+	for i, backend := range c.Backends {
+		if backend.Name == "" {
+			errs = append(errs, fmt.Errorf("backends[%d].name 不能为空", i))
+		} else if names[backend.Name] {
+			errs = append(errs, fmt.Errorf("backends[%d].name 重复: %s", i, backend.Name))
+		}
+		names[backend.Name] = true
+		if err := validateHttpUrl(backend.URL); err != nil {
+			errs = append(errs, fmt.Errorf("backends[%d].url 无效: %v", i, err))
+		}
+		if backend.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("backends[%d].timeout 不能为负数", i))
+		}
+		if backend.MaxConcurrent < 0 {
+			errs = append(errs, fmt.Errorf("backends[%d].max_concurrent 不能为负数", i))
+		}
+	}
+
+	if c.Server.DataDir == "" {
+		errs = append(errs, errors.New("server.data_dir 不能为空"))
+	}
+
+	switch c.Storage.Type {
+	case StorageTypeLocal:
+		if c.Storage.Path == "" {
+			errs = append(errs, errors.New("storage.path 不能为空"))
+		}
+	case StorageTypeS3:
+		errs = append(errs, c.Storage.S3.validate()...)
+	default:
+		errs = append(errs, fmt.Errorf("storage.type 无效: %s，可选值为 local、s3", c.Storage.Type))
+	}
+
+	errs = append(errs, c.Retention.validate()...)
+	if err := c.Output.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("output 配置无效: %v", err))
+	}
+	errs = append(errs, c.Variants.validate()...)
+	errs = append(errs, c.Provenance.validate()...)
+	errs = append(errs, c.Watermark.validate()...)
+	errs = append(errs, c.validateWatermarkRefs()...)
+	errs = append(errs, c.Tracing.validate()...)
+	errs = append(errs, c.Log.validate()...)
+	errs = append(errs, c.Audit.validate()...)
+	errs = append(errs, c.Moderation.validate()...)
+	errs = append(errs, c.validateModerationRefs()...)
+	errs = append(errs, c.Auth.validate()...)
+
+	limits := map[string]int{
+		"limits.max_width":         c.Limits.MaxWidth,
+		"limits.max_height":        c.Limits.MaxHeight,
+		"limits.max_steps":         c.Limits.MaxSteps,
+		"limits.max_batch_size":    c.Limits.MaxBatchSize,
+		"limits.max_n_iter":        c.Limits.MaxNIter,
+		"limits.max_export_images": c.Limits.MaxExportImages,
+	}
+	for key, value := range limits {
+		if value < 0 {
+			errs = append(errs, fmt.Errorf("%s 不能为负数", key))
+		}
+	}
+	errs = append(errs, c.Limits.RateLimit.validate("limits.rate_limit")...)
+	errs = append(errs, c.Limits.APIRateLimit.validate("limits.api_rate_limit")...)
+	errs = append(errs, c.Limits.Quota.validate("limits.quota")...)
+
+	for name := range c.Presets {
+		if strings.TrimSpace(name) == "" {
+			errs = append(errs, errors.New("presets 名称不能为空"))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Normalize 填充可推导的默认值，应在校验之前调用
+func (c *Config) Normalize() {
+	c.Server.normalize()
+	c.Auth.OAuth.normalize(c.Server.PublicURL)
+	c.Auth.SignedURLs.normalize()
+	c.Storage.S3.normalize()
+	c.Retention.normalize()
+	c.Output.normalize()
+	c.Variants.normalize()
+	c.Provenance.normalize(c.Server.PublicURL)
+	c.Watermark.normalize()
+	c.Tracing.normalize()
+	c.Log.normalize()
+	c.Audit.normalize()
+	c.Moderation.normalize()
+	for i := range c.Backends {
+		backend := &c.Backends[i]
+		backend.URL = strings.TrimSuffix(backend.URL, "/")
+		if backend.Name == "" {
+			// 未命名的后端使用主机名作为名称，仅有一个后端时使用 default
+			if len(c.Backends) == 1 {
+				backend.Name = "default"
+			} else if u, err := url.Parse(backend.URL); err == nil {
+				backend.Name = u.Host
+			}
+		}
+		if backend.Timeout == 0 {
+			backend.Timeout = 300 * time.Second
+		}
+	}
+}
+
+// Backend 按名称查找后端，名称为空时返回第一个后端
+func (c *Config) Backend(name string) (*BackendConfig, error) {
+	if name == "" {
+		if len(c.Backends) == 0 {
+			return nil, errors.New("未配置任何后端")
+		}
+		return &c.Backends[0], nil
+	}
+	for i := range c.Backends {
+		if c.Backends[i].Name == name {
+			return &c.Backends[i], nil
+		}
+	}
+	return nil, fmt.Errorf("后端不存在: %s", name)
+}
+
+func validateHttpUrl(rawUrl string) error {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("仅支持 http/https 地址: %q", rawUrl)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("缺少主机名: %q", rawUrl)
+	}
+	return nil
+}
+
+// LimitsFor 返回调用方适用的限流和配额，角色中的配置优先于全局配置
+func (c *Config) LimitsFor(principal *Principal) (RateLimitConfig, QuotaConfig) {
+	rateLimit, quota := c.Limits.RateLimit, c.Limits.Quota
+	if principal == nil {
+		return rateLimit, quota
+	}
+	if role, ok := c.Auth.Roles[principal.Role]; ok {
+		if role.RateLimit != nil {
+			rateLimit = *role.RateLimit
+		}
+		if role.Quota != nil {
+			quota = *role.Quota
+		}
+	}
+	return rateLimit, quota
+}
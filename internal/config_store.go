@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// configWatchInterval 配置文件变更检查间隔
+const configWatchInterval = 5 * time.Second
+
+// ConfigStore 持有当前生效的配置快照，支持运行时重新加载
+//
+// 各组件应在每次处理请求时通过 Get 获取快照，而不是在初始化时保存配置中的值，
+// 这样后端、预设、限额等配置在重新加载后可以立即生效。
+type ConfigStore struct {
+	path      string
+	overrides func(*Config)
+
+	current atomic.Pointer[Config]
+
+	mu        sync.Mutex
+	modTime   time.Time
+	listeners []func(old, new *Config)
+}
+
+// NewConfigStore 加载配置并创建 ConfigStore，overrides 用于在每次加载后应用命令行参数
+func NewConfigStore(path string, overrides func(*Config)) (*ConfigStore, error) {
+	s := &ConfigStore{
+		path:      path,
+		overrides: overrides,
+	}
+
+	config, err := s.load(nil)
+	if err != nil {
+		return nil, err
+	}
+	s.current.Store(config)
+	s.modTime = s.fileModTime()
+
+	return s, nil
+}
+
+// Get 返回当前配置快照，调用方不应修改返回值
+func (s *ConfigStore) Get() *Config {
+	return s.current.Load()
+}
+
+// OnChange 注册配置变更回调，回调在重新加载成功后同步执行
+func (s *ConfigStore) OnChange(fn func(old, new *Config)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+// Reload 重新加载配置文件和环境变量，校验失败时保留当前配置
+func (s *ConfigStore) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 加载失败时不更新修改时间，下次检查时继续重试（如文件只写入了一半）
+	modTime := s.fileModTime()
+	old := s.current.Load()
+	var restartRequired []string
+	config, err := s.load(func(config *Config) {
+		// 在 Normalize 之前还原，由 public_url 推导的配置（OAuth resource、溯源 server_id）与实际生效的 public_url 一致
+		restartRequired = keepRestartRequired(old, config)
+	})
+	if err != nil {
+		return err
+	}
+	s.modTime = modTime
+
+	for _, field := range restartRequired {
+		logrus.Warnf("配置项 %s 已修改，需要重启服务才能生效 (restart required)", field)
+	}
+
+	s.current.Store(config)
+	logrus.Infof("配置已重新加载")
+
+	for _, listener := range s.listeners {
+		listener(old, config)
+	}
+	return nil
+}
+
+// Watch 监听 SIGHUP 信号并定期检查配置文件修改时间，发生变化时重新加载，直到 ctx 结束
+func (s *ConfigStore) Watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logrus.Infof("收到 SIGHUP，重新加载配置")
+		case <-ticker.C:
+			if s.path == "" || !s.fileChanged() {
+				continue
+			}
+			logrus.Infof("检测到配置文件 %s 发生变化，重新加载配置", s.path)
+		}
+
+		if err := s.Reload(); err != nil {
+			logrus.Errorf("重新加载配置失败，继续使用当前配置: %v", err)
+		}
+	}
+}
+
+// load 加载配置并校验，prepare 不为 nil 时在应用命令行参数之后、Normalize 之前调用
+func (s *ConfigStore) load(prepare func(*Config)) (*Config, error) {
+	config, err := LoadConfig(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if s.overrides != nil {
+		s.overrides(config)
+	}
+	if prepare != nil {
+		prepare(config)
+	}
+	config.Normalize()
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (s *ConfigStore) fileModTime() time.Time {
+	if s.path == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func (s *ConfigStore) fileChanged() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.fileModTime().Equal(s.modTime)
+}
+
+// keepRestartRequired 将无法在运行时生效的配置项恢复为旧值，并返回发生变化的配置项名称；
+// new 尚未 Normalize，按规范化后的值比较，避免格式差异（如 public_url 末尾的斜杠）被当作修改
+func keepRestartRequired(old, new *Config) []string {
+	var changed []string
+	server, storage, tracing := new.Server, new.Storage, new.Tracing
+	server.normalize()
+	storage.S3.normalize()
+	tracing.normalize()
+
+	if old.Server.Listen != server.Listen {
+		changed = append(changed, "server.listen")
+	}
+	if old.Server.PublicURL != server.PublicURL {
+		changed = append(changed, "server.public_url")
+	}
+	if old.Server.DataDir != server.DataDir {
+		changed = append(changed, "server.data_dir")
+	}
+	new.Server = old.Server
+	if !reflect.DeepEqual(old.Storage, storage) {
+		changed = append(changed, "storage")
+	}
+	new.Storage = old.Storage
+	if !reflect.DeepEqual(old.Tracing, tracing) {
+		changed = append(changed, "tracing")
+	}
+	new.Tracing = old.Tracing
+	return changed
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, path string, content string, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	now := time.Now()
+	writeTestConfig(t, path, "limits:\n  max_steps: 30\n", now.Add(-time.Minute))
+
+	store, err := NewConfigStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := 0
+	store.OnChange(func(old, new *Config) { changes++ })
+
+	// 校验失败时保留当前配置，并在下次检查时重试
+	writeTestConfig(t, path, "limits:\n  max_steps: -1\n", now.Add(-30*time.Second))
+	if !store.fileChanged() {
+		t.Fatal("fileChanged() = false")
+	}
+	if err := store.Reload(); err == nil {
+		t.Fatal("Reload() 应返回校验错误")
+	}
+	if store.Get().Limits.MaxSteps != 30 || changes != 0 {
+		t.Fatalf("MaxSteps = %d, changes = %d", store.Get().Limits.MaxSteps, changes)
+	}
+	if !store.fileChanged() {
+		t.Fatal("加载失败后 fileChanged() 应仍为 true")
+	}
+
+	writeTestConfig(t, path, "limits:\n  max_steps: 50\n", now)
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if store.Get().Limits.MaxSteps != 50 || changes != 1 {
+		t.Fatalf("MaxSteps = %d, changes = %d", store.Get().Limits.MaxSteps, changes)
+	}
+	if store.fileChanged() {
+		t.Fatal("加载成功后 fileChanged() 应为 false")
+	}
+}
+
+// 需要重启的配置项在 Normalize 之前还原，由 public_url 推导的配置与生效的 public_url 一致
+func TestConfigStoreReloadRestartRequired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	now := time.Now()
+	writeTestConfig(t, path, "server:\n  public_url: http://a.test\n", now.Add(-time.Minute))
+
+	store, err := NewConfigStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestConfig(t, path, "server:\n  public_url: http://b.test\nlimits:\n  max_steps: 40\n", now)
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	config := store.Get()
+	if config.Limits.MaxSteps != 40 {
+		t.Errorf("MaxSteps = %d，可以运行时生效的配置应更新", config.Limits.MaxSteps)
+	}
+	if config.Server.PublicURL != "http://a.test" {
+		t.Errorf("PublicURL = %q", config.Server.PublicURL)
+	}
+	if config.Auth.OAuth.Resource != "http://a.test/mcp" || config.Auth.OAuth.Audience[0] != "http://a.test/mcp" {
+		t.Errorf("OAuth resource = %q, audience = %q", config.Auth.OAuth.Resource, config.Auth.OAuth.Audience)
+	}
+	if config.Provenance.ServerID != "http://a.test" {
+		t.Errorf("Provenance.ServerID = %q", config.Provenance.ServerID)
+	}
+}
+
+func TestKeepRestartRequired(t *testing.T) {
+	old := DefaultConfig()
+	old.Normalize()
+
+	// 只有格式差异时不视为修改
+	new := DefaultConfig()
+	new.Server.PublicURL += "/"
+	if changed := keepRestartRequired(old, new); len(changed) != 0 {
+		t.Errorf("keepRestartRequired() = %q", changed)
+	}
+
+	new = DefaultConfig()
+	new.Server.Listen = ":9000"
+	new.Storage.Path = "/tmp/other"
+	new.Limits.MaxSteps = 40
+	changed := keepRestartRequired(old, new)
+	if len(changed) != 2 || changed[0] != "server.listen" || changed[1] != "storage" {
+		t.Errorf("keepRestartRequired() = %q", changed)
+	}
+	if new.Server.Listen != old.Server.Listen || new.Storage.Path != old.Storage.Path || new.Limits.MaxSteps != 40 {
+		t.Errorf("listen = %q, storage.path = %q, max_steps = %d", new.Server.Listen, new.Storage.Path, new.Limits.MaxSteps)
+	}
+}
@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyEnv(t *testing.T) {
+	cfg := DefaultConfig()
+	err := ApplyEnv(cfg, []string{
+		"SDMCP_SERVER_LISTEN=:9000",
+		"SDMCP_BACKENDS=http://a:7860, http://b:7860",
+		"SDMCP_STORAGE_DEDUP=true",
+		"SDMCP_LIMITS_MAX_STEPS=50",
+		"SDMCP_AUDIT_MAX_FILE_BYTES=10MiB",
+		"SDMCP_AUTH_SIGNED_URLS_TTL=90m",
+		`SDMCP_PRESETS={"anime": {"params": {"steps": 28}}}`,
+		"SDMCP_AUTH_KEYS=[{label: alice, hash: abc, scopes: [generate]}]",
+		"SDMCP_CONFIG=/etc/sdmcp.yaml",
+		"PATH=/usr/bin",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Server.Listen != ":9000" || !cfg.Storage.Dedup || cfg.Limits.MaxSteps != 50 {
+		t.Errorf("listen = %q, dedup = %v, max_steps = %d", cfg.Server.Listen, cfg.Storage.Dedup, cfg.Limits.MaxSteps)
+	}
+	if len(cfg.Backends) != 2 || cfg.Backends[0].URL != "http://a:7860" || cfg.Backends[1].URL != "http://b:7860" {
+		t.Errorf("backends = %+v", cfg.Backends)
+	}
+	if cfg.Audit.MaxFileBytes != 10<<20 {
+		t.Errorf("audit.max_file_bytes = %d", cfg.Audit.MaxFileBytes)
+	}
+	if cfg.Auth.SignedURLs.TTL != 90*time.Minute {
+		t.Errorf("auth.signed_urls.ttl = %v", cfg.Auth.SignedURLs.TTL)
+	}
+	if steps, _ := numberArg(cfg.Presets["anime"].Params, "steps"); steps != 28 {
+		t.Errorf("presets = %+v", cfg.Presets)
+	}
+	if len(cfg.Auth.Keys) != 1 || cfg.Auth.Keys[0].Label != "alice" || cfg.Auth.Keys[0].Scopes[0] != ScopeGenerate {
+		t.Errorf("auth.keys = %+v", cfg.Auth.Keys)
+	}
+}
+
+func TestApplyEnvErrors(t *testing.T) {
+	err := ApplyEnv(DefaultConfig(), []string{
+		"SDMCP_SERVER_LISTN=:9000",
+		"SDMCP_LIMITS_MAX_STEPS=many",
+		"SDMCP_AUDIT_MAX_FILE_BYTES=10XB",
+		"SDMCP_PRESETS_ANIME_STEPS=28",
+	})
+	if err == nil {
+		t.Fatal("ApplyEnv() 应返回错误")
+	}
+	for _, want := range []string{"SDMCP_SERVER_LISTN", "SDMCP_LIMITS_MAX_STEPS", "SDMCP_AUDIT_MAX_FILE_BYTES", "SDMCP_PRESETS_ANIME_STEPS"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("错误信息中应包含 %s: %v", want, err)
+		}
+	}
+}
+
+// 优先级（由低到高）：内置默认值 < 配置文件 < 环境变量 < 命令行参数
+func TestConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeTestConfig(t, path, "server:\n  listen: ':1001'\n  public_url: http://file.test\nlimits:\n  max_steps: 30\n  max_width: 1024\n", time.Now())
+	t.Setenv("SDMCP_SERVER_LISTEN", ":1002")
+	t.Setenv("SDMCP_LIMITS_MAX_STEPS", "40")
+
+	store, err := NewConfigStore(path, func(c *Config) {
+		c.Server.Listen = ":1003"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := store.Get()
+	if cfg.Server.Listen != ":1003" {
+		t.Errorf("命令行参数应优先，listen = %q", cfg.Server.Listen)
+	}
+	if cfg.Limits.MaxSteps != 40 {
+		t.Errorf("环境变量应覆盖配置文件，max_steps = %d", cfg.Limits.MaxSteps)
+	}
+	if cfg.Server.PublicURL != "http://file.test" || cfg.Limits.MaxWidth != 1024 {
+		t.Errorf("配置文件应覆盖默认值，public_url = %q, max_width = %d", cfg.Server.PublicURL, cfg.Limits.MaxWidth)
+	}
+	if cfg.Storage.Path != DefaultConfig().Storage.Path {
+		t.Errorf("未配置的项应使用默认值，storage.path = %q", cfg.Storage.Path)
+	}
+
+	t.Setenv("SDMCP_SERVER_LISTN", ":1004")
+	if _, err := NewConfigStore(path, nil); err == nil || !strings.Contains(err.Error(), "SDMCP_SERVER_LISTN") {
+		t.Errorf("未知的环境变量 NewConfigStore() error = %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		want   string
+	}{
+		{"默认配置", func(c *Config) {}, ""},
+		{"监听地址为空", func(c *Config) { c.Server.Listen = "" }, "server.listen"},
+		{"public_url 无效", func(c *Config) { c.Server.PublicURL = "ftp://x" }, "server.public_url"},
+		{"没有后端", func(c *Config) { c.Backends = nil }, "backends"},
+		{"后端名称重复", func(c *Config) {
+			c.Backends = []BackendConfig{{Name: "a", URL: "http://a:7860"}, {Name: "a", URL: "http://b:7860"}}
+		}, "backends[1].name 重复"},
+		{"存储类型无效", func(c *Config) { c.Storage.Type = "ftp" }, "storage.type"},
+		{"签名密钥过短", func(c *Config) { c.Auth.SignedURLs = SignedURLConfig{Enabled: true, Secret: "short"} }, "secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tt.modify(cfg)
+			cfg.Normalize()
+			err := cfg.Validate()
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Validate() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	// 返回所有发现的问题，而不是只返回第一个
+	cfg := DefaultConfig()
+	cfg.Server.Listen = ""
+	cfg.Storage.Type = "ftp"
+	cfg.Normalize()
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "server.listen") || !strings.Contains(err.Error(), "storage.type") {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
@@ -1,80 +1,386 @@
 package internal
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"os"
+	"image/png"
+	"io"
 	"path"
-	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type FileService struct {
-	fileSavePath string
-	serverUrl    string
+	storage   Storage
+	index     *ImageIndex
+	urlSigner *URLSigner
+	variants  *VariantCache
+	// 溯源清单签名
+	provenance *ProvenanceSigner
+	// 可见和隐形水印
+	watermarker *Watermarker
+	// 按内容去重存储，相同内容的图片只保存一份
+	dedup bool
 }
 
-func NewFileService(fileSavePath string, serverUrl string) *FileService {
+func NewFileService(storage Storage, index *ImageIndex, urlSigner *URLSigner, variants *VariantCache, provenance *ProvenanceSigner, watermarker *Watermarker, dedup bool) *FileService {
 	return &FileService{
-		fileSavePath: fileSavePath,
-		serverUrl:    serverUrl,
+		storage:     storage,
+		index:       index,
+		urlSigner:   urlSigner,
+		variants:    variants,
+		provenance:  provenance,
+		watermarker: watermarker,
+		dedup:       dedup,
 	}
 }
 
-// saveImage 将base64图片数据保存到指定路径
-func (s *FileService) SaveImage(base64Data string) (string, error) {
+// BlobPrefix 去重存储的图片内容路径前缀
+const BlobPrefix = "blobs/"
+
+// ExportPrefix 导出文件的路径前缀
+const ExportPrefix = "exports/"
+
+// BlobKey 返回去重存储中图片内容的路径，如 blobs/ab/abcd....png
+func BlobKey(sha256Hex string, ext string) string {
+	return BlobPrefix + sha256Hex[:2] + "/" + sha256Hex + ext
+}
+
+// SaveImage 将base64图片数据按 output 指定的格式保存到存储中，并将元数据记录写入索引，返回图片的访问地址；
+// record 中的 ID、Key、SHA256、BlobKey、Size、ContentType、CreatedAt 和 Principal 由本方法填充
+func (s *FileService) SaveImage(ctx context.Context, base64Data string, output OutputConfig, record *ImageRecord) (string, error) {
+	ctx, span := Tracer().Start(ctx, "save image", trace.WithAttributes(
+		attribute.String("sdmcp.image.format", output.Format),
+		attribute.String("sdmcp.image.watermark", record.Watermark),
+		attribute.Bool("sdmcp.storage.dedup", s.dedup),
+	))
+	fileUrl, err := s.saveImage(ctx, base64Data, output, record)
+	span.SetAttributes(imageSpanAttributes(record)...)
+	EndSpan(span, err)
+	return fileUrl, err
+}
+
+func (s *FileService) saveImage(ctx context.Context, base64Data string, output OutputConfig, record *ImageRecord) (string, error) {
 	// 生成UUID作为文件名
 	fileID, err := uuid.NewRandom()
 	if err != nil {
 		return "", fmt.Errorf("生成UUID失败: %v", err)
 	}
 
-	// 创建文件名
-	fileName := fmt.Sprintf("%s.png", fileID.String())
-	// 生成日期文件夹（yyyy-MM-dd格式）
-	dateFolder := time.Now().Format("2006-01-02")
-	// 构建完整路径，包含日期文件夹
-	filePath := filepath.Join(s.fileSavePath, dateFolder, fileName)
+	// 解码base64数据
+	pngData, err := base64.StdEncoding.DecodeString(base64Data)
+	if err != nil {
+		return "", fmt.Errorf("解码base64数据失败: %v", err)
+	}
 
-	// 确保目录存在（包括日期文件夹）
-	dateDir := filepath.Join(s.fileSavePath, dateFolder)
-	if err := os.MkdirAll(dateDir, 0755); err != nil {
-		return "", fmt.Errorf("创建目录失败: %v", err)
+	record.ID = fileID.String()
+	record.CreatedAt = time.Now()
+	ctx = WithLogFields(ctx, logrus.Fields{LogFieldImageID: record.ID})
+	if principal := PrincipalFromContext(ctx); principal != nil {
+		record.Principal = principal.ID
 	}
 
-	// 解码base64数据
-	imageData, err := base64.StdEncoding.DecodeString(base64Data)
+	// 去重存储时不写入图片 ID 等每次请求不同的元数据，否则相同的图片内容无法复用
+	metadata := NewImageMetadata(record, !s.dedup)
+	var encoded *EncodedImage
+	if record.Watermark == "" {
+		encoded, err = EncodeImage(pngData, output, metadata)
+	} else {
+		encoded, err = s.encodeWithWatermark(pngData, output, metadata, record)
+	}
 	if err != nil {
-		return "", fmt.Errorf("解码base64数据失败: %v", err)
+		return "", err
 	}
+	imageData := encoded.Data
+	record.ContentType = encoded.ContentType
 
-	// 保存图片文件
-	if err := os.WriteFile(filePath, imageData, 0644); err != nil {
-		return "", fmt.Errorf("保存图片文件失败: %v", err)
+	// 签名的溯源清单包含创建时间和图片 ID，每张图片的内容都不同，启用后不会再去重
+	var manifest []byte
+	if s.provenance.Enabled() {
+		if imageData, manifest, err = s.provenance.Sign(imageData, record); err != nil {
+			return "", fmt.Errorf("生成溯源清单失败: %v", err)
+		}
 	}
 
-	// 构建相对路径用于URL（日期文件夹/文件名），使用path包确保URL使用正斜杠
+	// 创建文件名
+	fileName := fileID.String() + encoded.Ext
+	// 生成日期文件夹（yyyy-MM-dd格式）
+	dateFolder := record.CreatedAt.Format("2006-01-02")
+	// 构建相对路径（日期文件夹/文件名），使用path包确保使用正斜杠
 	relativePath := path.Join(dateFolder, fileName)
-	fileUrl := fmt.Sprintf("%s/api/v1/read/file/%s", s.serverUrl, relativePath)
-	logrus.Infof("fileUrl: %s", fileUrl)
+
+	sum := sha256.Sum256(imageData)
+	record.Key = relativePath
+	record.SHA256 = hex.EncodeToString(sum[:])
+	record.Size = int64(len(imageData))
+
+	if s.dedup {
+		record.BlobKey = BlobKey(record.SHA256, encoded.Ext)
+		err = s.saveBlob(ctx, imageData, record)
+	} else {
+		err = s.saveFile(ctx, imageData, record)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// 旁路清单保存失败时图片中仍有嵌入的清单，不影响生成结果
+	if manifest != nil {
+		sidecarKey := relativePath + ProvenanceSuffix
+		if err := s.storage.Put(ctx, sidecarKey, bytes.NewReader(manifest), int64(len(manifest)), "application/json"); err != nil {
+			Logger(ctx).WithError(err).Errorf("保存溯源清单 %s 失败", sidecarKey)
+		} else {
+			recordStored("provenance", int64(len(manifest)))
+		}
+	}
+
+	AuditImage(ctx, record.ID)
+	fileUrl := s.urlSigner.FileURL(relativePath)
+	Logger(ctx).WithFields(logrus.Fields{
+		"key":          record.Key,
+		"size":         record.Size,
+		"content_type": record.ContentType,
+	}).Info("图片已保存")
 
 	return fileUrl, nil
 }
 
-func (s *FileService) ReadFile(filePath string) (*os.File, error) {
-	if strings.Contains(filePath, "..") {
-		return nil, errors.New("file path contains invalid characters")
+// encodeWithWatermark 解码 WebUI 返回的 PNG 图片，加水印后按 output 指定的格式编码
+func (s *FileService) encodeWithWatermark(pngData []byte, output OutputConfig, metadata *ImageMetadata, record *ImageRecord) (*EncodedImage, error) {
+	img, err := png.Decode(bytes.NewReader(pngData))
+	if err != nil {
+		return nil, fmt.Errorf("解码 PNG 图片失败: %v", err)
+	}
+	if img, err = s.watermarker.Apply(img, record.Watermark, record); err != nil {
+		return nil, fmt.Errorf("添加水印失败: %v", err)
+	}
+	return encodeImage(img, output, metadata)
+}
+
+// saveFile 按图片路径保存图片后写入元数据索引，写入失败时删除已保存的图片，避免出现没有记录的图片
+func (s *FileService) saveFile(ctx context.Context, imageData []byte, record *ImageRecord) error {
+	if err := s.storage.Put(ctx, record.Key, bytes.NewReader(imageData), record.Size, record.ContentType); err != nil {
+		return fmt.Errorf("保存图片文件失败: %v", err)
+	}
+	if err := s.index.Put(record); err != nil {
+		if deleteErr := s.storage.Delete(context.WithoutCancel(ctx), record.Key); deleteErr != nil {
+			Logger(ctx).WithError(deleteErr).Errorf("删除图片 %s 失败", record.Key)
+		}
+		return fmt.Errorf("保存图片元数据失败: %v", err)
+	}
+	recordStored("image", record.Size)
+	storedImages.Inc()
+	return nil
+}
+
+// saveBlob 去重保存：锁定内容后写入元数据索引增加引用计数，再在内容不存在时保存内容；
+// 保留策略删除内容时持有同一把锁，确认没有引用后才删除，不会删除正在保存或刚被复用的内容
+func (s *FileService) saveBlob(ctx context.Context, imageData []byte, record *ImageRecord) error {
+	unlock := s.index.LockBlob(record.BlobKey)
+	defer unlock()
+
+	if err := s.index.Put(record); err != nil {
+		return fmt.Errorf("保存图片元数据失败: %v", err)
+	}
+
+	_, err := s.storage.Stat(ctx, record.BlobKey)
+	if errors.Is(err, ErrObjectNotFound) {
+		if err = s.storage.Put(ctx, record.BlobKey, bytes.NewReader(imageData), record.Size, record.ContentType); err == nil {
+			recordStored("image", record.Size)
+		}
+	} else if err == nil {
+		Logger(ctx).Infof("图片内容已存在，复用 %s", record.BlobKey)
+	}
+	if err != nil {
+		if _, deleteErr := s.index.Delete(record.ID); deleteErr != nil {
+			Logger(ctx).WithError(deleteErr).Error("删除图片记录失败")
+		}
+		return fmt.Errorf("保存图片文件失败: %v", err)
+	}
+	storedImages.Inc()
+	return nil
+}
+
+// objectKey 返回图片在存储中的实际路径，去重存储的图片路径是指向内容的别名
+func (s *FileService) objectKey(filePath string) string {
+	if record, err := s.index.GetByKey(filePath); err == nil && record.BlobKey != "" {
+		return record.BlobKey
+	}
+	return filePath
+}
+
+// CheckStorage 检查存储是否可用，见 Storage.Check
+func (s *FileService) CheckStorage(ctx context.Context) error {
+	return s.storage.Check(ctx)
+}
+
+// ImageByID 按 ID 获取图片元数据记录
+func (s *FileService) ImageByID(id string) (*ImageRecord, error) {
+	return s.index.Get(id)
+}
+
+// SearchImages 按条件检索图片元数据记录
+func (s *FileService) SearchImages(query ImageQuery) ([]*ImageRecord, int, error) {
+	return s.index.Search(query)
+}
+
+// VerifyProvenance 验证已保存图片的溯源清单，有旁路清单时使用旁路清单
+func (s *FileService) VerifyProvenance(ctx context.Context, record *ImageRecord) (*ProvenanceReport, error) {
+	file, _, err := s.ReadFile(ctx, record.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("读取图片失败: %v", err)
+	}
+
+	var sidecar []byte
+	sidecarFile, _, err := s.storage.Get(ctx, record.Key+ProvenanceSuffix)
+	if err == nil {
+		sidecar, err = io.ReadAll(sidecarFile)
+		sidecarFile.Close()
+	}
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return nil, fmt.Errorf("读取溯源清单失败: %v", err)
 	}
-	// 使用filepath.Join安全地拼接路径，支持日期文件夹/文件名的格式
-	fullPath := filepath.Join(s.fileSavePath, filePath)
-	file, err := os.Open(fullPath)
+	return s.provenance.Verify(data, sidecar)
+}
+
+// VerifyProvenanceData 验证上传的图片数据和可选的旁路清单
+func (s *FileService) VerifyProvenanceData(data []byte, sidecar []byte) (*ProvenanceReport, error) {
+	return s.provenance.Verify(data, sidecar)
+}
+
+// DetectWatermark 检测已保存图片中的隐形水印
+func (s *FileService) DetectWatermark(ctx context.Context, record *ImageRecord) (*WatermarkReport, error) {
+	file, _, err := s.ReadFile(ctx, record.Key)
 	if err != nil {
 		return nil, err
 	}
-	return file, nil
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("读取图片失败: %v", err)
+	}
+	return s.watermarker.Detect(data)
+}
+
+// DetectWatermarkData 检测上传的图片数据中的隐形水印
+func (s *FileService) DetectWatermarkData(data []byte) (*WatermarkReport, error) {
+	return s.watermarker.Detect(data)
+}
+
+// SaveExport 将 write 写出的导出文件保存到 exports/ 下，返回文件的访问地址；导出文件没有元数据记录，按保留策略清理
+func (s *FileService) SaveExport(ctx context.Context, ext string, write func(io.Writer) error) (string, error) {
+	fileID, err := uuid.NewRandom()
+	if err != nil {
+		return "", fmt.Errorf("生成UUID失败: %v", err)
+	}
+	key := path.Join(ExportPrefix, time.Now().Format("2006-01-02"), fileID.String()+ext)
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(write(writer))
+	}()
+	err = s.storage.Put(ctx, key, reader, -1, ContentTypeByKey(key))
+	reader.CloseWithError(err)
+	if err != nil {
+		return "", fmt.Errorf("保存导出文件失败: %v", err)
+	}
+	if info, err := s.storage.Stat(ctx, key); err == nil {
+		recordStored("export", info.Size)
+	}
+	return s.urlSigner.FileURL(key), nil
+}
+
+// SetPinned 设置图片的置顶状态，置顶的图片不会被保留策略清理
+func (s *FileService) SetPinned(id string, pinned bool) (*ImageRecord, error) {
+	return s.index.SetPinned(id, pinned)
+}
+
+// ImageURL 返回图片的访问地址，启用签名时附带签名
+func (s *FileService) ImageURL(filePath string) string {
+	return s.urlSigner.FileURL(filePath)
+}
+
+// ImageByPath 按存储路径获取图片元数据记录
+func (s *FileService) ImageByPath(filePath string) (*ImageRecord, error) {
+	return s.index.GetByKey(filePath)
+}
+
+// Exists 判断图片是否存在
+func (s *FileService) Exists(ctx context.Context, filePath string) bool {
+	_, err := s.storage.Stat(ctx, s.objectKey(filePath))
+	return err == nil
+}
+
+// ReadFile 打开图片，调用方负责关闭；图片不存在时返回 ErrObjectNotFound，路径非法时返回 ErrInvalidKey。
+// 返回的 ContentType 按文件内容识别，不依赖扩展名和存储中记录的类型
+func (s *FileService) ReadFile(ctx context.Context, filePath string) (io.ReadSeekCloser, *ObjectInfo, error) {
+	file, info, err := s.storage.Get(ctx, s.objectKey(filePath))
+	if err != nil {
+		return nil, nil, err
+	}
+	s.contentETag(filePath, info)
+	contentType, err := DetectContentType(file, info.ContentType)
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("读取文件失败: %v", err)
+	}
+	info.ContentType = contentType
+	return file, info, nil
+}
+
+// ReadVariant 打开缩放后的图片，调用方负责关闭；缩放图片在首次请求时生成并缓存
+func (s *FileService) ReadVariant(ctx context.Context, filePath string, opts *VariantOptions) (io.ReadSeekCloser, *ObjectInfo, error) {
+	objectKey := s.objectKey(filePath)
+	source, err := s.storage.Stat(ctx, objectKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.contentETag(filePath, source)
+	return s.variants.Get(ctx, source, opts, func() (io.ReadSeekCloser, error) {
+		file, _, err := s.storage.Get(ctx, objectKey)
+		return file, err
+	})
+}
+
+// contentETag 有元数据记录的图片使用内容的 SHA-256 作为 ETag
+func (s *FileService) contentETag(filePath string, info *ObjectInfo) {
+	if record, err := s.index.GetByKey(filePath); err == nil && record.SHA256 != "" {
+		info.ETag = `"` + record.SHA256 + `"`
+	}
+}
+
+// ContentAddressed 返回图片内容是否不可变（有内容摘要记录），不可变的图片可以长期缓存
+func (s *FileService) ContentAddressed(filePath string) bool {
+	record, err := s.index.GetByKey(filePath)
+	return err == nil && record.SHA256 != ""
+}
+
+// ThumbnailURL 返回图片缩略图的访问地址，尺寸为 variants.thumbnail_size
+func (s *FileService) ThumbnailURL(filePath string) string {
+	fileUrl := s.ImageURL(filePath)
+	query := ThumbnailQuery(s.variants.config.Get().Variants.ThumbnailSize)
+	if strings.Contains(fileUrl, "?") {
+		return fileUrl + "&" + query
+	}
+	return fileUrl + "?" + query
+}
+
+// DirectURL 返回存储提供的直接下载地址（如 S3 预签名地址），不支持时返回空字符串
+func (s *FileService) DirectURL(ctx context.Context, filePath string) (string, error) {
+	return s.storage.URL(ctx, s.objectKey(filePath))
 }
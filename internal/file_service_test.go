@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// failingPutStorage 写入时读取部分数据后返回错误，模拟上传中途失败
+type failingPutStorage struct {
+	Storage
+}
+
+func (s *failingPutStorage) Put(ctx context.Context, key string, data io.Reader, size int64, contentType string) error {
+	if _, err := io.CopyN(io.Discard, data, 16); err != nil {
+		return err
+	}
+	return errors.New("上传中断")
+}
+
+func TestSaveExportWriteError(t *testing.T) {
+	fs := newTestFileService(t, false, nil)
+	ctx := context.Background()
+
+	_, err := fs.SaveExport(ctx, ".zip", func(w io.Writer) error {
+		if _, err := io.WriteString(w, strings.Repeat("x", 1024)); err != nil {
+			return err
+		}
+		return errors.New("读取图片失败")
+	})
+	if err == nil || !strings.Contains(err.Error(), "读取图片失败") {
+		t.Fatalf("SaveExport() error = %v", err)
+	}
+	if objects, err := fs.storage.List(ctx, ExportPrefix); err != nil || len(objects) != 0 {
+		t.Errorf("写入失败后不应留下导出文件，List() = %v, %v", objects, err)
+	}
+}
+
+func TestSaveExportPutError(t *testing.T) {
+	fs := newTestFileService(t, false, nil)
+	fs.FileService.storage = &failingPutStorage{Storage: fs.storage}
+	ctx := context.Background()
+
+	written := make(chan error, 1)
+	_, err := fs.SaveExport(ctx, ".zip", func(w io.Writer) error {
+		_, err := io.WriteString(w, strings.Repeat("x", 1<<20))
+		written <- err
+		return err
+	})
+	if err == nil || !strings.Contains(err.Error(), "上传中断") {
+		t.Fatalf("SaveExport() error = %v", err)
+	}
+	// 存储失败后写入方不应一直阻塞
+	if err := <-written; err == nil {
+		t.Error("存储失败后写入应返回错误")
+	}
+	if objects, err := fs.storage.List(ctx, ExportPrefix); err != nil || len(objects) != 0 {
+		t.Errorf("写入失败后不应留下导出文件，List() = %v, %v", objects, err)
+	}
+}
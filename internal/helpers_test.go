@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/png"
+	"path/filepath"
+	"testing"
+)
+
+// newTestConfigStore 创建使用默认配置的 ConfigStore，modify 可以在校验前修改配置
+func newTestConfigStore(t *testing.T, modify func(*Config)) *ConfigStore {
+	t.Helper()
+	store, err := NewConfigStore("", modify)
+	if err != nil {
+		t.Fatalf("NewConfigStore() error = %v", err)
+	}
+	return store
+}
+
+// testImage 生成带渐变的测试图片，seed 不同时内容不同
+func testImage(width, height int, seed uint8) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			img.Set(x, y, color.NRGBA{R: uint8(x*255/width) + seed, G: uint8(y*255/height) ^ seed, B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+// testPNGBase64 返回 WebUI 响应格式的 base64 PNG
+func testPNGBase64(t *testing.T, seed uint8) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(64, 64, seed)); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+type testFileService struct {
+	*FileService
+	config  *ConfigStore
+	storage *LocalStorage
+	index   *ImageIndex
+}
+
+// newTestFileService 在临时目录中创建本地存储、图片索引和 FileService
+func newTestFileService(t *testing.T, dedup bool, modify func(*Config)) *testFileService {
+	t.Helper()
+	dir := t.TempDir()
+	config := newTestConfigStore(t, func(c *Config) {
+		c.Server.DataDir = dir
+		c.Storage.Dedup = dedup
+		if modify != nil {
+			modify(c)
+		}
+	})
+	storage := NewLocalStorage(filepath.Join(dir, "images"))
+	index, err := OpenImageIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { index.Close() })
+	variants, err := NewVariantCache(config, filepath.Join(dir, "variants"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileService := NewFileService(storage, index, NewURLSigner(config), variants, NewProvenanceSigner(config), NewWatermarker(config), dedup)
+	return &testFileService{FileService: fileService, config: config, storage: storage, index: index}
+}
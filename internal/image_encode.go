@@ -0,0 +1,306 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+
+	"github.com/gen2brain/webp"
+)
+
+const (
+	FormatPNG  = "png"
+	FormatJPEG = "jpeg"
+	FormatWebP = "webp"
+)
+
+// OutputConfig 生成图片的保存格式
+type OutputConfig struct {
+	// png（默认，保存 WebUI 返回的原始图片）、jpeg 或 webp
+	Format string `yaml:"format"`
+	// jpeg 和 webp 的压缩质量 1-100，默认 90；webp 为 100 时使用无损压缩
+	Quality int `yaml:"quality"`
+}
+
+func (c *OutputConfig) normalize() {
+	if c.Format == "" {
+		c.Format = FormatPNG
+	}
+	if c.Format == "jpg" {
+		c.Format = FormatJPEG
+	}
+	if c.Quality == 0 {
+		c.Quality = 90
+	}
+}
+
+// Validate 校验输出格式和质量
+func (c *OutputConfig) Validate() error {
+	switch c.Format {
+	case FormatPNG, FormatJPEG, FormatWebP:
+	default:
+		return fmt.Errorf("不支持的图片格式: %s，可选值为 png、jpeg、webp", c.Format)
+	}
+	if c.Quality < 1 || c.Quality > 100 {
+		return fmt.Errorf("图片质量需要在 1 到 100 之间: %d", c.Quality)
+	}
+	return nil
+}
+
+// Override 使用请求中指定的格式和质量覆盖默认配置
+func (c OutputConfig) Override(format string, quality int) OutputConfig {
+	if format != "" {
+		c.Format = format
+	}
+	if quality > 0 {
+		c.Quality = quality
+	}
+	c.normalize()
+	return c
+}
+
+// EncodedImage 转换格式后的图片
+type EncodedImage struct {
+	Data        []byte
+	ContentType string
+	Ext         string
+}
+
+// EncodeImage 将 WebUI 返回的 PNG 图片转换为指定格式并写入生成参数（与 WebUI 的 PNG Info 兼容）：
+// png 保留原始图片数据，写入 parameters 文本块；jpeg 和 webp 写入 EXIF UserComment 和 XMP 元数据
+func EncodeImage(pngData []byte, output OutputConfig, metadata *ImageMetadata) (*EncodedImage, error) {
+	if output.Format == FormatPNG {
+		data, err := pngWithMetadata(pngData, metadata)
+		if err != nil {
+			return nil, err
+		}
+		return &EncodedImage{Data: data, ContentType: "image/png", Ext: ".png"}, nil
+	}
+
+	img, err := png.Decode(bytes.NewReader(pngData))
+	if err != nil {
+		return nil, fmt.Errorf("解码 PNG 图片失败: %v", err)
+	}
+	return encodeImage(img, output, metadata)
+}
+
+// encodeImage 将图片编码为指定格式，metadata 为 nil 时不写入元数据
+func encodeImage(img image.Image, output OutputConfig, metadata *ImageMetadata) (*EncodedImage, error) {
+	var buf bytes.Buffer
+	switch output.Format {
+	case FormatPNG:
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, fmt.Errorf("编码 PNG 图片失败: %v", err)
+		}
+		data, err := pngWithMetadata(buf.Bytes(), metadata)
+		if err != nil {
+			return nil, err
+		}
+		return &EncodedImage{Data: data, ContentType: "image/png", Ext: ".png"}, nil
+	case FormatJPEG:
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: output.Quality}); err != nil {
+			return nil, fmt.Errorf("编码 JPEG 图片失败: %v", err)
+		}
+		data, err := jpegWithMetadata(buf.Bytes(), metadata)
+		if err != nil {
+			return nil, err
+		}
+		return &EncodedImage{Data: data, ContentType: "image/jpeg", Ext: ".jpg"}, nil
+	case FormatWebP:
+		if err := webp.Encode(&buf, img, webp.Options{Quality: output.Quality, Lossless: output.Quality == 100}); err != nil {
+			return nil, fmt.Errorf("编码 WebP 图片失败: %v", err)
+		}
+		data, err := webpWithMetadata(buf.Bytes(), img.Bounds(), metadata)
+		if err != nil {
+			return nil, err
+		}
+		return &EncodedImage{Data: data, ContentType: "image/webp", Ext: ".webp"}, nil
+	}
+	return nil, fmt.Errorf("不支持的图片格式: %s", output.Format)
+}
+
+// pngParametersKeyword WebUI 保存生成参数使用的 PNG 文本块关键字
+const pngParametersKeyword = "parameters"
+
+// pngWithMetadata 替换 PNG 中已有的 parameters 文本块，在 IHDR 之后写入新的生成参数；
+// 文本可以用 Latin-1 表示时使用 tEXt，否则使用 UTF-8 的 iTXt
+func pngWithMetadata(data []byte, metadata *ImageMetadata) ([]byte, error) {
+	if metadata == nil {
+		return data, nil
+	}
+	const signature = "\x89PNG\r\n\x1a\n"
+	if len(data) < len(signature) || string(data[:len(signature)]) != signature {
+		return nil, errors.New("无效的 PNG 数据")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(signature)
+	for rest := data[len(signature):]; len(rest) > 0; {
+		if len(rest) < 12 {
+			return nil, errors.New("PNG 数据不完整")
+		}
+		length := int(binary.BigEndian.Uint32(rest[0:4]))
+		if 12+length > len(rest) {
+			return nil, errors.New("PNG 数据不完整")
+		}
+		chunkType := string(rest[4:8])
+		chunk := rest[:12+length]
+		rest = rest[12+length:]
+
+		switch chunkType {
+		case "tEXt", "iTXt", "zTXt":
+			if keyword, _, _ := bytes.Cut(chunk[8:8+length], []byte{0}); string(keyword) == pngParametersKeyword {
+				continue
+			}
+		}
+		buf.Write(chunk)
+		if chunkType == "IHDR" {
+			writePNGText(&buf, pngParametersKeyword, metadata.parameters())
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func writePNGText(buf *bytes.Buffer, keyword string, text string) {
+	var payload []byte
+	if latin1, ok := toLatin1(text); ok {
+		payload = append([]byte(keyword+"\x00"), latin1...)
+		writePNGChunk(buf, "tEXt", payload)
+		return
+	}
+	// 不压缩，语言标签和翻译后的关键字为空
+	payload = append([]byte(keyword+"\x00\x00\x00\x00\x00"), text...)
+	writePNGChunk(buf, "iTXt", payload)
+}
+
+func writePNGChunk(buf *bytes.Buffer, chunkType string, payload []byte) {
+	_ = binary.Write(buf, binary.BigEndian, uint32(len(payload)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunkType))
+	crc.Write(payload)
+	buf.WriteString(chunkType)
+	buf.Write(payload)
+	_ = binary.Write(buf, binary.BigEndian, crc.Sum32())
+}
+
+func toLatin1(text string) ([]byte, bool) {
+	latin1 := make([]byte, 0, len(text))
+	for _, r := range text {
+		if r > 0xFF {
+			return nil, false
+		}
+		latin1 = append(latin1, byte(r))
+	}
+	return latin1, true
+}
+
+// jpegWithMetadata 在 SOI 之后插入 EXIF 和 XMP 的 APP1 段
+func jpegWithMetadata(data []byte, metadata *ImageMetadata) ([]byte, error) {
+	if metadata == nil {
+		return data, nil
+	}
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errors.New("无效的 JPEG 数据")
+	}
+
+	var buf bytes.Buffer
+	buf.Write(data[:2])
+	for _, payload := range [][]byte{
+		append([]byte("Exif\x00\x00"), metadata.exif()...),
+		append([]byte("http://ns.adobe.com/xap/1.0/\x00"), metadata.xmp()...),
+	} {
+		// APP1 段长度包含长度字段本身，最大 65535
+		if len(payload)+2 > 0xFFFF {
+			continue
+		}
+		buf.Write([]byte{0xFF, 0xE1})
+		_ = binary.Write(&buf, binary.BigEndian, uint16(len(payload)+2))
+		buf.Write(payload)
+	}
+	buf.Write(data[2:])
+	return buf.Bytes(), nil
+}
+
+// webpWithMetadata 将 WebP 转换为扩展格式（VP8X）并追加 EXIF 和 XMP 块
+func webpWithMetadata(data []byte, bounds image.Rectangle, metadata *ImageMetadata) ([]byte, error) {
+	if metadata == nil {
+		return data, nil
+	}
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("无效的 WebP 数据")
+	}
+
+	const (
+		flagXMP   = 0x04
+		flagEXIF  = 0x08
+		flagAlpha = 0x10
+	)
+
+	var chunks bytes.Buffer
+	var flags byte = flagXMP | flagEXIF
+	for rest := data[12:]; len(rest) >= 8; {
+		fourCC := string(rest[0:4])
+		size := int(binary.LittleEndian.Uint32(rest[4:8]))
+		padded := size + size%2
+		if 8+padded > len(rest) {
+			return nil, errors.New("WebP 数据不完整")
+		}
+		chunk := rest[:8+padded]
+		rest = rest[8+padded:]
+
+		switch fourCC {
+		case "VP8X":
+			// 重新生成 VP8X，保留原有的标志位
+			flags |= chunk[8]
+			continue
+		case "EXIF", "XMP ":
+			continue
+		case "ALPH":
+			flags |= flagAlpha
+		case "VP8L":
+			// VP8L 头中的 alpha_is_used 标志位
+			if size >= 5 && binary.LittleEndian.Uint32(chunk[9:13])&(1<<28) != 0 {
+				flags |= flagAlpha
+			}
+		}
+		chunks.Write(chunk)
+	}
+
+	vp8x := make([]byte, 10)
+	vp8x[0] = flags
+	putUint24(vp8x[4:7], uint32(bounds.Dx()-1))
+	putUint24(vp8x[7:10], uint32(bounds.Dy()-1))
+
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	writeRiffChunk(&body, "VP8X", vp8x)
+	body.Write(chunks.Bytes())
+	writeRiffChunk(&body, "EXIF", metadata.exif())
+	writeRiffChunk(&body, "XMP ", metadata.xmp())
+
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(body.Len()))
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+func writeRiffChunk(buf *bytes.Buffer, fourCC string, payload []byte) {
+	buf.WriteString(fourCC)
+	_ = binary.Write(buf, binary.LittleEndian, uint32(len(payload)))
+	buf.Write(payload)
+	if len(payload)%2 == 1 {
+		buf.WriteByte(0)
+	}
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image/png"
+	"testing"
+)
+
+type pngChunk struct {
+	Type string
+	Data []byte
+}
+
+// readPNGChunks 解析 PNG 数据块并校验 CRC
+func readPNGChunks(t *testing.T, data []byte) []pngChunk {
+	t.Helper()
+	if !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		t.Fatal("缺少 PNG 签名")
+	}
+	var chunks []pngChunk
+	for rest := data[8:]; len(rest) > 0; {
+		if len(rest) < 12 {
+			t.Fatal("PNG 数据不完整")
+		}
+		length := int(binary.BigEndian.Uint32(rest[0:4]))
+		if 12+length > len(rest) {
+			t.Fatal("PNG 数据不完整")
+		}
+		chunkType := string(rest[4:8])
+		if crc := binary.BigEndian.Uint32(rest[8+length:]); crc != crc32.ChecksumIEEE(rest[4:8+length]) {
+			t.Errorf("数据块 %s 的 CRC 错误", chunkType)
+		}
+		chunks = append(chunks, pngChunk{Type: chunkType, Data: rest[8 : 8+length]})
+		rest = rest[12+length:]
+	}
+	return chunks
+}
+
+// pngTextChunks 返回关键字为 keyword 的文本块
+func pngTextChunks(chunks []pngChunk, keyword string) []pngChunk {
+	var found []pngChunk
+	for _, chunk := range chunks {
+		if chunk.Type != "tEXt" && chunk.Type != "iTXt" {
+			continue
+		}
+		if name, _, _ := bytes.Cut(chunk.Data, []byte{0}); string(name) == keyword {
+			found = append(found, chunk)
+		}
+	}
+	return found
+}
+
+func TestPNGWithMetadata(t *testing.T) {
+	src := testImage(64, 64, 3)
+	var plain bytes.Buffer
+	if err := png.Encode(&plain, src); err != nil {
+		t.Fatal(err)
+	}
+	// WebUI 返回的图片中已有的 parameters 文本块会被替换
+	var existing bytes.Buffer
+	chunks := readPNGChunks(t, plain.Bytes())
+	existing.WriteString("\x89PNG\r\n\x1a\n")
+	for _, chunk := range chunks {
+		writePNGChunk(&existing, chunk.Type, chunk.Data)
+		if chunk.Type == "IHDR" {
+			writePNGText(&existing, pngParametersKeyword, "old parameters")
+		}
+	}
+
+	tests := []struct {
+		name     string
+		input    []byte
+		metadata *ImageMetadata
+		chunk    string
+		want     string
+	}{
+		{"Latin-1 使用 tEXt", plain.Bytes(), &ImageMetadata{Parameters: "a cat, café\nSteps: 20, Seed: 1"}, "tEXt", "a cat, café\nSteps: 20, Seed: 1"},
+		{"非 Latin-1 使用 iTXt", plain.Bytes(), &ImageMetadata{Parameters: "一只猫\nSteps: 20", Backend: "gpu-1"}, "iTXt", "一只猫\nSteps: 20, Backend: gpu-1"},
+		{"替换已有的 parameters", existing.Bytes(), &ImageMetadata{Parameters: "new parameters"}, "tEXt", "new parameters"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := pngWithMetadata(tt.input, tt.metadata)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chunks := readPNGChunks(t, data)
+
+			texts := pngTextChunks(chunks, pngParametersKeyword)
+			if len(texts) != 1 || texts[0].Type != tt.chunk {
+				t.Fatalf("parameters 文本块 = %+v", texts)
+			}
+			// 文本块紧跟 IHDR，位于 IDAT 之前
+			if chunks[0].Type != "IHDR" || chunks[1].Type != tt.chunk {
+				t.Errorf("文本块位置错误: %s, %s", chunks[0].Type, chunks[1].Type)
+			}
+
+			_, text, _ := bytes.Cut(texts[0].Data, []byte{0})
+			var got string
+			if tt.chunk == "iTXt" {
+				// 压缩标志、压缩方法、语言标签和翻译后的关键字
+				if !bytes.HasPrefix(text, []byte{0, 0, 0, 0}) {
+					t.Fatalf("iTXt 头部 = %q", text[:4])
+				}
+				got = string(text[4:])
+			} else {
+				runes := make([]rune, len(text))
+				for i, b := range text {
+					runes[i] = rune(b)
+				}
+				got = string(runes)
+			}
+			if got != tt.want {
+				t.Errorf("parameters = %q, want %q", got, tt.want)
+			}
+
+			img, err := png.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("写入元数据后无法解码: %v", err)
+			}
+			r1, g1, b1, _ := img.At(10, 20).RGBA()
+			r2, g2, b2, _ := src.At(10, 20).RGBA()
+			if img.Bounds() != src.Bounds() || r1 != r2 || g1 != g2 || b1 != b2 {
+				t.Error("写入元数据后图片内容改变")
+			}
+		})
+	}
+
+	if _, err := pngWithMetadata([]byte("not a png"), &ImageMetadata{}); err == nil {
+		t.Error("无效的 PNG 数据应返回错误")
+	}
+	if _, err := pngWithMetadata(plain.Bytes()[:40], &ImageMetadata{}); err == nil {
+		t.Error("不完整的 PNG 数据应返回错误")
+	}
+}
@@ -0,0 +1,326 @@
+package internal
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const imageIndexFileName = "images.db"
+
+var (
+	imagesBucket      = []byte("images")
+	imagesByKeyBucket = []byte("images_by_key")
+	// 去重存储的图片内容引用计数：blob key -> 引用该内容的图片数量
+	blobRefsBucket = []byte("blob_refs")
+)
+
+var ErrImageNotFound = errors.New("图片记录不存在")
+
+// ImageRecord 生成图片的元数据记录
+type ImageRecord struct {
+	ID string `json:"id"`
+	// 生成该图片的 txt2img 调用 ID，同一次调用生成的多张图片相同
+	RequestID string `json:"request_id,omitempty"`
+	// 图片路径，如 2006-01-02/uuid.png，启用去重时为指向 BlobKey 的别名
+	Key string `json:"key"`
+	// 图片内容的 SHA-256
+	SHA256 string `json:"sha256,omitempty"`
+	// 启用去重时图片内容在存储中的实际路径，如 blobs/ab/abcd....png
+	BlobKey     string    `json:"blob_key,omitempty"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	CreatedAt   time.Time `json:"created_at"`
+	// 调用方标识，如 api_key:alice、oauth:user@example.com
+	Principal string `json:"principal"`
+	// 生成所用的后端和模型
+	Backend   string `json:"backend"`
+	Model     string `json:"model,omitempty"`
+	ModelHash string `json:"model_hash,omitempty"`
+	// 从生成信息中解析出的该图片的主要参数
+	Prompt         string  `json:"prompt"`
+	NegativePrompt string  `json:"negative_prompt,omitempty"`
+	Seed           int64   `json:"seed"`
+	Width          int     `json:"width"`
+	Height         int     `json:"height"`
+	Steps          int     `json:"steps"`
+	SamplerName    string  `json:"sampler_name,omitempty"`
+	CFGScale       float64 `json:"cfg_scale,omitempty"`
+	// 图片在本次生成结果中的序号
+	BatchIndex int `json:"batch_index"`
+	// 本次生成（包含同批次所有图片）的耗时
+	GenerationMs int64 `json:"generation_ms"`
+	// 作为输入图片（如 ControlNet 条件图）的已生成图片
+	ParentID string `json:"parent_id,omitempty"`
+	// 调用方在生成时指定的标签
+	Tags []string `json:"tags,omitempty"`
+	// 置顶（收藏）的图片不会被保留策略清理
+	Pinned bool `json:"pinned,omitempty"`
+	// 图片所加的水印（watermark.profiles 中的名称），由调用方在保存前按 API Key 和预设设置
+	Watermark string `json:"watermark,omitempty"`
+	// 原始请求参数、WebUI 返回的 parameters 和解析后的 info
+	Request    map[string]any `json:"request,omitempty"`
+	Parameters map[string]any `json:"parameters,omitempty"`
+	Info       map[string]any `json:"info,omitempty"`
+}
+
+// ImageIndex 图片元数据索引，保存在 data_dir/images.db（bbolt）
+type ImageIndex struct {
+	db *bolt.DB
+	// 去重内容的保存和删除按 BlobKey 互斥，保证引用计数和存储中的内容一致；
+	// 索引文件同一时间只能被一个进程打开，进程内加锁即可
+	blobLocks keyedMutex
+}
+
+// OpenImageIndex 打开图片元数据索引，文件不存在时自动创建
+func OpenImageIndex(dataDir string) (*ImageIndex, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("创建数据目录失败: %v", err)
+	}
+	path := filepath.Join(dataDir, imageIndexFileName)
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("图片索引 %s 正被其他进程使用，请先停止服务", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("打开图片索引 %s 失败: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{imagesBucket, imagesByKeyBucket, blobRefsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("初始化图片索引失败: %v", err)
+	}
+	return &ImageIndex{db: db}, nil
+}
+
+func (i *ImageIndex) Close() error {
+	return i.db.Close()
+}
+
+// Put 写入或覆盖图片记录，并维护 BlobKey 的引用计数
+func (i *ImageIndex) Put(record *ImageRecord) error {
+	if record.ID == "" || record.Key == "" {
+		return errors.New("图片记录缺少 id 或 key")
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return i.db.Update(func(tx *bolt.Tx) error {
+		images := tx.Bucket(imagesBucket)
+		byKey := tx.Bucket(imagesByKeyBucket)
+
+		// 覆盖时清理旧的 key 索引和引用计数
+		if old := images.Get([]byte(record.ID)); old != nil {
+			var oldRecord ImageRecord
+			if err := json.Unmarshal(old, &oldRecord); err == nil {
+				if oldRecord.Key != record.Key {
+					if err := byKey.Delete([]byte(oldRecord.Key)); err != nil {
+						return err
+					}
+				}
+				if _, err := addBlobRef(tx, oldRecord.BlobKey, -1); err != nil {
+					return err
+				}
+			}
+		}
+
+		if _, err := addBlobRef(tx, record.BlobKey, 1); err != nil {
+			return err
+		}
+		if err := images.Put([]byte(record.ID), data); err != nil {
+			return err
+		}
+		return byKey.Put([]byte(record.Key), []byte(record.ID))
+	})
+}
+
+// Get 按 ID 获取图片记录，不存在时返回 ErrImageNotFound
+func (i *ImageIndex) Get(id string) (*ImageRecord, error) {
+	var record *ImageRecord
+	err := i.db.View(func(tx *bolt.Tx) error {
+		var err error
+		record, err = getImage(tx, id)
+		return err
+	})
+	return record, err
+}
+
+// GetByKey 按存储路径获取图片记录，不存在时返回 ErrImageNotFound
+func (i *ImageIndex) GetByKey(key string) (*ImageRecord, error) {
+	var record *ImageRecord
+	err := i.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(imagesByKeyBucket).Get([]byte(key))
+		if id == nil {
+			return ErrImageNotFound
+		}
+		var err error
+		record, err = getImage(tx, string(id))
+		return err
+	})
+	return record, err
+}
+
+// All 返回所有图片记录
+func (i *ImageIndex) All() ([]*ImageRecord, error) {
+	var records []*ImageRecord
+	err := i.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(imagesBucket).ForEach(func(k, v []byte) error {
+			var record ImageRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return fmt.Errorf("解析图片记录 %s 失败: %v", k, err)
+			}
+			records = append(records, &record)
+			return nil
+		})
+	})
+	return records, err
+}
+
+// SetPinned 设置图片的置顶状态，返回更新后的记录
+func (i *ImageIndex) SetPinned(id string, pinned bool) (*ImageRecord, error) {
+	var record *ImageRecord
+	err := i.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		record, err = getImage(tx, id)
+		if err != nil {
+			return err
+		}
+		record.Pinned = pinned
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(imagesBucket).Put([]byte(id), data)
+	})
+	return record, err
+}
+
+// Delete 删除图片记录，记录不存在时不返回错误；
+// 记录引用的 BlobKey 不再被任何记录引用时返回该 BlobKey，由调用方从存储中删除
+func (i *ImageIndex) Delete(id string) (string, error) {
+	var orphanedBlob string
+	err := i.db.Update(func(tx *bolt.Tx) error {
+		record, err := getImage(tx, id)
+		if errors.Is(err, ErrImageNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		refs, err := addBlobRef(tx, record.BlobKey, -1)
+		if err != nil {
+			return err
+		}
+		if record.BlobKey != "" && refs == 0 {
+			orphanedBlob = record.BlobKey
+		}
+		if err := tx.Bucket(imagesByKeyBucket).Delete([]byte(record.Key)); err != nil {
+			return err
+		}
+		return tx.Bucket(imagesBucket).Delete([]byte(id))
+	})
+	return orphanedBlob, err
+}
+
+// LockBlob 锁定去重内容，返回解锁函数；增加引用后检查内容是否存在、
+// 以及确认没有引用后删除内容都需要在锁内完成
+func (i *ImageIndex) LockBlob(blobKey string) func() {
+	return i.blobLocks.lock(blobKey)
+}
+
+// BlobRefs 返回引用该 BlobKey 的图片数量
+func (i *ImageIndex) BlobRefs(blobKey string) (uint64, error) {
+	var refs uint64
+	err := i.db.View(func(tx *bolt.Tx) error {
+		if value := tx.Bucket(blobRefsBucket).Get([]byte(blobKey)); len(value) == 8 {
+			refs = binary.BigEndian.Uint64(value)
+		}
+		return nil
+	})
+	return refs, err
+}
+
+// addBlobRef 调整 BlobKey 的引用计数并返回调整后的值，计数为 0 时删除
+func addBlobRef(tx *bolt.Tx, blobKey string, delta int) (uint64, error) {
+	if blobKey == "" {
+		return 0, nil
+	}
+	bucket := tx.Bucket(blobRefsBucket)
+	var refs uint64
+	if value := bucket.Get([]byte(blobKey)); len(value) == 8 {
+		refs = binary.BigEndian.Uint64(value)
+	}
+	if delta < 0 && refs < uint64(-delta) {
+		refs = 0
+	} else {
+		refs = uint64(int64(refs) + int64(delta))
+	}
+	if refs == 0 {
+		return 0, bucket.Delete([]byte(blobKey))
+	}
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, refs)
+	return refs, bucket.Put([]byte(blobKey), value)
+}
+
+func getImage(tx *bolt.Tx, id string) (*ImageRecord, error) {
+	data := tx.Bucket(imagesBucket).Get([]byte(id))
+	if data == nil {
+		return nil, ErrImageNotFound
+	}
+	var record ImageRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("解析图片记录 %s 失败: %v", id, err)
+	}
+	return &record, nil
+}
+
+// keyedMutex 按 key 加锁，没有等待者的锁会被释放
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+func (m *keyedMutex) lock(key string) func() {
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*keyedLock)
+	}
+	l, ok := m.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		m.locks[key] = l
+	}
+	l.refs++
+	m.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(m.locks, key)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// ImageMetadata 写入图片文件的生成信息
+type ImageMetadata struct {
+	// WebUI 格式的生成参数文本（infotext），与 PNG Info 兼容
+	Parameters string
+	Model      string
+	Seed       int64
+	Backend    string
+	// 以下为每次请求不同的字段，启用去重时不写入，使相同参数生成的相同图片内容一致
+	ImageID   string
+	RequestID string
+	Principal string
+	CreatedAt time.Time
+}
+
+// NewImageMetadata 根据图片记录构建写入文件的元数据，includeRequestFields 为 false 时不包含图片 ID、调用方和创建时间
+func NewImageMetadata(record *ImageRecord, includeRequestFields bool) *ImageMetadata {
+	metadata := &ImageMetadata{
+		Parameters: record.Infotext(),
+		Model:      record.Model,
+		Seed:       record.Seed,
+		Backend:    record.Backend,
+	}
+	if includeRequestFields {
+		metadata.ImageID = record.ID
+		metadata.RequestID = record.RequestID
+		metadata.Principal = record.Principal
+		metadata.CreatedAt = record.CreatedAt
+	}
+	return metadata
+}
+
+// Infotext 返回 WebUI 生成信息中该图片的参数文本，没有时返回提示词
+func (r *ImageRecord) Infotext() string {
+	if infotexts, ok := r.Info["infotexts"].([]any); ok && r.BatchIndex < len(infotexts) {
+		if infotext, ok := infotexts[r.BatchIndex].(string); ok && infotext != "" {
+			return infotext
+		}
+	}
+	return r.Prompt
+}
+
+// parameters 返回写入图片的生成参数文本：在 WebUI 的参数行后追加本服务的字段，
+// 格式与 WebUI 一致，PNG Info 可以正常解析
+func (m *ImageMetadata) parameters() string {
+	var fields []string
+	for _, field := range [][2]string{{"Request ID", m.RequestID}, {"Caller", m.Principal}, {"Backend", m.Backend}} {
+		if field[1] != "" {
+			fields = append(fields, field[0]+": "+quoteInfotextValue(field[1]))
+		}
+	}
+	if len(fields) == 0 {
+		return m.Parameters
+	}
+
+	extra := strings.Join(fields, ", ")
+	lastLine := m.Parameters[strings.LastIndex(m.Parameters, "\n")+1:]
+	if strings.Contains(lastLine, "Steps: ") {
+		return m.Parameters + ", " + extra
+	}
+	if m.Parameters == "" {
+		return extra
+	}
+	return m.Parameters + "\n" + extra
+}
+
+// quoteInfotextValue 与 WebUI 相同，值中包含逗号、冒号或换行时使用 JSON 字符串
+func quoteInfotextValue(value string) string {
+	if !strings.ContainsAny(value, ",:\n") {
+		return value
+	}
+	quoted, _ := json.Marshal(value)
+	return string(quoted)
+}
+
+// exif 生成只包含 UserComment 的 EXIF（TIFF 大端格式），WebUI 从该字段读取 JPEG/WebP 的生成参数
+func (m *ImageMetadata) exif() []byte {
+	const (
+		tagExifIFDPointer = 0x8769
+		tagUserComment    = 0x9286
+		typeLong          = 4
+		typeUndefined     = 7
+	)
+
+	comment := []byte("UNICODE\x00")
+	for _, u := range utf16.Encode([]rune(m.parameters())) {
+		comment = binary.BigEndian.AppendUint16(comment, u)
+	}
+
+	// TIFF 头(8) + IFD0(2+12+4) + Exif IFD(2+12+4) + UserComment
+	const exifIFDOffset = 8 + 18
+	const commentOffset = exifIFDOffset + 18
+
+	var buf bytes.Buffer
+	buf.WriteString("MM")
+	_ = binary.Write(&buf, binary.BigEndian, []any{uint16(42), uint32(8)})
+	// IFD0: 指向 Exif IFD
+	_ = binary.Write(&buf, binary.BigEndian, []any{uint16(1), uint16(tagExifIFDPointer), uint16(typeLong), uint32(1), uint32(exifIFDOffset), uint32(0)})
+	// Exif IFD: UserComment
+	_ = binary.Write(&buf, binary.BigEndian, []any{uint16(1), uint16(tagUserComment), uint16(typeUndefined), uint32(len(comment)), uint32(commentOffset), uint32(0)})
+	buf.Write(comment)
+	return buf.Bytes()
+}
+
+// xmp 生成 XMP 数据包
+func (m *ImageMetadata) xmp() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("<?xpacket begin=\"\uFEFF\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	buf.WriteString(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">`)
+	buf.WriteString(`<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmlns:sdmcp="urn:stable-diffusion-webui-mcp:1.0">`)
+
+	writeXMPElement(&buf, "xmp:CreatorTool", "stable-diffusion-webui-mcp")
+	if !m.CreatedAt.IsZero() {
+		writeXMPElement(&buf, "xmp:CreateDate", m.CreatedAt.Format(time.RFC3339))
+	}
+	buf.WriteString(`<dc:description><rdf:Alt><rdf:li xml:lang="x-default">`)
+	_ = xml.EscapeText(&buf, []byte(m.parameters()))
+	buf.WriteString(`</rdf:li></rdf:Alt></dc:description>`)
+	writeXMPElement(&buf, "sdmcp:Model", m.Model)
+	writeXMPElement(&buf, "sdmcp:Seed", strconv.FormatInt(m.Seed, 10))
+	writeXMPElement(&buf, "sdmcp:Backend", m.Backend)
+	writeXMPElement(&buf, "sdmcp:ImageID", m.ImageID)
+	writeXMPElement(&buf, "sdmcp:RequestID", m.RequestID)
+	writeXMPElement(&buf, "sdmcp:Principal", m.Principal)
+
+	buf.WriteString("</rdf:Description></rdf:RDF></x:xmpmeta>\n")
+	buf.WriteString(`<?xpacket end="w"?>`)
+	return buf.Bytes()
+}
+
+func writeXMPElement(buf *bytes.Buffer, name string, value string) {
+	if value == "" {
+		return
+	}
+	fmt.Fprintf(buf, "<%s>", name)
+	_ = xml.EscapeText(buf, []byte(value))
+	fmt.Fprintf(buf, "</%s>", name)
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	DefaultImageQueryLimit = 20
+	MaxImageQueryLimit     = 100
+)
+
+// ImageQuery 图片检索条件，零值字段表示不过滤
+type ImageQuery struct {
+	// 创建时间范围 [From, To)
+	From time.Time
+	To   time.Time
+	// 模型名称或哈希，支持 * 通配
+	Model string
+	// 提示词子串，不区分大小写
+	Prompt string
+	// 全文检索，所有关键词都需要出现在提示词、负面提示词、标签或模型名称中
+	Text      string
+	Seed      *int64
+	Principal string
+	// 需要包含的全部标签
+	Tags   []string
+	Pinned *bool
+	Limit  int
+	Offset int
+}
+
+// Search 按条件检索图片记录，结果按创建时间倒序，同时返回符合条件的总数
+func (i *ImageIndex) Search(query ImageQuery) ([]*ImageRecord, int, error) {
+	keywords := textKeywords(query.Text)
+
+	var matched []*ImageRecord
+	err := i.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(imagesBucket).ForEach(func(k, v []byte) error {
+			var record ImageRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return fmt.Errorf("解析图片记录 %s 失败: %v", k, err)
+			}
+			if query.match(&record, keywords) {
+				// 列表中不需要完整的请求和生成信息
+				record.Request = nil
+				record.Parameters = nil
+				record.Info = nil
+				matched = append(matched, &record)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sort.Slice(matched, func(a, b int) bool {
+		return matched[a].CreatedAt.After(matched[b].CreatedAt)
+	})
+
+	total := len(matched)
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultImageQueryLimit
+	}
+	limit = min(limit, MaxImageQueryLimit)
+	start := min(max(query.Offset, 0), total)
+	end := min(start+limit, total)
+	return matched[start:end], total, nil
+}
+
+func (q *ImageQuery) match(record *ImageRecord, keywords []string) bool {
+	if !q.From.IsZero() && record.CreatedAt.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !record.CreatedAt.Before(q.To) {
+		return false
+	}
+	if q.Principal != "" && record.Principal != q.Principal {
+		return false
+	}
+	if q.Pinned != nil && record.Pinned != *q.Pinned {
+		return false
+	}
+	if q.Seed != nil && record.Seed != *q.Seed {
+		return false
+	}
+	if q.Model != "" && !matchAny([]string{q.Model}, record.Model) && !strings.EqualFold(q.Model, record.ModelHash) {
+		return false
+	}
+	if q.Prompt != "" && !strings.Contains(strings.ToLower(record.Prompt), strings.ToLower(q.Prompt)) {
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !slices.ContainsFunc(record.Tags, func(t string) bool { return strings.EqualFold(t, tag) }) {
+			return false
+		}
+	}
+	if len(keywords) > 0 {
+		words := textKeywords(strings.Join(append([]string{record.Prompt, record.NegativePrompt, record.Model}, record.Tags...), " "))
+		for _, keyword := range keywords {
+			if !slices.Contains(words, keyword) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// textKeywords 将文本拆分为小写关键词，并去掉英文复数的词尾 s，使 cats 可以匹配 cat
+func textKeywords(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	keywords := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if len(field) > 3 && strings.HasSuffix(field, "s") && !strings.HasSuffix(field, "ss") {
+			field = strings.TrimSuffix(field, "s")
+		}
+		keywords = append(keywords, field)
+	}
+	return keywords
+}
@@ -0,0 +1,379 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/image/draw"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	FitContain = "contain"
+	FitCover   = "cover"
+	FitFill    = "fill"
+)
+
+// ErrInvalidVariant 缩放参数无效或原图无法缩放
+var ErrInvalidVariant = errors.New("缩放参数无效")
+
+// maxVariantSourcePixels 生成缩放图片时原图的最大像素数，避免解码过大的图片占用大量内存
+const maxVariantSourcePixels = 64 << 20
+
+// VariantsConfig 缩略图和缩放图片配置，缩放图片在首次请求时生成并缓存在 data_dir/variants 中
+type VariantsConfig struct {
+	// 缩放后的最大宽高，默认 2048
+	MaxSize int `yaml:"max_size"`
+	// 磁盘缓存大小上限，默认 1GiB，超出时删除最久未访问的缓存
+	CacheMaxBytes ByteSize `yaml:"cache_max_bytes"`
+	// 图片列表中 thumbnail_url 的尺寸，默认 256
+	ThumbnailSize int `yaml:"thumbnail_size"`
+}
+
+func (c *VariantsConfig) normalize() {
+	if c.MaxSize == 0 {
+		c.MaxSize = 2048
+	}
+	if c.CacheMaxBytes == 0 {
+		c.CacheMaxBytes = 1 << 30
+	}
+	if c.ThumbnailSize == 0 {
+		c.ThumbnailSize = 256
+	}
+}
+
+func (c *VariantsConfig) validate() []error {
+	if c.MaxSize < 0 || c.CacheMaxBytes < 0 || c.ThumbnailSize < 0 {
+		return []error{errors.New("variants 中的尺寸和大小不能为负数")}
+	}
+	return nil
+}
+
+// VariantOptions 缩放图片参数，对应读取图片接口的 w、h、fit、fmt、q 查询参数
+type VariantOptions struct {
+	Width  int
+	Height int
+	// contain（默认，等比缩放到宽高范围内）、cover（等比缩放后居中裁剪为指定宽高）或 fill（拉伸为指定宽高）
+	Fit string
+	// png、jpeg 或 webp，默认与原图相同
+	Format  string
+	Quality int
+}
+
+// ParseVariantOptions 解析查询参数中的缩放参数，没有缩放参数时返回 nil
+func ParseVariantOptions(query url.Values) (*VariantOptions, error) {
+	if query.Get("w") == "" && query.Get("h") == "" && query.Get("fmt") == "" && query.Get("fit") == "" && query.Get("q") == "" {
+		return nil, nil
+	}
+
+	opts := &VariantOptions{Fit: strings.ToLower(query.Get("fit")), Format: strings.ToLower(query.Get("fmt"))}
+	for name, value := range map[string]*int{"w": &opts.Width, "h": &opts.Height, "q": &opts.Quality} {
+		raw := query.Get(name)
+		if raw == "" {
+			continue
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("参数 %s 无效: %s", name, raw)
+		}
+		*value = n
+	}
+
+	if opts.Fit == "" {
+		opts.Fit = FitContain
+	}
+	switch opts.Fit {
+	case FitContain, FitCover, FitFill:
+	default:
+		return nil, fmt.Errorf("参数 fit 无效: %s，可选值为 contain、cover、fill", opts.Fit)
+	}
+	if (opts.Fit == FitCover || opts.Fit == FitFill) && (opts.Width == 0 || opts.Height == 0) {
+		return nil, fmt.Errorf("fit=%s 需要同时指定 w 和 h", opts.Fit)
+	}
+	if opts.Format == "jpg" {
+		opts.Format = FormatJPEG
+	}
+	switch opts.Format {
+	case "", FormatPNG, FormatJPEG, FormatWebP:
+	default:
+		return nil, fmt.Errorf("参数 fmt 无效: %s，可选值为 png、jpeg、webp", opts.Format)
+	}
+	if opts.Quality > 100 {
+		return nil, fmt.Errorf("参数 q 需要在 1 到 100 之间: %d", opts.Quality)
+	}
+	return opts, nil
+}
+
+// cacheKey 缓存文件名，原图内容变化时（ETag 不同）生成新的缓存
+func (o *VariantOptions) cacheKey(source *ObjectInfo) string {
+	raw := fmt.Sprintf("%s|%s|%d|%d|%d|%s|%s|%d", source.Key, source.ETag, source.Size, o.Width, o.Height, o.Fit, o.Format, o.Quality)
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// ThumbnailQuery 返回缩略图的查询参数
+func ThumbnailQuery(size int) string {
+	return fmt.Sprintf("w=%d&h=%d&fmt=webp", size, size)
+}
+
+// VariantCache 缩放图片的磁盘缓存，按最近访问时间淘汰
+type VariantCache struct {
+	config *ConfigStore
+	dir    string
+
+	group singleflight.Group
+	// 限制同时生成缩放图片的数量
+	workers chan struct{}
+
+	mu   sync.Mutex
+	size int64
+}
+
+// NewVariantCache 创建缩放图片缓存，dir 中已有的缓存会继续使用
+func NewVariantCache(config *ConfigStore, dir string) (*VariantCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("创建缩放图片缓存目录失败: %v", err)
+	}
+	c := &VariantCache{
+		config:  config,
+		dir:     dir,
+		workers: make(chan struct{}, runtime.NumCPU()),
+	}
+	files, err := c.files()
+	if err != nil {
+		return nil, fmt.Errorf("读取缩放图片缓存失败: %v", err)
+	}
+	for _, file := range files {
+		c.size += file.size
+	}
+	return c, nil
+}
+
+// Get 返回缩放后的图片，缓存不存在时通过 open 读取原图生成
+func (c *VariantCache) Get(ctx context.Context, source *ObjectInfo, opts *VariantOptions, open func() (io.ReadSeekCloser, error)) (io.ReadSeekCloser, *ObjectInfo, error) {
+	config := c.config.Get()
+	if opts.Width > config.Variants.MaxSize || opts.Height > config.Variants.MaxSize {
+		return nil, nil, fmt.Errorf("%w: 缩放尺寸不能超过 %d", ErrInvalidVariant, config.Variants.MaxSize)
+	}
+
+	key := opts.cacheKey(source)
+	cachePath := filepath.Join(c.dir, key[:2], key)
+	if file, info, err := c.open(cachePath, source); err == nil {
+		return file, info, nil
+	}
+
+	_, err, _ := c.group.Do(key, func() (any, error) {
+		select {
+		case c.workers <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		defer func() { <-c.workers }()
+		return nil, c.generate(cachePath, opts, config.Output.Quality, open)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.open(cachePath, source)
+}
+
+func (c *VariantCache) open(cachePath string, source *ObjectInfo) (io.ReadSeekCloser, *ObjectInfo, error) {
+	file, err := os.Open(cachePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	// 修改时间记录最近访问时间，用于淘汰
+	now := time.Now()
+	_ = os.Chtimes(cachePath, now, now)
+	contentType, err := DetectContentType(file, "application/octet-stream")
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, &ObjectInfo{
+		Key:  source.Key,
+		Size: stat.Size(),
+		// 缓存文件的修改时间记录的是访问时间，使用原图的修改时间
+		ModTime:     source.ModTime,
+		ContentType: contentType,
+		ETag:        `"` + filepath.Base(cachePath) + `"`,
+	}, nil
+}
+
+func (c *VariantCache) generate(cachePath string, opts *VariantOptions, defaultQuality int, open func() (io.ReadSeekCloser, error)) error {
+	if _, err := os.Stat(cachePath); err == nil {
+		return nil
+	}
+
+	file, err := open()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	imageConfig, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return fmt.Errorf("%w: 无法识别的图片格式: %v", ErrInvalidVariant, err)
+	}
+	if imageConfig.Width*imageConfig.Height > maxVariantSourcePixels {
+		return fmt.Errorf("%w: 原图尺寸过大 %dx%d", ErrInvalidVariant, imageConfig.Width, imageConfig.Height)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	src, _, err := image.Decode(file)
+	if err != nil {
+		return fmt.Errorf("解码图片失败: %v", err)
+	}
+
+	output := OutputConfig{Format: opts.Format, Quality: opts.Quality}
+	if output.Format == "" {
+		output.Format = format
+	}
+	if output.Quality == 0 {
+		output.Quality = defaultQuality
+	}
+	encoded, err := encodeImage(resizeImage(src, opts), output, nil)
+	if err != nil {
+		return err
+	}
+	if err := WriteFileAtomic(cachePath, encoded.Data, 0644); err != nil {
+		return fmt.Errorf("写入缩放图片缓存失败: %v", err)
+	}
+
+	c.mu.Lock()
+	c.size += int64(len(encoded.Data))
+	c.mu.Unlock()
+	c.evict(cachePath)
+	return nil
+}
+
+// resizeImage 按缩放参数缩放图片，不会放大原图
+func resizeImage(src image.Image, opts *VariantOptions) image.Image {
+	bounds := src.Bounds()
+	srcWidth, srcHeight := float64(bounds.Dx()), float64(bounds.Dy())
+	width, height := opts.Width, opts.Height
+	srcRect := bounds
+
+	switch opts.Fit {
+	case FitFill:
+	case FitCover:
+		// 按较大的缩放比例缩放后居中裁剪
+		scale := max(float64(width)/srcWidth, float64(height)/srcHeight)
+		if scale > 1 {
+			width, height = int(float64(width)/scale), int(float64(height)/scale)
+			scale = 1
+		}
+		cropWidth, cropHeight := int(float64(width)/scale), int(float64(height)/scale)
+		x := bounds.Min.X + (bounds.Dx()-cropWidth)/2
+		y := bounds.Min.Y + (bounds.Dy()-cropHeight)/2
+		srcRect = image.Rect(x, y, x+cropWidth, y+cropHeight)
+	default:
+		scale := 1.0
+		if width > 0 {
+			scale = min(scale, float64(width)/srcWidth)
+		}
+		if height > 0 {
+			scale = min(scale, float64(height)/srcHeight)
+		}
+		width, height = int(srcWidth*scale+0.5), int(srcHeight*scale+0.5)
+	}
+
+	width, height = max(width, 1), max(height, 1)
+	if srcRect == bounds && width == bounds.Dx() && height == bounds.Dy() {
+		return src
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, srcRect, draw.Src, nil)
+	return dst
+}
+
+type cacheFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func (c *VariantCache) files() ([]cacheFile, error) {
+	var files []cacheFile
+	err := filepath.WalkDir(c.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.Contains(entry.Name(), ".tmp-") {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, cacheFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	return files, err
+}
+
+// evict 缓存超过上限时删除最久未访问的文件，直到低于上限的 90%；keep 为刚生成的缓存，不会被删除
+func (c *VariantCache) evict(keep string) {
+	maxBytes := int64(c.config.Get().Variants.CacheMaxBytes)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size <= maxBytes {
+		return
+	}
+
+	files, err := c.files()
+	if err != nil {
+		logrus.Errorf("读取缩放图片缓存失败: %v", err)
+		return
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	c.size = 0
+	for _, file := range files {
+		c.size += file.size
+	}
+	target := maxBytes / 10 * 9
+	removed := 0
+	for _, file := range files {
+		if c.size <= target {
+			break
+		}
+		if file.path == keep {
+			continue
+		}
+		if err := os.Remove(file.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logrus.Warnf("删除缩放图片缓存 %s 失败: %v", file.path, err)
+			continue
+		}
+		c.size -= file.size
+		removed++
+	}
+	logrus.Infof("缩放图片缓存超过 %s，已删除 %d 个最久未访问的缓存", ByteSize(maxBytes), removed)
+}
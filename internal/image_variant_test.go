@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"io"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestParseVariantOptions(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    *VariantOptions
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"w=256", &VariantOptions{Width: 256, Fit: FitContain}, false},
+		{"w=256&h=128&fit=COVER&fmt=jpg&q=80", &VariantOptions{Width: 256, Height: 128, Fit: FitCover, Format: FormatJPEG, Quality: 80}, false},
+		{"fmt=webp", &VariantOptions{Fit: FitContain, Format: FormatWebP}, false},
+		{"w=0", nil, true},
+		{"w=-1", nil, true},
+		{"h=abc", nil, true},
+		{"w=256&fit=cover", nil, true},
+		{"w=256&h=256&fit=crop", nil, true},
+		{"fmt=gif", nil, true},
+		{"q=101", nil, true},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		got, err := ParseVariantOptions(query)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseVariantOptions(%q) error = %v", tt.query, err)
+			continue
+		}
+		if tt.want == nil && got != nil || tt.want != nil && (got == nil || *got != *tt.want) {
+			t.Errorf("ParseVariantOptions(%q) = %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestResizeImage(t *testing.T) {
+	src := testImage(400, 200, 1)
+	tests := []struct {
+		name   string
+		opts   VariantOptions
+		width  int
+		height int
+	}{
+		{"contain 按宽度", VariantOptions{Width: 100, Fit: FitContain}, 100, 50},
+		{"contain 按较小的比例", VariantOptions{Width: 100, Height: 100, Fit: FitContain}, 100, 50},
+		{"contain 不放大", VariantOptions{Width: 800, Fit: FitContain}, 400, 200},
+		{"cover 裁剪为指定宽高", VariantOptions{Width: 100, Height: 100, Fit: FitCover}, 100, 100},
+		{"cover 不放大，保持宽高比", VariantOptions{Width: 800, Height: 800, Fit: FitCover}, 200, 200},
+		{"fill 拉伸", VariantOptions{Width: 100, Height: 100, Fit: FitFill}, 100, 100},
+		{"最小 1 像素", VariantOptions{Width: 1, Fit: FitContain}, 1, 1},
+	}
+	for _, tt := range tests {
+		bounds := resizeImage(src, &tt.opts).Bounds()
+		if bounds.Dx() != tt.width || bounds.Dy() != tt.height {
+			t.Errorf("%s: resizeImage() = %dx%d, want %dx%d", tt.name, bounds.Dx(), bounds.Dy(), tt.width, tt.height)
+		}
+	}
+}
+
+// variantSource 返回打开测试图片的函数，并记录打开次数
+func variantSource(data []byte, opens *int) func() (io.ReadSeekCloser, error) {
+	return func() (io.ReadSeekCloser, error) {
+		*opens++
+		return nopSeekCloser{bytes.NewReader(data)}, nil
+	}
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
+
+func newTestVariantCache(t *testing.T) *VariantCache {
+	t.Helper()
+	config := newTestConfigStore(t, func(c *Config) {
+		c.Variants.MaxSize = 512
+	})
+	cache, err := NewVariantCache(config, filepath.Join(t.TempDir(), "variants"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func TestVariantCacheGet(t *testing.T) {
+	cache := newTestVariantCache(t)
+	ctx := context.Background()
+	data := encodeTestImage(t, testImage(400, 200, 1), FormatPNG, 0)
+	source := &ObjectInfo{Key: "2026-01-01/a.png", Size: int64(len(data)), ModTime: time.Now(), ETag: `"abc"`}
+	opens := 0
+
+	get := func(source *ObjectInfo, opts VariantOptions) *ObjectInfo {
+		t.Helper()
+		file, info, err := cache.Get(ctx, source, &opts, variantSource(data, &opens))
+		if err != nil {
+			t.Fatalf("Get(%+v) error = %v", opts, err)
+		}
+		defer file.Close()
+		img, format, err := image.Decode(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format != "png" || img.Bounds().Dx() != opts.Width {
+			t.Errorf("缩放图片 %s %dx%d", format, img.Bounds().Dx(), img.Bounds().Dy())
+		}
+		return info
+	}
+
+	first := get(source, VariantOptions{Width: 100, Fit: FitContain})
+	second := get(source, VariantOptions{Width: 100, Fit: FitContain})
+	if opens != 1 || first.ETag != second.ETag {
+		t.Errorf("相同参数应使用缓存，opens = %d, ETag = %s, %s", opens, first.ETag, second.ETag)
+	}
+	// 缓存文件名是参数和原图的摘要，不包含调用方可控的路径字符
+	if !regexp.MustCompile(`^"[0-9a-f]{64}"$`).MatchString(first.ETag) {
+		t.Errorf("缓存 ETag = %s", first.ETag)
+	}
+
+	other := get(source, VariantOptions{Width: 120, Fit: FitContain})
+	changed := *source
+	changed.ETag = `"def"`
+	replaced := get(&changed, VariantOptions{Width: 100, Fit: FitContain})
+	if other.ETag == first.ETag || replaced.ETag == first.ETag || opens != 3 {
+		t.Errorf("参数或原图变化时应重新生成，opens = %d", opens)
+	}
+}
+
+func TestVariantCacheGetBounds(t *testing.T) {
+	cache := newTestVariantCache(t)
+	ctx := context.Background()
+	source := &ObjectInfo{Key: "a.png", ETag: `"abc"`}
+	opens := 0
+
+	for _, opts := range []VariantOptions{{Width: 513, Fit: FitContain}, {Height: 513, Fit: FitContain}} {
+		if _, _, err := cache.Get(ctx, source, &opts, variantSource(nil, &opens)); !errors.Is(err, ErrInvalidVariant) {
+			t.Errorf("超过 max_size Get(%+v) error = %v", opts, err)
+		}
+	}
+	if opens != 0 {
+		t.Error("参数无效时不应读取原图")
+	}
+
+	// 只读取 PNG 头部判断尺寸，不解码过大的原图
+	huge := pngHeader(9000, 9000)
+	if _, _, err := cache.Get(ctx, &ObjectInfo{Key: "huge.png"}, &VariantOptions{Width: 100, Fit: FitContain}, variantSource(huge, &opens)); !errors.Is(err, ErrInvalidVariant) {
+		t.Errorf("原图过大 Get() error = %v", err)
+	}
+	if _, _, err := cache.Get(ctx, &ObjectInfo{Key: "text.png"}, &VariantOptions{Width: 100, Fit: FitContain}, variantSource([]byte("not an image"), &opens)); !errors.Is(err, ErrInvalidVariant) {
+		t.Errorf("无法识别的图片 Get() error = %v", err)
+	}
+}
+
+// pngHeader 返回只包含签名和 IHDR 的 PNG 数据
+func pngHeader(width, height uint32) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], width)
+	binary.BigEndian.PutUint32(ihdr[4:], height)
+	ihdr[8], ihdr[9] = 8, 2
+	binary.Write(&buf, binary.BigEndian, uint32(len(ihdr)))
+	chunk := append([]byte("IHDR"), ihdr...)
+	buf.Write(chunk)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+	return buf.Bytes()
+}
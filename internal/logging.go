@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 日志格式
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// 日志中统一使用的字段名
+const (
+	LogFieldRequestID = "request_id"
+	LogFieldJobID     = "job_id"
+	LogFieldTool      = "tool"
+	LogFieldSession   = "session"
+	LogFieldPrincipal = "principal"
+	LogFieldBackend   = "backend"
+	LogFieldImageID   = "image_id"
+	LogFieldTraceID   = "trace_id"
+)
+
+// LogConfig 日志输出，修改后重新加载配置即生效
+type LogConfig struct {
+	// debug、info（默认）、warn 或 error
+	Level string `yaml:"level"`
+	// text（默认）或 json，json 格式每行一条日志，便于日志平台采集
+	Format string `yaml:"format"`
+	// 隐藏日志中的提示词和 base64 图片数据，默认开启
+	Redact bool `yaml:"redact"`
+}
+
+func (c *LogConfig) normalize() {
+	c.Level = strings.ToLower(c.Level)
+	if c.Level == "" {
+		c.Level = "info"
+	}
+	c.Format = strings.ToLower(c.Format)
+	if c.Format == "" {
+		c.Format = LogFormatText
+	}
+}
+
+func (c *LogConfig) validate() []error {
+	var errs []error
+	if _, err := logrus.ParseLevel(c.Level); err != nil {
+		errs = append(errs, fmt.Errorf("log.level 无效: %s，可选值为 debug、info、warn、error", c.Level))
+	}
+	if c.Format != LogFormatText && c.Format != LogFormatJSON {
+		errs = append(errs, fmt.Errorf("log.format 无效: %s，可选值为 text、json", c.Format))
+	}
+	return errs
+}
+
+// ConfigureLogging 按配置设置全局日志级别和格式
+func ConfigureLogging(config LogConfig) {
+	if level, err := logrus.ParseLevel(config.Level); err == nil {
+		logrus.SetLevel(level)
+	}
+
+	var formatter logrus.Formatter = &logrus.TextFormatter{FullTimestamp: true}
+	if config.Format == LogFormatJSON {
+		formatter = &logrus.JSONFormatter{
+			FieldMap: logrus.FieldMap{logrus.FieldKeyMsg: "message"},
+		}
+	}
+	if config.Redact {
+		formatter = &redactingFormatter{formatter}
+	}
+	logrus.SetFormatter(formatter)
+}
+
+type logFieldsKey struct{}
+
+// WithLogFields 返回携带日志字段的 context，与 context 中已有的字段合并，之后通过 Logger 输出的日志都会带上这些字段
+func WithLogFields(ctx context.Context, fields logrus.Fields) context.Context {
+	merged := make(logrus.Fields, len(fields))
+	if existing, ok := ctx.Value(logFieldsKey{}).(logrus.Fields); ok {
+		for key, value := range existing {
+			merged[key] = value
+		}
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return context.WithValue(ctx, logFieldsKey{}, merged)
+}
+
+// Logger 返回带有 context 中日志字段（request_id、job_id、tool 等）和 trace_id 的日志记录器
+func Logger(ctx context.Context) *logrus.Entry {
+	entry := logrus.WithContext(ctx)
+	if fields, ok := ctx.Value(logFieldsKey{}).(logrus.Fields); ok {
+		entry = entry.WithFields(fields)
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsSampled() {
+		entry = entry.WithField(LogFieldTraceID, spanContext.TraceID().String())
+	}
+	return entry
+}
+
+// RequestIDFromContext 返回当前 HTTP 请求的 ID
+func RequestIDFromContext(ctx context.Context) string {
+	return logField(ctx, LogFieldRequestID)
+}
+
+// JobIDFromContext 返回当前工具调用的 ID，同一次调用生成的图片记录中的 request_id 与之相同
+func JobIDFromContext(ctx context.Context) string {
+	return logField(ctx, LogFieldJobID)
+}
+
+func logField(ctx context.Context, key string) string {
+	fields, _ := ctx.Value(logFieldsKey{}).(logrus.Fields)
+	value, _ := fields[key].(string)
+	return value
+}
+
+// redactedLogFields 内容需要隐藏的日志字段
+var redactedLogFields = map[string]bool{
+	"prompt":          true,
+	"negative_prompt": true,
+}
+
+// base64Pattern 匹配日志中的长 base64 数据（含 data URL 前缀）
+var base64Pattern = regexp.MustCompile(`(data:[\w/+.-]+;base64,)?[A-Za-z0-9+/]{200,}={0,2}`)
+
+// redactingFormatter 输出前隐藏提示词和 base64 图片数据，不修改原始日志记录
+type redactingFormatter struct {
+	logrus.Formatter
+}
+
+func (f *redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	redacted := *entry
+	redacted.Message = redactBase64(entry.Message)
+	redacted.Data = make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		redacted.Data[key] = redactLogValue(key, value)
+	}
+	return f.Formatter.Format(&redacted)
+}
+
+func redactLogValue(key string, value any) any {
+	switch v := value.(type) {
+	case string:
+		if redactedLogFields[key] {
+			return fmt.Sprintf("[已隐藏 %d 字]", len([]rune(v)))
+		}
+		return redactBase64(v)
+	case map[string]any:
+		redacted := make(map[string]any, len(v))
+		for k, item := range v {
+			redacted[k] = redactLogValue(k, item)
+		}
+		return redacted
+	case []any:
+		redacted := make([]any, len(v))
+		for i, item := range v {
+			redacted[i] = redactLogValue(key, item)
+		}
+		return redacted
+	case error:
+		return redactBase64(v.Error())
+	}
+	return value
+}
+
+func redactBase64(s string) string {
+	if len(s) < 200 {
+		return s
+	}
+	return base64Pattern.ReplaceAllStringFunc(s, func(match string) string {
+		return fmt.Sprintf("[base64 %d 字节]", len(match))
+	})
+}
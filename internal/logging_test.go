@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func formatRedacted(t *testing.T, message string, fields logrus.Fields) string {
+	t.Helper()
+	entry := logrus.NewEntry(logrus.New()).WithFields(fields)
+	entry.Message = message
+	out, err := (&redactingFormatter{Formatter: &logrus.JSONFormatter{}}).Format(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestRedactingFormatter(t *testing.T) {
+	const prompt = "a secret castle on the hill"
+	const negative = "blurry hands"
+	image := strings.Repeat("iVBORw0KGgoAAAANSUhEUg", 20)
+
+	request := map[string]any{
+		"prompt":          prompt,
+		"negative_prompt": negative,
+		"steps":           20,
+		"controlnet_units": []any{
+			map[string]any{"input_image": image, "module": "canny"},
+		},
+		"alwayson_scripts": map[string]any{
+			"adetailer": map[string]any{"args": []any{map[string]any{"prompt": prompt}}},
+		},
+	}
+	fields := logrus.Fields{
+		"request": request,
+		"prompt":  []any{prompt, negative},
+		"error":   errors.New("解码图片失败: data:image/png;base64," + image),
+		"images":  []any{image},
+		"tool":    "txt2img",
+	}
+	out := formatRedacted(t, "收到请求 data:image/png;base64,"+image, fields)
+
+	for _, secret := range []string{"secret castle", "blurry hands", "iVBORw0KGgo", "base64,"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("输出中包含 %q: %s", secret, out)
+		}
+	}
+	for _, want := range []string{`"module":"canny"`, `"steps":20`, `"tool":"txt2img"`, "[已隐藏", "[base64 "} {
+		if !strings.Contains(out, want) {
+			t.Errorf("输出中应包含 %q: %s", want, out)
+		}
+	}
+
+	// 不修改原始日志记录
+	if request["prompt"] != prompt || fields["images"].([]any)[0] != image {
+		t.Error("原始日志记录被修改")
+	}
+}
+
+func TestRedactBase64Threshold(t *testing.T) {
+	short := strings.Repeat("A", 199)
+	if got := redactBase64("data " + short + " end"); got != "data "+short+" end" {
+		t.Errorf("199 字符的 base64 不应隐藏: %q", got)
+	}
+	long := strings.Repeat("A", 200)
+	if got := redactBase64("data " + long + " end"); got != "data [base64 200 字节] end" {
+		t.Errorf("200 字符的 base64 应隐藏: %q", got)
+	}
+	// 普通长文本中的空格和标点打断 base64 匹配
+	text := strings.Repeat("a long log line, ", 20)
+	if got := redactBase64(text); got != text {
+		t.Errorf("普通文本不应隐藏: %q", got)
+	}
+}
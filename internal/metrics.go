@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// 工具调用结果
+const (
+	OutcomeSuccess = "success"
+	OutcomeError   = "error"
+	// 权限或角色策略拒绝
+	OutcomeDenied = "denied"
+	// 限流或配额超限
+	OutcomeLimited = "limited"
+	// 提示词被内容审核拒绝
+	OutcomeRejected = "rejected"
+	OutcomePanic    = "panic"
+)
+
+// durationBuckets 工具调用和 WebUI 请求耗时的分桶，生成图片通常需要数秒到数分钟
+var durationBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+var (
+	toolCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sdmcp_tool_calls_total",
+		Help: "MCP 工具调用次数，outcome 为 success、error、denied、limited 或 panic",
+	}, []string{"tool", "outcome"})
+
+	toolDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sdmcp_tool_call_duration_seconds",
+		Help:    "MCP 工具调用耗时（不包含被拒绝和限流的调用）",
+		Buckets: durationBuckets,
+	}, []string{"tool"})
+
+	webuiDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sdmcp_webui_request_duration_seconds",
+		Help:    "Stable Diffusion WebUI 请求耗时，status 为 HTTP 状态码，请求失败时为 error",
+		Buckets: durationBuckets,
+	}, []string{"backend", "endpoint", "status"})
+
+	generationSecondsPerMegapixel = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sdmcp_generation_seconds_per_megapixel",
+		Help:    "txt2img 生成耗时除以生成的总像素数（百万像素）",
+		Buckets: []float64{0.25, 0.5, 1, 2, 5, 10, 20, 40, 80, 160},
+	}, []string{"backend"})
+
+	backendQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sdmcp_backend_queue_depth",
+		Help: "已发往后端、尚未返回的 txt2img 请求数，WebUI 按顺序处理，大于 1 表示有请求在排队",
+	}, []string{"backend"})
+
+	storedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sdmcp_stored_bytes_total",
+		Help: "写入存储的字节数，kind 为 image、provenance 或 export，去重存储复用已有内容时不计入",
+	}, []string{"kind"})
+
+	storedImages = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sdmcp_stored_images_total",
+		Help: "保存的图片数量",
+	})
+
+	fileRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sdmcp_file_requests_total",
+		Help: "图片读取接口的请求数，kind 为 original、variant 或 redirect，status 为 HTTP 状态码",
+	}, []string{"kind", "status"})
+
+	moderationEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sdmcp_moderation_events_total",
+		Help: "提示词命中内容审核规则的次数，action 为 reject、sanitize 或 log",
+	}, []string{"policy", "action"})
+)
+
+// RecordToolCall 记录工具调用结果，duration 为 0 时不记录耗时
+func RecordToolCall(tool string, outcome string, duration time.Duration) {
+	toolCalls.WithLabelValues(tool, outcome).Inc()
+	if duration > 0 {
+		toolDuration.WithLabelValues(tool).Observe(duration.Seconds())
+	}
+}
+
+// ObserveWebUIRequest 记录 WebUI 请求耗时
+func ObserveWebUIRequest(backend string, endpoint string, status string, duration time.Duration) {
+	webuiDuration.WithLabelValues(backend, endpoint, status).Observe(duration.Seconds())
+}
+
+// ObserveGeneration 记录一次 txt2img 生成每百万像素的耗时
+func ObserveGeneration(backend string, megapixels float64, duration time.Duration) {
+	if megapixels > 0 {
+		generationSecondsPerMegapixel.WithLabelValues(backend).Observe(duration.Seconds() / megapixels)
+	}
+}
+
+// BackendQueue 返回后端排队请求数的指标，请求发出前 Inc，返回后 Dec
+func BackendQueue(backend string) prometheus.Gauge {
+	return backendQueueDepth.WithLabelValues(backend)
+}
+
+// RecordFileRequest 记录图片读取接口的请求
+func RecordFileRequest(kind string, status int) {
+	fileRequests.WithLabelValues(kind, strconv.Itoa(status)).Inc()
+}
+
+var (
+	sessionGaugeOnce sync.Once
+	sessionCount     atomic.Pointer[func() int]
+)
+
+// RegisterSessionGauge 注册当前活跃的 MCP 会话数指标，count 在每次采集时调用；
+// 重复调用时只替换 count，指标只注册一次
+func RegisterSessionGauge(count func() int) {
+	sessionCount.Store(&count)
+	sessionGaugeOnce.Do(func() {
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "sdmcp_mcp_active_sessions",
+			Help: "当前活跃的 MCP 会话数（Streamable HTTP 和 SSE）",
+		}, func() float64 {
+			return float64((*sessionCount.Load())())
+		})
+	})
+}
+
+func recordStored(kind string, size int64) {
+	storedBytes.WithLabelValues(kind).Add(float64(size))
+}
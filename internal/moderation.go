@@ -0,0 +1,552 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 审核命中后的处理方式
+const (
+	ModerationReject   = "reject"
+	ModerationSanitize = "sanitize"
+	ModerationLog      = "log"
+	// ModerationNone API Key 配置为 none 时不审核
+	ModerationNone = "none"
+)
+
+const moderationLogFileName = "moderation.jsonl"
+
+// ModerationConfig 提示词内容审核，在调用 WebUI 生成图片之前执行
+type ModerationConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// 所有策略共用的屏蔽词，中英文均可；匹配时忽略大小写、全角半角和字符间的空格、符号，
+	// 并识别常见的 leetspeak 写法（如 s3x、n00d）；英文词按整词匹配
+	Terms []string `yaml:"terms"`
+	// 所有策略共用的正则表达式（RE2 语法），在规范化（全角转半角、小写、合并空白）后的提示词上匹配，
+	// 同时也会在进一步还原 leetspeak、去除字符间分隔符后的文本上匹配
+	Patterns []string `yaml:"patterns"`
+	// 未单独指定策略的调用方使用的策略（policies 中的名称），为空时不审核
+	Default  string                      `yaml:"default"`
+	Policies map[string]ModerationPolicy `yaml:"policies"`
+}
+
+// ModerationPolicy 审核策略，API Key 通过 moderation 选择策略
+type ModerationPolicy struct {
+	// reject（默认，拒绝生成）、sanitize（删除命中的内容后继续生成）或 log（只记录）
+	Action string `yaml:"action"`
+	// 在全局屏蔽词和正则之外额外屏蔽的内容
+	Terms    []string `yaml:"terms"`
+	Patterns []string `yaml:"patterns"`
+	// 总是追加到负面提示词中的内容
+	NegativePrompt string `yaml:"negative_prompt"`
+}
+
+func (c *ModerationConfig) normalize() {
+	for name, policy := range c.Policies {
+		if policy.Action == "" {
+			policy.Action = ModerationReject
+		}
+		c.Policies[name] = policy
+	}
+}
+
+func (c *ModerationConfig) validate() []error {
+	var errs []error
+	for i, pattern := range c.Patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			errs = append(errs, fmt.Errorf("moderation.patterns[%d] 无效: %v", i, err))
+		}
+	}
+	for name, policy := range c.Policies {
+		switch policy.Action {
+		case ModerationReject, ModerationSanitize, ModerationLog:
+		default:
+			errs = append(errs, fmt.Errorf("moderation.policies.%s.action 无效: %s，可选值为 reject、sanitize、log", name, policy.Action))
+		}
+		for i, pattern := range policy.Patterns {
+			if _, err := regexp.Compile(pattern); err != nil {
+				errs = append(errs, fmt.Errorf("moderation.policies.%s.patterns[%d] 无效: %v", name, i, err))
+			}
+		}
+	}
+	if c.Default != "" {
+		if _, ok := c.Policies[c.Default]; !ok {
+			errs = append(errs, fmt.Errorf("moderation.default 引用了不存在的策略: %s", c.Default))
+		}
+	}
+	return errs
+}
+
+// validateModerationRefs 检查 API Key 引用的审核策略是否存在
+func (c *Config) validateModerationRefs() []error {
+	var errs []error
+	for i, key := range c.Auth.Keys {
+		if key.Moderation == "" || key.Moderation == ModerationNone {
+			continue
+		}
+		if _, ok := c.Moderation.Policies[key.Moderation]; !ok {
+			errs = append(errs, fmt.Errorf("auth.keys[%d].moderation 引用了不存在的审核策略: %s", i, key.Moderation))
+		}
+	}
+	return errs
+}
+
+// ModerationFor 返回调用方适用的审核策略名称，API Key 的设置优先于默认策略，不审核时返回空字符串
+func (c *Config) ModerationFor(principal *Principal) string {
+	if !c.Moderation.Enabled {
+		return ""
+	}
+	name := c.Moderation.Default
+	if principal != nil && principal.Kind == PrincipalAPIKey {
+		for _, key := range c.Auth.Keys {
+			if key.Label == principal.Label && key.Moderation != "" {
+				name = key.Moderation
+			}
+		}
+	}
+	if name == ModerationNone {
+		return ""
+	}
+	return name
+}
+
+// ModerationError 提示词被审核策略拒绝
+type ModerationError struct {
+	Policy string
+}
+
+func (e *ModerationError) Error() string {
+	return fmt.Sprintf("提示词包含不允许的内容，已被内容审核策略 %s 拒绝，请修改提示词后重试", e.Policy)
+}
+
+// ModerationResult 审核结果
+type ModerationResult struct {
+	Policy string
+	Action string
+	// 命中的屏蔽词和正则
+	Matches []string
+	// 审核后的提示词，sanitize 时已删除命中的内容
+	Prompt string
+	// 追加了策略负面提示词后的负面提示词
+	NegativePrompt string
+}
+
+// ModerationEvent 命中审核规则的记录，保存在 server.data_dir/moderation.jsonl 中供人工复核
+type ModerationEvent struct {
+	Time            time.Time `json:"time"`
+	Principal       string    `json:"principal,omitempty"`
+	RequestID       string    `json:"request_id,omitempty"`
+	JobID           string    `json:"job_id,omitempty"`
+	Policy          string    `json:"policy"`
+	Action          string    `json:"action"`
+	Rejected        bool      `json:"rejected"`
+	Matches         []string  `json:"matches"`
+	Prompt          string    `json:"prompt"`
+	SanitizedPrompt string    `json:"sanitized_prompt,omitempty"`
+}
+
+// Moderator 按调用方的审核策略检查提示词，编译后的规则随配置重新加载更新
+type Moderator struct {
+	config  *ConfigStore
+	logPath string
+
+	mu       sync.Mutex
+	compiled *Config
+	policies map[string]*moderationRules
+}
+
+type moderationRules struct {
+	policy ModerationPolicy
+	rules  []moderationRule
+}
+
+type moderationRule struct {
+	// 屏蔽词或正则原文，用于记录命中的规则
+	source string
+	// 屏蔽词编译后的正则，在原始提示词上匹配，第 1 个分组为命中的内容
+	term *regexp.Regexp
+	// 用户配置的正则，在规范化后的提示词上匹配
+	pattern *regexp.Regexp
+}
+
+func NewModerator(config *ConfigStore, dataDir string) *Moderator {
+	return &Moderator{
+		config:  config,
+		logPath: filepath.Join(dataDir, moderationLogFileName),
+	}
+}
+
+// Check 审核提示词：reject 策略命中时返回 *ModerationError，sanitize 删除命中的内容（删除后仍能匹配时拒绝），
+// log 只记录；命中的记录写入复核日志，策略的负面提示词总是追加；调用方不需要审核时返回 nil
+func (m *Moderator) Check(ctx context.Context, prompt string, negativePrompt string) (*ModerationResult, error) {
+	config := m.config.Get()
+	name := config.ModerationFor(PrincipalFromContext(ctx))
+	if name == "" {
+		return nil, nil
+	}
+	rules, err := m.rules(config, name)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ModerationResult{
+		Policy:         name,
+		Action:         rules.policy.Action,
+		Prompt:         prompt,
+		NegativePrompt: appendPrompt(negativePrompt, rules.policy.NegativePrompt),
+		Matches:        rules.match(prompt),
+	}
+	if len(result.Matches) == 0 {
+		return result, nil
+	}
+
+	rejected := result.Action == ModerationReject
+	if result.Action == ModerationSanitize {
+		result.Prompt = rules.sanitize(prompt)
+		// 只在规范化后的文本上命中的内容无法从原文中删除，此时拒绝
+		if len(rules.match(result.Prompt)) > 0 {
+			rejected = true
+		}
+	}
+
+	event := &ModerationEvent{
+		Time:      time.Now(),
+		RequestID: RequestIDFromContext(ctx),
+		JobID:     JobIDFromContext(ctx),
+		Policy:    name,
+		Action:    result.Action,
+		Rejected:  rejected,
+		Matches:   result.Matches,
+		Prompt:    prompt,
+	}
+	if principal := PrincipalFromContext(ctx); principal != nil {
+		event.Principal = principal.ID
+	}
+	if result.Action == ModerationSanitize && !rejected {
+		event.SanitizedPrompt = result.Prompt
+	}
+	m.record(event)
+
+	outcome := result.Action
+	if rejected {
+		outcome = ModerationReject
+	}
+	moderationEvents.WithLabelValues(name, outcome).Inc()
+	Logger(ctx).WithFields(logrus.Fields{
+		"policy":   name,
+		"action":   result.Action,
+		"rejected": rejected,
+		"matches":  result.Matches,
+	}).Warn("提示词命中内容审核规则")
+	AuditResult(ctx, "moderation", map[string]any{
+		"policy":   name,
+		"action":   result.Action,
+		"rejected": rejected,
+		"matches":  result.Matches,
+	})
+
+	if rejected {
+		err := &ModerationError{Policy: name}
+		SetAuditOutcome(ctx, OutcomeRejected, err.Error())
+		return result, err
+	}
+	return result, nil
+}
+
+// rules 返回策略编译后的规则，配置重新加载后重新编译
+func (m *Moderator) rules(config *Config, name string) (*moderationRules, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.compiled != config {
+		m.compiled = config
+		m.policies = make(map[string]*moderationRules)
+	}
+	if rules, ok := m.policies[name]; ok {
+		return rules, nil
+	}
+
+	policy, ok := config.Moderation.Policies[name]
+	if !ok {
+		return nil, fmt.Errorf("审核策略不存在: %s", name)
+	}
+	rules := &moderationRules{policy: policy}
+	for _, term := range slices.Concat(config.Moderation.Terms, policy.Terms) {
+		if re := compileTerm(term); re != nil {
+			rules.rules = append(rules.rules, moderationRule{source: term, term: re})
+		}
+	}
+	for _, pattern := range slices.Concat(config.Moderation.Patterns, policy.Patterns) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("审核正则无效: %v", err)
+		}
+		rules.rules = append(rules.rules, moderationRule{source: pattern, pattern: re})
+	}
+	m.policies[name] = rules
+	return rules, nil
+}
+
+// match 返回命中的屏蔽词和正则
+func (r *moderationRules) match(prompt string) []string {
+	light, full := normalizeForModeration(prompt)
+	var matches []string
+	for _, rule := range r.rules {
+		var matched bool
+		if rule.term != nil {
+			matched = rule.term.MatchString(prompt)
+		} else {
+			matched = rule.pattern.MatchString(light) || rule.pattern.MatchString(full)
+		}
+		if matched {
+			matches = append(matches, rule.source)
+		}
+	}
+	return matches
+}
+
+// sanitize 从原始提示词中删除命中的屏蔽词和正则
+func (r *moderationRules) sanitize(prompt string) string {
+	for _, rule := range r.rules {
+		if rule.term != nil {
+			// 相邻的命中共用边界字符，需要重复替换
+			for i := 0; i < 8 && rule.term.MatchString(prompt); i++ {
+				prompt = removeSubmatch(rule.term, prompt)
+			}
+		} else {
+			prompt = rule.pattern.ReplaceAllString(prompt, " ")
+		}
+	}
+	return cleanPrompt(prompt)
+}
+
+func removeSubmatch(re *regexp.Regexp, s string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range re.FindAllStringSubmatchIndex(s, -1) {
+		b.WriteString(s[last:loc[2]])
+		b.WriteString(" ")
+		last = loc[3]
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+var (
+	repeatedCommas = regexp.MustCompile(`\s*[,，]\s*([,，]\s*)+`)
+	repeatedSpaces = regexp.MustCompile(`\s{2,}`)
+)
+
+// cleanPrompt 删除内容后合并多余的逗号和空格
+func cleanPrompt(prompt string) string {
+	prompt = repeatedCommas.ReplaceAllString(prompt, ", ")
+	prompt = repeatedSpaces.ReplaceAllString(prompt, " ")
+	return strings.Trim(prompt, " ,，")
+}
+
+// appendPrompt 将策略的负面提示词追加到请求的负面提示词后，已包含时不重复追加
+func appendPrompt(prompt string, extra string) string {
+	extra = strings.TrimSpace(extra)
+	switch {
+	case extra == "" || strings.Contains(prompt, extra):
+		return prompt
+	case strings.TrimSpace(prompt) == "":
+		return extra
+	}
+	return strings.TrimRight(prompt, " ,，") + ", " + extra
+}
+
+// leetVariants 字母常见的 leetspeak 替代字符
+var leetVariants = map[rune]string{
+	'a': "4@",
+	'b': "8",
+	'e': "3",
+	'g': "96",
+	'i': "1!|",
+	'l': "1|",
+	'o': "0",
+	's': "5$",
+	't': "7+",
+	'z': "2",
+}
+
+// leetLetters leetspeak 字符还原为字母，用于规范化后匹配正则
+var leetLetters = map[rune]rune{
+	'4': 'a', '@': 'a', '8': 'b', '3': 'e', '9': 'g', '6': 'g',
+	'1': 'i', '!': 'i', '|': 'i', '0': 'o', '5': 's', '$': 's', '7': 't', '+': 't', '2': 'z',
+}
+
+// termSeparator 屏蔽词字符之间允许出现的空白和符号
+const termSeparator = `[\s\p{P}\p{S}_]{0,3}`
+
+// compileTerm 将屏蔽词编译为容忍大小写、全角、leetspeak 和字符间分隔符的正则，
+// 英文等使用空格分词的屏蔽词要求前后不是字母或数字
+func compileTerm(term string) *regexp.Regexp {
+	var parts []string
+	wordBoundary := true
+	for _, r := range strings.ToLower(strings.TrimSpace(term)) {
+		if unicode.IsSpace(r) {
+			continue
+		}
+		if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) {
+			wordBoundary = false
+		}
+		parts = append(parts, runeClass(r))
+	}
+	if len(parts) == 0 {
+		return nil
+	}
+	core := "(" + strings.Join(parts, termSeparator) + ")"
+	if wordBoundary {
+		core = `(?:^|[^\p{L}\p{N}])` + core + `(?:$|[^\p{L}\p{N}])`
+	}
+	return regexp.MustCompile(core)
+}
+
+// runeClass 返回匹配字符本身、大小写、全角形式和 leetspeak 写法的字符类
+func runeClass(r rune) string {
+	variants := []rune{r}
+	if upper := unicode.ToUpper(r); upper != r {
+		variants = append(variants, upper)
+	}
+	for _, v := range variants {
+		if v >= '!' && v <= '~' {
+			variants = append(variants, v+0xFEE0)
+		}
+	}
+	variants = append(variants, []rune(leetVariants[r])...)
+
+	var b strings.Builder
+	b.WriteString("[")
+	for _, v := range variants {
+		b.WriteString(regexp.QuoteMeta(string(v)))
+	}
+	b.WriteString("]")
+	return b.String()
+}
+
+// normalizeForModeration 返回两种规范化文本：light 为全角转半角、小写、合并空白；
+// full 在此基础上还原 leetspeak，将符号替换为空格，并合并被空格拆开的单个字符（如 "n u d e"、"色 情"）
+func normalizeForModeration(text string) (light string, full string) {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == 0x3000:
+			r = ' '
+		case r >= 0xFF01 && r <= 0xFF5E:
+			r -= 0xFEE0
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	light = strings.Join(strings.Fields(b.String()), " ")
+
+	b.Reset()
+	for _, r := range light {
+		if letter, ok := leetLetters[r]; ok {
+			r = letter
+		}
+		if !unicode.IsLetter(r) && !unicode.IsNumber(r) {
+			r = ' '
+		}
+		b.WriteRune(r)
+	}
+	var tokens []string
+	var single strings.Builder
+	for _, token := range strings.Fields(b.String()) {
+		if len([]rune(token)) == 1 {
+			single.WriteString(token)
+			continue
+		}
+		if single.Len() > 0 {
+			tokens = append(tokens, single.String())
+			single.Reset()
+		}
+		tokens = append(tokens, token)
+	}
+	if single.Len() > 0 {
+		tokens = append(tokens, single.String())
+	}
+	return light, strings.Join(tokens, " ")
+}
+
+// record 追加复核记录，写入失败只记录日志
+func (m *Moderator) record(event *ModerationEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		logrus.Errorf("序列化审核记录失败: %v", err)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	file, err := os.OpenFile(m.logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		logrus.Errorf("写入审核记录失败: %v", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		logrus.Errorf("写入审核记录失败: %v", err)
+	}
+}
+
+// ModerationQuery 审核记录查询条件，为空的条件不限制
+type ModerationQuery struct {
+	Principal    string
+	Policy       string
+	RejectedOnly bool
+	Limit        int
+}
+
+// Events 按时间倒序返回命中审核规则的记录
+func (m *Moderator) Events(query ModerationQuery) ([]*ModerationEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, err := os.Open(m.logPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []*ModerationEvent
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		var event ModerationEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue
+		}
+		if (query.Principal != "" && event.Principal != query.Principal) ||
+			(query.Policy != "" && event.Policy != query.Policy) ||
+			(query.RejectedOnly && !event.Rejected) {
+			continue
+		}
+		events = append(events, &event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	slices.Reverse(events)
+	if query.Limit > 0 && len(events) > query.Limit {
+		events = events[:query.Limit]
+	}
+	return events, nil
+}
@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestNormalizeForModeration(t *testing.T) {
+	tests := []struct {
+		input string
+		light string
+		full  string
+	}{
+		{"A  Cat\tin  FOREST", "a cat in forest", "a cat in forest"},
+		{"ＮＵＤＥ　ｇｉｒｌ", "nude girl", "nude girl"},
+		{"n u d e, portrait", "n u d e, portrait", "nude portrait"},
+		{"n.u.d.e", "n.u.d.e", "nude"},
+		{"s3x n00d", "s3x n00d", "sex nood"},
+		{"色 情 图片", "色 情 图片", "色情 图片"},
+	}
+	for _, tt := range tests {
+		light, full := normalizeForModeration(tt.input)
+		if light != tt.light || full != tt.full {
+			t.Errorf("normalizeForModeration(%q) = %q, %q, want %q, %q", tt.input, light, full, tt.light, tt.full)
+		}
+	}
+}
+
+func testModerationRules(t *testing.T) *moderationRules {
+	t.Helper()
+	config := newTestConfigStore(t, func(c *Config) {
+		c.Moderation = ModerationConfig{
+			Enabled:  true,
+			Terms:    []string{"nude", "色情"},
+			Patterns: []string{`\bgore\b`},
+			Default:  "strict",
+			Policies: map[string]ModerationPolicy{"strict": {}},
+		}
+	}).Get()
+	rules, err := NewModerator(nil, t.TempDir()).rules(config, "strict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
+
+func TestModerationMatch(t *testing.T) {
+	rules := testModerationRules(t)
+
+	tests := []struct {
+		prompt string
+		want   []string
+	}{
+		{"a cat in forest", nil},
+		{"NUDE portrait", []string{"nude"}},
+		{"ｎｕｄｅ portrait", []string{"nude"}},
+		{"n u d e portrait", []string{"nude"}},
+		{"n.u.d.e portrait", []string{"nude"}},
+		{"nud3, n_u_d_e", []string{"nude"}},
+		// 英文屏蔽词按整词匹配
+		{"denuded hillside", nil},
+		{"色情图片", []string{"色情"}},
+		{"色 情", []string{"色情"}},
+		{"ＧＯＲＥ", []string{`\bgore\b`}},
+		{"g0r3 scene", []string{`\bgore\b`}},
+		{"gorey", nil},
+	}
+	for _, tt := range tests {
+		if got := rules.match(tt.prompt); !slices.Equal(got, tt.want) {
+			t.Errorf("match(%q) = %q, want %q", tt.prompt, got, tt.want)
+		}
+	}
+}
+
+func TestModerationSanitize(t *testing.T) {
+	rules := testModerationRules(t)
+
+	tests := []struct {
+		prompt string
+		want   string
+	}{
+		{"a girl, nude, forest", "a girl, forest"},
+		{"NUDE, N U D E, portrait", "portrait"},
+		{"portrait, ｎｕｄｅ", "portrait"},
+		{"风景，色情，高清", "风景, 高清"},
+		{"gore, castle", "castle"},
+	}
+	for _, tt := range tests {
+		got := rules.sanitize(tt.prompt)
+		if got != tt.want {
+			t.Errorf("sanitize(%q) = %q, want %q", tt.prompt, got, tt.want)
+		}
+		if matches := rules.match(got); len(matches) > 0 {
+			t.Errorf("sanitize(%q) = %q 仍然命中 %q", tt.prompt, got, matches)
+		}
+	}
+}
+
+func TestModeratorCheck(t *testing.T) {
+	config := newTestConfigStore(t, func(c *Config) {
+		c.Auth.Keys = []APIKeyConfig{
+			{Label: "reject", Hash: HashAPIKey("k1"), Scopes: []string{ScopeGenerate}},
+			{Label: "sanitize", Hash: HashAPIKey("k2"), Scopes: []string{ScopeGenerate}, Moderation: "sanitize"},
+			{Label: "log", Hash: HashAPIKey("k3"), Scopes: []string{ScopeGenerate}, Moderation: "log"},
+			{Label: "trusted", Hash: HashAPIKey("k4"), Scopes: []string{ScopeGenerate}, Moderation: ModerationNone},
+		}
+		c.Moderation = ModerationConfig{
+			Enabled:  true,
+			Terms:    []string{"nude"},
+			Patterns: []string{`\bgore\b`},
+			Default:  "reject",
+			Policies: map[string]ModerationPolicy{
+				"reject":   {NegativePrompt: "nsfw"},
+				"sanitize": {Action: ModerationSanitize},
+				"log":      {Action: ModerationLog},
+			},
+		}
+	})
+	moderator := NewModerator(config, t.TempDir())
+	ctxFor := func(label string) context.Context {
+		return WithPrincipal(context.Background(), &Principal{ID: "api_key:" + label, Label: label, Kind: PrincipalAPIKey})
+	}
+
+	result, err := moderator.Check(ctxFor("reject"), "a cat", "blurry")
+	if err != nil || len(result.Matches) != 0 || result.NegativePrompt != "blurry, nsfw" {
+		t.Fatalf("未命中 Check() = %+v, %v", result, err)
+	}
+
+	var moderationErr *ModerationError
+	if _, err := moderator.Check(ctxFor("reject"), "n u d e girl", ""); !errors.As(err, &moderationErr) || moderationErr.Policy != "reject" {
+		t.Errorf("reject Check() error = %v", err)
+	}
+
+	result, err = moderator.Check(ctxFor("sanitize"), "a girl, nude, forest", "")
+	if err != nil || result.Prompt != "a girl, forest" {
+		t.Errorf("sanitize Check() = %+v, %v", result, err)
+	}
+	// 只在规范化后的文本上命中的内容无法删除，拒绝生成
+	if _, err := moderator.Check(ctxFor("sanitize"), "g0r3 scene", ""); !errors.As(err, &moderationErr) {
+		t.Errorf("无法删除的内容 Check() error = %v", err)
+	}
+
+	result, err = moderator.Check(ctxFor("log"), "nude", "")
+	if err != nil || result.Prompt != "nude" || len(result.Matches) != 1 {
+		t.Errorf("log Check() = %+v, %v", result, err)
+	}
+
+	if result, err := moderator.Check(ctxFor("trusted"), "nude", ""); result != nil || err != nil {
+		t.Errorf("none Check() = %+v, %v", result, err)
+	}
+
+	events, err := moderator.Events(ModerationQuery{})
+	if err != nil || len(events) != 4 {
+		t.Fatalf("Events() = %d, %v", len(events), err)
+	}
+	if events[0].Principal != "api_key:log" || events[0].Rejected {
+		t.Errorf("最新的记录 = %+v", events[0])
+	}
+	if events[2].SanitizedPrompt != "a girl, forest" {
+		t.Errorf("sanitize 记录 = %+v", events[2])
+	}
+	rejected, err := moderator.Events(ModerationQuery{RejectedOnly: true})
+	if err != nil || len(rejected) != 2 {
+		t.Errorf("Events(RejectedOnly) = %d, %v", len(rejected), err)
+	}
+}
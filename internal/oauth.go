@@ -0,0 +1,420 @@
+package internal
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+// PrincipalOAuth 通过 OAuth 访问令牌认证的调用方
+const PrincipalOAuth = "oauth"
+
+// jwksMinRefreshInterval 遇到未知 kid 时强制刷新 JWKS 的最小间隔，防止被恶意令牌触发频繁请求
+const jwksMinRefreshInterval = 30 * time.Second
+
+// OAuthConfig OAuth 2.1 受保护资源配置（MCP Authorization 规范）
+type OAuthConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// 资源标识，默认为 server.public_url + /mcp
+	Resource string `yaml:"resource"`
+	// 授权服务器的 issuer 地址，会在受保护资源元数据中返回
+	AuthorizationServers []string `yaml:"authorization_servers"`
+	// 访问令牌的 iss 必须与之一致
+	Issuer string `yaml:"issuer"`
+	// 访问令牌的 aud 必须包含其中之一，默认为 resource
+	Audience []string `yaml:"audience"`
+	// JWKS 来源，二选一
+	JWKSURL  string `yaml:"jwks_url"`
+	JWKSFile string `yaml:"jwks_file"`
+	// JWKS 刷新间隔，默认 10 分钟
+	JWKSRefreshInterval time.Duration `yaml:"jwks_refresh_interval"`
+	// 允许的时钟误差，默认 1 分钟
+	ClockSkew time.Duration `yaml:"clock_skew"`
+	// 令牌 scope 到服务权限（generate/read-files/admin）的映射，为空时直接使用令牌中的 scope
+	ScopeMap map[string][]string `yaml:"scope_map"`
+	// 从令牌中读取角色的 claim 名称，如 role
+	RoleClaim string `yaml:"role_claim"`
+	// 令牌中没有角色时使用的角色，为空时只按 scope 控制权限
+	DefaultRole string `yaml:"default_role"`
+}
+
+// ScopesSupported 受保护资源元数据中公布的 scope 列表
+func (c *OAuthConfig) ScopesSupported() []string {
+	if len(c.ScopeMap) == 0 {
+		return AllScopes
+	}
+	scopes := make([]string, 0, len(c.ScopeMap))
+	for scope := range c.ScopeMap {
+		scopes = append(scopes, scope)
+	}
+	slices.Sort(scopes)
+	return scopes
+}
+
+// mapScopes 将令牌中的 scope 映射为服务权限
+func (c *OAuthConfig) mapScopes(tokenScopes []string) []string {
+	var scopes []string
+	for _, tokenScope := range tokenScopes {
+		mapped := []string{tokenScope}
+		if len(c.ScopeMap) > 0 {
+			mapped = c.ScopeMap[tokenScope]
+		}
+		for _, scope := range mapped {
+			if slices.Contains(AllScopes, scope) && !slices.Contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	return scopes
+}
+
+func (c *OAuthConfig) normalize(publicUrl string) {
+	if c.Resource == "" {
+		c.Resource = publicUrl + "/mcp"
+	}
+	if len(c.Audience) == 0 {
+		c.Audience = []string{c.Resource}
+	}
+	if c.JWKSRefreshInterval == 0 {
+		c.JWKSRefreshInterval = 10 * time.Minute
+	}
+	if c.ClockSkew == 0 {
+		c.ClockSkew = time.Minute
+	}
+}
+
+func (c *OAuthConfig) validate() []error {
+	if !c.Enabled {
+		return nil
+	}
+	var errs []error
+	if c.Issuer == "" {
+		errs = append(errs, errors.New("auth.oauth.issuer 不能为空"))
+	}
+	if len(c.AuthorizationServers) == 0 {
+		errs = append(errs, errors.New("auth.oauth.authorization_servers 至少需要配置一个授权服务器"))
+	}
+	if (c.JWKSURL == "") == (c.JWKSFile == "") {
+		errs = append(errs, errors.New("auth.oauth.jwks_url 和 auth.oauth.jwks_file 必须且只能配置一个"))
+	}
+	if c.JWKSURL != "" {
+		if err := validateHttpUrl(c.JWKSURL); err != nil {
+			errs = append(errs, fmt.Errorf("auth.oauth.jwks_url 无效: %v", err))
+		}
+	}
+	for tokenScope, scopes := range c.ScopeMap {
+		for _, scope := range scopes {
+			if !slices.Contains(AllScopes, scope) {
+				errs = append(errs, fmt.Errorf("auth.oauth.scope_map.%s 包含未知权限: %s", tokenScope, scope))
+			}
+		}
+	}
+	return errs
+}
+
+// OAuthVerifier 校验 JWT 访问令牌，JWKS 按来源缓存，配置重新加载后自动使用新的来源
+type OAuthVerifier struct {
+	client *http.Client
+	// 同一来源的并发刷新只请求一次，请求 JWKS 时不持有 mu
+	group singleflight.Group
+
+	mu   sync.Mutex
+	sets map[string]*jwkSet
+}
+
+type jwkSet struct {
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+func NewOAuthVerifier() *OAuthVerifier {
+	return &OAuthVerifier{
+		client: &http.Client{Timeout: 10 * time.Second},
+		sets:   make(map[string]*jwkSet),
+	}
+}
+
+// LooksLikeJWT 判断令牌是否为 JWT 格式，用于区分 API Key 和 OAuth 访问令牌
+func LooksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Verify 校验访问令牌的签名、issuer、audience 和有效期，成功时返回调用方
+func (v *OAuthVerifier) Verify(ctx context.Context, config *OAuthConfig, token string) (*Principal, error) {
+	claims := jwt.MapClaims{}
+	parser := jwt.NewParser(
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithIssuer(config.Issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(config.ClockSkew),
+	)
+	_, err := parser.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.key(ctx, config, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("访问令牌无效: %w", err)
+	}
+
+	audience, err := claims.GetAudience()
+	if err != nil {
+		return nil, fmt.Errorf("访问令牌 aud 无效: %w", err)
+	}
+	if !slices.ContainsFunc(audience, func(aud string) bool { return slices.Contains(config.Audience, aud) }) {
+		return nil, fmt.Errorf("访问令牌 aud %v 不属于本服务", []string(audience))
+	}
+
+	// 没有 sub 的令牌无法区分调用方，会共用限流、配额和图片归属
+	subject, _ := claims.GetSubject()
+	if subject == "" {
+		return nil, errors.New("访问令牌缺少 sub")
+	}
+	expiresAt, _ := claims.GetExpirationTime()
+
+	role := config.DefaultRole
+	if config.RoleClaim != "" {
+		if claimRole, ok := claims[config.RoleClaim].(string); ok && claimRole != "" {
+			role = claimRole
+		}
+	}
+
+	return &Principal{
+		ID:        PrincipalOAuth + ":" + subject,
+		Label:     subject,
+		Kind:      PrincipalOAuth,
+		Scopes:    config.mapScopes(tokenScopes(claims)),
+		Role:      role,
+		ExpiresAt: expiresAt.Time,
+	}, nil
+}
+
+// tokenScopes 读取令牌中的 scope，兼容空格分隔的 scope 和数组形式的 scp
+func tokenScopes(claims jwt.MapClaims) []string {
+	if scope, ok := claims["scope"].(string); ok {
+		return strings.Fields(scope)
+	}
+	var scopes []string
+	if scp, ok := claims["scp"].([]any); ok {
+		for _, s := range scp {
+			if str, ok := s.(string); ok {
+				scopes = append(scopes, str)
+			}
+		}
+	}
+	return scopes
+}
+
+// key 按 kid 查找公钥，缓存过期或找不到 kid 时重新加载 JWKS；
+// 加载在锁外进行，JWKS 地址响应缓慢时不会阻塞使用缓存的其他请求
+func (v *OAuthVerifier) key(ctx context.Context, config *OAuthConfig, kid string) (crypto.PublicKey, error) {
+	source := config.JWKSURL
+	if source == "" {
+		source = config.JWKSFile
+	}
+
+	v.mu.Lock()
+	set := v.sets[source]
+	v.mu.Unlock()
+
+	stale := set == nil || time.Since(set.fetchedAt) > config.JWKSRefreshInterval
+	if !stale {
+		if key := set.find(kid); key != nil {
+			return key, nil
+		}
+		// 授权服务器可能已轮换密钥
+		stale = time.Since(set.fetchedAt) > jwksMinRefreshInterval
+	}
+
+	if stale {
+		fresh, err, _ := v.group.Do(source, func() (any, error) {
+			// 读取缓存后其他请求已完成刷新
+			v.mu.Lock()
+			current := v.sets[source]
+			v.mu.Unlock()
+			if current != set {
+				return current, nil
+			}
+			// 结果由等待同一来源的所有请求共用，不随第一个请求取消
+			fresh, err := v.load(context.WithoutCancel(ctx), config)
+			if err != nil {
+				return nil, err
+			}
+			v.mu.Lock()
+			defer v.mu.Unlock()
+			v.sets[source] = fresh
+			return fresh, nil
+		})
+		if err != nil {
+			if set == nil {
+				return nil, err
+			}
+			logrus.Warnf("刷新 JWKS 失败，继续使用缓存: %v", err)
+		} else {
+			set = fresh.(*jwkSet)
+		}
+	}
+
+	if key := set.find(kid); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("JWKS 中不存在 kid=%q 的密钥", kid)
+}
+
+func (s *jwkSet) find(kid string) crypto.PublicKey {
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key
+		}
+	}
+	return s.keys[kid]
+}
+
+func (v *OAuthVerifier) load(ctx context.Context, config *OAuthConfig) (*jwkSet, error) {
+	var data []byte
+	if config.JWKSFile != "" {
+		fileData, err := os.ReadFile(config.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("读取 JWKS 文件失败: %v", err)
+		}
+		data = fileData
+	} else {
+		req, err := http.NewRequestWithContext(ctx, "GET", config.JWKSURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("创建 JWKS 请求失败: %v", err)
+		}
+		resp, err := v.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("获取 JWKS 失败: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("获取 JWKS 失败，状态码: %d", resp.StatusCode)
+		}
+		data, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err != nil {
+			return nil, fmt.Errorf("读取 JWKS 失败: %v", err)
+		}
+	}
+
+	keys, err := ParseJWKS(data)
+	if err != nil {
+		return nil, err
+	}
+	return &jwkSet{keys: keys, fetchedAt: time.Now()}, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ParseJWKS 解析 JWK Set，支持 RSA、EC（P-256/P-384/P-521）和 OKP（Ed25519）公钥，忽略不支持的密钥
+func ParseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("解析 JWKS 失败: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		publicKey, err := key.publicKey()
+		if err != nil {
+			logrus.Warnf("忽略无效的 JWK (kid=%s): %v", key.Kid, err)
+			continue
+		}
+		keys[key.Kid] = publicKey
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS 中没有可用的签名公钥")
+	}
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("不支持的曲线: %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("公钥不在曲线上")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("不支持的曲线: %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("Ed25519 公钥无效")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("不支持的密钥类型: %s", k.Kty)
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("base64url 数值无效: %q", value)
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testIssuer   = "https://auth.example.com"
+	testResource = "https://mcp.example.com/mcp"
+)
+
+// testJWKS 在本地提供 JWKS，可以在测试中轮换密钥
+type testJWKS struct {
+	mu      sync.Mutex
+	keys    map[string]*ecdsa.PrivateKey
+	fetches atomic.Int32
+	server  *httptest.Server
+}
+
+func newTestJWKS(t *testing.T, kids ...string) *testJWKS {
+	t.Helper()
+	j := &testJWKS{keys: make(map[string]*ecdsa.PrivateKey)}
+	for _, kid := range kids {
+		j.add(t, kid)
+	}
+	j.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		j.fetches.Add(1)
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		var keys []map[string]string
+		for kid, key := range j.keys {
+			keys = append(keys, map[string]string{
+				"kty": "EC",
+				"kid": kid,
+				"use": "sig",
+				"crv": "P-256",
+				"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+				"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	}))
+	t.Cleanup(j.server.Close)
+	return j
+}
+
+func (j *testJWKS) add(t *testing.T, kid string) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.keys[kid] = key
+	return key
+}
+
+func (j *testJWKS) config() *OAuthConfig {
+	config := &OAuthConfig{
+		Enabled:              true,
+		Issuer:               testIssuer,
+		AuthorizationServers: []string{testIssuer},
+		JWKSURL:              j.server.URL,
+		ScopeMap:             map[string][]string{"images": {ScopeGenerate, ScopeReadFiles}},
+	}
+	config.normalize("https://mcp.example.com")
+	return config
+}
+
+func signToken(t *testing.T, key *ecdsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func validClaims() jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":   testIssuer,
+		"aud":   testResource,
+		"sub":   "alice",
+		"scope": "images",
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+}
+
+func TestOAuthVerifyValidToken(t *testing.T) {
+	jwks := newTestJWKS(t, "k1")
+	token := signToken(t, jwks.keys["k1"], "k1", validClaims())
+
+	principal, err := NewOAuthVerifier().Verify(context.Background(), jwks.config(), token)
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if principal.ID != "oauth:alice" || principal.Kind != PrincipalOAuth {
+		t.Errorf("principal = %+v", principal)
+	}
+	if len(principal.Scopes) != 2 || principal.Scopes[0] != ScopeGenerate || principal.Scopes[1] != ScopeReadFiles {
+		t.Errorf("scopes = %v", principal.Scopes)
+	}
+}
+
+func TestOAuthVerifyRejects(t *testing.T) {
+	jwks := newTestJWKS(t, "k1")
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	tests := []struct {
+		name   string
+		key    *ecdsa.PrivateKey
+		modify func(jwt.MapClaims)
+		want   string
+	}{
+		{"签名错误", other, nil, "signature"},
+		{"已过期", nil, func(c jwt.MapClaims) {
+			c["iat"] = time.Now().Add(-3 * time.Hour).Unix()
+			c["exp"] = time.Now().Add(-2 * time.Hour).Unix()
+		}, "expired"},
+		{"aud 不匹配", nil, func(c jwt.MapClaims) { c["aud"] = "https://other.example.com" }, "aud"},
+		{"issuer 不匹配", nil, func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }, "issuer"},
+		{"缺少 sub", nil, func(c jwt.MapClaims) { delete(c, "sub") }, "sub"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims()
+			if tt.modify != nil {
+				tt.modify(claims)
+			}
+			key := tt.key
+			if key == nil {
+				key = jwks.keys["k1"]
+			}
+			_, err := NewOAuthVerifier().Verify(context.Background(), jwks.config(), signToken(t, key, "k1", claims))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Verify() error = %v, want containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestOAuthVerifyKeyRotation(t *testing.T) {
+	jwks := newTestJWKS(t, "k1")
+	config := jwks.config()
+	verifier := NewOAuthVerifier()
+
+	if _, err := verifier.Verify(context.Background(), config, signToken(t, jwks.keys["k1"], "k1", validClaims())); err != nil {
+		t.Fatalf("Verify(k1) error = %v", err)
+	}
+
+	// 授权服务器轮换到新的 kid，缓存刚加载时不会被未知 kid 触发刷新
+	k2 := jwks.add(t, "k2")
+	token := signToken(t, k2, "k2", validClaims())
+	if _, err := verifier.Verify(context.Background(), config, token); err == nil {
+		t.Fatal("未到最小刷新间隔时不应刷新 JWKS")
+	}
+	if got := jwks.fetches.Load(); got != 1 {
+		t.Fatalf("fetches = %d, want 1", got)
+	}
+
+	verifier.mu.Lock()
+	verifier.sets[config.JWKSURL].fetchedAt = time.Now().Add(-jwksMinRefreshInterval - time.Second)
+	verifier.mu.Unlock()
+
+	if _, err := verifier.Verify(context.Background(), config, token); err != nil {
+		t.Fatalf("Verify(k2) after rotation error = %v", err)
+	}
+	if got := jwks.fetches.Load(); got != 2 {
+		t.Errorf("fetches = %d, want 2", got)
+	}
+}
+
+func TestOAuthVerifyConcurrentRefresh(t *testing.T) {
+	jwks := newTestJWKS(t, "k1")
+	config := jwks.config()
+	verifier := NewOAuthVerifier()
+	token := signToken(t, jwks.keys["k1"], "k1", validClaims())
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := verifier.Verify(context.Background(), config, token); err != nil {
+				t.Errorf("Verify() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := jwks.fetches.Load(); got != 1 {
+		t.Errorf("fetches = %d, 并发验证应共用 JWKS 请求", got)
+	}
+}
@@ -0,0 +1,258 @@
+package internal
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// RoleConfig 角色配置，限制可调用的工具和工具参数
+type RoleConfig struct {
+	// 允许调用的工具名称，支持 * 通配，为空表示不允许调用任何工具
+	Tools []string `yaml:"tools"`
+	// 工具参数约束
+	Constraints ToolConstraints `yaml:"constraints"`
+	// 覆盖全局的 limits.rate_limit 和 limits.quota
+	RateLimit *RateLimitConfig `yaml:"rate_limit"`
+	Quota     *QuotaConfig     `yaml:"quota"`
+}
+
+// ToolConstraints 工具参数约束，数值为 0 或列表为空表示不限制
+type ToolConstraints struct {
+	MaxWidth     int `yaml:"max_width"`
+	MaxHeight    int `yaml:"max_height"`
+	MaxSteps     int `yaml:"max_steps"`
+	MaxBatchSize int `yaml:"max_batch_size"`
+	MaxNIter     int `yaml:"max_n_iter"`
+	// 允许使用的模型，支持 * 通配，与模型标题或名称匹配
+	AllowedModels []string `yaml:"allowed_models"`
+	// 允许使用的后端名称
+	AllowedBackends []string `yaml:"allowed_backends"`
+}
+
+// ToolTxt2Img 生成图片的工具名称
+const ToolTxt2Img = "txt2img"
+
+// defaultBackendTools 使用后端的工具，未指定 backend 时使用第一个后端；
+// server_status 未指定时返回所有后端的状态，不在此列
+var defaultBackendTools = []string{ToolTxt2Img, "sd_models", "switch_model"}
+
+// Txt2ImgDefaults txt2img 未设置（或为 0）的参数使用的默认值，
+// 发送给 WebUI 的请求、角色约束检查和用量估算共用
+var Txt2ImgDefaults = map[string]any{
+	"width":        512,
+	"height":       512,
+	"steps":        20,
+	"sampler_name": "Euler a",
+	"cfg_scale":    7.0,
+	"batch_size":   1,
+	"n_iter":       1,
+}
+
+// ApplyTxt2ImgDefaults 为未设置的 txt2img 参数填充默认值
+func ApplyTxt2ImgDefaults(args map[string]any) {
+	for key, value := range Txt2ImgDefaults {
+		if IsUnsetArg(args[key]) {
+			args[key] = value
+		}
+	}
+}
+
+// IsUnsetArg 判断参数是否未设置：缺失、null 和零值（空字符串、0、false、空列表或对象）都视为未设置，
+// 请求结构体中没有 omitempty 的字段（如 prompt）序列化后总是存在，不能只按是否存在判断
+func IsUnsetArg(value any) bool {
+	switch value := value.(type) {
+	case nil:
+		return true
+	case string:
+		return value == ""
+	case bool:
+		return !value
+	case []any:
+		return len(value) == 0
+	case map[string]any:
+		return len(value) == 0
+	}
+	number, ok := toNumber(value)
+	return ok && number == 0
+}
+
+// PolicyError 工具调用被策略拒绝
+type PolicyError struct {
+	Tool   string
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("调用工具 %s 被拒绝: %s", e.Tool, e.Reason)
+}
+
+// Authorize 根据调用方的权限范围、角色允许的工具和参数约束判断是否允许调用工具，
+// args 为工具参数的 JSON 对象形式。允许时返回 nil，拒绝时返回 *PolicyError。
+func (c *Config) Authorize(principal *Principal, toolName string, scope string, args map[string]any) error {
+	if principal == nil {
+		return &PolicyError{Tool: toolName, Reason: "需要先进行认证"}
+	}
+	if !principal.HasScope(scope) {
+		return &PolicyError{Tool: toolName, Reason: fmt.Sprintf("需要 %s 权限", scope)}
+	}
+	if principal.Role == "" {
+		return nil
+	}
+
+	role, ok := c.Auth.Roles[principal.Role]
+	if !ok {
+		return &PolicyError{Tool: toolName, Reason: fmt.Sprintf("角色 %s 不存在", principal.Role)}
+	}
+	if !matchAny(role.Tools, toolName) {
+		return &PolicyError{Tool: toolName, Reason: fmt.Sprintf("角色 %s 不允许调用该工具", principal.Role)}
+	}
+
+	if err := role.Constraints.check(c.EffectiveArgs(toolName, args)); err != nil {
+		return &PolicyError{Tool: toolName, Reason: err.Error()}
+	}
+	return nil
+}
+
+// EffectiveArgs 合并预设参数、填充默认值并解析默认后端，使约束检查和用量估算与实际发送给 WebUI 的参数一致
+func (c *Config) EffectiveArgs(toolName string, args map[string]any) map[string]any {
+	merged := make(map[string]any, len(args))
+	if toolName == ToolTxt2Img {
+		presetName, _ := args["preset"].(string)
+		if preset, ok := c.Presets[presetName]; ok {
+			for key, value := range preset.Params {
+				merged[key] = value
+			}
+		}
+	}
+	for key, value := range args {
+		// 与 txt2img 合并预设的规则一致，未设置的参数不覆盖预设
+		if _, exists := merged[key]; exists && IsUnsetArg(value) {
+			continue
+		}
+		merged[key] = value
+	}
+
+	if toolName == ToolTxt2Img {
+		ApplyTxt2ImgDefaults(merged)
+	}
+	if backend, _ := merged["backend"].(string); backend == "" && slices.Contains(defaultBackendTools, toolName) && len(c.Backends) > 0 {
+		merged["backend"] = c.Backends[0].Name
+	}
+	return merged
+}
+
+func (c *ToolConstraints) check(args map[string]any) error {
+	maxInts := []struct {
+		key   string
+		name  string
+		limit int
+	}{
+		{"width", "图片宽度", c.MaxWidth},
+		{"height", "图片高度", c.MaxHeight},
+		{"steps", "采样步数", c.MaxSteps},
+		{"batch_size", "批次大小", c.MaxBatchSize},
+		{"n_iter", "批次数量", c.MaxNIter},
+	}
+	for _, item := range maxInts {
+		if item.limit <= 0 {
+			continue
+		}
+		if value, ok := numberArg(args, item.key); ok && value > float64(item.limit) {
+			return fmt.Errorf("%s %v 超出角色允许的上限 %d", item.name, value, item.limit)
+		}
+	}
+
+	if len(c.AllowedBackends) > 0 {
+		if backend, _ := args["backend"].(string); backend != "" && !slices.Contains(c.AllowedBackends, backend) {
+			return fmt.Errorf("不允许使用后端 %s", backend)
+		}
+	}
+
+	if len(c.AllowedModels) > 0 {
+		for _, model := range modelArgs(args) {
+			if !matchAny(c.AllowedModels, model) {
+				return fmt.Errorf("不允许使用模型 %s", model)
+			}
+		}
+	}
+	return nil
+}
+
+// modelArgs 提取参数中指定的模型：switch_model 的 sd_model_checkpoint 和 txt2img 的 override_settings
+func modelArgs(args map[string]any) []string {
+	var models []string
+	if model, _ := args["sd_model_checkpoint"].(string); model != "" {
+		models = append(models, model)
+	}
+	if overrides, ok := args["override_settings"].(map[string]any); ok {
+		if model, _ := overrides["sd_model_checkpoint"].(string); model != "" {
+			models = append(models, model)
+		}
+	}
+	return models
+}
+
+func numberArg(args map[string]any, key string) (float64, bool) {
+	return toNumber(args[key])
+}
+
+func toNumber(value any) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case int:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case uint64:
+		return float64(value), true
+	}
+	return 0, false
+}
+
+// matchAny 判断名称是否匹配任意一个模式，模式支持 * 通配；
+// 模型标题形如 "name.safetensors [hash]"，同时使用去掉哈希后的名称匹配
+func matchAny(patterns []string, name string) bool {
+	candidates := []string{name}
+	if before, _, found := strings.Cut(name, " ["); found {
+		candidates = append(candidates, before)
+	}
+	for _, pattern := range patterns {
+		for _, candidate := range candidates {
+			if matched, _ := path.Match(pattern, candidate); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *AuthConfig) validateRoles() []error {
+	var errs []error
+	for name, role := range c.Roles {
+		for _, pattern := range append(slices.Clone(role.Tools), role.Constraints.AllowedModels...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, fmt.Errorf("auth.roles.%s 包含无效的通配模式: %s", name, pattern))
+			}
+		}
+	}
+	for name, role := range c.Roles {
+		if role.RateLimit != nil {
+			errs = append(errs, role.RateLimit.validate("auth.roles."+name+".rate_limit")...)
+		}
+		if role.Quota != nil {
+			errs = append(errs, role.Quota.validate("auth.roles."+name+".quota")...)
+		}
+	}
+	for i, key := range c.Keys {
+		if _, ok := c.Roles[key.Role]; key.Role != "" && !ok {
+			errs = append(errs, fmt.Errorf("auth.keys[%d].role 不存在: %s", i, key.Role))
+		}
+	}
+	if _, ok := c.Roles[c.OAuth.DefaultRole]; c.OAuth.DefaultRole != "" && !ok {
+		errs = append(errs, fmt.Errorf("auth.oauth.default_role 不存在: %s", c.OAuth.DefaultRole))
+	}
+	return errs
+}
@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+)
+
+func testPolicyConfig() *Config {
+	return &Config{
+		Backends: []BackendConfig{{Name: "a"}, {Name: "b"}},
+		Presets: map[string]PresetConfig{
+			"large": {Params: map[string]any{"width": 1024, "height": 1024}},
+		},
+		Auth: AuthConfig{
+			Roles: map[string]RoleConfig{
+				"intern": {
+					Tools: []string{"txt2img", "sd_*", "switch_model"},
+					Constraints: ToolConstraints{
+						MaxWidth:        768,
+						MaxSteps:        10,
+						MaxBatchSize:    2,
+						AllowedModels:   []string{"v1-5-*"},
+						AllowedBackends: []string{"b"},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	config := testPolicyConfig()
+	intern := &Principal{ID: "api_key:intern", Scopes: []string{ScopeGenerate}, Role: "intern"}
+
+	tests := []struct {
+		name    string
+		tool    string
+		scope   string
+		args    map[string]any
+		allowed bool
+	}{
+		{"满足约束", "txt2img", ScopeGenerate, map[string]any{"steps": 8.0, "backend": "b"}, true},
+		{"超出步数", "txt2img", ScopeGenerate, map[string]any{"steps": 30.0, "backend": "b"}, false},
+		// 省略 steps 时使用默认值 20，同样超出 max_steps
+		{"省略步数使用默认值", "txt2img", ScopeGenerate, map[string]any{"backend": "b"}, false},
+		{"步数为 0 使用默认值", "txt2img", ScopeGenerate, map[string]any{"steps": 0.0, "backend": "b"}, false},
+		// 省略 backend 时使用第一个后端 a，不在允许列表中
+		{"省略后端使用默认后端", "txt2img", ScopeGenerate, map[string]any{"steps": 8.0}, false},
+		{"预设参数超出宽度", "txt2img", ScopeGenerate, map[string]any{"steps": 8.0, "backend": "b", "preset": "large"}, false},
+		{"显式参数覆盖预设", "txt2img", ScopeGenerate, map[string]any{"steps": 8.0, "backend": "b", "preset": "large", "width": 512.0}, true},
+		{"不允许的模型", "switch_model", ScopeGenerate, map[string]any{"sd_model_checkpoint": "sdxl.safetensors [abc]", "backend": "b"}, false},
+		{"允许的模型", "switch_model", ScopeGenerate, map[string]any{"sd_model_checkpoint": "v1-5-pruned.safetensors [abc]", "backend": "b"}, true},
+		{"switch_model 省略后端", "switch_model", ScopeGenerate, map[string]any{"sd_model_checkpoint": "v1-5-pruned.safetensors"}, false},
+		// 非 txt2img 工具不填充生成参数的默认值
+		{"通配工具", "sd_models", ScopeGenerate, map[string]any{"backend": "b"}, true},
+		{"角色不允许的工具", "list_images", ScopeReadFiles, map[string]any{}, false},
+		{"缺少权限", "txt2img", ScopeAdmin, map[string]any{"steps": 8.0, "backend": "b"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := config.Authorize(intern, tt.tool, tt.scope, tt.args)
+			if tt.allowed && err != nil {
+				t.Errorf("Authorize() error = %v, want allowed", err)
+			}
+			var policyErr *PolicyError
+			if !tt.allowed && !errors.As(err, &policyErr) {
+				t.Errorf("Authorize() error = %v, want *PolicyError", err)
+			}
+		})
+	}
+}
+
+func TestAuthorizeWithoutRole(t *testing.T) {
+	config := testPolicyConfig()
+	user := &Principal{ID: "api_key:user", Scopes: []string{ScopeGenerate}}
+	if err := config.Authorize(user, "txt2img", ScopeGenerate, map[string]any{"steps": 100.0}); err != nil {
+		t.Errorf("没有角色时只检查权限范围, error = %v", err)
+	}
+	if err := config.Authorize(nil, "txt2img", ScopeGenerate, nil); err == nil {
+		t.Error("未认证的调用方应被拒绝")
+	}
+	if err := config.Authorize(&Principal{Role: "missing", Scopes: []string{ScopeAdmin}}, "txt2img", ScopeGenerate, nil); err == nil {
+		t.Error("角色不存在时应被拒绝")
+	}
+}
+
+func TestEffectiveArgs(t *testing.T) {
+	config := testPolicyConfig()
+	// 零值视为未设置，使用预设的值；显式传入的值优先于预设
+	args := config.EffectiveArgs(ToolTxt2Img, map[string]any{"preset": "large", "width": 0.0, "height": 768.0, "steps": 0.0, "sampler_name": ""})
+	want := map[string]any{"width": 1024, "height": 768.0, "steps": 20, "sampler_name": "Euler a", "batch_size": 1, "n_iter": 1, "backend": "a"}
+	for key, value := range want {
+		if args[key] != value {
+			t.Errorf("%s = %v, want %v", key, args[key], value)
+		}
+	}
+
+	// server_status 未指定后端时返回所有后端，不解析默认后端
+	if backend, ok := config.EffectiveArgs("server_status", map[string]any{})["backend"]; ok {
+		t.Errorf("server_status backend = %v, want unset", backend)
+	}
+}
@@ -0,0 +1,476 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// ProvenanceSuffix 溯源清单旁路文件的后缀，如 2006-01-02/uuid.png.provenance.json
+	ProvenanceSuffix = ".provenance.json"
+
+	provenanceVersion = "1"
+	// IPTC 数字来源类型：由训练的算法模型生成的媒体
+	digitalSourceTypeAI = "http://cv.iptc.org/newscodes/digitalsourcetype/trainedAlgorithmicMedia"
+	// PNG 文本块关键字
+	pngProvenanceKeyword = "provenance"
+	// JPEG APP11 段的标识
+	jpegProvenanceHeader = "sdmcp-provenance\x00"
+	// WebP 扩展格式中的 RIFF 块
+	webpProvenanceChunk = "PROV"
+)
+
+// ProvenanceConfig 生成图片的溯源清单，启用后保存图片时写入 Ed25519 签名的清单（嵌入图片并保存旁路文件）
+type ProvenanceConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Ed25519 私钥文件（PKCS#8 PEM），可通过 provenance-keygen 子命令生成
+	PrivateKeyFile string `yaml:"private_key_file"`
+	// 写入清单的服务标识，默认为 server.public_url
+	ServerID string `yaml:"server_id"`
+	// 验证时额外信任的公钥（base64），本服务的公钥总是受信任
+	TrustedKeys []string `yaml:"trusted_keys"`
+}
+
+func (c *ProvenanceConfig) normalize(publicURL string) {
+	if c.ServerID == "" {
+		c.ServerID = publicURL
+	}
+}
+
+func (c *ProvenanceConfig) validate() []error {
+	var errs []error
+	if c.Enabled && c.PrivateKeyFile == "" {
+		errs = append(errs, errors.New("启用 provenance 时必须配置 provenance.private_key_file"))
+	}
+	for _, key := range c.TrustedKeys {
+		if _, err := parsePublicKey(key); err != nil {
+			errs = append(errs, fmt.Errorf("provenance.trusted_keys 无效: %v", err))
+		}
+	}
+	return errs
+}
+
+// ProvenanceManifest 溯源清单，签名覆盖除 signature 以外的全部字段
+type ProvenanceManifest struct {
+	Version        string `json:"version"`
+	ClaimGenerator string `json:"claim_generator"`
+	// 声明图片由 AI 生成
+	AIGenerated       bool      `json:"ai_generated"`
+	DigitalSourceType string    `json:"digital_source_type"`
+	CreatedAt         time.Time `json:"created_at"`
+	ServerID          string    `json:"server_id"`
+	ImageID           string    `json:"image_id,omitempty"`
+	RequestID         string    `json:"request_id,omitempty"`
+	Model             string    `json:"model,omitempty"`
+	ModelHash         string    `json:"model_hash,omitempty"`
+	ContentType       string    `json:"content_type"`
+	// 嵌入清单之前的图片内容摘要，格式为 sha256:<hex>
+	ContentHash string               `json:"content_hash"`
+	Signature   *ProvenanceSignature `json:"signature,omitempty"`
+}
+
+// ProvenanceSignature 清单签名
+type ProvenanceSignature struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"key_id"`
+	PublicKey string `json:"public_key"`
+	Value     string `json:"value"`
+}
+
+// signingPayload 返回签名覆盖的内容：不含 signature 字段的清单 JSON
+func (m *ProvenanceManifest) signingPayload() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = nil
+	return json.Marshal(&unsigned)
+}
+
+// ProvenanceReport 溯源验证结果
+type ProvenanceReport struct {
+	// 清单来源: embedded（图片中嵌入）或 sidecar（旁路文件）
+	Source string `json:"source,omitempty"`
+	// 签名与清单内容一致
+	SignatureValid bool `json:"signature_valid"`
+	// 签名公钥为本服务或受信任的公钥
+	TrustedKey bool `json:"trusted_key"`
+	// 图片内容与清单中的摘要一致
+	ContentHashMatch bool `json:"content_hash_match"`
+	// 以上检查全部通过
+	Valid    bool                `json:"valid"`
+	Problems []string            `json:"problems,omitempty"`
+	Manifest *ProvenanceManifest `json:"manifest,omitempty"`
+}
+
+// ProvenanceSigner 使用配置中的 Ed25519 私钥签名和验证溯源清单，私钥文件修改后自动重新加载
+type ProvenanceSigner struct {
+	config *ConfigStore
+
+	mu   sync.Mutex
+	keys map[string]*provenanceKey
+}
+
+type provenanceKey struct {
+	modTime time.Time
+	key     ed25519.PrivateKey
+}
+
+func NewProvenanceSigner(config *ConfigStore) *ProvenanceSigner {
+	return &ProvenanceSigner{
+		config: config,
+		keys:   make(map[string]*provenanceKey),
+	}
+}
+
+// Enabled 返回是否启用溯源清单
+func (s *ProvenanceSigner) Enabled() bool {
+	return s.config.Get().Provenance.Enabled
+}
+
+// privateKey 读取私钥，按文件修改时间缓存
+func (s *ProvenanceSigner) privateKey(path string) (ed25519.PrivateKey, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取溯源签名私钥失败: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cached := s.keys[path]; cached != nil && cached.modTime.Equal(info.ModTime()) {
+		return cached.key, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取溯源签名私钥失败: %v", err)
+	}
+	key, err := ParseProvenancePrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	s.keys[path] = &provenanceKey{modTime: info.ModTime(), key: key}
+	return key, nil
+}
+
+// Sign 为图片生成签名清单并嵌入图片，返回嵌入清单后的图片和清单 JSON
+func (s *ProvenanceSigner) Sign(data []byte, record *ImageRecord) ([]byte, []byte, error) {
+	config := s.config.Get().Provenance
+	key, err := s.privateKey(config.PrivateKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	manifest := &ProvenanceManifest{
+		Version:           provenanceVersion,
+		ClaimGenerator:    "stable-diffusion-webui-mcp",
+		AIGenerated:       true,
+		DigitalSourceType: digitalSourceTypeAI,
+		CreatedAt:         record.CreatedAt.UTC(),
+		ServerID:          config.ServerID,
+		ImageID:           record.ID,
+		RequestID:         record.RequestID,
+		Model:             record.Model,
+		ModelHash:         record.ModelHash,
+		ContentType:       record.ContentType,
+		ContentHash:       "sha256:" + hex.EncodeToString(sum[:]),
+	}
+	payload, err := manifest.signingPayload()
+	if err != nil {
+		return nil, nil, err
+	}
+	publicKey := key.Public().(ed25519.PublicKey)
+	manifest.Signature = &ProvenanceSignature{
+		Algorithm: "Ed25519",
+		KeyID:     ProvenanceKeyID(publicKey),
+		PublicKey: base64.StdEncoding.EncodeToString(publicKey),
+		Value:     base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload)),
+	}
+
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, nil, err
+	}
+	signed, err := embedProvenance(data, manifestJSON)
+	if err != nil {
+		return nil, nil, err
+	}
+	return signed, manifestJSON, nil
+}
+
+// Verify 验证图片的溯源清单，sidecar 不为空时使用旁路清单，否则使用图片中嵌入的清单
+func (s *ProvenanceSigner) Verify(data []byte, sidecar []byte) (*ProvenanceReport, error) {
+	embedded, stripped, err := extractProvenance(data)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ProvenanceReport{}
+	manifestJSON := embedded
+	report.Source = "embedded"
+	if len(sidecar) > 0 {
+		manifestJSON = sidecar
+		report.Source = "sidecar"
+	}
+	if manifestJSON == nil {
+		report.Source = ""
+		report.Problems = append(report.Problems, "图片中没有溯源清单")
+		return report, nil
+	}
+
+	var manifest ProvenanceManifest
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		return nil, fmt.Errorf("解析溯源清单失败: %v", err)
+	}
+	report.Manifest = &manifest
+
+	sum := sha256.Sum256(stripped)
+	report.ContentHashMatch = manifest.ContentHash == "sha256:"+hex.EncodeToString(sum[:])
+	if !report.ContentHashMatch {
+		report.Problems = append(report.Problems, "图片内容与清单中的摘要不一致")
+	}
+
+	publicKey, err := s.verifySignature(&manifest)
+	if err != nil {
+		report.Problems = append(report.Problems, err.Error())
+	} else {
+		report.SignatureValid = true
+		report.TrustedKey = s.trusted(publicKey)
+		if !report.TrustedKey {
+			report.Problems = append(report.Problems, "签名公钥不受信任: "+manifest.Signature.KeyID)
+		}
+	}
+
+	report.Valid = report.SignatureValid && report.TrustedKey && report.ContentHashMatch
+	return report, nil
+}
+
+func (s *ProvenanceSigner) verifySignature(manifest *ProvenanceManifest) (ed25519.PublicKey, error) {
+	if manifest.Signature == nil {
+		return nil, errors.New("清单没有签名")
+	}
+	if manifest.Signature.Algorithm != "Ed25519" {
+		return nil, fmt.Errorf("不支持的签名算法: %s", manifest.Signature.Algorithm)
+	}
+	publicKey, err := parsePublicKey(manifest.Signature.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.StdEncoding.DecodeString(manifest.Signature.Value)
+	if err != nil {
+		return nil, errors.New("签名格式错误")
+	}
+	payload, err := manifest.signingPayload()
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(publicKey, payload, signature) {
+		return nil, errors.New("签名与清单内容不一致")
+	}
+	return publicKey, nil
+}
+
+// trusted 返回公钥是否为本服务的公钥或配置中信任的公钥
+func (s *ProvenanceSigner) trusted(publicKey ed25519.PublicKey) bool {
+	config := s.config.Get().Provenance
+	if config.PrivateKeyFile != "" {
+		if key, err := s.privateKey(config.PrivateKeyFile); err == nil && publicKey.Equal(key.Public()) {
+			return true
+		}
+	}
+	for _, trusted := range config.TrustedKeys {
+		if key, err := parsePublicKey(trusted); err == nil && publicKey.Equal(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// GenerateProvenanceKey 生成 Ed25519 私钥，返回 PKCS#8 PEM 和 base64 公钥
+func GenerateProvenanceKey() ([]byte, string, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), base64.StdEncoding.EncodeToString(publicKey), nil
+}
+
+// ParseProvenancePrivateKey 解析 PKCS#8 PEM 格式的 Ed25519 私钥
+func ParseProvenancePrivateKey(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("溯源签名私钥不是 PEM 格式")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("解析溯源签名私钥失败: %v", err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("溯源签名私钥不是 Ed25519 密钥")
+	}
+	return privateKey, nil
+}
+
+// ProvenanceKeyID 返回公钥标识：公钥 SHA-256 的前 8 字节
+func ProvenanceKeyID(publicKey ed25519.PublicKey) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:8])
+}
+
+func parsePublicKey(value string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("无效的 Ed25519 公钥: %s", value)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// embedProvenance 将清单嵌入图片：PNG 写入 provenance 文本块，JPEG 写入 APP11 段，WebP 追加 PROV 块；
+// 移除嵌入的清单后得到原始图片，用于验证内容摘要
+func embedProvenance(data []byte, manifest []byte) ([]byte, error) {
+	switch detectImageFormat(data) {
+	case FormatPNG:
+		var buf bytes.Buffer
+		// IHDR 固定为签名之后的第一个块，长度为 13
+		const ihdrEnd = 8 + 12 + 13
+		buf.Write(data[:ihdrEnd])
+		writePNGText(&buf, pngProvenanceKeyword, string(manifest))
+		buf.Write(data[ihdrEnd:])
+		return buf.Bytes(), nil
+	case FormatJPEG:
+		payload := append([]byte(jpegProvenanceHeader), manifest...)
+		if len(payload)+2 > 0xFFFF {
+			return nil, errors.New("溯源清单过大")
+		}
+		// JFIF（APP0）和 Exif（APP1）要求紧跟在 SOI 之后，APP11 段插入到它们之后
+		offset := 2
+		for offset+4 <= len(data) && data[offset] == 0xFF && (data[offset+1] == 0xE0 || data[offset+1] == 0xE1) {
+			end := offset + 2 + int(binary.BigEndian.Uint16(data[offset+2:offset+4]))
+			if end > len(data) {
+				break
+			}
+			offset = end
+		}
+		var buf bytes.Buffer
+		buf.Write(data[:offset])
+		buf.Write([]byte{0xFF, 0xEB})
+		_ = binary.Write(&buf, binary.BigEndian, uint16(len(payload)+2))
+		buf.Write(payload)
+		buf.Write(data[offset:])
+		return buf.Bytes(), nil
+	case FormatWebP:
+		// 只有扩展格式（VP8X）允许包含其他块
+		if len(data) < 16 || string(data[12:16]) != "VP8X" {
+			return nil, errors.New("WebP 不是扩展格式，无法嵌入溯源清单")
+		}
+		var body bytes.Buffer
+		body.Write(data[8:])
+		writeRiffChunk(&body, webpProvenanceChunk, manifest)
+		var buf bytes.Buffer
+		buf.WriteString("RIFF")
+		_ = binary.Write(&buf, binary.LittleEndian, uint32(body.Len()))
+		buf.Write(body.Bytes())
+		return buf.Bytes(), nil
+	}
+	return nil, errors.New("不支持的图片格式，无法嵌入溯源清单")
+}
+
+// extractProvenance 返回图片中嵌入的清单（没有时为 nil）和移除清单后的图片
+func extractProvenance(data []byte) ([]byte, []byte, error) {
+	switch detectImageFormat(data) {
+	case FormatPNG:
+		for offset := 8; offset+12 <= len(data); {
+			length := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+			end := offset + 12 + length
+			if end > len(data) {
+				break
+			}
+			chunkType := string(data[offset+4 : offset+8])
+			if chunkType == "tEXt" || chunkType == "iTXt" {
+				keyword, text, _ := bytes.Cut(data[offset+8:offset+8+length], []byte{0})
+				if string(keyword) == pngProvenanceKeyword {
+					if chunkType == "iTXt" && len(text) >= 4 {
+						// 跳过压缩标志、压缩方法、语言标签和翻译后的关键字
+						_, text, _ = bytes.Cut(text[2:], []byte{0})
+						_, text, _ = bytes.Cut(text, []byte{0})
+					}
+					return text, concat(data[:offset], data[end:]), nil
+				}
+			}
+			if chunkType == "IDAT" {
+				break
+			}
+			offset = end
+		}
+		return nil, data, nil
+	case FormatJPEG:
+		for offset := 2; offset+4 <= len(data) && data[offset] == 0xFF; {
+			marker := data[offset+1]
+			if marker == 0xDA || marker == 0xD9 {
+				break
+			}
+			end := offset + 2 + int(binary.BigEndian.Uint16(data[offset+2:offset+4]))
+			if end > len(data) {
+				break
+			}
+			segment := data[offset+4 : end]
+			if marker == 0xEB && bytes.HasPrefix(segment, []byte(jpegProvenanceHeader)) {
+				return segment[len(jpegProvenanceHeader):], concat(data[:offset], data[end:]), nil
+			}
+			offset = end
+		}
+		return nil, data, nil
+	case FormatWebP:
+		for offset := 12; offset+8 <= len(data); {
+			size := int(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+			end := offset + 8 + size + size%2
+			if end > len(data) {
+				break
+			}
+			if string(data[offset:offset+4]) == webpProvenanceChunk {
+				stripped := concat(data[:offset], data[end:])
+				binary.LittleEndian.PutUint32(stripped[4:8], uint32(len(stripped)-8))
+				return data[offset+8 : offset+8+size], stripped, nil
+			}
+			offset = end
+		}
+		return nil, data, nil
+	}
+	return nil, nil, errors.New("不支持的图片格式")
+}
+
+// detectImageFormat 根据文件头识别图片格式
+func detectImageFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return FormatPNG
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		return FormatJPEG
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return FormatWebP
+	}
+	return ""
+}
+
+func concat(parts ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, part := range parts {
+		buf.Write(part)
+	}
+	return buf.Bytes()
+}
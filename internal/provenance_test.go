@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	_ "image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/gen2brain/webp"
+)
+
+// newTestProvenanceSigner 生成临时私钥并返回签名器和 base64 公钥
+func newTestProvenanceSigner(t *testing.T, trustedKeys ...string) (*ProvenanceSigner, string) {
+	t.Helper()
+	pemData, publicKey, err := GenerateProvenanceKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "provenance.pem")
+	if err := os.WriteFile(keyFile, pemData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer := NewProvenanceSigner(newTestConfigStore(t, func(c *Config) {
+		c.Provenance = ProvenanceConfig{Enabled: true, PrivateKeyFile: keyFile, ServerID: "https://img.example.com", TrustedKeys: trustedKeys}
+	}))
+	return signer, publicKey
+}
+
+func testEncodedImage(t *testing.T, format string) []byte {
+	t.Helper()
+	record := &ImageRecord{Prompt: "a cat", Model: "v1-5-pruned", Seed: 42, Width: 64, Height: 64}
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, testImage(64, 64, 3)); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := EncodeImage(pngData.Bytes(), OutputConfig{Format: format, Quality: 90}, NewImageMetadata(record, true))
+	if err != nil {
+		t.Fatalf("EncodeImage(%s) error = %v", format, err)
+	}
+	return encoded.Data
+}
+
+func TestProvenanceSignVerify(t *testing.T) {
+	signer, _ := newTestProvenanceSigner(t)
+
+	for _, format := range []string{FormatPNG, FormatJPEG, FormatWebP} {
+		t.Run(format, func(t *testing.T) {
+			data := testEncodedImage(t, format)
+			record := &ImageRecord{ID: "img-1", RequestID: "req-1", Model: "v1-5-pruned", ContentType: ContentTypeByKey("a." + format), CreatedAt: time.Now()}
+
+			signed, manifestJSON, err := signer.Sign(data, record)
+			if err != nil {
+				t.Fatalf("Sign() error = %v", err)
+			}
+			if _, _, err := image.Decode(bytes.NewReader(signed)); err != nil {
+				t.Fatalf("嵌入清单后图片无法解码: %v", err)
+			}
+
+			// 移除嵌入的清单后得到原始图片
+			embedded, stripped, err := extractProvenance(signed)
+			if err != nil || !bytes.Equal(embedded, manifestJSON) || !bytes.Equal(stripped, data) {
+				t.Fatalf("extractProvenance() embedded = %v, stripped = %v, error = %v", bytes.Equal(embedded, manifestJSON), bytes.Equal(stripped, data), err)
+			}
+
+			for _, sidecar := range [][]byte{nil, manifestJSON} {
+				report, err := signer.Verify(signed, sidecar)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !report.Valid || report.Manifest.ImageID != "img-1" || !report.Manifest.AIGenerated {
+					t.Errorf("Verify() source = %s, report = %+v", report.Source, report)
+				}
+			}
+		})
+	}
+}
+
+// JPEG 的 APP11 段位于 JFIF/Exif 段之后
+func TestProvenanceJPEGSegmentOrder(t *testing.T) {
+	signer, _ := newTestProvenanceSigner(t)
+	data := testEncodedImage(t, FormatJPEG)
+
+	signed, _, err := signer.Sign(data, &ImageRecord{ID: "img-1", ContentType: "image/jpeg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var markers []byte
+	for offset := 2; offset+4 <= len(signed) && signed[offset] == 0xFF && signed[offset+1] != 0xDA; {
+		markers = append(markers, signed[offset+1])
+		offset += 2 + int(binary.BigEndian.Uint16(signed[offset+2:offset+4]))
+	}
+	app11 := bytes.IndexByte(markers, 0xEB)
+	if app11 < 0 {
+		t.Fatalf("markers = %x, 没有 APP11 段", markers)
+	}
+	for _, marker := range markers[:app11] {
+		if marker != 0xE0 && marker != 0xE1 {
+			t.Fatalf("markers = %x, APP11 之前只应有 APP0/APP1", markers)
+		}
+	}
+	if bytes.IndexByte(markers[app11:], 0xE1) >= 0 || bytes.IndexByte(markers[app11:], 0xE0) >= 0 {
+		t.Fatalf("markers = %x, APP0/APP1 应位于 APP11 之前", markers)
+	}
+}
+
+func TestProvenanceVerifyRejects(t *testing.T) {
+	signer, _ := newTestProvenanceSigner(t)
+	data := testEncodedImage(t, FormatPNG)
+	signed, manifestJSON, err := signer.Sign(data, &ImageRecord{ID: "img-1", Model: "v1-5-pruned", ContentType: "image/png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 修改清单内容
+	var manifest ProvenanceManifest
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	manifest.Model = "other"
+	tampered, _ := json.Marshal(&manifest)
+	report, err := signer.Verify(signed, tampered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Valid || report.SignatureValid || !report.ContentHashMatch {
+		t.Errorf("修改清单 report = %+v", report)
+	}
+
+	// 修改图片内容
+	report, err = signer.Verify(testEncodedImage(t, FormatPNG)[:len(data)-1], manifestJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Valid || report.ContentHashMatch || !report.SignatureValid {
+		t.Errorf("修改图片 report = %+v", report)
+	}
+
+	// 没有清单
+	report, err = signer.Verify(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Valid || report.Source != "" || len(report.Problems) == 0 {
+		t.Errorf("没有清单 report = %+v", report)
+	}
+}
+
+func TestProvenanceTrustedKeys(t *testing.T) {
+	other, otherPublicKey := newTestProvenanceSigner(t)
+	signed, _, err := other.Sign(testEncodedImage(t, FormatPNG), &ImageRecord{ID: "img-1", ContentType: "image/png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, _ := newTestProvenanceSigner(t)
+	report, err := signer.Verify(signed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Valid || !report.SignatureValid || report.TrustedKey {
+		t.Errorf("其他服务的签名 report = %+v", report)
+	}
+
+	trusting, _ := newTestProvenanceSigner(t, otherPublicKey)
+	report, err = trusting.Verify(signed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Valid {
+		t.Errorf("trusted_keys 中的公钥 report = %+v", report)
+	}
+}
@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimiterIdleTTL 超过该时间未使用的令牌桶会被清理
+const rateLimiterIdleTTL = time.Hour
+
+// RateLimitConfig 令牌桶限流配置，RequestsPerMinute 为 0 表示不限流
+type RateLimitConfig struct {
+	// 每分钟补充的令牌数
+	RequestsPerMinute float64 `yaml:"requests_per_minute" json:"requests_per_minute"`
+	// 桶容量，允许的突发请求数，默认等于每分钟请求数
+	Burst int `yaml:"burst" json:"burst"`
+}
+
+func (c *RateLimitConfig) validate(name string) []error {
+	if c.RequestsPerMinute < 0 || c.Burst < 0 {
+		return []error{fmt.Errorf("%s 不能为负数", name)}
+	}
+	return nil
+}
+
+func (c *RateLimitConfig) capacity() float64 {
+	if c.Burst > 0 {
+		return float64(c.Burst)
+	}
+	return math.Max(1, c.RequestsPerMinute)
+}
+
+// RateLimitError 请求超出限流
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("请求过于频繁，请在 %d 秒后重试", RetryAfterSeconds(e.RetryAfter))
+}
+
+// RetryAfterSeconds 将等待时间向上取整为秒，用于 Retry-After
+func RetryAfterSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
+
+// RetryAfter 从限流或配额错误中获取建议的重试等待时间
+func RetryAfter(err error) (time.Duration, bool) {
+	var rateErr *RateLimitError
+	if errors.As(err, &rateErr) {
+		return rateErr.RetryAfter, true
+	}
+	var quotaErr *QuotaError
+	if errors.As(err, &quotaErr) {
+		return quotaErr.RetryAfter, true
+	}
+	return 0, false
+}
+
+// RateLimiter 按调用方（API Key、OAuth 用户或会话）维护的令牌桶限流器
+type RateLimiter struct {
+	mu          sync.Mutex
+	buckets     map[string]*tokenBucket
+	lastCleanup time.Time
+}
+
+type tokenBucket struct {
+	tokens   float64
+	updated  time.Time
+	lastUsed time.Time
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		buckets:     make(map[string]*tokenBucket),
+		lastCleanup: time.Now(),
+	}
+}
+
+// Allow 尝试消耗一个令牌，超出限流时返回 *RateLimitError
+func (l *RateLimiter) Allow(key string, config RateLimitConfig) error {
+	if config.RequestsPerMinute <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.cleanup(now)
+
+	capacity := config.capacity()
+	ratePerSecond := config.RequestsPerMinute / 60
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: capacity, updated: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(capacity, bucket.tokens+now.Sub(bucket.updated).Seconds()*ratePerSecond)
+	bucket.updated = now
+	bucket.lastUsed = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / ratePerSecond * float64(time.Second))
+		return &RateLimitError{RetryAfter: wait}
+	}
+	bucket.tokens--
+	return nil
+}
+
+func (l *RateLimiter) cleanup(now time.Time) {
+	if now.Sub(l.lastCleanup) < rateLimiterIdleTTL {
+		return
+	}
+	l.lastCleanup = now
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.lastUsed) > rateLimiterIdleTTL {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// unindexedGracePeriod 没有元数据记录的对象在创建后该时间内不会被清理，避免删除正在写入记录的图片
+const unindexedGracePeriod = time.Hour
+
+// RetentionConfig 图片保留策略，数值为 0 表示不限制，置顶（pinned）的图片不会被清理
+type RetentionConfig struct {
+	// 启用后台定期清理
+	Enabled bool `yaml:"enabled"`
+	// 清理间隔，默认 1 小时
+	Interval time.Duration `yaml:"interval"`
+	// 只输出清理报告，不删除图片
+	DryRun bool `yaml:"dry_run"`
+	// 图片最长保留时间
+	MaxAge time.Duration `yaml:"max_age"`
+	// 所有图片的总大小上限，超出时从最旧的图片开始清理
+	MaxTotalBytes ByteSize `yaml:"max_total_bytes"`
+	// 每个调用方的图片总大小上限
+	MaxBytesPerUser ByteSize `yaml:"max_bytes_per_user"`
+}
+
+func (c *RetentionConfig) normalize() {
+	if c.Interval == 0 {
+		c.Interval = time.Hour
+	}
+}
+
+func (c *RetentionConfig) validate() []error {
+	if c.Interval < 0 || c.MaxAge < 0 || c.MaxTotalBytes < 0 || c.MaxBytesPerUser < 0 {
+		return []error{errors.New("retention 中的时间和大小不能为负数")}
+	}
+	return nil
+}
+
+// ByteSize 字节数，配置中可以使用整数或带单位的字符串，如 500MB、10GiB（单位按 1024 计算）
+type ByteSize int64
+
+func (b *ByteSize) UnmarshalYAML(unmarshal func(any) error) error {
+	var n int64
+	if err := unmarshal(&n); err == nil {
+		*b = ByteSize(n)
+		return nil
+	}
+	var raw string
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	size, err := ParseByteSize(raw)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+// ParseByteSize 解析带单位的字节数，支持 B、K/KB/KiB、M/MB/MiB、G/GB/GiB、T/TB/TiB
+func ParseByteSize(raw string) (ByteSize, error) {
+	s := strings.ToUpper(strings.TrimSpace(raw))
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i == -1 {
+		i = len(s)
+	}
+	number, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("无效的大小: %s", raw)
+	}
+	unit := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(s[i:]), "B"), "I")
+	multipliers := map[string]float64{"": 1, "K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+	multiplier, ok := multipliers[unit]
+	if !ok {
+		return 0, fmt.Errorf("无效的大小单位: %s", raw)
+	}
+	return ByteSize(number * multiplier), nil
+}
+
+func (b ByteSize) String() string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	size := float64(b)
+	i := 0
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", int64(b))
+	}
+	return fmt.Sprintf("%.1f %s", size, units[i])
+}
+
+// GCItem 被清理（或 dry-run 时将被清理）的图片
+type GCItem struct {
+	ID        string    `json:"id,omitempty"`
+	Key       string    `json:"key"`
+	BlobKey   string    `json:"blob_key,omitempty"`
+	Principal string    `json:"principal,omitempty"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+	Reason    string    `json:"reason"`
+	// 实际释放的空间，去重存储的内容仍被其他图片引用时为 0
+	Freed int64 `json:"freed"`
+}
+
+// GCReport 一次清理的结果
+type GCReport struct {
+	DryRun     bool      `json:"dry_run"`
+	StartedAt  time.Time `json:"started_at"`
+	Scanned    int       `json:"scanned"`
+	TotalBytes int64     `json:"total_bytes"`
+	Pinned     int       `json:"pinned"`
+	Deleted    []GCItem  `json:"deleted"`
+	FreedBytes int64     `json:"freed_bytes"`
+	Errors     []string  `json:"errors,omitempty"`
+}
+
+// RetentionSweeper 按保留策略清理图片，同时删除存储中的图片和元数据记录
+type RetentionSweeper struct {
+	config  *ConfigStore
+	storage Storage
+	index   *ImageIndex
+}
+
+func NewRetentionSweeper(config *ConfigStore, storage Storage, index *ImageIndex) *RetentionSweeper {
+	return &RetentionSweeper{
+		config:  config,
+		storage: storage,
+		index:   index,
+	}
+}
+
+// Run 按 retention.interval 定期清理，直到 ctx 结束；未启用时只等待配置变化
+func (s *RetentionSweeper) Run(ctx context.Context) {
+	for {
+		config := s.config.Get().Retention
+		if config.Enabled {
+			report, err := s.Sweep(ctx, config, config.DryRun)
+			if err != nil {
+				logrus.Errorf("图片清理失败: %v", err)
+			} else {
+				logReport(report)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(config.Interval):
+		}
+	}
+}
+
+// Sweep 执行一次清理，dryRun 为 true 时只生成报告
+func (s *RetentionSweeper) Sweep(ctx context.Context, config RetentionConfig, dryRun bool) (*GCReport, error) {
+	report := &GCReport{DryRun: dryRun, StartedAt: time.Now(), Deleted: []GCItem{}}
+
+	collected, err := s.collect(ctx, report)
+	if err != nil {
+		return nil, err
+	}
+	candidates := collected.items
+
+	// 从最旧的图片开始清理
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].CreatedAt.Before(candidates[j].CreatedAt)
+	})
+
+	deleted := make(map[string]bool)
+	remove := func(item GCItem, reason string) int64 {
+		if deleted[item.Key] {
+			return 0
+		}
+		freed := item.Size
+		if item.BlobKey != "" {
+			// 去重存储的内容在最后一个引用被删除时才会释放
+			collected.blobRefs[item.BlobKey]--
+			if collected.blobRefs[item.BlobKey] > 0 {
+				freed = 0
+			}
+		}
+		item.Reason = reason
+		item.Freed = freed
+		deleted[item.Key] = true
+		report.Deleted = append(report.Deleted, item)
+		report.FreedBytes += freed
+		return freed
+	}
+
+	if config.MaxAge > 0 {
+		cutoff := report.StartedAt.Add(-config.MaxAge)
+		for _, item := range candidates {
+			if item.CreatedAt.Before(cutoff) {
+				remove(item, "max_age")
+			}
+		}
+	}
+
+	if config.MaxBytesPerUser > 0 {
+		// 置顶的图片计入调用方的用量，但不会被清理
+		usedByUser := collected.pinnedBytes
+		for _, item := range candidates {
+			if item.Principal != "" && !deleted[item.Key] {
+				usedByUser[item.Principal] += item.Size
+			}
+		}
+		for _, item := range candidates {
+			if item.Principal == "" || deleted[item.Key] || usedByUser[item.Principal] <= int64(config.MaxBytesPerUser) {
+				continue
+			}
+			usedByUser[item.Principal] -= item.Size
+			remove(item, "max_bytes_per_user")
+		}
+	}
+
+	if config.MaxTotalBytes > 0 {
+		used := report.TotalBytes - report.FreedBytes
+		for _, item := range candidates {
+			if used <= int64(config.MaxTotalBytes) {
+				break
+			}
+			if deleted[item.Key] {
+				continue
+			}
+			used -= remove(item, "max_total_bytes")
+		}
+	}
+
+	if dryRun {
+		return report, nil
+	}
+
+	for _, item := range report.Deleted {
+		if err := s.delete(ctx, item); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", item.Key, err))
+			report.FreedBytes -= item.Freed
+		}
+	}
+	return report, nil
+}
+
+type gcCandidates struct {
+	// 未置顶的图片
+	items []GCItem
+	// 每个调用方置顶图片的总大小
+	pinnedBytes map[string]int64
+	// 去重存储的内容被引用的次数
+	blobRefs map[string]int
+}
+
+// collect 收集可以清理的图片
+func (s *RetentionSweeper) collect(ctx context.Context, report *GCReport) (*gcCandidates, error) {
+	records, err := s.index.All()
+	if err != nil {
+		return nil, fmt.Errorf("读取图片索引失败: %v", err)
+	}
+
+	collected := &gcCandidates{
+		pinnedBytes: make(map[string]int64),
+		blobRefs:    make(map[string]int),
+	}
+	indexed := make(map[string]bool, len(records))
+	recordKeys := make(map[string]bool, len(records))
+	for _, record := range records {
+		recordKeys[record.Key] = true
+		report.Scanned++
+		if record.BlobKey != "" {
+			// 去重存储的内容只计算一次大小
+			if collected.blobRefs[record.BlobKey] == 0 {
+				report.TotalBytes += record.Size
+			}
+			collected.blobRefs[record.BlobKey]++
+			indexed[record.BlobKey] = true
+		} else {
+			report.TotalBytes += record.Size
+			indexed[record.Key] = true
+		}
+		if record.Pinned {
+			report.Pinned++
+			collected.pinnedBytes[record.Principal] += record.Size
+			continue
+		}
+		collected.items = append(collected.items, GCItem{
+			ID:        record.ID,
+			Key:       record.Key,
+			BlobKey:   record.BlobKey,
+			Principal: record.Principal,
+			Size:      record.Size,
+			CreatedAt: record.CreatedAt,
+		})
+	}
+
+	// 没有元数据记录的图片（如启用索引前生成的图片）和没有引用的去重内容按修改时间参与清理，不计入任何调用方
+	objects, err := s.storage.List(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("列出存储中的图片失败: %v", err)
+	}
+	for _, object := range objects {
+		if indexed[object.Key] {
+			continue
+		}
+		// 溯源清单随图片一起删除
+		if imageKey, ok := strings.CutSuffix(object.Key, ProvenanceSuffix); ok && recordKeys[imageKey] {
+			continue
+		}
+		report.Scanned++
+		report.TotalBytes += object.Size
+		if report.StartedAt.Sub(object.ModTime) < unindexedGracePeriod {
+			continue
+		}
+		collected.items = append(collected.items, GCItem{
+			Key:       object.Key,
+			Size:      object.Size,
+			CreatedAt: object.ModTime,
+		})
+	}
+	return collected, nil
+}
+
+func (s *RetentionSweeper) delete(ctx context.Context, item GCItem) error {
+	if item.ID == "" {
+		// 没有引用的去重内容在收集之后可能被新生成的图片引用，确认引用计数和删除内容在锁内完成
+		if strings.HasPrefix(item.Key, BlobPrefix) {
+			unlock := s.index.LockBlob(item.Key)
+			defer unlock()
+			refs, err := s.index.BlobRefs(item.Key)
+			if err != nil {
+				return err
+			}
+			if refs > 0 {
+				return errors.New("图片内容已被引用，跳过")
+			}
+		}
+		return s.storage.Delete(ctx, item.Key)
+	}
+
+	// 收集之后可能被置顶
+	record, err := s.index.Get(item.ID)
+	if err == nil && record.Pinned {
+		return errors.New("图片已置顶，跳过")
+	}
+
+	if err := s.deleteImage(ctx, item); err != nil {
+		return err
+	}
+	// 溯源清单删除失败时，下次清理会将其作为没有记录的文件处理
+	if err := s.storage.Delete(ctx, item.Key+ProvenanceSuffix); err != nil {
+		logrus.Warnf("删除溯源清单 %s 失败: %v", item.Key+ProvenanceSuffix, err)
+	}
+	return nil
+}
+
+// deleteImage 删除有元数据记录的图片和记录
+func (s *RetentionSweeper) deleteImage(ctx context.Context, item GCItem) error {
+	if item.BlobKey == "" {
+		// 先删除图片再删除记录，记录删除失败时下次清理会再次处理
+		if err := s.storage.Delete(ctx, item.Key); err != nil {
+			return err
+		}
+		_, err := s.index.Delete(item.ID)
+		return err
+	}
+
+	// 去重存储的图片先删除记录，内容不再被引用时再删除内容，删除记录和内容之间持有内容锁，
+	// 期间保存相同内容的图片会等待删除完成后重新上传；内容删除失败时，下次清理会将其作为没有引用的内容处理
+	unlock := s.index.LockBlob(item.BlobKey)
+	defer unlock()
+	orphanedBlob, err := s.index.Delete(item.ID)
+	if err != nil || orphanedBlob == "" {
+		return err
+	}
+	return s.storage.Delete(ctx, orphanedBlob)
+}
+
+func logReport(report *GCReport) {
+	if report.DryRun {
+		for _, item := range report.Deleted {
+			logrus.Infof("图片清理预演: 将删除 %s (%s, %s)", item.Key, item.Reason, ByteSize(item.Size))
+		}
+		logrus.Infof("图片清理预演完成: 扫描 %d 张，将删除 %d 张，释放 %s", report.Scanned, len(report.Deleted), ByteSize(report.FreedBytes))
+		return
+	}
+	for _, e := range report.Errors {
+		logrus.Warnf("删除图片失败: %s", e)
+	}
+	if len(report.Deleted) > 0 {
+		logrus.Infof("图片清理完成: 扫描 %d 张，删除 %d 张，释放 %s", report.Scanned, len(report.Deleted)-len(report.Errors), ByteSize(report.FreedBytes))
+	}
+}
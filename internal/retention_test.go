@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func saveTestImage(t *testing.T, fs *testFileService, seed uint8) *ImageRecord {
+	t.Helper()
+	record := &ImageRecord{}
+	if _, err := fs.SaveImage(context.Background(), testPNGBase64(t, seed), OutputConfig{Format: FormatPNG}, record); err != nil {
+		t.Fatalf("SaveImage() error = %v", err)
+	}
+	return record
+}
+
+func blobExists(t *testing.T, fs *testFileService, key string) bool {
+	t.Helper()
+	_, err := fs.storage.Stat(context.Background(), key)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
+func TestDedupRefcount(t *testing.T) {
+	fs := newTestFileService(t, true, nil)
+	sweeper := NewRetentionSweeper(fs.config, fs.storage, fs.index)
+	ctx := context.Background()
+
+	first := saveTestImage(t, fs, 1)
+	second := saveTestImage(t, fs, 1)
+	other := saveTestImage(t, fs, 2)
+	if first.BlobKey != second.BlobKey || first.BlobKey == other.BlobKey {
+		t.Fatalf("BlobKey = %s, %s, %s", first.BlobKey, second.BlobKey, other.BlobKey)
+	}
+	if refs, _ := fs.index.BlobRefs(first.BlobKey); refs != 2 {
+		t.Fatalf("BlobRefs = %d, want 2", refs)
+	}
+
+	// 仍被引用的内容不会被删除
+	if err := sweeper.delete(ctx, GCItem{ID: first.ID, Key: first.Key, BlobKey: first.BlobKey}); err != nil {
+		t.Fatal(err)
+	}
+	if refs, _ := fs.index.BlobRefs(first.BlobKey); refs != 1 || !blobExists(t, fs, first.BlobKey) {
+		t.Fatalf("删除一个引用后 BlobRefs = %d, exists = %v", refs, blobExists(t, fs, first.BlobKey))
+	}
+
+	if err := sweeper.delete(ctx, GCItem{ID: second.ID, Key: second.Key, BlobKey: second.BlobKey}); err != nil {
+		t.Fatal(err)
+	}
+	if refs, _ := fs.index.BlobRefs(first.BlobKey); refs != 0 || blobExists(t, fs, first.BlobKey) {
+		t.Fatal("最后一个引用删除后内容应被删除")
+	}
+	if !blobExists(t, fs, other.BlobKey) {
+		t.Fatal("其他内容不应被删除")
+	}
+}
+
+func TestSweepMaxAgeSkipsPinned(t *testing.T) {
+	fs := newTestFileService(t, true, nil)
+	sweeper := NewRetentionSweeper(fs.config, fs.storage, fs.index)
+	ctx := context.Background()
+
+	old := saveTestImage(t, fs, 1)
+	pinned := saveTestImage(t, fs, 2)
+	fresh := saveTestImage(t, fs, 3)
+	for _, record := range []*ImageRecord{old, pinned} {
+		record.CreatedAt = time.Now().Add(-48 * time.Hour)
+		if err := fs.index.Put(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fs.SetPinned(pinned.ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := sweeper.Sweep(ctx, RetentionConfig{MaxAge: 24 * time.Hour}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Deleted) != 1 || report.Deleted[0].ID != old.ID || !blobExists(t, fs, old.BlobKey) {
+		t.Fatalf("dry run Deleted = %+v", report.Deleted)
+	}
+
+	report, err = sweeper.Sweep(ctx, RetentionConfig{MaxAge: 24 * time.Hour}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Deleted) != 1 || len(report.Errors) > 0 {
+		t.Fatalf("Deleted = %+v, Errors = %v", report.Deleted, report.Errors)
+	}
+	if _, err := fs.ImageByID(old.ID); !errors.Is(err, ErrImageNotFound) || blobExists(t, fs, old.BlobKey) {
+		t.Fatal("过期图片应被删除")
+	}
+	for _, record := range []*ImageRecord{pinned, fresh} {
+		if _, err := fs.ImageByID(record.ID); err != nil || !blobExists(t, fs, record.BlobKey) {
+			t.Fatalf("图片 %s 不应被删除", record.ID)
+		}
+	}
+}
+
+// slowDeleteStorage 延迟删除，放大删除记录和删除内容之间的时间窗口
+type slowDeleteStorage struct {
+	Storage
+	delay time.Duration
+}
+
+func (s *slowDeleteStorage) Delete(ctx context.Context, key string) error {
+	time.Sleep(s.delay)
+	return s.Storage.Delete(ctx, key)
+}
+
+// 删除最后一个引用的同时保存相同内容的图片，保存成功的记录引用的内容必须存在
+func TestSaveBlobConcurrentWithDelete(t *testing.T) {
+	fs := newTestFileService(t, true, nil)
+	sweeper := NewRetentionSweeper(fs.config, &slowDeleteStorage{Storage: fs.storage, delay: 50 * time.Millisecond}, fs.index)
+	ctx := context.Background()
+
+	for range 3 {
+		existing := saveTestImage(t, fs, 7)
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sweeper.delete(ctx, GCItem{ID: existing.ID, Key: existing.Key, BlobKey: existing.BlobKey}); err != nil {
+				t.Errorf("delete() error = %v", err)
+			}
+		}()
+		// 在清理删除记录之后、删除内容之前保存
+		time.Sleep(10 * time.Millisecond)
+		saved := saveTestImage(t, fs, 7)
+		wg.Wait()
+
+		if !blobExists(t, fs, saved.BlobKey) {
+			t.Fatal("新保存的图片引用的内容已被删除")
+		}
+		if err := sweeper.delete(ctx, GCItem{ID: saved.ID, Key: saved.Key, BlobKey: saved.BlobKey}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 没有引用的内容在收集之后被新图片引用时不会被删除
+func TestUnreferencedBlobRecheck(t *testing.T) {
+	fs := newTestFileService(t, true, nil)
+	sweeper := NewRetentionSweeper(fs.config, fs.storage, fs.index)
+
+	record := saveTestImage(t, fs, 1)
+	err := sweeper.delete(context.Background(), GCItem{Key: record.BlobKey})
+	if err == nil || !blobExists(t, fs, record.BlobKey) {
+		t.Fatalf("delete() error = %v, 被引用的内容不应被删除", err)
+	}
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileURLPath 图片读取接口的路径前缀
+const FileURLPath = "/api/v1/read/file/"
+
+var (
+	ErrSignatureExpired = errors.New("链接已过期")
+	ErrSignatureInvalid = errors.New("链接签名无效")
+)
+
+// SignedURLConfig 图片链接签名配置
+type SignedURLConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// HMAC 密钥，至少 32 个字符
+	Secret string `yaml:"secret"`
+	// 链接默认有效期，默认 24 小时
+	TTL time.Duration `yaml:"ttl"`
+	// 重新签名时允许指定的最长有效期，默认 7 天
+	MaxTTL time.Duration `yaml:"max_ttl"`
+}
+
+func (c *SignedURLConfig) normalize() {
+	if c.TTL == 0 {
+		c.TTL = 24 * time.Hour
+	}
+	if c.MaxTTL == 0 {
+		c.MaxTTL = 7 * 24 * time.Hour
+	}
+}
+
+func (c *SignedURLConfig) validate() []error {
+	if !c.Enabled {
+		return nil
+	}
+	var errs []error
+	if len(c.Secret) < 32 {
+		errs = append(errs, errors.New("auth.signed_urls.secret 至少需要 32 个字符"))
+	}
+	if c.TTL < 0 || c.MaxTTL < 0 {
+		errs = append(errs, errors.New("auth.signed_urls.ttl 和 max_ttl 不能为负数"))
+	} else if c.TTL > c.MaxTTL {
+		errs = append(errs, errors.New("auth.signed_urls.ttl 不能大于 max_ttl"))
+	}
+	return errs
+}
+
+// URLSigner 生成和校验带有效期的图片链接（?exp=...&sig=...）
+type URLSigner struct {
+	config *ConfigStore
+}
+
+func NewURLSigner(config *ConfigStore) *URLSigner {
+	return &URLSigner{config: config}
+}
+
+// FileURL 返回图片的访问地址，启用签名时附带默认有效期的签名
+func (s *URLSigner) FileURL(relativePath string) string {
+	config := s.config.Get()
+	fileUrl := config.Server.PublicURL + FileURLPath + relativePath
+	if !config.Auth.SignedURLs.Enabled {
+		return fileUrl
+	}
+	return fileUrl + "?" + s.query(&config.Auth.SignedURLs, relativePath, time.Now().Add(config.Auth.SignedURLs.TTL))
+}
+
+// Sign 返回指定有效期的签名链接，ttl 为 0 时使用默认有效期，超过 max_ttl 时按 max_ttl 处理
+func (s *URLSigner) Sign(relativePath string, ttl time.Duration) (string, time.Time, error) {
+	config := s.config.Get()
+	signing := &config.Auth.SignedURLs
+	if !signing.Enabled {
+		return "", time.Time{}, errors.New("未启用图片链接签名")
+	}
+	if ttl <= 0 {
+		ttl = signing.TTL
+	}
+	ttl = min(ttl, signing.MaxTTL)
+	expiresAt := time.Now().Add(ttl)
+	return config.Server.PublicURL + FileURLPath + relativePath + "?" + s.query(signing, relativePath, expiresAt), expiresAt, nil
+}
+
+// Verify 校验链接签名和有效期
+func (s *URLSigner) Verify(relativePath string, exp string, sig string) error {
+	signing := &s.config.Get().Auth.SignedURLs
+	if !signing.Enabled {
+		return errors.New("未启用图片链接签名")
+	}
+
+	expUnix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return ErrSignatureInvalid
+	}
+	expected := signature(signing.Secret, relativePath, expUnix)
+	if !hmac.Equal([]byte(expected), []byte(sig)) {
+		return ErrSignatureInvalid
+	}
+	if time.Now().Unix() > expUnix {
+		return ErrSignatureExpired
+	}
+	return nil
+}
+
+func (s *URLSigner) query(signing *SignedURLConfig, relativePath string, expiresAt time.Time) string {
+	values := url.Values{}
+	values.Set("exp", strconv.FormatInt(expiresAt.Unix(), 10))
+	values.Set("sig", signature(signing.Secret, relativePath, expiresAt.Unix()))
+	return values.Encode()
+}
+
+func signature(secret string, relativePath string, exp int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%d", relativePath, exp)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// RelativePathFromURL 从图片链接或相对路径中提取存储相对路径（日期文件夹/文件名）
+func RelativePathFromURL(fileUrl string) (string, error) {
+	fileUrl = strings.TrimSpace(fileUrl)
+	if parsed, err := url.Parse(fileUrl); err == nil {
+		fileUrl = parsed.Path
+	}
+	if _, after, found := strings.Cut(fileUrl, FileURLPath); found {
+		fileUrl = after
+	}
+	fileUrl = strings.TrimPrefix(fileUrl, "/")
+	if fileUrl == "" || strings.Contains(fileUrl, "..") {
+		return "", fmt.Errorf("无效的图片地址: %s", fileUrl)
+	}
+	return fileUrl, nil
+}
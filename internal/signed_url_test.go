@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+func newTestURLSigner(t *testing.T) *URLSigner {
+	t.Helper()
+	return NewURLSigner(newTestConfigStore(t, func(c *Config) {
+		c.Server.PublicURL = "https://img.example.com"
+		c.Auth.SignedURLs = SignedURLConfig{Enabled: true, Secret: testSecret, TTL: time.Hour, MaxTTL: 2 * time.Hour}
+	}))
+}
+
+func signedQuery(t *testing.T, signedUrl string) (string, string) {
+	t.Helper()
+	parsed, err := url.Parse(signedUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Query().Get("exp"), parsed.Query().Get("sig")
+}
+
+func TestURLSignerRoundTrip(t *testing.T) {
+	signer := newTestURLSigner(t)
+	key := "2026-10-19/abc.png"
+
+	fileUrl := signer.FileURL(key)
+	if !strings.HasPrefix(fileUrl, "https://img.example.com"+FileURLPath+key+"?") {
+		t.Fatalf("FileURL() = %s", fileUrl)
+	}
+	exp, sig := signedQuery(t, fileUrl)
+	if err := signer.Verify(key, exp, sig); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+
+	// 签名绑定路径和有效期
+	if err := signer.Verify("2026-10-19/other.png", exp, sig); !errors.Is(err, ErrSignatureInvalid) {
+		t.Errorf("其他路径 Verify() error = %v, want ErrSignatureInvalid", err)
+	}
+	expUnix, _ := strconv.ParseInt(exp, 10, 64)
+	if err := signer.Verify(key, strconv.FormatInt(expUnix+3600, 10), sig); !errors.Is(err, ErrSignatureInvalid) {
+		t.Errorf("修改有效期 Verify() error = %v, want ErrSignatureInvalid", err)
+	}
+	if err := signer.Verify(key, "abc", sig); !errors.Is(err, ErrSignatureInvalid) {
+		t.Errorf("无效的 exp Verify() error = %v, want ErrSignatureInvalid", err)
+	}
+}
+
+func TestURLSignerExpiry(t *testing.T) {
+	signer := newTestURLSigner(t)
+	key := "2026-10-19/abc.png"
+
+	expired := time.Now().Add(-time.Minute).Unix()
+	sig := signature(testSecret, key, expired)
+	if err := signer.Verify(key, strconv.FormatInt(expired, 10), sig); !errors.Is(err, ErrSignatureExpired) {
+		t.Errorf("Verify() error = %v, want ErrSignatureExpired", err)
+	}
+}
+
+func TestURLSignerTTL(t *testing.T) {
+	signer := newTestURLSigner(t)
+
+	_, expiresAt, err := signer.Sign("a.png", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(expiresAt); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("默认有效期 = %v, want 1h", d)
+	}
+
+	_, expiresAt, err = signer.Sign("a.png", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(expiresAt); d > 2*time.Hour {
+		t.Errorf("有效期 = %v, 不应超过 max_ttl", d)
+	}
+}
+
+func TestRelativePathFromURL(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"https://img.example.com/api/v1/read/file/2026-10-19/a.png?exp=1&sig=x", "2026-10-19/a.png", false},
+		{"/2026-10-19/a.png", "2026-10-19/a.png", false},
+		{"2026-10-19/../../etc/passwd", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		got, err := RelativePathFromURL(tt.input)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("RelativePathFromURL(%q) = %q, %v", tt.input, got, err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	StorageTypeLocal = "local"
+	StorageTypeS3    = "s3"
+)
+
+var (
+	ErrObjectNotFound = errors.New("文件不存在")
+	ErrInvalidKey     = errors.New("非法的文件路径")
+)
+
+// ObjectInfo 存储对象的元信息
+type ObjectInfo struct {
+	// 相对于存储根目录的路径，使用正斜杠分隔，如 2006-01-02/uuid.png
+	Key         string
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+	// 带引号的实体标签，用于 HTTP 缓存校验
+	ETag string
+}
+
+// Storage 生成图片的存储后端
+type Storage interface {
+	// Put 写入对象，size 未知时传 -1
+	Put(ctx context.Context, key string, data io.Reader, size int64, contentType string) error
+	// Get 打开对象，调用方负责关闭，对象不存在时返回 ErrObjectNotFound
+	Get(ctx context.Context, key string) (io.ReadSeekCloser, *ObjectInfo, error)
+	// Stat 获取对象元信息，对象不存在时返回 ErrObjectNotFound
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	// List 列出指定前缀下的所有对象
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// Delete 删除对象，对象不存在时不返回错误
+	Delete(ctx context.Context, key string) error
+	// URL 返回可直接下载对象的地址，存储不支持直接访问或未启用时返回空字符串
+	URL(ctx context.Context, key string) (string, error)
+	// Check 供就绪检查使用，确认存储可用且不留下任何对象
+	Check(ctx context.Context) error
+}
+
+// NewStorage 按配置创建存储后端
+func NewStorage(ctx context.Context, config StorageConfig) (Storage, error) {
+	switch config.Type {
+	case StorageTypeLocal:
+		return NewLocalStorage(config.Path), nil
+	case StorageTypeS3:
+		storage, err := NewS3Storage(ctx, config.S3)
+		if err != nil {
+			return nil, err
+		}
+		return storage, nil
+	default:
+		return nil, fmt.Errorf("不支持的存储类型: %s", config.Type)
+	}
+}
+
+// ValidateKey 校验对象路径，防止路径遍历
+func ValidateKey(key string) error {
+	if key == "" || strings.Contains(key, "..") || strings.Contains(key, "\\") || strings.HasPrefix(key, "/") {
+		return ErrInvalidKey
+	}
+	if path.Clean(key) != key {
+		return ErrInvalidKey
+	}
+	return nil
+}
+
+// ContentTypeByKey 根据扩展名推断对象的 Content-Type
+func ContentTypeByKey(key string) string {
+	if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// DetectContentType 根据文件内容判断实际的 Content-Type，无法识别时返回 fallback；读取后恢复到文件开头
+func DetectContentType(file io.ReadSeeker, fallback string) (string, error) {
+	header := make([]byte, 512)
+	n, err := io.ReadFull(file, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	contentType := http.DetectContentType(header[:n])
+	if contentType == "application/octet-stream" || strings.HasPrefix(contentType, "text/plain") {
+		return fallback, nil
+	}
+	return contentType, nil
+}
@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LocalStorage 本地磁盘存储
+type LocalStorage struct {
+	root string
+}
+
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{root: root}
+}
+
+func (s *LocalStorage) Put(ctx context.Context, key string, data io.Reader, size int64, contentType string) error {
+	fullPath, err := s.fullPath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+
+	// 先写入临时文件再重命名，避免读取到写了一半的图片
+	tmp, err := os.CreateTemp(filepath.Dir(fullPath), filepath.Base(fullPath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fullPath)
+}
+
+func (s *LocalStorage) Get(ctx context.Context, key string) (io.ReadSeekCloser, *ObjectInfo, error) {
+	fullPath, err := s.fullPath(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return nil, nil, notFoundOr(err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, nil, ErrObjectNotFound
+	}
+	return file, localObjectInfo(key, info), nil
+}
+
+func (s *LocalStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	fullPath, err := s.fullPath(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, notFoundOr(err)
+	}
+	if info.IsDir() {
+		return nil, ErrObjectNotFound
+	}
+	return localObjectInfo(key, info), nil
+}
+
+func (s *LocalStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := filepath.WalkDir(s.root, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, fullPath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) || isTempFile(key) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		objects = append(objects, *localObjectInfo(key, info))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (s *LocalStorage) Delete(ctx context.Context, key string) error {
+	fullPath, err := s.fullPath(key)
+	if err != nil {
+		return err
+	}
+	// 不清理空的日期目录：删除目录与同一目录下的 Put（MkdirAll 之后、创建临时文件之前）存在竞争
+	if err := os.Remove(fullPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Check 在存储目录中创建并删除一个临时文件，确认磁盘可写（只读挂载、磁盘已满、没有写权限时返回错误）；
+// 临时文件名带随机后缀，并发的探针互不干扰，List 也不会返回临时文件
+func (s *LocalStorage) Check(ctx context.Context) error {
+	if err := os.MkdirAll(s.root, 0755); err != nil {
+		return fmt.Errorf("存储不可写: %v", err)
+	}
+	tmp, err := os.CreateTemp(s.root, ".readyz.tmp-*")
+	if err != nil {
+		return fmt.Errorf("存储不可写: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write([]byte("ok"))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("存储不可写: %v", err)
+	}
+	return nil
+}
+
+// URL 本地存储只能通过图片读取接口访问
+func (s *LocalStorage) URL(ctx context.Context, key string) (string, error) {
+	return "", nil
+}
+
+func (s *LocalStorage) fullPath(key string) (string, error) {
+	if err := ValidateKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+func localObjectInfo(key string, info fs.FileInfo) *ObjectInfo {
+	return &ObjectInfo{
+		Key:         key,
+		Size:        info.Size(),
+		ModTime:     info.ModTime(),
+		ContentType: ContentTypeByKey(key),
+		// 本地文件没有内容摘要，按修改时间和大小生成
+		ETag: fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()),
+	}
+}
+
+func notFoundOr(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrObjectNotFound
+	}
+	return err
+}
+
+func isTempFile(key string) bool {
+	matched, _ := path.Match("*.tmp-*", path.Base(key))
+	return matched
+}
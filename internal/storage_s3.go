@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3StorageConfig S3 兼容对象存储配置（AWS S3、MinIO 等）
+type S3StorageConfig struct {
+	// 服务地址，需包含协议，如 https://s3.amazonaws.com、http://127.0.0.1:9000
+	Endpoint string `yaml:"endpoint"`
+	Region   string `yaml:"region"`
+	Bucket   string `yaml:"bucket"`
+	// 对象名前缀，如 sdmcp/images
+	Prefix string `yaml:"prefix"`
+	// 访问密钥，为空时依次从 AWS_ACCESS_KEY_ID、MINIO_ACCESS_KEY 等环境变量和 IAM 获取
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	// 使用路径风格访问（endpoint/bucket/key），MinIO 通常需要开启
+	PathStyle bool `yaml:"path_style"`
+	// 存储桶不存在时自动创建
+	CreateBucket bool `yaml:"create_bucket"`
+	// 启用后图片读取接口重定向到预签名地址，图片不再经由本服务转发
+	PresignRedirect bool `yaml:"presign_redirect"`
+	// 预签名地址有效期，默认 15 分钟
+	PresignTTL time.Duration `yaml:"presign_ttl"`
+}
+
+func (c *S3StorageConfig) normalize() {
+	c.Endpoint = strings.TrimSuffix(c.Endpoint, "/")
+	c.Prefix = strings.Trim(c.Prefix, "/")
+	if c.PresignTTL == 0 {
+		c.PresignTTL = 15 * time.Minute
+	}
+}
+
+func (c *S3StorageConfig) validate() []error {
+	var errs []error
+	if err := validateHttpUrl(c.Endpoint); err != nil {
+		errs = append(errs, fmt.Errorf("storage.s3.endpoint 无效: %v", err))
+	}
+	if c.Bucket == "" {
+		errs = append(errs, errors.New("storage.s3.bucket 不能为空"))
+	}
+	if (c.AccessKey == "") != (c.SecretKey == "") {
+		errs = append(errs, errors.New("storage.s3.access_key 和 secret_key 需要同时配置"))
+	}
+	// S3 预签名地址最长有效期为 7 天
+	if c.PresignTTL < 0 || c.PresignTTL > 7*24*time.Hour {
+		errs = append(errs, errors.New("storage.s3.presign_ttl 需要在 0 到 168h 之间"))
+	}
+	return errs
+}
+
+// S3Storage S3 兼容对象存储
+type S3Storage struct {
+	client *minio.Client
+	config S3StorageConfig
+}
+
+// NewS3Storage 创建 S3 存储并检查存储桶是否可用
+func NewS3Storage(ctx context.Context, config S3StorageConfig) (*S3Storage, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("解析 storage.s3.endpoint 失败: %v", err)
+	}
+
+	creds := credentials.NewStaticV4(config.AccessKey, config.SecretKey, "")
+	if config.AccessKey == "" {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.IAM{},
+		})
+	}
+
+	bucketLookup := minio.BucketLookupAuto
+	if config.PathStyle {
+		bucketLookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(endpoint.Host, &minio.Options{
+		Creds:        creds,
+		Secure:       endpoint.Scheme == "https",
+		Region:       config.Region,
+		BucketLookup: bucketLookup,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("创建 S3 客户端失败: %v", err)
+	}
+
+	exists, err := client.BucketExists(ctx, config.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("检查存储桶 %s 失败: %v", config.Bucket, err)
+	}
+	if !exists {
+		if !config.CreateBucket {
+			return nil, fmt.Errorf("存储桶 %s 不存在", config.Bucket)
+		}
+		if err := client.MakeBucket(ctx, config.Bucket, minio.MakeBucketOptions{Region: config.Region}); err != nil {
+			return nil, fmt.Errorf("创建存储桶 %s 失败: %v", config.Bucket, err)
+		}
+	}
+
+	return &S3Storage{client: client, config: config}, nil
+}
+
+func (s *S3Storage) Put(ctx context.Context, key string, data io.Reader, size int64, contentType string) error {
+	objectName, err := s.objectName(key)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.PutObject(ctx, s.config.Bucket, objectName, data, size, minio.PutObjectOptions{
+		ContentType: contentType,
+	})
+	return err
+}
+
+func (s *S3Storage) Get(ctx context.Context, key string) (io.ReadSeekCloser, *ObjectInfo, error) {
+	objectName, err := s.objectName(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	object, err := s.client.GetObject(ctx, s.config.Bucket, objectName, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, s3Error(err)
+	}
+	// GetObject 不会发起请求，通过 Stat 确认对象存在
+	info, err := object.Stat()
+	if err != nil {
+		object.Close()
+		return nil, nil, s3Error(err)
+	}
+	return object, s.objectInfo(info), nil
+}
+
+func (s *S3Storage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	objectName, err := s.objectName(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.client.StatObject(ctx, s.config.Bucket, objectName, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return s.objectInfo(info), nil
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	listPrefix := prefix
+	if s.config.Prefix != "" {
+		listPrefix = s.config.Prefix + "/" + prefix
+	}
+
+	var objects []ObjectInfo
+	for info := range s.client.ListObjects(ctx, s.config.Bucket, minio.ListObjectsOptions{
+		Prefix:    listPrefix,
+		Recursive: true,
+	}) {
+		if info.Err != nil {
+			return nil, info.Err
+		}
+		objects = append(objects, *s.objectInfo(info))
+	}
+	return objects, nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	objectName, err := s.objectName(key)
+	if err != nil {
+		return err
+	}
+	return s.client.RemoveObject(ctx, s.config.Bucket, objectName, minio.RemoveObjectOptions{})
+}
+
+// s3HealthCheckKey 就绪检查时查询的对象，不需要存在
+const s3HealthCheckKey = "healthcheck/readyz"
+
+// Check 对检查对象发送一次 HEAD 请求，确认服务地址、凭证和存储桶可用；
+// 探针调用频繁，不写入对象，避免产生费用和并发探针之间的干扰
+func (s *S3Storage) Check(ctx context.Context) error {
+	if _, err := s.Stat(ctx, s3HealthCheckKey); err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return fmt.Errorf("存储不可访问: %v", err)
+	}
+	return nil
+}
+
+// URL 启用 presign_redirect 时返回预签名下载地址
+func (s *S3Storage) URL(ctx context.Context, key string) (string, error) {
+	if !s.config.PresignRedirect {
+		return "", nil
+	}
+	objectName, err := s.objectName(key)
+	if err != nil {
+		return "", err
+	}
+	presigned, err := s.client.PresignedGetObject(ctx, s.config.Bucket, objectName, s.config.PresignTTL, nil)
+	if err != nil {
+		return "", err
+	}
+	return presigned.String(), nil
+}
+
+func (s *S3Storage) objectName(key string) (string, error) {
+	if err := ValidateKey(key); err != nil {
+		return "", err
+	}
+	if s.config.Prefix == "" {
+		return key, nil
+	}
+	return s.config.Prefix + "/" + key, nil
+}
+
+func (s *S3Storage) objectInfo(info minio.ObjectInfo) *ObjectInfo {
+	key := info.Key
+	if s.config.Prefix != "" {
+		key = strings.TrimPrefix(key, s.config.Prefix+"/")
+	}
+	contentType := info.ContentType
+	if contentType == "" {
+		contentType = ContentTypeByKey(key)
+	}
+	return &ObjectInfo{
+		Key:         key,
+		Size:        info.Size,
+		ModTime:     info.LastModified,
+		ContentType: contentType,
+		ETag:        `"` + strings.Trim(info.ETag, `"`) + `"`,
+	}
+}
+
+func s3Error(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NotFound":
+		return ErrObjectNotFound
+	}
+	return err
+}
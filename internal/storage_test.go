@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStorageContract 检查存储后端是否满足 Storage 接口约定，prefix 用于隔离不同测试写入的对象
+func testStorageContract(t *testing.T, storage Storage, prefix string) {
+	ctx := context.Background()
+	key := prefix + "2026-10-19/a.png"
+	data := []byte("image data")
+
+	if err := storage.Put(ctx, key, bytes.NewReader(data), int64(len(data)), "image/png"); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	t.Cleanup(func() { storage.Delete(context.Background(), key) })
+
+	reader, info, err := storage.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	got, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Get() = %q, %v", got, err)
+	}
+	if info.Key != key || info.Size != int64(len(data)) || info.ETag == "" {
+		t.Errorf("Get() info = %+v", info)
+	}
+
+	info, err = storage.Stat(ctx, key)
+	if err != nil || info.Size != int64(len(data)) || info.ContentType != "image/png" {
+		t.Errorf("Stat() = %+v, %v", info, err)
+	}
+
+	// 覆盖写入
+	data = []byte("new image data")
+	if err := storage.Put(ctx, key, bytes.NewReader(data), -1, "image/png"); err != nil {
+		t.Fatalf("Put() size -1 error = %v", err)
+	}
+	if info, err := storage.Stat(ctx, key); err != nil || info.Size != int64(len(data)) {
+		t.Errorf("覆盖后 Stat() = %+v, %v", info, err)
+	}
+
+	other := prefix + "2026-10-20/b.webp"
+	if err := storage.Put(ctx, other, strings.NewReader("b"), 1, "image/webp"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { storage.Delete(context.Background(), other) })
+
+	objects, err := storage.List(ctx, prefix)
+	if err != nil || len(objects) != 2 || objects[0].Key != key || objects[1].Key != other {
+		t.Fatalf("List() = %+v, %v", objects, err)
+	}
+	objects, err = storage.List(ctx, prefix+"2026-10-20/")
+	if err != nil || len(objects) != 1 || objects[0].Key != other {
+		t.Fatalf("List() 前缀过滤 = %+v, %v", objects, err)
+	}
+
+	if err := storage.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := storage.Stat(ctx, key); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("删除后 Stat() error = %v, want ErrObjectNotFound", err)
+	}
+	if _, _, err := storage.Get(ctx, key); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("删除后 Get() error = %v, want ErrObjectNotFound", err)
+	}
+	if err := storage.Delete(ctx, key); err != nil {
+		t.Errorf("删除不存在的对象 Delete() error = %v", err)
+	}
+
+	if err := storage.Put(ctx, prefix+"../escape.png", strings.NewReader("x"), 1, "image/png"); err == nil {
+		t.Error("Put() 应拒绝包含 .. 的 key")
+	}
+}
+
+func TestLocalStorageContract(t *testing.T) {
+	testStorageContract(t, NewLocalStorage(t.TempDir()), "")
+}
+
+// 同一目录下并发写入和删除，删除最后一个文件不能导致其他写入失败
+func TestLocalStorageConcurrentPutDelete(t *testing.T) {
+	storage := NewLocalStorage(t.TempDir())
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 200 {
+				key := fmt.Sprintf("2026-10-19/%d-%d.png", i, j)
+				if err := storage.Put(ctx, key, strings.NewReader("x"), 1, "image/png"); err != nil {
+					t.Errorf("Put() error = %v", err)
+					return
+				}
+				if err := storage.Delete(ctx, key); err != nil {
+					t.Errorf("Delete() error = %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestS3StorageContract 针对真实的 S3 兼容存储运行，需要设置 SDMCP_TEST_S3_ENDPOINT，例如：
+//
+//	docker run -d -p 9000:9000 minio/minio server /data
+//	SDMCP_TEST_S3_ENDPOINT=http://127.0.0.1:9000 SDMCP_TEST_S3_ACCESS_KEY=minioadmin SDMCP_TEST_S3_SECRET_KEY=minioadmin go test ./internal -run S3
+func TestS3StorageContract(t *testing.T) {
+	endpoint := os.Getenv("SDMCP_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("未设置 SDMCP_TEST_S3_ENDPOINT")
+	}
+	bucket := os.Getenv("SDMCP_TEST_S3_BUCKET")
+	if bucket == "" {
+		bucket = "sdmcp-test"
+	}
+
+	config := S3StorageConfig{
+		Endpoint:     endpoint,
+		Region:       os.Getenv("SDMCP_TEST_S3_REGION"),
+		Bucket:       bucket,
+		AccessKey:    os.Getenv("SDMCP_TEST_S3_ACCESS_KEY"),
+		SecretKey:    os.Getenv("SDMCP_TEST_S3_SECRET_KEY"),
+		PathStyle:    true,
+		CreateBucket: true,
+	}
+	config.normalize()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	storage, err := NewS3Storage(ctx, config)
+	if err != nil {
+		t.Fatalf("NewS3Storage() error = %v", err)
+	}
+
+	testStorageContract(t, storage, fmt.Sprintf("test-%d/", time.Now().UnixNano()))
+
+	// 带前缀的配置只能访问前缀下的对象
+	config.Prefix = fmt.Sprintf("prefixed-%d", time.Now().UnixNano())
+	prefixed, err := NewS3Storage(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorageContract(t, prefixed, "")
+}
+
+func TestCheckStorage(t *testing.T) {
+	fs := newTestFileService(t, false, nil)
+	ctx := context.Background()
+
+	if err := fs.CheckStorage(ctx); err != nil {
+		t.Fatalf("CheckStorage() error = %v", err)
+	}
+	// 检查不留下任何文件
+	entries, err := os.ReadDir(fs.storage.root)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("ReadDir() = %v, %v", entries, err)
+	}
+
+	// 存储根目录是普通文件时不可用
+	if err := os.Remove(fs.storage.root); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fs.storage.root, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CheckStorage(ctx); err == nil {
+		t.Error("存储根目录是普通文件时 CheckStorage() 应返回错误")
+	}
+}
+
+// 存储目录只读时就绪检查失败
+func TestCheckStorageReadOnly(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root 用户不受目录权限限制")
+	}
+	storage := NewLocalStorage(t.TempDir())
+	if err := os.Chmod(storage.root, 0555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(storage.root, 0755) })
+
+	// 只读时仍然可以读取，只检查 Stat 无法发现问题
+	if _, err := storage.Stat(context.Background(), "healthcheck/readyz"); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if err := storage.Check(context.Background()); err == nil {
+		t.Error("存储目录只读时 Check() 应返回错误")
+	}
+}
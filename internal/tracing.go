@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 链路追踪导出方式
+const (
+	TraceExporterOTLP   = "otlp"
+	TraceExporterStdout = "stdout"
+	TraceExporterFile   = "file"
+)
+
+// TracerName 本服务创建 span 使用的 tracer 名称
+const TracerName = "qiuxs.com/stable-diffusion-webui-mcp"
+
+// TracingConfig OpenTelemetry 链路追踪，修改后需要重启才能生效
+type TracingConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// otlp（OTLP/HTTP，默认）、stdout 或 file
+	Exporter string `yaml:"exporter"`
+	// OTLP/HTTP 接收地址，如 http://otel-collector:4318，为空时使用 OTEL_EXPORTER_OTLP_ENDPOINT 或 http://localhost:4318
+	Endpoint string `yaml:"endpoint"`
+	// OTLP 请求头，如认证信息
+	Headers map[string]string `yaml:"headers"`
+	// file 导出方式写入的文件，每行一个 JSON 格式的 span
+	File string `yaml:"file"`
+	// 采样比例 0-1，默认 1；上游请求已采样时总是采样
+	SampleRatio *float64 `yaml:"sample_ratio"`
+	// 默认 stable-diffusion-webui-mcp
+	ServiceName string `yaml:"service_name"`
+}
+
+func (c *TracingConfig) normalize() {
+	if c.Exporter == "" {
+		c.Exporter = TraceExporterOTLP
+	}
+	if c.SampleRatio == nil {
+		ratio := 1.0
+		c.SampleRatio = &ratio
+	}
+	if c.ServiceName == "" {
+		c.ServiceName = "stable-diffusion-webui-mcp"
+	}
+}
+
+func (c *TracingConfig) validate() []error {
+	var errs []error
+	switch c.Exporter {
+	case TraceExporterOTLP:
+		if c.Endpoint != "" {
+			if err := validateHttpUrl(c.Endpoint); err != nil {
+				errs = append(errs, fmt.Errorf("tracing.endpoint 无效: %v", err))
+			}
+		}
+	case TraceExporterStdout:
+	case TraceExporterFile:
+		if c.Enabled && c.File == "" {
+			errs = append(errs, errors.New("tracing.exporter 为 file 时必须配置 tracing.file"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("tracing.exporter 无效: %s，可选值为 otlp、stdout、file", c.Exporter))
+	}
+	if c.SampleRatio != nil && (*c.SampleRatio < 0 || *c.SampleRatio > 1) {
+		errs = append(errs, errors.New("tracing.sample_ratio 需要在 0-1 之间"))
+	}
+	return errs
+}
+
+// InitTracing 按配置初始化全局的 TracerProvider，返回退出前用于导出剩余 span 的关闭函数；
+// 未启用时只设置 W3C Trace Context 传播，上游的 trace 上下文仍会传递给 WebUI
+func InitTracing(config TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !config.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	var closeFile func() error
+	var err error
+	switch config.Exporter {
+	case TraceExporterStdout:
+		exporter, err = stdouttrace.New()
+	case TraceExporterFile:
+		var file *os.File
+		file, err = os.OpenFile(config.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("打开链路追踪文件失败: %v", err)
+		}
+		closeFile = file.Close
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		var options []otlptracehttp.Option
+		if config.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpointURL(strings.TrimSuffix(config.Endpoint, "/")+"/v1/traces"))
+		}
+		if len(config.Headers) > 0 {
+			options = append(options, otlptracehttp.WithHeaders(config.Headers))
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("创建链路追踪导出器失败: %v", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(config.ServiceName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("创建链路追踪资源失败: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(*config.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closeFile != nil {
+			err = errors.Join(err, closeFile())
+		}
+		return err
+	}, nil
+}
+
+// Tracer 返回本服务的 tracer
+func Tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+// ExtractTraceContext 从 HTTP 请求头中提取上游的 trace 上下文（traceparent、tracestate、baggage）
+func ExtractTraceContext(ctx context.Context, header http.Header) context.Context {
+	if header == nil {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// InjectTraceContext 将当前的 trace 上下文写入发往下游的 HTTP 请求头
+func InjectTraceContext(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// EndSpan 记录错误并结束 span
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// imageSpanAttributes 保存图片 span 的属性
+func imageSpanAttributes(record *ImageRecord) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("sdmcp.image.id", record.ID),
+		attribute.String("sdmcp.image.key", record.Key),
+		attribute.String("sdmcp.image.content_type", record.ContentType),
+		attribute.Int64("sdmcp.image.size", record.Size),
+	}
+}
@@ -0,0 +1,267 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const usageFileName = "usage.json"
+
+// QuotaConfig GPU 用量配额，0 表示不限制
+//
+// 用量以 megapixel-steps（宽 × 高 × 步数 × 图片数量 / 10^6）计算，生成前即可预估，
+// 同时记录实际占用的 GPU 秒数。
+type QuotaConfig struct {
+	DailyMegapixelSteps   float64 `yaml:"daily_megapixel_steps" json:"daily_megapixel_steps"`
+	MonthlyMegapixelSteps float64 `yaml:"monthly_megapixel_steps" json:"monthly_megapixel_steps"`
+	DailyGPUSeconds       float64 `yaml:"daily_gpu_seconds" json:"daily_gpu_seconds"`
+	MonthlyGPUSeconds     float64 `yaml:"monthly_gpu_seconds" json:"monthly_gpu_seconds"`
+}
+
+func (c *QuotaConfig) validate(name string) []error {
+	if c.DailyMegapixelSteps < 0 || c.MonthlyMegapixelSteps < 0 || c.DailyGPUSeconds < 0 || c.MonthlyGPUSeconds < 0 {
+		return []error{fmt.Errorf("%s 不能为负数", name)}
+	}
+	return nil
+}
+
+// QuotaError 用量超出配额
+type QuotaError struct {
+	Period     string
+	Metric     string
+	Used       float64
+	Limit      float64
+	RetryAfter time.Duration
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s %s 配额不足（已用 %.1f / %.1f），配额将在 %d 秒后重置",
+		e.Period, e.Metric, e.Used, e.Limit, RetryAfterSeconds(e.RetryAfter))
+}
+
+// UsageCounter 一个统计周期内的用量
+type UsageCounter struct {
+	Period          string  `json:"period"`
+	Calls           int64   `json:"calls"`
+	Images          int64   `json:"images"`
+	MegapixelSteps  float64 `json:"megapixel_steps"`
+	GPUSeconds      float64 `json:"gpu_seconds"`
+	LastUpdatedUnix int64   `json:"last_updated"`
+}
+
+// UsageRecord 调用方的当日和当月用量
+type UsageRecord struct {
+	Daily   UsageCounter `json:"daily"`
+	Monthly UsageCounter `json:"monthly"`
+}
+
+// UsageTracker 记录每个调用方的 GPU 用量，持久化到 data_dir/usage.json
+type UsageTracker struct {
+	path string
+
+	mu      sync.Mutex
+	records map[string]*UsageRecord
+	// 正在执行的调用预留的 megapixel-steps，检查配额时计入已用量，不持久化
+	reserved map[string]float64
+}
+
+// UsageReservation 一次调用预留的用量，调用结束后通过 Settle 按实际用量结算
+type UsageReservation struct {
+	tracker        *UsageTracker
+	principalId    string
+	megapixelSteps float64
+	settled        bool
+}
+
+// NewUsageTracker 创建用量记录器并加载已有的用量数据
+func NewUsageTracker(dataDir string) (*UsageTracker, error) {
+	t := &UsageTracker{
+		path:     filepath.Join(dataDir, usageFileName),
+		records:  make(map[string]*UsageRecord),
+		reserved: make(map[string]float64),
+	}
+
+	data, err := os.ReadFile(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取用量数据失败: %v", err)
+	}
+	if err := json.Unmarshal(data, &t.records); err != nil {
+		return nil, fmt.Errorf("解析用量数据 %s 失败: %v", t.path, err)
+	}
+	return t, nil
+}
+
+// Reserve 检查本次预估用量是否会超出配额，超出时返回 *QuotaError；未超出时预留预估用量，
+// 并发的调用会计入已预留的用量，避免同时通过检查后超出配额
+func (t *UsageTracker) Reserve(principalId string, quota QuotaConfig, megapixelSteps float64) (*UsageReservation, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	record := t.current(principalId, now)
+	reserved := t.reserved[principalId]
+
+	checks := []struct {
+		period string
+		metric string
+		used   float64
+		cost   float64
+		limit  float64
+		reset  time.Time
+	}{
+		{"每日", "megapixel-steps", record.Daily.MegapixelSteps + reserved, megapixelSteps, quota.DailyMegapixelSteps, nextDay(now)},
+		{"每月", "megapixel-steps", record.Monthly.MegapixelSteps + reserved, megapixelSteps, quota.MonthlyMegapixelSteps, nextMonth(now)},
+		// GPU 秒数无法预估，已用量达到配额后拒绝
+		{"每日", "GPU 秒数", record.Daily.GPUSeconds, 0, quota.DailyGPUSeconds, nextDay(now)},
+		{"每月", "GPU 秒数", record.Monthly.GPUSeconds, 0, quota.MonthlyGPUSeconds, nextMonth(now)},
+	}
+	for _, check := range checks {
+		if check.limit <= 0 {
+			continue
+		}
+		if check.used+check.cost > check.limit || check.used >= check.limit {
+			return nil, &QuotaError{
+				Period:     check.period,
+				Metric:     check.metric,
+				Used:       check.used,
+				Limit:      check.limit,
+				RetryAfter: check.reset.Sub(now),
+			}
+		}
+	}
+
+	t.reserved[principalId] += megapixelSteps
+	return &UsageReservation{tracker: t, principalId: principalId, megapixelSteps: megapixelSteps}, nil
+}
+
+// Settle 释放预留的用量并记录实际用量；调用失败时 images 和 megapixelSteps 为 0，
+// 但已占用的 GPU 秒数仍会计入。重复调用时只结算一次
+func (r *UsageReservation) Settle(images int64, megapixelSteps float64, gpuSeconds float64) {
+	t := r.tracker
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if r.settled {
+		return
+	}
+	r.settled = true
+	if t.reserved[r.principalId] -= r.megapixelSteps; t.reserved[r.principalId] <= 0 {
+		delete(t.reserved, r.principalId)
+	}
+	t.record(r.principalId, images, megapixelSteps, gpuSeconds)
+}
+
+// record 记录一次调用的用量并持久化，调用方需持有 t.mu
+func (t *UsageTracker) record(principalId string, images int64, megapixelSteps float64, gpuSeconds float64) {
+	now := time.Now()
+	record := t.current(principalId, now)
+	for _, counter := range []*UsageCounter{&record.Daily, &record.Monthly} {
+		counter.Calls++
+		counter.Images += images
+		counter.MegapixelSteps += megapixelSteps
+		counter.GPUSeconds += gpuSeconds
+		counter.LastUpdatedUnix = now.Unix()
+	}
+
+	if err := t.save(); err != nil {
+		logrus.Errorf("保存用量数据失败: %v", err)
+	}
+}
+
+// Get 返回调用方当前周期的用量
+func (t *UsageTracker) Get(principalId string) UsageRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return *t.current(principalId, time.Now())
+}
+
+// current 返回调用方的用量记录，跨天或跨月时重置对应的计数
+func (t *UsageTracker) current(principalId string, now time.Time) *UsageRecord {
+	record, ok := t.records[principalId]
+	if !ok {
+		record = &UsageRecord{}
+		t.records[principalId] = record
+	}
+	if day := now.Format("2006-01-02"); record.Daily.Period != day {
+		record.Daily = UsageCounter{Period: day}
+	}
+	if month := now.Format("2006-01"); record.Monthly.Period != month {
+		record.Monthly = UsageCounter{Period: month}
+	}
+	return record
+}
+
+func (t *UsageTracker) save() error {
+	data, err := json.MarshalIndent(t.records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(t.path, data, 0644)
+}
+
+// EstimateMegapixelSteps 根据 txt2img 参数（JSON 对象形式）估算 GPU 用量，未设置的参数使用 WebUI 默认值
+func EstimateMegapixelSteps(args map[string]any) float64 {
+	number := func(key string, def float64) float64 {
+		if value, ok := numberArg(args, key); ok && value > 0 {
+			return value
+		}
+		return def
+	}
+
+	width := number("width", 512)
+	height := number("height", 512)
+	steps := number("steps", 20)
+	images := number("batch_size", 1) * number("n_iter", 1)
+	cost := width * height * steps * images
+
+	// 高分辨率修复会在放大后的尺寸上再执行一轮采样
+	if enableHr, _ := args["enable_hr"].(bool); enableHr {
+		scale := number("hr_scale", 2)
+		cost += width * scale * height * scale * number("hr_steps", steps) * images
+	}
+	return cost / 1e6
+}
+
+// WriteFileAtomic 先写入临时文件再重命名，避免进程中断导致文件损坏
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func nextDay(now time.Time) time.Time {
+	year, month, day := now.Date()
+	return time.Date(year, month, day+1, 0, 0, 0, 0, now.Location())
+}
+
+func nextMonth(now time.Time) time.Time {
+	year, month, _ := now.Date()
+	return time.Date(year, month+1, 1, 0, 0, 0, 0, now.Location())
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestUsageReserveConcurrent(t *testing.T) {
+	tracker, err := NewUsageTracker(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	quota := QuotaConfig{DailyMegapixelSteps: 100}
+
+	// 每次预估 30，并发调用最多只能有 3 个通过
+	var accepted atomic.Int32
+	var wg sync.WaitGroup
+	reservations := make(chan *UsageReservation, 10)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reservation, err := tracker.Reserve("api_key:alice", quota, 30)
+			if err != nil {
+				var quotaErr *QuotaError
+				if !errors.As(err, &quotaErr) {
+					t.Errorf("Reserve() error = %v, want *QuotaError", err)
+				}
+				return
+			}
+			accepted.Add(1)
+			reservations <- reservation
+		}()
+	}
+	wg.Wait()
+	close(reservations)
+	if got := accepted.Load(); got != 3 {
+		t.Fatalf("accepted = %d, want 3", got)
+	}
+
+	for reservation := range reservations {
+		reservation.Settle(1, 30, 2)
+	}
+	usage := tracker.Get("api_key:alice")
+	if usage.Daily.MegapixelSteps != 90 || usage.Daily.Images != 3 || usage.Daily.GPUSeconds != 6 {
+		t.Errorf("Daily = %+v", usage.Daily)
+	}
+	if _, err := tracker.Reserve("api_key:alice", quota, 20); err == nil {
+		t.Error("结算后剩余配额为 10，预估 20 时应被拒绝")
+	}
+}
+
+func TestUsageSettleFailure(t *testing.T) {
+	dir := t.TempDir()
+	tracker, err := NewUsageTracker(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quota := QuotaConfig{DailyMegapixelSteps: 50, DailyGPUSeconds: 10}
+
+	reservation, err := tracker.Reserve("api_key:bob", quota, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 失败的调用释放预留的 megapixel-steps，但计入 GPU 秒数
+	reservation.Settle(0, 0, 12)
+	reservation.Settle(0, 0, 12)
+
+	usage := tracker.Get("api_key:bob")
+	if usage.Daily.MegapixelSteps != 0 || usage.Daily.GPUSeconds != 12 || usage.Daily.Calls != 1 {
+		t.Errorf("Daily = %+v", usage.Daily)
+	}
+	var quotaErr *QuotaError
+	if _, err := tracker.Reserve("api_key:bob", quota, 1); !errors.As(err, &quotaErr) || quotaErr.Metric != "GPU 秒数" {
+		t.Errorf("Reserve() error = %v, want GPU 秒数配额不足", err)
+	}
+
+	// 用量持久化后重新加载
+	reloaded, err := NewUsageTracker(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.Get("api_key:bob").Daily.GPUSeconds; got != 12 {
+		t.Errorf("reloaded GPUSeconds = %v, want 12", got)
+	}
+}
+
+func TestEstimateMegapixelSteps(t *testing.T) {
+	tests := []struct {
+		name string
+		args map[string]any
+		want float64
+	}{
+		{"默认参数", map[string]any{}, 512 * 512 * 20 / 1e6},
+		{"批量", map[string]any{"width": 1024.0, "height": 1024.0, "steps": 10.0, "batch_size": 2.0, "n_iter": 2.0}, 1024 * 1024 * 10 * 4 / 1e6},
+		{"高分辨率修复", map[string]any{"enable_hr": true, "hr_scale": 2.0, "hr_steps": 5.0}, (512*512*20 + 1024*1024*5) / 1e6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EstimateMegapixelSteps(tt.args); got != tt.want {
+				t.Errorf("EstimateMegapixelSteps() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,609 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	// WatermarkNone 在 API Key 或预设中显式关闭水印
+	WatermarkNone = "none"
+
+	// WatermarkLSB 隐形水印写入像素 RGB 的最低有效位，只能经受 PNG 无损保存
+	WatermarkLSB = "lsb"
+	// WatermarkDCT 隐形水印写入亮度 8x8 分块的 DCT 系数，可以经受 JPEG、WebP 有损压缩
+	WatermarkDCT = "dct"
+
+	PositionTopLeft     = "top-left"
+	PositionTopRight    = "top-right"
+	PositionBottomLeft  = "bottom-left"
+	PositionBottomRight = "bottom-right"
+	PositionCenter      = "center"
+)
+
+const (
+	// MaxWatermarkPayload 隐形水印内容的最大字节数
+	MaxWatermarkPayload = 40
+	// 隐形水印帧：1 字节长度 + 定长内容 + CRC32，帧长固定，检测时不需要知道内容长度
+	watermarkFrameBytes = 1 + MaxWatermarkPayload + 4
+	watermarkFrameBits  = watermarkFrameBytes * 8
+
+	defaultDCTStrength = 40
+	// dct 水印使用的系数位置（中低频，兼顾稳健和不可察觉）
+	dctU, dctV = 2, 1
+)
+
+// WatermarkConfig 水印配置，auth.keys[].watermark 和 presets.<name>.watermark 引用 profiles 中的名称
+type WatermarkConfig struct {
+	// 未指定水印时使用的水印名称，为空表示默认不加水印
+	Default  string                      `yaml:"default"`
+	Profiles map[string]WatermarkProfile `yaml:"profiles"`
+}
+
+// WatermarkProfile 一组水印设置，可见水印和隐形水印可以同时使用
+type WatermarkProfile struct {
+	Visible   *VisibleWatermark   `yaml:"visible"`
+	Invisible *InvisibleWatermark `yaml:"invisible"`
+}
+
+// VisibleWatermark 可见水印，文字和 logo 二选一
+type VisibleWatermark struct {
+	Text string `yaml:"text"`
+	// 文字字体（TrueType/OpenType），默认使用内置的 Go 字体，不包含中文字形
+	FontFile string `yaml:"font_file"`
+	// 文字颜色，#RRGGBB，默认白色
+	Color string `yaml:"color"`
+	// logo 图片文件（PNG、JPEG 或 WebP），保留透明通道
+	LogoFile string `yaml:"logo_file"`
+	// 位置: top-left、top-right、bottom-left、bottom-right（默认）、center
+	Position string `yaml:"position"`
+	// 不透明度 0-1，默认 0.5
+	Opacity float64 `yaml:"opacity"`
+	// 文字高度占图片高度的比例（默认 0.04），或 logo 宽度占图片宽度的比例（默认 0.2）
+	Scale float64 `yaml:"scale"`
+}
+
+// InvisibleWatermark 隐形水印，可通过 detect_watermark 工具读取
+type InvisibleWatermark struct {
+	// dct（默认）或 lsb
+	Method string `yaml:"method"`
+	// 嵌入的内容，支持 {image_id}、{request_id}、{principal} 占位符，最长 40 字节，默认 {image_id}
+	Payload string `yaml:"payload"`
+	// dct 的量化步长，越大越能经受压缩但越容易察觉，默认 40（可经受质量 80 的 WebP、质量 50 的 JPEG）
+	Strength float64 `yaml:"strength"`
+}
+
+func (c *WatermarkConfig) normalize() {
+	for name, profile := range c.Profiles {
+		if v := profile.Visible; v != nil {
+			if v.Position == "" {
+				v.Position = PositionBottomRight
+			}
+			if v.Opacity == 0 {
+				v.Opacity = 0.5
+			}
+			if v.Color == "" {
+				v.Color = "#FFFFFF"
+			}
+			if v.Scale == 0 {
+				v.Scale = 0.2
+				if v.Text != "" {
+					v.Scale = 0.04
+				}
+			}
+		}
+		if v := profile.Invisible; v != nil {
+			if v.Method == "" {
+				v.Method = WatermarkDCT
+			}
+			if v.Payload == "" {
+				v.Payload = "{image_id}"
+			}
+			if v.Strength == 0 {
+				v.Strength = defaultDCTStrength
+			}
+		}
+		c.Profiles[name] = profile
+	}
+}
+
+func (c *WatermarkConfig) validate() []error {
+	var errs []error
+	if c.Default != "" && c.Default != WatermarkNone {
+		if _, ok := c.Profiles[c.Default]; !ok {
+			errs = append(errs, fmt.Errorf("watermark.default 引用了不存在的水印: %s", c.Default))
+		}
+	}
+	for name, profile := range c.Profiles {
+		prefix := "watermark.profiles." + name
+		if name == WatermarkNone {
+			errs = append(errs, fmt.Errorf("%s: %s 为保留名称，用于关闭水印", prefix, WatermarkNone))
+		}
+		if profile.Visible == nil && profile.Invisible == nil {
+			errs = append(errs, fmt.Errorf("%s 至少需要配置 visible 或 invisible", prefix))
+		}
+		if v := profile.Visible; v != nil {
+			if (v.Text == "") == (v.LogoFile == "") {
+				errs = append(errs, fmt.Errorf("%s.visible 需要配置 text 或 logo_file 其中之一", prefix))
+			}
+			if _, err := parseHexColor(v.Color); err != nil {
+				errs = append(errs, fmt.Errorf("%s.visible.color 无效: %v", prefix, err))
+			}
+			switch v.Position {
+			case PositionTopLeft, PositionTopRight, PositionBottomLeft, PositionBottomRight, PositionCenter:
+			default:
+				errs = append(errs, fmt.Errorf("%s.visible.position 无效: %s，可选值为 top-left、top-right、bottom-left、bottom-right、center", prefix, v.Position))
+			}
+			if v.Opacity <= 0 || v.Opacity > 1 {
+				errs = append(errs, fmt.Errorf("%s.visible.opacity 需要在 0-1 之间", prefix))
+			}
+			if v.Scale <= 0 || v.Scale > 1 {
+				errs = append(errs, fmt.Errorf("%s.visible.scale 需要在 0-1 之间", prefix))
+			}
+		}
+		if v := profile.Invisible; v != nil {
+			if v.Method != WatermarkDCT && v.Method != WatermarkLSB {
+				errs = append(errs, fmt.Errorf("%s.invisible.method 无效: %s，可选值为 dct、lsb", prefix, v.Method))
+			}
+			if v.Strength < 4 || v.Strength > 128 {
+				errs = append(errs, fmt.Errorf("%s.invisible.strength 需要在 4-128 之间", prefix))
+			}
+		}
+	}
+	return errs
+}
+
+// WatermarkFor 返回调用方使用预设生成图片时应加的水印名称，空字符串表示不加水印；
+// API Key 的设置优先于预设，调用方不能通过选择预设去掉 Key 要求的水印
+func (c *Config) WatermarkFor(principal *Principal, preset string) string {
+	name := c.Watermark.Default
+	if p, ok := c.Presets[preset]; ok && p.Watermark != "" {
+		name = p.Watermark
+	}
+	if principal != nil && principal.Kind == PrincipalAPIKey {
+		for _, key := range c.Auth.Keys {
+			if key.Label == principal.Label && key.Watermark != "" {
+				name = key.Watermark
+			}
+		}
+	}
+	if name == WatermarkNone {
+		return ""
+	}
+	return name
+}
+
+// validateWatermarkRefs 检查 API Key 和预设引用的水印是否存在
+func (c *Config) validateWatermarkRefs() []error {
+	var errs []error
+	check := func(field string, name string) {
+		if name == "" || name == WatermarkNone {
+			return
+		}
+		if _, ok := c.Watermark.Profiles[name]; !ok {
+			errs = append(errs, fmt.Errorf("%s 引用了不存在的水印: %s", field, name))
+		}
+	}
+	for i, key := range c.Auth.Keys {
+		check(fmt.Sprintf("auth.keys[%d].watermark", i), key.Watermark)
+	}
+	for name, preset := range c.Presets {
+		check("presets."+name+".watermark", preset.Watermark)
+	}
+	return errs
+}
+
+// WatermarkReport 隐形水印检测结果
+type WatermarkReport struct {
+	Detected bool   `json:"detected"`
+	Method   string `json:"method,omitempty"`
+	Payload  string `json:"payload,omitempty"`
+	// 水印内容为本服务图片 ID 且调用方有权查看时返回
+	ImageID string `json:"image_id,omitempty"`
+}
+
+// Watermarker 按配置为图片加水印，字体和 logo 文件修改后自动重新加载
+type Watermarker struct {
+	config *ConfigStore
+
+	mu     sync.Mutex
+	assets map[string]*watermarkAsset
+}
+
+type watermarkAsset struct {
+	modTime time.Time
+	value   any
+}
+
+func NewWatermarker(config *ConfigStore) *Watermarker {
+	return &Watermarker{
+		config: config,
+		assets: make(map[string]*watermarkAsset),
+	}
+}
+
+// Apply 按名称为 name 的水印配置为图片加水印，先加可见水印再嵌入隐形水印
+func (w *Watermarker) Apply(img image.Image, name string, record *ImageRecord) (image.Image, error) {
+	profile, ok := w.config.Get().Watermark.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("水印不存在: %s", name)
+	}
+
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+
+	if v := profile.Visible; v != nil {
+		var err error
+		if v.Text != "" {
+			err = w.drawText(dst, v)
+		} else {
+			err = w.drawLogo(dst, v)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if v := profile.Invisible; v != nil {
+		payload := strings.NewReplacer(
+			"{image_id}", record.ID,
+			"{request_id}", record.RequestID,
+			"{principal}", record.Principal,
+		).Replace(v.Payload)
+		frame, err := watermarkFrame(payload)
+		if err != nil {
+			return nil, err
+		}
+		if v.Method == WatermarkLSB {
+			err = embedLSB(dst, frame)
+		} else {
+			err = embedDCT(dst, frame, v.Strength)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
+
+// Detect 检测图片中的隐形水印，依次尝试 dct（配置中出现的各个强度）和 lsb
+func (w *Watermarker) Detect(data []byte) (*WatermarkReport, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("解码图片失败: %v", err)
+	}
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+
+	strengths := []float64{defaultDCTStrength}
+	for _, profile := range w.config.Get().Watermark.Profiles {
+		if v := profile.Invisible; v != nil && v.Method == WatermarkDCT && !slices.Contains(strengths, v.Strength) {
+			strengths = append(strengths, v.Strength)
+		}
+	}
+	for _, strength := range strengths {
+		if payload, ok := parseWatermarkFrame(extractDCT(rgba, strength)); ok {
+			return &WatermarkReport{Detected: true, Method: WatermarkDCT, Payload: payload}, nil
+		}
+	}
+	if payload, ok := parseWatermarkFrame(extractLSB(rgba)); ok {
+		return &WatermarkReport{Detected: true, Method: WatermarkLSB, Payload: payload}, nil
+	}
+	return &WatermarkReport{}, nil
+}
+
+func (w *Watermarker) drawText(dst *image.RGBA, v *VisibleWatermark) error {
+	var f *opentype.Font
+	var err error
+	if v.FontFile != "" {
+		f, err = w.font(v.FontFile)
+	} else {
+		f, err = w.defaultFont()
+	}
+	if err != nil {
+		return err
+	}
+
+	size := max(float64(dst.Bounds().Dy())*v.Scale, 10)
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return fmt.Errorf("加载水印字体失败: %v", err)
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	width := font.MeasureString(face, v.Text).Ceil()
+	height := (metrics.Ascent + metrics.Descent).Ceil()
+	// 文字下方的阴影，保证在浅色背景上也能看清
+	shadow := max(int(size/16), 1)
+
+	mask := image.NewAlpha(image.Rect(0, 0, width, height))
+	drawer := &font.Drawer{
+		Dst:  mask,
+		Src:  image.NewUniform(color.Alpha{A: uint8(255 * v.Opacity)}),
+		Face: face,
+		Dot:  fixed.Point26_6{Y: metrics.Ascent},
+	}
+	drawer.DrawString(v.Text)
+
+	textColor, _ := parseHexColor(v.Color)
+	origin := watermarkOrigin(dst.Bounds(), image.Pt(width+shadow, height+shadow), v.Position)
+	shadowRect := image.Rectangle{Min: origin.Add(image.Pt(shadow, shadow)), Max: origin.Add(image.Pt(width+shadow, height+shadow))}
+	draw.DrawMask(dst, shadowRect, image.NewUniform(color.RGBA{A: 160}), image.Point{}, mask, image.Point{}, draw.Over)
+	draw.DrawMask(dst, image.Rectangle{Min: origin, Max: origin.Add(image.Pt(width, height))}, image.NewUniform(textColor), image.Point{}, mask, image.Point{}, draw.Over)
+	return nil
+}
+
+func (w *Watermarker) drawLogo(dst *image.RGBA, v *VisibleWatermark) error {
+	logo, err := w.logo(v.LogoFile)
+	if err != nil {
+		return err
+	}
+	logoBounds := logo.Bounds()
+	width := max(int(float64(dst.Bounds().Dx())*v.Scale), 1)
+	height := max(width*logoBounds.Dy()/logoBounds.Dx(), 1)
+
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), logo, logoBounds, draw.Src, nil)
+
+	origin := watermarkOrigin(dst.Bounds(), scaled.Bounds().Size(), v.Position)
+	draw.DrawMask(dst, image.Rectangle{Min: origin, Max: origin.Add(scaled.Bounds().Size())}, scaled, image.Point{},
+		image.NewUniform(color.Alpha{A: uint8(255 * v.Opacity)}), image.Point{}, draw.Over)
+	return nil
+}
+
+var (
+	defaultFontOnce sync.Once
+	defaultFont     *opentype.Font
+	defaultFontErr  error
+)
+
+func (w *Watermarker) defaultFont() (*opentype.Font, error) {
+	defaultFontOnce.Do(func() {
+		defaultFont, defaultFontErr = opentype.Parse(goregular.TTF)
+	})
+	return defaultFont, defaultFontErr
+}
+
+func (w *Watermarker) font(path string) (*opentype.Font, error) {
+	value, err := w.asset(path, func(data []byte) (any, error) {
+		return opentype.Parse(data)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("加载水印字体失败: %v", err)
+	}
+	return value.(*opentype.Font), nil
+}
+
+func (w *Watermarker) logo(path string) (image.Image, error) {
+	value, err := w.asset(path, func(data []byte) (any, error) {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		return img, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("加载水印 logo 失败: %v", err)
+	}
+	return value.(image.Image), nil
+}
+
+// asset 读取并解析字体或 logo 文件，按文件修改时间缓存
+func (w *Watermarker) asset(path string, parse func([]byte) (any, error)) (any, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if cached, ok := w.assets[path]; ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.value, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	value, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+	w.assets[path] = &watermarkAsset{modTime: info.ModTime(), value: value}
+	return value, nil
+}
+
+// watermarkOrigin 返回尺寸为 size 的水印在图片中的左上角坐标，边距为图片短边的 1/40
+func watermarkOrigin(bounds image.Rectangle, size image.Point, position string) image.Point {
+	margin := max(min(bounds.Dx(), bounds.Dy())/40, 2)
+	left, top := bounds.Min.X+margin, bounds.Min.Y+margin
+	right, bottom := bounds.Max.X-margin-size.X, bounds.Max.Y-margin-size.Y
+	switch position {
+	case PositionTopLeft:
+		return image.Pt(left, top)
+	case PositionTopRight:
+		return image.Pt(right, top)
+	case PositionBottomLeft:
+		return image.Pt(left, bottom)
+	case PositionCenter:
+		return image.Pt(bounds.Min.X+(bounds.Dx()-size.X)/2, bounds.Min.Y+(bounds.Dy()-size.Y)/2)
+	default:
+		return image.Pt(right, bottom)
+	}
+}
+
+func parseHexColor(value string) (color.RGBA, error) {
+	hex, ok := strings.CutPrefix(value, "#")
+	if !ok || len(hex) != 6 {
+		return color.RGBA{}, fmt.Errorf("需要 #RRGGBB 格式: %s", value)
+	}
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("需要 #RRGGBB 格式: %s", value)
+	}
+	return color.RGBA{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb), A: 255}, nil
+}
+
+// watermarkFrame 将水印内容编码为定长的比特序列
+func watermarkFrame(payload string) ([]byte, error) {
+	if len(payload) > MaxWatermarkPayload {
+		return nil, fmt.Errorf("隐形水印内容超过 %d 字节: %s", MaxWatermarkPayload, payload)
+	}
+	frame := make([]byte, watermarkFrameBytes)
+	frame[0] = byte(len(payload))
+	copy(frame[1:], payload)
+	binary.BigEndian.PutUint32(frame[watermarkFrameBytes-4:], crc32.ChecksumIEEE(frame[:watermarkFrameBytes-4]))
+
+	bits := make([]byte, watermarkFrameBits)
+	for i := range bits {
+		bits[i] = frame[i/8] >> (7 - i%8) & 1
+	}
+	return bits, nil
+}
+
+// parseWatermarkFrame 解析比特序列，校验失败表示图片中没有水印
+func parseWatermarkFrame(bits []byte) (string, bool) {
+	if len(bits) != watermarkFrameBits {
+		return "", false
+	}
+	frame := make([]byte, watermarkFrameBytes)
+	for i, bit := range bits {
+		frame[i/8] |= bit << (7 - i%8)
+	}
+	if binary.BigEndian.Uint32(frame[watermarkFrameBytes-4:]) != crc32.ChecksumIEEE(frame[:watermarkFrameBytes-4]) {
+		return "", false
+	}
+	length := int(frame[0])
+	if length > MaxWatermarkPayload {
+		return "", false
+	}
+	return string(frame[1 : 1+length]), true
+}
+
+// embedLSB 将比特序列循环写入每个像素 R、G、B 的最低有效位
+func embedLSB(img *image.RGBA, bits []byte) error {
+	slots := img.Bounds().Dx() * img.Bounds().Dy() * 3
+	if slots < len(bits) {
+		return fmt.Errorf("图片尺寸 %dx%d 太小，无法嵌入 lsb 隐形水印", img.Bounds().Dx(), img.Bounds().Dy())
+	}
+	for i := 0; i < slots; i++ {
+		offset := i/3*4 + i%3
+		img.Pix[offset] = img.Pix[offset]&^1 | bits[i%len(bits)]
+	}
+	return nil
+}
+
+// extractLSB 读取 embedLSB 写入的比特序列，重复写入的比特按多数表决
+func extractLSB(img *image.RGBA) []byte {
+	slots := img.Bounds().Dx() * img.Bounds().Dy() * 3
+	if slots < watermarkFrameBits {
+		return nil
+	}
+	votes := make([]int, watermarkFrameBits)
+	for i := 0; i < slots; i++ {
+		if img.Pix[i/3*4+i%3]&1 == 1 {
+			votes[i%watermarkFrameBits]++
+		} else {
+			votes[i%watermarkFrameBits]--
+		}
+	}
+	return majority(votes)
+}
+
+// dctBasis 8x8 DCT-II 在 (dctU, dctV) 处的正交基
+var dctBasis = func() (basis [8][8]float64) {
+	alpha := func(k int) float64 {
+		if k == 0 {
+			return math.Sqrt(1.0 / 8)
+		}
+		return math.Sqrt(2.0 / 8)
+	}
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			basis[y][x] = alpha(dctU) * alpha(dctV) *
+				math.Cos(float64(2*x+1)*dctU*math.Pi/16) * math.Cos(float64(2*y+1)*dctV*math.Pi/16)
+		}
+	}
+	return basis
+}()
+
+// embedDCT 按量化索引调制（QIM）将比特序列循环写入每个 8x8 分块亮度的 DCT 系数，
+// 分块与 JPEG 的分块对齐；R、G、B 加上相同的偏移，只改变亮度
+func embedDCT(img *image.RGBA, bits []byte, strength float64) error {
+	cols, rows := img.Bounds().Dx()/8, img.Bounds().Dy()/8
+	if cols*rows < len(bits) {
+		return fmt.Errorf("图片尺寸 %dx%d 太小，无法嵌入 dct 隐形水印", img.Bounds().Dx(), img.Bounds().Dy())
+	}
+	for i := 0; i < cols*rows; i++ {
+		x0, y0 := i%cols*8, i/cols*8
+		coefficient := blockCoefficient(img, x0, y0)
+		offset := float64(bits[i%len(bits)]) * strength / 2
+		delta := math.Round((coefficient-offset)/strength)*strength + offset - coefficient
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 8; x++ {
+				change := delta * dctBasis[y][x]
+				p := img.PixOffset(x0+x, y0+y)
+				for c := 0; c < 3; c++ {
+					img.Pix[p+c] = uint8(min(max(math.Round(float64(img.Pix[p+c])+change), 0), 255))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// extractDCT 读取 embedDCT 写入的比特序列，重复写入的比特按多数表决
+func extractDCT(img *image.RGBA, strength float64) []byte {
+	cols, rows := img.Bounds().Dx()/8, img.Bounds().Dy()/8
+	if cols*rows < watermarkFrameBits {
+		return nil
+	}
+	votes := make([]int, watermarkFrameBits)
+	for i := 0; i < cols*rows; i++ {
+		coefficient := blockCoefficient(img, i%cols*8, i/cols*8)
+		if int64(math.Round(coefficient/(strength/2)))%2 != 0 {
+			votes[i%watermarkFrameBits]++
+		} else {
+			votes[i%watermarkFrameBits]--
+		}
+	}
+	return majority(votes)
+}
+
+func blockCoefficient(img *image.RGBA, x0, y0 int) float64 {
+	var sum float64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			p := img.PixOffset(x0+x, y0+y)
+			luma := 0.299*float64(img.Pix[p]) + 0.587*float64(img.Pix[p+1]) + 0.114*float64(img.Pix[p+2])
+			sum += luma * dctBasis[y][x]
+		}
+	}
+	return sum
+}
+
+func majority(votes []int) []byte {
+	bits := make([]byte, len(votes))
+	for i, vote := range votes {
+		if vote > 0 {
+			bits[i] = 1
+		}
+	}
+	return bits
+}
@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"image"
+	"strings"
+	"testing"
+)
+
+func newTestWatermarker(t *testing.T, profiles map[string]WatermarkProfile) *Watermarker {
+	t.Helper()
+	return NewWatermarker(newTestConfigStore(t, func(c *Config) {
+		c.Watermark.Profiles = profiles
+	}))
+}
+
+// encodeTestImage 按指定格式和质量编码后返回图片数据
+func encodeTestImage(t *testing.T, img image.Image, format string, quality int) []byte {
+	t.Helper()
+	encoded, err := encodeImage(img, OutputConfig{Format: format, Quality: quality}, nil)
+	if err != nil {
+		t.Fatalf("encodeImage(%s) error = %v", format, err)
+	}
+	return encoded.Data
+}
+
+func TestWatermarkRoundTrip(t *testing.T) {
+	w := newTestWatermarker(t, map[string]WatermarkProfile{
+		"dct": {Invisible: &InvisibleWatermark{Method: WatermarkDCT, Payload: "{image_id}"}},
+		"lsb": {Invisible: &InvisibleWatermark{Method: WatermarkLSB, Payload: "{principal}/{request_id}"}},
+	})
+	record := &ImageRecord{ID: "0d9f3c1e-5b7a-4c2d-9e8f-1a2b3c4d5e6f", RequestID: "req-1", Principal: "api_key:alice"}
+
+	tests := []struct {
+		name    string
+		profile string
+		format  string
+		quality int
+		method  string
+		payload string
+	}{
+		{"dct png", "dct", FormatPNG, 0, WatermarkDCT, record.ID},
+		{"dct jpeg 50", "dct", FormatJPEG, 50, WatermarkDCT, record.ID},
+		{"dct webp 80", "dct", FormatWebP, 80, WatermarkDCT, record.ID},
+		{"lsb png", "lsb", FormatPNG, 0, WatermarkLSB, "api_key:alice/req-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			marked, err := w.Apply(testImage(512, 512, 5), tt.profile, record)
+			if err != nil {
+				t.Fatalf("Apply() error = %v", err)
+			}
+			report, err := w.Detect(encodeTestImage(t, marked, tt.format, tt.quality))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !report.Detected || report.Method != tt.method || report.Payload != tt.payload {
+				t.Errorf("Detect() = %+v, want %s %s", report, tt.method, tt.payload)
+			}
+		})
+	}
+}
+
+func TestWatermarkDetectNone(t *testing.T) {
+	w := newTestWatermarker(t, nil)
+	for _, format := range []string{FormatPNG, FormatJPEG} {
+		report, err := w.Detect(encodeTestImage(t, testImage(512, 512, 5), format, 90))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Detected {
+			t.Errorf("%s 没有水印的图片 Detect() = %+v", format, report)
+		}
+	}
+	if _, err := w.Detect([]byte("not an image")); err == nil {
+		t.Error("无法解码的图片 Detect() 应返回错误")
+	}
+}
+
+// lsb 水印无法经受有损压缩，压缩后不应检测出错误的内容
+func TestWatermarkLSBLossy(t *testing.T) {
+	w := newTestWatermarker(t, map[string]WatermarkProfile{
+		"lsb": {Invisible: &InvisibleWatermark{Method: WatermarkLSB, Payload: "{image_id}"}},
+	})
+	marked, err := w.Apply(testImage(512, 512, 5), "lsb", &ImageRecord{ID: "img-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := w.Detect(encodeTestImage(t, marked, FormatJPEG, 90))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Detected && report.Payload != "img-1" {
+		t.Errorf("Detect() = %+v", report)
+	}
+}
+
+func TestWatermarkApplyErrors(t *testing.T) {
+	w := newTestWatermarker(t, map[string]WatermarkProfile{
+		"dct":  {Invisible: &InvisibleWatermark{Method: WatermarkDCT, Payload: "{image_id}"}},
+		"long": {Invisible: &InvisibleWatermark{Method: WatermarkDCT, Payload: strings.Repeat("x", MaxWatermarkPayload+1)}},
+	})
+	record := &ImageRecord{ID: "img-1"}
+
+	if _, err := w.Apply(testImage(512, 512, 5), "missing", record); err == nil {
+		t.Error("不存在的水印 Apply() 应返回错误")
+	}
+	if _, err := w.Apply(testImage(512, 512, 5), "long", record); err == nil {
+		t.Error("内容过长 Apply() 应返回错误")
+	}
+	if _, err := w.Apply(testImage(64, 64, 5), "dct", record); err == nil {
+		t.Error("图片过小 Apply() 应返回错误")
+	}
+}
+
+func TestVisibleWatermark(t *testing.T) {
+	w := newTestWatermarker(t, map[string]WatermarkProfile{
+		"text": {Visible: &VisibleWatermark{Text: "SAMPLE", Position: PositionBottomRight, Opacity: 1, Color: "#FF0000", Scale: 0.1}},
+	})
+	src := testImage(256, 256, 5)
+	marked, err := w.Apply(src, "text", &ImageRecord{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := func(rect image.Rectangle) int {
+		count := 0
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				r1, g1, b1, _ := src.At(x, y).RGBA()
+				r2, g2, b2, _ := marked.At(x, y).RGBA()
+				if r1 != r2 || g1 != g2 || b1 != b2 {
+					count++
+				}
+			}
+		}
+		return count
+	}
+	if n := changed(image.Rect(128, 192, 256, 256)); n == 0 {
+		t.Error("右下角应绘制文字水印")
+	}
+	if n := changed(image.Rect(0, 0, 128, 128)); n != 0 {
+		t.Errorf("左上角不应改变，changed = %d", n)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"qiuxs.com/stable-diffusion-webui-mcp/internal"
+)
+
+// RequestIDHeader 请求 ID 的请求头和响应头
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength 接受调用方传入的请求 ID 的最大长度，超出或包含非法字符时重新生成
+const maxRequestIDLength = 128
+
+// requestLogMiddleware 为每个请求分配请求 ID 并写入 context 和响应头，请求结束后输出访问日志；
+// 调用方传入的 X-Request-ID 会被沿用，便于与上游系统的日志关联
+func requestLogMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		requestId := c.GetHeader(RequestIDHeader)
+		if !validRequestID(requestId) {
+			requestId = uuid.NewString()
+		}
+		// MCP 工具调用从请求头读取请求 ID
+		c.Request.Header.Set(RequestIDHeader, requestId)
+		c.Header(RequestIDHeader, requestId)
+		c.Request = c.Request.WithContext(internal.WithLogFields(c.Request.Context(), logrus.Fields{
+			internal.LogFieldRequestID: requestId,
+		}))
+
+		c.Next()
+
+		fields := logrus.Fields{
+			"method":     c.Request.Method,
+			"path":       c.Request.URL.Path,
+			"status":     c.Writer.Status(),
+			"latency_ms": time.Since(start).Milliseconds(),
+			"client_ip":  c.ClientIP(),
+			"bytes":      c.Writer.Size(),
+		}
+		if sessionId := c.GetHeader("Mcp-Session-Id"); sessionId != "" {
+			fields[internal.LogFieldSession] = sessionId
+		}
+		if len(c.Errors) > 0 {
+			fields["errors"] = c.Errors.String()
+		}
+
+		entry := internal.Logger(c.Request.Context()).WithFields(fields)
+		switch {
+		case c.Writer.Status() >= 500:
+			entry.Error("HTTP 请求")
+		case c.Writer.Status() >= 400:
+			entry.Warn("HTTP 请求")
+		default:
+			entry.Info("HTTP 请求")
+		}
+	}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if r < '!' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
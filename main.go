@@ -1,43 +1,151 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"strings"
+	"os"
+	"path/filepath"
+	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 	"qiuxs.com/stable-diffusion-webui-mcp/internal"
 	"qiuxs.com/stable-diffusion-webui-mcp/sdwebui"
 )
 
 func main() {
+	// 子命令
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "keygen":
+			runKeygen(os.Args[2:])
+			return
+		case "gc":
+			runGC(os.Args[2:])
+			return
+		case "provenance-keygen":
+			runProvenanceKeygen(os.Args[2:])
+			return
+		}
+	}
+
 	var (
+		configPath    string
 		port          string
 		sdwebuiUrl    string
 		imageSavePath string
 		serverUrl     string
 	)
 
-	flag.StringVar(&port, "port", ":18080", "端口")
-	flag.StringVar(&sdwebuiUrl, "sdwebui-url", "http://127.0.0.1:7860", "Stable Diffusion WebUI 服务地址")
-	flag.StringVar(&imageSavePath, "image-save-path", "./images", "生成的图片存储位置")
-	flag.StringVar(&serverUrl, "server-url", "http://127.0.0.1:18080", "访问MCP服务的url")
+	flag.StringVar(&configPath, "config", os.Getenv(internal.EnvConfigPath), "配置文件路径（YAML），也可通过 SDMCP_CONFIG 指定")
+	flag.StringVar(&port, "port", "", "端口，覆盖 server.listen")
+	flag.StringVar(&sdwebuiUrl, "sdwebui-url", "", "Stable Diffusion WebUI 服务地址，覆盖 backends")
+	flag.StringVar(&imageSavePath, "image-save-path", "", "生成的图片存储位置，覆盖 storage.path")
+	flag.StringVar(&serverUrl, "server-url", "", "访问MCP服务的url，覆盖 server.public_url")
 
 	flag.Parse()
 
-	serverUrlNoSuffix, _ := strings.CutSuffix(serverUrl, "/")
+	// 命令行参数优先级最高，仅覆盖显式传入的参数，重新加载配置时同样生效
+	overrides := func(config *internal.Config) {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "port":
+				config.Server.Listen = port
+			case "sdwebui-url":
+				config.Backends = []internal.BackendConfig{{Name: "default", URL: sdwebuiUrl}}
+			case "image-save-path":
+				config.Storage.Type = internal.StorageTypeLocal
+				config.Storage.Path = imageSavePath
+			case "server-url":
+				config.Server.PublicURL = serverUrl
+			}
+		})
+	}
+
+	configStore, err := internal.NewConfigStore(configPath, overrides)
+	if err != nil {
+		logrus.Fatalf("加载配置失败:\n%v", err)
+	}
+	config := configStore.Get()
+
+	internal.ConfigureLogging(config.Log)
+	// JSON 日志时不输出 gin 的调试信息，避免混入非 JSON 行
+	if config.Log.Format == internal.LogFormatJSON && os.Getenv(gin.EnvGinMode) == "" {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	configStore.OnChange(func(old, new *internal.Config) {
+		internal.ConfigureLogging(new.Log)
+	})
+
+	for _, backend := range config.Backends {
+		logrus.Infof("using Stable Diffusion WebUI server: %s (%s)", backend.URL, backend.Name)
+	}
+	switch config.Storage.Type {
+	case internal.StorageTypeS3:
+		logrus.Infof("save image to: s3 %s/%s/%s", config.Storage.S3.Endpoint, config.Storage.S3.Bucket, config.Storage.S3.Prefix)
+	default:
+		logrus.Infof("save image to: %s", config.Storage.Path)
+	}
+	logrus.Infof("server url: %s", config.Server.PublicURL)
+
+	shutdownTracing, err := internal.InitTracing(config.Tracing)
+	if err != nil {
+		logrus.Fatalf("初始化链路追踪失败: %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logrus.Warnf("导出剩余的链路追踪数据失败: %v", err)
+		}
+	}()
+	if config.Tracing.Enabled {
+		logrus.Infof("tracing enabled: %s", config.Tracing.Exporter)
+	}
+
+	usageTracker, err := internal.NewUsageTracker(config.Server.DataDir)
+	if err != nil {
+		logrus.Fatalf("初始化用量统计失败: %v", err)
+	}
+
+	urlSigner := internal.NewURLSigner(configStore)
+	storage, err := internal.NewStorage(context.Background(), config.Storage)
+	if err != nil {
+		logrus.Fatalf("初始化图片存储失败: %v", err)
+	}
+	imageIndex, err := internal.OpenImageIndex(config.Server.DataDir)
+	if err != nil {
+		logrus.Fatalf("初始化图片索引失败: %v", err)
+	}
+	defer imageIndex.Close()
+
+	variantCache, err := internal.NewVariantCache(configStore, filepath.Join(config.Server.DataDir, "variants"))
+	if err != nil {
+		logrus.Fatalf("初始化缩放图片缓存失败: %v", err)
+	}
+
+	provenanceSigner := internal.NewProvenanceSigner(configStore)
+	watermarker := internal.NewWatermarker(configStore)
+
+	fileService := internal.NewFileService(storage, imageIndex, urlSigner, variantCache, provenanceSigner, watermarker, config.Storage.Dedup)
+
+	auditLog := internal.NewAuditLog(configStore, config.Server.DataDir)
+	defer auditLog.Close()
 
-	logrus.Infof("using Stable Diffusion WebUI server: %s", sdwebuiUrl)
-	logrus.Infof("save image to: %s", imageSavePath)
-	logrus.Infof("server url: %s", serverUrlNoSuffix)
+	moderator := internal.NewModerator(configStore, config.Server.DataDir)
+	sdwebuiService := sdwebui.NewSdwebuiService(configStore, fileService, moderator)
 
-	fileService := internal.NewFileService(imageSavePath, serverUrlNoSuffix)
+	mcpHandler := NewMcpHandler(configStore, sdwebuiService, fileService, urlSigner, usageTracker)
+	apiHandler := NewApiHandler(configStore, sdwebuiService, fileService, auditLog, moderator)
+	appService := NewAppService(configStore, sdwebuiService, mcpHandler, apiHandler, urlSigner, usageTracker, auditLog)
 
-	sdwebuiService := sdwebui.NewSdwebuiService(sdwebuiUrl, fileService)
+	// 监听 SIGHUP 和配置文件变化，运行时重新加载配置
+	go configStore.Watch(context.Background())
 
-	apiHandler := NewApiHandler(fileService)
-	appService := NewAppService(sdwebuiService, apiHandler)
+	// 按保留策略定期清理图片
+	go internal.NewRetentionSweeper(configStore, storage, imageIndex).Run(context.Background())
 
-	if err := appService.Start(port); err != nil {
+	if err := appService.Start(config.Server.Listen); err != nil {
 		logrus.Fatalf("failed to run server: %v", err)
 	}
 }
@@ -3,13 +3,21 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"time"
 
+	"qiuxs.com/stable-diffusion-webui-mcp/internal"
 	"qiuxs.com/stable-diffusion-webui-mcp/sdwebui"
 )
 
 type McpHandler struct {
+	config         *internal.ConfigStore
 	sdwebuiService *sdwebui.SdwebuiService
+	fileService    *internal.FileService
+	urlSigner      *internal.URLSigner
+	usageTracker   *internal.UsageTracker
 }
 
 func (h *McpHandler) textToImage(ctx context.Context, arg sdwebui.TextToImageRequest) *MCPToolResult {
@@ -74,8 +82,8 @@ func (h *McpHandler) textToImage(ctx context.Context, arg sdwebui.TextToImageReq
 	}
 }
 
-func (h *McpHandler) sdModels(ctx context.Context) *MCPToolResult {
-	models, err := h.sdwebuiService.SdModels(ctx)
+func (h *McpHandler) sdModels(ctx context.Context, arg sdwebui.SdModelsRequest) *MCPToolResult {
+	models, err := h.sdwebuiService.SdModels(ctx, arg)
 	if err != nil {
 		return errorResult(fmt.Sprintf("获取模型列表失败: %v", err))
 	}
@@ -99,6 +107,158 @@ func (h *McpHandler) switchModel(ctx context.Context, arg sdwebui.SwitchModelReq
 	return errorResult(response.Message)
 }
 
+func (h *McpHandler) serverStatus(ctx context.Context, arg sdwebui.ServerStatusRequest) *MCPToolResult {
+	response, err := serverStatus(ctx, h.config.Get(), h.sdwebuiService, h.fileService, arg.Backend)
+	if err != nil {
+		return errorResult(fmt.Sprintf("获取服务状态失败: %v", err))
+	}
+	jsonStatus, err := json.Marshal(response)
+	if err != nil {
+		return errorResult(fmt.Sprintf("获取服务状态失败: %v", err))
+	}
+	return successResult(toContents(makeTextContent(string(jsonStatus))))
+}
+
+func (h *McpHandler) listPresets(ctx context.Context) *MCPToolResult {
+	jsonPresets, err := json.Marshal(h.sdwebuiService.Presets())
+	if err != nil {
+		return errorResult(fmt.Sprintf("获取预设列表失败: %v", err))
+	}
+	return successResult(toContents(makeTextContent(string(jsonPresets))))
+}
+
+func (h *McpHandler) signImageUrl(ctx context.Context, arg SignImageUrlRequest) *MCPToolResult {
+	relativePath, err := internal.RelativePathFromURL(arg.Url)
+	if err != nil {
+		return errorResult(err.Error())
+	}
+	// 签名链接无需认证即可访问，非 admin 调用方只能为自己生成的图片签名
+	principal := internal.PrincipalFromContext(ctx)
+	if _, err := ownImage(h.fileService, principal, "", relativePath); err != nil {
+		switch {
+		case errors.Is(err, internal.ErrImageNotFound) && principal.HasScope(internal.ScopeAdmin) && h.fileService.Exists(ctx, relativePath):
+			// admin 可以为没有元数据记录的文件（如启用索引前生成的图片）签名
+		case errors.Is(err, internal.ErrImageNotFound), errors.Is(err, errForeignImage):
+			return errorResult(fmt.Sprintf("图片不存在: %s", relativePath))
+		default:
+			return errorResult(fmt.Sprintf("获取图片信息失败: %v", err))
+		}
+	}
+
+	signedUrl, expiresAt, err := h.urlSigner.Sign(relativePath, time.Duration(arg.TTLSeconds)*time.Second)
+	if err != nil {
+		return errorResult(fmt.Sprintf("生成签名链接失败: %v", err))
+	}
+
+	return successResult(toContents(
+		makeTextContent(signedUrl),
+		makeTextContent(fmt.Sprintf("有效期至: %s", expiresAt.Format(time.RFC3339))),
+	))
+}
+
+func (h *McpHandler) listImages(ctx context.Context, arg ListImagesRequest) *MCPToolResult {
+	return h.searchImages(ctx, SearchImagesRequest{
+		DateFrom: arg.DateFrom,
+		DateTo:   arg.DateTo,
+		Limit:    arg.Limit,
+		Offset:   arg.Offset,
+	})
+}
+
+func (h *McpHandler) searchImages(ctx context.Context, arg SearchImagesRequest) *MCPToolResult {
+	response, err := searchImages(h.fileService, internal.PrincipalFromContext(ctx), arg)
+	if err != nil {
+		return errorResult(fmt.Sprintf("检索图片失败: %v", err))
+	}
+	jsonImages, err := json.Marshal(response)
+	if err != nil {
+		return errorResult(fmt.Sprintf("检索图片失败: %v", err))
+	}
+	return successResult(toContents(makeTextContent(string(jsonImages))))
+}
+
+func (h *McpHandler) pinImage(ctx context.Context, arg PinImageRequest) *MCPToolResult {
+	record, err := pinImage(h.fileService, internal.PrincipalFromContext(ctx), arg)
+	if err != nil {
+		return errorResult(fmt.Sprintf("设置图片置顶失败: %v", err))
+	}
+	if record.Pinned {
+		return successResult(toContents(makeTextContent(fmt.Sprintf("已置顶图片 %s，该图片不会被自动清理", record.ID))))
+	}
+	return successResult(toContents(makeTextContent(fmt.Sprintf("已取消置顶图片 %s", record.ID))))
+}
+
+// exportImages 将图片打包保存到存储中，返回压缩包的下载地址
+func (h *McpHandler) exportImages(ctx context.Context, arg ExportImagesRequest) *MCPToolResult {
+	principal := internal.PrincipalFromContext(ctx)
+	records, err := selectExportImages(h.fileService, principal, arg, h.config.Get().Limits.MaxExportImages)
+	if err != nil {
+		return errorResult(fmt.Sprintf("导出图片失败: %v", err))
+	}
+
+	exportUrl, err := h.fileService.SaveExport(ctx, ".zip", func(w io.Writer) error {
+		return writeExportArchive(ctx, w, h.fileService, records, arg.Manifest)
+	})
+	if err != nil {
+		return errorResult(fmt.Sprintf("导出图片失败: %v", err))
+	}
+	internal.Logger(ctx).Infof("导出了 %d 张图片: %s", len(records), exportUrl)
+
+	return successResult(toContents(
+		makeTextContent(fmt.Sprintf("已导出 %d 张图片，压缩包中包含图片和清单文件", len(records))),
+		makeTextContent(exportUrl),
+	))
+}
+
+// verifyProvenance 验证图片的溯源清单，返回 JSON 格式的验证结果
+func (h *McpHandler) verifyProvenance(ctx context.Context, arg VerifyProvenanceRequest) *MCPToolResult {
+	report, err := verifyProvenance(ctx, h.fileService, internal.PrincipalFromContext(ctx), arg)
+	if errors.Is(err, errForeignImage) {
+		err = internal.ErrImageNotFound
+	}
+	if err != nil {
+		return errorResult(fmt.Sprintf("验证溯源清单失败: %v", err))
+	}
+	jsonReport, err := json.Marshal(report)
+	if err != nil {
+		return errorResult(fmt.Sprintf("验证溯源清单失败: %v", err))
+	}
+	return successResult(toContents(makeTextContent(string(jsonReport))))
+}
+
+// detectWatermark 检测图片中的隐形水印，返回 JSON 格式的检测结果
+func (h *McpHandler) detectWatermark(ctx context.Context, arg DetectWatermarkRequest) *MCPToolResult {
+	report, err := detectWatermark(ctx, h.fileService, internal.PrincipalFromContext(ctx), arg)
+	if errors.Is(err, errForeignImage) {
+		err = internal.ErrImageNotFound
+	}
+	if err != nil {
+		return errorResult(fmt.Sprintf("检测水印失败: %v", err))
+	}
+	jsonReport, err := json.Marshal(report)
+	if err != nil {
+		return errorResult(fmt.Sprintf("检测水印失败: %v", err))
+	}
+	return successResult(toContents(makeTextContent(string(jsonReport))))
+}
+
+func (h *McpHandler) myUsage(ctx context.Context) *MCPToolResult {
+	principal := internal.PrincipalFromContext(ctx)
+	rateLimit, quota := h.config.Get().LimitsFor(principal)
+
+	jsonUsage, err := json.Marshal(MyUsageResponse{
+		Principal: principal.ID,
+		Role:      principal.Role,
+		Usage:     h.usageTracker.Get(principal.ID),
+		Quota:     quota,
+		RateLimit: rateLimit,
+	})
+	if err != nil {
+		return errorResult(fmt.Sprintf("获取用量失败: %v", err))
+	}
+	return successResult(toContents(makeTextContent(string(jsonUsage))))
+}
+
 func toContents(content ...MCPContent) []MCPContent {
 	return content
 }
@@ -129,8 +289,12 @@ func errorResult(message string) *MCPToolResult {
 	}
 }
 
-func NewMcpHandler(sdwebuiService *sdwebui.SdwebuiService) *McpHandler {
+func NewMcpHandler(config *internal.ConfigStore, sdwebuiService *sdwebui.SdwebuiService, fileService *internal.FileService, urlSigner *internal.URLSigner, usageTracker *internal.UsageTracker) *McpHandler {
 	return &McpHandler{
+		config:         config,
 		sdwebuiService: sdwebuiService,
+		fileService:    fileService,
+		urlSigner:      urlSigner,
+		usageTracker:   usageTracker,
 	}
 }
@@ -3,11 +3,21 @@ package main
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"runtime/debug"
+	"strings"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/modelcontextprotocol/go-sdk/mcp"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"qiuxs.com/stable-diffusion-webui-mcp/internal"
 	"qiuxs.com/stable-diffusion-webui-mcp/sdwebui"
 )
 
@@ -32,14 +42,26 @@ func withPanicRecovery[T any](
 ) func(context.Context, *mcp.CallToolRequest, T) (*mcp.CallToolResult, any, error) {
 
 	return func(ctx context.Context, req *mcp.CallToolRequest, args T) (result *mcp.CallToolResult, resp any, err error) {
+		ctx, span := internal.Tracer().Start(toolTraceContext(ctx, req), "tools/call "+toolName,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("mcp.tool.name", toolName)),
+		)
+		if req != nil && req.Session != nil && req.Session.ID() != "" {
+			span.SetAttributes(attribute.String("mcp.session.id", req.Session.ID()))
+		}
+		ctx = toolLogContext(ctx, req, toolName)
+		span.SetAttributes(attribute.String("sdmcp.job_id", internal.JobIDFromContext(ctx)))
+		internal.Logger(ctx).WithField("args", toolArgsMap(args)).Debug("工具调用开始")
+		start := time.Now()
+
 		defer func() {
+			defer span.End()
 			if r := recover(); r != nil {
-				logrus.WithFields(logrus.Fields{
-					"tool":  toolName,
+				internal.Logger(ctx).WithFields(logrus.Fields{
 					"panic": r,
-				}).Error("Tool handler panicked")
-
-				logrus.Errorf("Stack trace:\n%s", debug.Stack())
+					"stack": string(debug.Stack()),
+				}).Error("工具调用发生 panic")
+				internal.RecordToolCall(toolName, internal.OutcomePanic, 0)
 
 				result = &mcp.CallToolResult{
 					Content: []mcp.Content{
@@ -51,6 +73,19 @@ func withPanicRecovery[T any](
 				}
 				resp = nil
 				err = nil
+				span.SetStatus(codes.Error, fmt.Sprintf("panic: %v", r))
+				return
+			}
+			logger := internal.Logger(ctx).WithField("duration_ms", time.Since(start).Milliseconds())
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				logger.WithError(err).Warn("工具调用失败")
+			} else if result != nil && result.IsError {
+				span.SetStatus(codes.Error, "工具返回错误结果")
+				logger.WithField("error", toolResultText(result)).Warn("工具调用返回错误")
+			} else {
+				logger.Info("工具调用完成")
 			}
 		}()
 
@@ -58,6 +93,252 @@ func withPanicRecovery[T any](
 	}
 }
 
+// toolLogContext 为工具调用分配 job ID，并将请求 ID、工具名和会话写入日志字段；
+// Streamable HTTP 的请求 ID 由 requestLogMiddleware 写入请求头
+func toolLogContext(ctx context.Context, req *mcp.CallToolRequest, toolName string) context.Context {
+	fields := logrus.Fields{
+		internal.LogFieldJobID: uuid.NewString(),
+		internal.LogFieldTool:  toolName,
+	}
+	if req != nil {
+		if req.Extra != nil && internal.RequestIDFromContext(ctx) == "" {
+			if requestId := req.Extra.Header.Get(RequestIDHeader); requestId != "" {
+				fields[internal.LogFieldRequestID] = requestId
+			}
+		}
+		if req.Session != nil && req.Session.ID() != "" {
+			fields[internal.LogFieldSession] = req.Session.ID()
+		}
+	}
+	return internal.WithLogFields(ctx, fields)
+}
+
+// toolResultText 返回工具结果中的文本内容，用于记录错误原因
+func toolResultText(result *mcp.CallToolResult) string {
+	var texts []string
+	for _, content := range result.Content {
+		if text, ok := content.(*mcp.TextContent); ok {
+			texts = append(texts, text.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// toolTraceContext 提取上游的 trace 上下文：优先使用 Streamable HTTP 请求头中的 traceparent，
+// 其次使用工具调用 _meta 中的 traceparent，便于通过 SSE 等无法携带请求头的传输方式串联链路
+func toolTraceContext(ctx context.Context, req *mcp.CallToolRequest) context.Context {
+	if req == nil {
+		return ctx
+	}
+	if req.Extra != nil {
+		ctx = internal.ExtractTraceContext(ctx, req.Extra.Header)
+		if trace.SpanContextFromContext(ctx).IsRemote() {
+			return ctx
+		}
+	}
+	if req.Params != nil && req.Params.Meta != nil {
+		carrier := propagation.MapCarrier{}
+		for _, key := range otel.GetTextMapPropagator().Fields() {
+			if value, ok := req.Params.Meta[key].(string); ok {
+				carrier[key] = value
+			}
+		}
+		ctx = otel.GetTextMapPropagator().Extract(ctx, carrier)
+	}
+	return ctx
+}
+
+// withAudit 将工具调用写入审计日志，位于 withPanicRecovery 之内、withPolicy 之外，
+// 被拒绝、限流和发生 panic 的调用同样会记录；调用方、生成的图片等由内层处理补充到 context 中的审计记录
+func withAudit[T any](
+	appService *AppService,
+	toolName string,
+	scope string,
+	handler func(context.Context, *mcp.CallToolRequest, T) (*mcp.CallToolResult, any, error),
+) func(context.Context, *mcp.CallToolRequest, T) (*mcp.CallToolResult, any, error) {
+
+	return func(ctx context.Context, req *mcp.CallToolRequest, args T) (result *mcp.CallToolResult, resp any, err error) {
+		if !appService.auditLog.Enabled() {
+			return handler(ctx, req, args)
+		}
+
+		entry := &internal.AuditEntry{
+			Time:      time.Now(),
+			Action:    internal.AuditActionTool,
+			Tool:      toolName,
+			Admin:     scope == internal.ScopeAdmin,
+			RequestID: internal.RequestIDFromContext(ctx),
+			JobID:     internal.JobIDFromContext(ctx),
+			Args:      internal.AuditArgs(toolArgsMap(args)),
+		}
+		if req != nil && req.Session != nil {
+			entry.Session = req.Session.ID()
+		}
+
+		completed := false
+		defer func() {
+			entry.DurationMs = time.Since(entry.Time).Milliseconds()
+			switch {
+			case !completed:
+				entry.Outcome = internal.OutcomePanic
+			case entry.Outcome != "":
+				// 拒绝或限流，由内层设置
+			case err != nil:
+				entry.Outcome, entry.Error = internal.OutcomeError, err.Error()
+			case result != nil && result.IsError:
+				entry.Outcome, entry.Error = internal.OutcomeError, toolResultText(result)
+			default:
+				entry.Outcome = internal.OutcomeSuccess
+			}
+			appService.auditLog.Write(entry)
+		}()
+
+		result, resp, err = handler(internal.WithAuditEntry(ctx, entry), req, args)
+		completed = true
+		return result, resp, err
+	}
+}
+
+// withPolicy 工具调用的授权策略：检查调用方的权限范围、角色允许的工具和参数约束，
+// 拒绝时返回 MCP 错误结果；允许时将调用方写入 context 供后续处理使用
+func withPolicy[T any](
+	appService *AppService,
+	toolName string,
+	scope string,
+	handler func(context.Context, *mcp.CallToolRequest, T) (*mcp.CallToolResult, any, error),
+) func(context.Context, *mcp.CallToolRequest, T) (*mcp.CallToolResult, any, error) {
+
+	return func(ctx context.Context, req *mcp.CallToolRequest, args T) (*mcp.CallToolResult, any, error) {
+		principal := principalFromRequest(ctx, appService, req)
+
+		if err := appService.config.Get().Authorize(principal, toolName, scope, toolArgsMap(args)); err != nil {
+			fields := logrus.Fields{"reason": err.Error()}
+			if principal != nil {
+				fields[internal.LogFieldPrincipal] = principal.ID
+				fields["role"] = principal.Role
+			}
+			internal.Logger(ctx).WithFields(fields).Warn("工具调用被拒绝")
+			internal.SetAuditPrincipal(ctx, principal)
+			internal.SetAuditOutcome(ctx, internal.OutcomeDenied, err.Error())
+			internal.RecordToolCall(toolName, internal.OutcomeDenied, 0)
+			return convertToMCPResult(errorResult(err.Error())), nil, nil
+		}
+
+		if principal != nil {
+			trace.SpanFromContext(ctx).SetAttributes(attribute.String("sdmcp.principal", principal.ID))
+			ctx = internal.WithLogFields(ctx, logrus.Fields{internal.LogFieldPrincipal: principal.ID})
+			internal.SetAuditPrincipal(ctx, principal)
+		}
+		return handler(internal.WithPrincipal(ctx, principal), req, args)
+	}
+}
+
+// meteredTools 计入 GPU 用量配额的工具
+var meteredTools = map[string]bool{
+	internal.ToolTxt2Img: true,
+}
+
+// withUsageLimits 按调用方执行工具调用限流和 GPU 用量配额检查，需位于 withPolicy 之内以获取调用方
+func withUsageLimits[T any](
+	appService *AppService,
+	toolName string,
+	handler func(context.Context, *mcp.CallToolRequest, T) (*mcp.CallToolResult, any, error),
+) func(context.Context, *mcp.CallToolRequest, T) (*mcp.CallToolResult, any, error) {
+
+	return func(ctx context.Context, req *mcp.CallToolRequest, args T) (*mcp.CallToolResult, any, error) {
+		config := appService.config.Get()
+		principal := internal.PrincipalFromContext(ctx)
+		rateLimit, quota := config.LimitsFor(principal)
+
+		// 匿名调用方按会话限流
+		limiterKey := principal.ID
+		if principal.Kind == internal.PrincipalAnonymous && req != nil && req.Session != nil && req.Session.ID() != "" {
+			limiterKey = "session:" + req.Session.ID()
+		}
+		if err := appService.rateLimiter.Allow("tool:"+limiterKey, rateLimit); err != nil {
+			return limitExceededResult(ctx, toolName, err), nil, nil
+		}
+
+		if !meteredTools[toolName] {
+			return handler(ctx, req, args)
+		}
+
+		effectiveArgs := config.EffectiveArgs(toolName, toolArgsMap(args))
+		cost := internal.EstimateMegapixelSteps(effectiveArgs)
+		reservation, err := appService.usageTracker.Reserve(principal.ID, quota, cost)
+		if err != nil {
+			return limitExceededResult(ctx, toolName, err), nil, nil
+		}
+
+		// GPU 秒数按工具调用耗时统计，失败或超时的调用同样占用了后端，只计入 GPU 秒数；
+		// panic 时也需要释放预留的用量
+		start := time.Now()
+		var result *mcp.CallToolResult
+		var resp any
+		defer func() {
+			gpuSeconds := time.Since(start).Seconds()
+			if err == nil && result != nil && !result.IsError {
+				images := int64(max(1, intArg(effectiveArgs, "batch_size")) * max(1, intArg(effectiveArgs, "n_iter")))
+				reservation.Settle(images, cost, gpuSeconds)
+			} else {
+				reservation.Settle(0, 0, gpuSeconds)
+			}
+		}()
+		result, resp, err = handler(ctx, req, args)
+		return result, resp, err
+	}
+}
+
+// withMetrics 记录工具调用的结果和耗时，位于最内层，只统计实际执行的调用；
+// 被拒绝、限流和发生 panic 的调用由对应的中间件记录
+func withMetrics[T any](
+	toolName string,
+	handler func(context.Context, *mcp.CallToolRequest, T) (*mcp.CallToolResult, any, error),
+) func(context.Context, *mcp.CallToolRequest, T) (*mcp.CallToolResult, any, error) {
+
+	return func(ctx context.Context, req *mcp.CallToolRequest, args T) (*mcp.CallToolResult, any, error) {
+		start := time.Now()
+		result, resp, err := handler(ctx, req, args)
+		outcome := internal.OutcomeSuccess
+		if err != nil || result == nil || result.IsError {
+			outcome = internal.OutcomeError
+		}
+		internal.RecordToolCall(toolName, outcome, time.Since(start))
+		return result, resp, err
+	}
+}
+
+// limitExceededResult 返回限流或配额错误，并在 _meta.retry_after_seconds 中给出建议的重试等待时间
+func limitExceededResult(ctx context.Context, toolName string, err error) *mcp.CallToolResult {
+	internal.Logger(ctx).WithField("reason", err.Error()).Warn("工具调用超出限制")
+	internal.SetAuditOutcome(ctx, internal.OutcomeLimited, err.Error())
+	internal.RecordToolCall(toolName, internal.OutcomeLimited, 0)
+
+	result := convertToMCPResult(errorResult(err.Error()))
+	if retryAfter, ok := internal.RetryAfter(err); ok {
+		result.Meta = mcp.Meta{"retry_after_seconds": internal.RetryAfterSeconds(retryAfter)}
+	}
+	return result
+}
+
+func intArg(args map[string]any, key string) int {
+	value, _ := args[key].(float64)
+	return int(value)
+}
+
+// toolArgsMap 将工具参数转换为 JSON 对象形式，供策略检查使用
+func toolArgsMap(args any) map[string]any {
+	raw, err := json.Marshal(args)
+	if err != nil {
+		return nil
+	}
+	var argsMap map[string]any
+	if err := json.Unmarshal(raw, &argsMap); err != nil {
+		return nil
+	}
+	return argsMap
+}
+
 // convertToMCPResult 将自定义的 MCPToolResult 转换为官方 SDK 的格式
 func convertToMCPResult(result *MCPToolResult) *mcp.CallToolResult {
 	var contents []mcp.Content
@@ -69,7 +350,7 @@ func convertToMCPResult(result *MCPToolResult) *mcp.CallToolResult {
 			// 解码 base64 字符串为 []byte
 			imageData, err := base64.StdEncoding.DecodeString(c.Data)
 			if err != nil {
-				logrus.WithError(err).Error("Failed to decode base64 image data")
+				logrus.WithError(err).Error("解码 base64 图片数据失败")
 				// 如果解码失败，添加错误文本
 				contents = append(contents, &mcp.TextContent{
 					Text: "图片数据解码失败: " + err.Error(),
@@ -89,37 +370,176 @@ func convertToMCPResult(result *MCPToolResult) *mcp.CallToolResult {
 	}
 }
 
+// addTool 注册工具并套用统一的处理链：panic 恢复 → 审计 → 授权策略 → 限流与配额 → 指标 → 工具处理
+func addTool[T any](
+	mcpServer *mcp.Server,
+	appService *AppService,
+	tool *mcp.Tool,
+	scope string,
+	handler func(context.Context, *mcp.CallToolRequest, T) (*mcp.CallToolResult, any, error),
+) {
+	mcp.AddTool(mcpServer, tool,
+		withPanicRecovery(tool.Name,
+			withAudit(appService, tool.Name, scope,
+				withPolicy(appService, tool.Name, scope,
+					withUsageLimits(appService, tool.Name,
+						withMetrics(tool.Name, handler))))))
+}
+
 func registerTools(mcpServer *mcp.Server, appService *AppService) {
-	mcp.AddTool(mcpServer,
+	addTool(mcpServer, appService,
 		&mcp.Tool{
-			Name:        "txt2img",
+			Name:        internal.ToolTxt2Img,
 			Description: "根据文本生成图片",
 		},
-		withPanicRecovery("text_to_image", func(ctx context.Context, req *mcp.CallToolRequest, arg sdwebui.TextToImageRequest) (*mcp.CallToolResult, any, error) {
+		internal.ScopeGenerate,
+		func(ctx context.Context, req *mcp.CallToolRequest, arg sdwebui.TextToImageRequest) (*mcp.CallToolResult, any, error) {
 			result := appService.mcpHandler.textToImage(ctx, arg)
 			return convertToMCPResult(result), nil, nil
-		}),
+		},
 	)
 
-	mcp.AddTool(mcpServer,
+	addTool(mcpServer, appService,
 		&mcp.Tool{
 			Name:        "sd_models",
 			Description: "获取SD模型列表",
 		},
-		withPanicRecovery("sd_models", func(ctx context.Context, req *mcp.CallToolRequest, arg any) (*mcp.CallToolResult, any, error) {
-			result := appService.mcpHandler.sdModels(ctx)
+		internal.ScopeGenerate,
+		func(ctx context.Context, req *mcp.CallToolRequest, arg sdwebui.SdModelsRequest) (*mcp.CallToolResult, any, error) {
+			result := appService.mcpHandler.sdModels(ctx, arg)
+			return convertToMCPResult(result), nil, nil
+		},
+	)
+
+	addTool(mcpServer, appService,
+		&mcp.Tool{
+			Name:        "server_status",
+			Description: "获取服务状态，包括存储是否可写，以及每个后端是否可访问、当前模型、显存、队列长度和最近一次错误",
+		},
+		internal.ScopeGenerate,
+		func(ctx context.Context, req *mcp.CallToolRequest, arg sdwebui.ServerStatusRequest) (*mcp.CallToolResult, any, error) {
+			result := appService.mcpHandler.serverStatus(ctx, arg)
 			return convertToMCPResult(result), nil, nil
-		}),
+		},
 	)
 
-	mcp.AddTool(mcpServer,
+	addTool(mcpServer, appService,
 		&mcp.Tool{
 			Name:        "switch_model",
 			Description: "切换SD模型",
 		},
-		withPanicRecovery("switch_model", func(ctx context.Context, req *mcp.CallToolRequest, arg sdwebui.SwitchModelRequest) (*mcp.CallToolResult, any, error) {
+		internal.ScopeAdmin,
+		func(ctx context.Context, req *mcp.CallToolRequest, arg sdwebui.SwitchModelRequest) (*mcp.CallToolResult, any, error) {
 			result := appService.mcpHandler.switchModel(ctx, arg)
 			return convertToMCPResult(result), nil, nil
-		}),
+		},
+	)
+
+	addTool(mcpServer, appService,
+		&mcp.Tool{
+			Name:        "list_presets",
+			Description: "获取服务端配置的生成参数预设，可在txt2img中通过preset参数使用",
+		},
+		internal.ScopeGenerate,
+		func(ctx context.Context, req *mcp.CallToolRequest, arg any) (*mcp.CallToolResult, any, error) {
+			result := appService.mcpHandler.listPresets(ctx)
+			return convertToMCPResult(result), nil, nil
+		},
+	)
+
+	addTool(mcpServer, appService,
+		&mcp.Tool{
+			Name:        "sign_image_url",
+			Description: "为已生成的图片重新生成带有效期的签名链接，用于分享图片",
+		},
+		internal.ScopeReadFiles,
+		func(ctx context.Context, req *mcp.CallToolRequest, arg SignImageUrlRequest) (*mcp.CallToolResult, any, error) {
+			result := appService.mcpHandler.signImageUrl(ctx, arg)
+			return convertToMCPResult(result), nil, nil
+		},
+	)
+
+	addTool(mcpServer, appService,
+		&mcp.Tool{
+			Name:        "list_images",
+			Description: "按时间倒序列出已生成的图片，可按日期范围过滤并分页；非admin调用方只能看到自己生成的图片",
+		},
+		internal.ScopeReadFiles,
+		func(ctx context.Context, req *mcp.CallToolRequest, arg ListImagesRequest) (*mcp.CallToolResult, any, error) {
+			result := appService.mcpHandler.listImages(ctx, arg)
+			return convertToMCPResult(result), nil, nil
+		},
+	)
+
+	addTool(mcpServer, appService,
+		&mcp.Tool{
+			Name:        "search_images",
+			Description: "按日期范围、模型、提示词、全文关键词、种子、调用方和标签检索已生成的图片，支持分页；非admin调用方只能检索自己生成的图片",
+		},
+		internal.ScopeReadFiles,
+		func(ctx context.Context, req *mcp.CallToolRequest, arg SearchImagesRequest) (*mcp.CallToolResult, any, error) {
+			result := appService.mcpHandler.searchImages(ctx, arg)
+			return convertToMCPResult(result), nil, nil
+		},
+	)
+
+	addTool(mcpServer, appService,
+		&mcp.Tool{
+			Name:        "pin_image",
+			Description: "置顶（收藏）或取消置顶图片，置顶的图片不会被保留策略自动清理",
+		},
+		internal.ScopeGenerate,
+		func(ctx context.Context, req *mcp.CallToolRequest, arg PinImageRequest) (*mcp.CallToolResult, any, error) {
+			result := appService.mcpHandler.pinImage(ctx, arg)
+			return convertToMCPResult(result), nil, nil
+		},
+	)
+
+	addTool(mcpServer, appService,
+		&mcp.Tool{
+			Name:        "export_images",
+			Description: "将指定ID或符合检索条件的图片打包为ZIP压缩包，包含manifest.json或manifest.csv清单（完整生成参数），返回压缩包下载地址；非admin调用方只能导出自己生成的图片",
+		},
+		internal.ScopeReadFiles,
+		func(ctx context.Context, req *mcp.CallToolRequest, arg ExportImagesRequest) (*mcp.CallToolResult, any, error) {
+			result := appService.mcpHandler.exportImages(ctx, arg)
+			return convertToMCPResult(result), nil, nil
+		},
+	)
+
+	addTool(mcpServer, appService,
+		&mcp.Tool{
+			Name:        "verify_provenance",
+			Description: "验证图片的溯源清单（Ed25519签名的AI生成标识），检查签名、签名公钥是否受信任以及图片内容是否被修改；可按ID或地址验证已保存的图片，也可验证base64图片数据",
+		},
+		internal.ScopeReadFiles,
+		func(ctx context.Context, req *mcp.CallToolRequest, arg VerifyProvenanceRequest) (*mcp.CallToolResult, any, error) {
+			result := appService.mcpHandler.verifyProvenance(ctx, arg)
+			return convertToMCPResult(result), nil, nil
+		},
+	)
+
+	addTool(mcpServer, appService,
+		&mcp.Tool{
+			Name:        "detect_watermark",
+			Description: "检测图片中的隐形水印并返回水印内容，水印内容为图片ID且调用方有权查看时同时返回image_id；可按ID或地址检测已保存的图片，也可检测base64图片数据",
+		},
+		internal.ScopeReadFiles,
+		func(ctx context.Context, req *mcp.CallToolRequest, arg DetectWatermarkRequest) (*mcp.CallToolResult, any, error) {
+			result := appService.mcpHandler.detectWatermark(ctx, arg)
+			return convertToMCPResult(result), nil, nil
+		},
+	)
+
+	addTool(mcpServer, appService,
+		&mcp.Tool{
+			Name:        "my_usage",
+			Description: "查询当前调用方今日和本月的GPU用量、配额和限流设置",
+		},
+		"",
+		func(ctx context.Context, req *mcp.CallToolRequest, arg any) (*mcp.CallToolResult, any, error) {
+			result := appService.mcpHandler.myUsage(ctx)
+			return convertToMCPResult(result), nil, nil
+		},
 	)
 }
@@ -0,0 +1,80 @@
+package sdwebui
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"qiuxs.com/stable-diffusion-webui-mcp/internal"
+)
+
+// backendQueue 按后端限制同时进行的生成请求数，超出 max_concurrent 的请求排队等待
+type backendQueue struct {
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+	// 已发往后端和排队等待的生成请求数
+	pending map[string]int
+}
+
+func newBackendQueue() *backendQueue {
+	return &backendQueue{
+		slots:   make(map[string]chan struct{}),
+		pending: make(map[string]int),
+	}
+}
+
+// acquire 等待后端的空闲位置，返回释放位置的函数；max_concurrent 为 0 时不限制。
+// 重新加载配置修改 max_concurrent 后新请求使用新的限制，已在执行的请求仍释放到原来的位置
+func (q *backendQueue) acquire(ctx context.Context, backend *internal.BackendConfig) (func(), error) {
+	_, span := internal.Tracer().Start(ctx, "queue wait")
+	span.SetAttributes(
+		attribute.String("sdmcp.backend", backend.Name),
+		attribute.Int("sdmcp.backend.max_concurrent", backend.MaxConcurrent),
+	)
+
+	q.mu.Lock()
+	q.add(backend.Name, 1)
+	if backend.MaxConcurrent <= 0 {
+		q.mu.Unlock()
+		internal.EndSpan(span, nil)
+		return func() { q.done(backend.Name) }, nil
+	}
+	slots, ok := q.slots[backend.Name]
+	if !ok || cap(slots) != backend.MaxConcurrent {
+		slots = make(chan struct{}, backend.MaxConcurrent)
+		q.slots[backend.Name] = slots
+	}
+	q.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		internal.EndSpan(span, nil)
+		return func() {
+			<-slots
+			q.done(backend.Name)
+		}, nil
+	case <-ctx.Done():
+		q.done(backend.Name)
+		internal.EndSpan(span, ctx.Err())
+		return nil, ctx.Err()
+	}
+}
+
+// Len 返回后端已发送和排队中的生成请求数
+func (q *backendQueue) Len(name string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending[name]
+}
+
+func (q *backendQueue) done(name string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.add(name, -1)
+}
+
+// add 调用方需持有 q.mu
+func (q *backendQueue) add(name string, delta int) {
+	q.pending[name] += delta
+	internal.BackendQueue(name).Add(float64(delta))
+}
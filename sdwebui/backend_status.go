@@ -0,0 +1,167 @@
+package sdwebui
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"qiuxs.com/stable-diffusion-webui-mcp/internal"
+)
+
+// statusCheckTimeout 状态检查的超时时间，后端配置的 timeout 更短时使用后者
+const statusCheckTimeout = 5 * time.Second
+
+// backendErrors 记录每个后端最近一次请求失败的原因
+type backendErrors struct {
+	mu   sync.Mutex
+	last map[string]backendError
+}
+
+type backendError struct {
+	message string
+	at      time.Time
+}
+
+func newBackendErrors() *backendErrors {
+	return &backendErrors{last: make(map[string]backendError)}
+}
+
+func (e *backendErrors) record(name string, message string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.last[name] = backendError{message: message, at: time.Now()}
+}
+
+func (e *backendErrors) get(name string) (backendError, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	last, ok := e.last[name]
+	return last, ok
+}
+
+// Status 并发检查后端状态：当前模型、显存、队列长度和最近一次错误，name 为空时检查所有后端
+func (s *SdwebuiService) Status(ctx context.Context, name string) ([]BackendStatus, error) {
+	config := s.config.Get()
+	backends := config.Backends
+	if name != "" {
+		backend, err := config.Backend(name)
+		if err != nil {
+			return nil, err
+		}
+		backends = []internal.BackendConfig{*backend}
+	}
+
+	statuses := make([]BackendStatus, len(backends))
+	var wg sync.WaitGroup
+	for i := range backends {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = s.backendStatus(ctx, &backends[i])
+		}(i)
+	}
+	wg.Wait()
+	return statuses, nil
+}
+
+// Ready 检查是否至少有一个后端可以访问，返回可访问的后端名称
+func (s *SdwebuiService) Ready(ctx context.Context) ([]string, error) {
+	statuses, err := s.Status(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	var reachable []string
+	var lastErr string
+	for _, status := range statuses {
+		if status.Reachable {
+			reachable = append(reachable, status.Name)
+		} else {
+			lastErr = fmt.Sprintf("%s: %s", status.Name, status.Error)
+		}
+	}
+	if len(reachable) == 0 {
+		return nil, fmt.Errorf("没有可以访问的 WebUI 后端，%s", lastErr)
+	}
+	return reachable, nil
+}
+
+func (s *SdwebuiService) backendStatus(ctx context.Context, backend *internal.BackendConfig) BackendStatus {
+	status := BackendStatus{
+		Name:          backend.Name,
+		QueueLength:   s.queue.Len(backend.Name),
+		MaxConcurrent: backend.MaxConcurrent,
+	}
+
+	timeout := statusCheckTimeout
+	if backend.Timeout > 0 && backend.Timeout < timeout {
+		timeout = backend.Timeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	var options struct {
+		SdModelCheckpoint string `json:"sd_model_checkpoint"`
+	}
+	if err := s.getJSON(ctx, backend, "/sdapi/v1/options", "options", &options); err != nil {
+		status.Error = err.Error()
+	} else {
+		status.Reachable = true
+		status.Model = options.SdModelCheckpoint
+
+		// 显存信息获取失败不影响后端可用状态
+		var memory struct {
+			Cuda struct {
+				System *struct {
+					Free  float64 `json:"free"`
+					Used  float64 `json:"used"`
+					Total float64 `json:"total"`
+				} `json:"system"`
+			} `json:"cuda"`
+		}
+		if err := s.getJSON(ctx, backend, "/sdapi/v1/memory", "memory", &memory); err != nil {
+			status.Error = fmt.Sprintf("获取显存信息失败: %v", err)
+		} else if system := memory.Cuda.System; system != nil {
+			status.VRAM = &VRAMStatus{
+				TotalBytes: int64(system.Total),
+				UsedBytes:  int64(system.Used),
+				FreeBytes:  int64(system.Free),
+			}
+		}
+	}
+	status.LatencyMs = time.Since(start).Milliseconds()
+
+	if last, ok := s.errors.get(backend.Name); ok {
+		status.LastError = last.message
+		status.LastErrorAt = &last.at
+	}
+	return status
+}
+
+func (s *SdwebuiService) getJSON(ctx context.Context, backend *internal.BackendConfig, path string, endpoint string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", backend.URL+path, nil)
+	if err != nil {
+		return fmt.Errorf("创建HTTP请求失败: %v", err)
+	}
+	resp, err := s.do(req, backend, endpoint)
+	if err != nil {
+		return fmt.Errorf("调用Stable Diffusion API失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("读取响应体失败: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("API返回错误状态码: %d", resp.StatusCode)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("解析响应JSON失败: %v", err)
+	}
+	return nil
+}
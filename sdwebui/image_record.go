@@ -0,0 +1,121 @@
+package sdwebui
+
+import (
+	"encoding/json"
+	"strings"
+
+	"qiuxs.com/stable-diffusion-webui-mcp/internal"
+)
+
+// newImageRecord 根据请求参数和 WebUI 返回的生成信息构建第 index 张图片的元数据记录，
+// 生成信息中缺少的字段使用请求参数
+func newImageRecord(arg TextToImageRequest, info map[string]any, index int) *internal.ImageRecord {
+	record := &internal.ImageRecord{
+		Prompt:         infoString(info, "all_prompts", index, "prompt", arg.Prompt),
+		NegativePrompt: infoString(info, "all_negative_prompts", index, "negative_prompt", arg.NegativePrompt),
+		Seed:           int64(infoNumber(info, "all_seeds", index, "seed", float64(arg.Seed))),
+		Width:          int(infoNumber(info, "", index, "width", float64(arg.Width))),
+		Height:         int(infoNumber(info, "", index, "height", float64(arg.Height))),
+		Steps:          int(infoNumber(info, "", index, "steps", float64(arg.Steps))),
+		SamplerName:    infoString(info, "", index, "sampler_name", arg.SamplerName),
+		CFGScale:       infoNumber(info, "", index, "cfg_scale", arg.CFGScale),
+		Model:          infoString(info, "", index, "sd_model_name", ""),
+		ModelHash:      infoString(info, "", index, "sd_model_hash", ""),
+		BatchIndex:     index,
+		Tags:           arg.Tags,
+	}
+	if record.Model == "" {
+		if model, ok := arg.OverrideSettings["sd_model_checkpoint"].(string); ok {
+			record.Model = model
+		}
+	}
+	return record
+}
+
+// infoValue 优先从 listKey 列表中取第 index 个值（批量生成时每张图片的值），否则取 key 的值
+func infoValue(info map[string]any, listKey string, index int, key string) any {
+	if list, ok := info[listKey].([]any); ok && index < len(list) {
+		return list[index]
+	}
+	return info[key]
+}
+
+func infoString(info map[string]any, listKey string, index int, key string, def string) string {
+	if value, ok := infoValue(info, listKey, index, key).(string); ok && value != "" {
+		return value
+	}
+	return def
+}
+
+func infoNumber(info map[string]any, listKey string, index int, key string, def float64) float64 {
+	if value, ok := infoValue(info, listKey, index, key).(float64); ok {
+		return value
+	}
+	return def
+}
+
+// requestRecord 将请求参数转换为元数据记录，去掉 ControlNet 中以 base64 传入的图片
+func requestRecord(arg TextToImageRequest) map[string]any {
+	units := make([]ControlNetUnit, len(arg.ControlNetUnits))
+	for i, unit := range arg.ControlNetUnits {
+		unit.InputImage = omitBase64Image(unit.InputImage)
+		unit.Mask = omitBase64Image(unit.Mask)
+		inputImages := make([]string, len(unit.InputImages))
+		for j, image := range unit.InputImages {
+			inputImages[j] = omitBase64Image(image)
+		}
+		unit.InputImages = inputImages
+		units[i] = unit
+	}
+	arg.ControlNetUnits = units
+
+	raw, err := json.Marshal(arg)
+	if err != nil {
+		return nil
+	}
+	var record map[string]any
+	if err := json.Unmarshal(raw, &record); err != nil {
+		return nil
+	}
+	return record
+}
+
+// parametersRecord 去掉 WebUI 返回参数中的 alwayson_scripts，其中可能包含 base64 图片，相关参数已记录在请求中
+func parametersRecord(parameters map[string]any) map[string]any {
+	if _, ok := parameters["alwayson_scripts"]; !ok {
+		return parameters
+	}
+	record := make(map[string]any, len(parameters))
+	for key, value := range parameters {
+		if key != "alwayson_scripts" {
+			record[key] = value
+		}
+	}
+	return record
+}
+
+func omitBase64Image(image string) string {
+	if image == "" || strings.Contains(image, "://") {
+		return image
+	}
+	return "<base64 omitted>"
+}
+
+// parentImageId 查找作为 ControlNet 输入图片的已生成图片
+func (s *SdwebuiService) parentImageId(arg TextToImageRequest) string {
+	for _, unit := range arg.ControlNetUnits {
+		for _, image := range append([]string{unit.InputImage}, unit.InputImages...) {
+			if !strings.Contains(image, internal.FileURLPath) {
+				continue
+			}
+			relativePath, err := internal.RelativePathFromURL(image)
+			if err != nil {
+				continue
+			}
+			if record, err := s.fileService.ImageByPath(relativePath); err == nil {
+				return record.ID
+			}
+		}
+	}
+	return ""
+}
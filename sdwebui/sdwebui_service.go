@@ -7,54 +7,92 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"qiuxs.com/stable-diffusion-webui-mcp/internal"
 )
 
 type SdwebuiService struct {
-	baseUrl     string
+	config      *internal.ConfigStore
 	fileService *internal.FileService
+	moderator   *internal.Moderator
 	client      *http.Client
+	queue       *backendQueue
+	errors      *backendErrors
 }
 
-func NewSdwebuiService(sdwebuiUrl string, fileService *internal.FileService) *SdwebuiService {
+func NewSdwebuiService(config *internal.ConfigStore, fileService *internal.FileService, moderator *internal.Moderator) *SdwebuiService {
 	return &SdwebuiService{
-		baseUrl:     sdwebuiUrl,
+		config:      config,
 		fileService: fileService,
-		client: &http.Client{
-			Timeout: 300 * time.Second, // 5分钟超时，因为图片生成可能需要较长时间
-		},
+		moderator:   moderator,
+		// 超时由各后端的 timeout 配置通过 context 控制
+		client: &http.Client{},
+		queue:  newBackendQueue(),
+		errors: newBackendErrors(),
 	}
 }
 
+// backend 按名称选择后端，并返回带有该后端超时设置的 context
+func (s *SdwebuiService) backend(ctx context.Context, config *internal.Config, name string) (*internal.BackendConfig, context.Context, context.CancelFunc, error) {
+	backend, err := config.Backend(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, backend.Timeout)
+	ctx = internal.WithLogFields(ctx, logrus.Fields{internal.LogFieldBackend: backend.Name})
+	return backend, ctx, cancel, nil
+}
+
 func (s *SdwebuiService) TextToImage(ctx context.Context, arg TextToImageRequest) (*TextToImageResponse, error) {
-	// 设置默认值
-	if arg.Width == 0 {
-		arg.Width = 512
+	// 整个请求使用同一份配置快照
+	config := s.config.Get()
+
+	// 应用预设参数，请求中显式传入的参数优先
+	if arg.Preset != "" {
+		if err := applyPreset(config, &arg); err != nil {
+			return nil, err
+		}
 	}
-	if arg.Height == 0 {
-		arg.Height = 512
+
+	// 内容审核，拒绝时不调用 WebUI
+	moderation, err := s.moderator.Check(ctx, arg.Prompt, arg.NegativePrompt)
+	if err != nil {
+		return nil, err
 	}
-	if arg.Steps == 0 {
-		arg.Steps = 20
+	if moderation != nil {
+		arg.Prompt = moderation.Prompt
+		arg.NegativePrompt = moderation.NegativePrompt
 	}
-	if arg.SamplerName == "" {
-		arg.SamplerName = "Euler a"
+
+	// 设置默认值，与角色约束检查和用量估算使用相同的默认值
+	if err := applyDefaults(&arg); err != nil {
+		return nil, err
 	}
-	if arg.CFGScale == 0 {
-		arg.CFGScale = 7.0
+
+	if err := checkLimits(config.Limits, arg); err != nil {
+		return nil, err
 	}
-	if arg.BatchSize == 0 {
-		arg.BatchSize = 1
+
+	output := config.Output.Override(arg.OutputFormat, arg.Quality)
+	if err := output.Validate(); err != nil {
+		return nil, err
 	}
-	if arg.NIter == 0 {
-		arg.NIter = 1
+
+	backend, ctx, cancel, err := s.backend(ctx, config, arg.Backend)
+	if err != nil {
+		return nil, err
 	}
+	defer cancel()
 
 	// 准备请求体（兼容 ControlNet 在 WebUI 1.10.1 中的 alwayson_scripts.controlnet.args 写法）
 	var requestBody []byte
-	var err error
 	if arg.ControlNetEnabled && len(arg.ControlNetUnits) > 0 {
 		// 将结构体转为通用 map 以便注入 alwayson_scripts 结构
 		rawBytes, marshalErr := json.Marshal(arg)
@@ -83,7 +121,7 @@ func (s *SdwebuiService) TextToImage(ctx context.Context, arg TextToImageRequest
 	}
 
 	// 构建API URL
-	apiUrl := fmt.Sprintf("%s/sdapi/v1/txt2img", s.baseUrl)
+	apiUrl := fmt.Sprintf("%s/sdapi/v1/txt2img", backend.URL)
 
 	// 创建HTTP请求
 	req, err := http.NewRequestWithContext(ctx, "POST", apiUrl, bytes.NewBuffer(requestBody))
@@ -92,8 +130,14 @@ func (s *SdwebuiService) TextToImage(ctx context.Context, arg TextToImageRequest
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	// 发送请求
-	resp, err := s.client.Do(req)
+	// 发送请求，WebUI 按顺序处理生成请求，未返回的请求数（含等待 max_concurrent 位置的请求）即为排队深度
+	release, err := s.queue.acquire(ctx, backend)
+	if err != nil {
+		return nil, fmt.Errorf("等待后端 %s 空闲超时: %v", backend.Name, err)
+	}
+	start := time.Now()
+	resp, err := s.do(req, backend, "txt2img")
+	release()
 	if err != nil {
 		return nil, fmt.Errorf("调用Stable Diffusion API失败: %v", err)
 	}
@@ -116,10 +160,40 @@ func (s *SdwebuiService) TextToImage(ctx context.Context, arg TextToImageRequest
 		return nil, fmt.Errorf("解析响应JSON失败: %v", err)
 	}
 
+	generationTime := time.Since(start)
+	generationMs := generationTime.Milliseconds()
+	internal.ObserveGeneration(backend.Name, float64(arg.Width*arg.Height*arg.BatchSize*arg.NIter)/1e6, generationTime)
+
+	// 解析生成信息，用于记录每张图片的种子、模型等元数据
+	var info map[string]any
+	if err := json.Unmarshal([]byte(response.Info), &info); err != nil {
+		internal.Logger(ctx).WithError(err).Warn("解析生成信息失败")
+	}
+	request := requestRecord(arg)
+	parameters := parametersRecord(response.Parameters)
+	parentId := s.parentImageId(arg)
+	// 使用工具调用的 job ID 作为请求 ID，便于从日志找到生成的图片
+	requestId := internal.JobIDFromContext(ctx)
+	if requestId == "" {
+		requestId = uuid.NewString()
+	}
+	// 按 API Key 和预设选择水印，内部预览加水印，交付给客户的图片不加
+	watermark := config.WatermarkFor(internal.PrincipalFromContext(ctx), arg.Preset)
+
 	// 保存生成的图片
 	var fileUrls []string
-	for _, imageData := range response.Images {
-		fileUrl, err := s.fileService.SaveImage(imageData)
+	for i, imageData := range response.Images {
+		record := newImageRecord(arg, info, i)
+		record.RequestID = requestId
+		record.Watermark = watermark
+		record.Backend = backend.Name
+		record.GenerationMs = generationMs
+		record.ParentID = parentId
+		record.Request = request
+		record.Parameters = parameters
+		record.Info = info
+
+		fileUrl, err := s.fileService.SaveImage(ctx, imageData, output, record)
 		if err != nil {
 			return nil, fmt.Errorf("保存图片失败: %v", err)
 		}
@@ -132,9 +206,15 @@ func (s *SdwebuiService) TextToImage(ctx context.Context, arg TextToImageRequest
 	return &response, nil
 }
 
-func (s *SdwebuiService) SdModels(ctx context.Context) (*SdModelsResponse, error) {
+func (s *SdwebuiService) SdModels(ctx context.Context, arg SdModelsRequest) (*SdModelsResponse, error) {
+	backend, ctx, cancel, err := s.backend(ctx, s.config.Get(), arg.Backend)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
 	// 构建API URL
-	apiUrl := fmt.Sprintf("%s/sdapi/v1/sd-models", s.baseUrl)
+	apiUrl := fmt.Sprintf("%s/sdapi/v1/sd-models", backend.URL)
 
 	// 创建HTTP请求
 	req, err := http.NewRequestWithContext(ctx, "GET", apiUrl, nil)
@@ -144,7 +224,7 @@ func (s *SdwebuiService) SdModels(ctx context.Context) (*SdModelsResponse, error
 	req.Header.Set("Content-Type", "application/json")
 
 	// 发送请求
-	resp, err := s.client.Do(req)
+	resp, err := s.do(req, backend, "sd-models")
 	if err != nil {
 		return nil, fmt.Errorf("调用Stable Diffusion API失败: %v", err)
 	}
@@ -174,11 +254,20 @@ func (s *SdwebuiService) SdModels(ctx context.Context) (*SdModelsResponse, error
 }
 
 func (s *SdwebuiService) SwitchModel(ctx context.Context, arg SwitchModelRequest) (*SwitchModelResponse, error) {
+	backend, ctx, cancel, err := s.backend(ctx, s.config.Get(), arg.Backend)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
 	// 构建API URL
-	apiUrl := fmt.Sprintf("%s/sdapi/v1/options", s.baseUrl)
+	apiUrl := fmt.Sprintf("%s/sdapi/v1/options", backend.URL)
 
 	// 准备请求参数
-	requestBody, err := json.Marshal(arg)
+	// backend 为本服务扩展参数，不能写入 WebUI 的 options
+	requestBody, err := json.Marshal(map[string]string{
+		"sd_model_checkpoint": arg.SdModelCheckpoint,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("序列化请求参数失败: %v", err)
 	}
@@ -191,7 +280,7 @@ func (s *SdwebuiService) SwitchModel(ctx context.Context, arg SwitchModelRequest
 	req.Header.Set("Content-Type", "application/json")
 
 	// 发送请求
-	resp, err := s.client.Do(req)
+	resp, err := s.do(req, backend, "options")
 	if err != nil {
 		return nil, fmt.Errorf("调用Stable Diffusion API失败: %v", err)
 	}
@@ -202,9 +291,143 @@ func (s *SdwebuiService) SwitchModel(ctx context.Context, arg SwitchModelRequest
 		body, _ := io.ReadAll(resp.Body)
 		return nil, fmt.Errorf("API返回错误状态码: %d %s, 响应: %s", resp.StatusCode, resp.Status, body)
 	}
+	internal.AuditResult(ctx, "webui_options", map[string]any{
+		"backend":             backend.Name,
+		"sd_model_checkpoint": arg.SdModelCheckpoint,
+	})
 
 	return &SwitchModelResponse{
 		Success: true,
 		Message: "切换模型成功",
 	}, nil
 }
+
+// do 发送请求到 WebUI 后端，并按后端和接口记录请求耗时
+// 每次调用创建一个 client span，并通过 traceparent 请求头将 trace 上下文传递给后端
+func (s *SdwebuiService) do(req *http.Request, backend *internal.BackendConfig, endpoint string) (*http.Response, error) {
+	ctx, span := internal.Tracer().Start(req.Context(), req.Method+" "+req.URL.Path,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.full", req.URL.Redacted()),
+			attribute.String("server.address", req.URL.Hostname()),
+			attribute.String("sdmcp.backend", backend.Name),
+			attribute.String("sdmcp.webui.endpoint", endpoint),
+		),
+	)
+	req = req.WithContext(ctx)
+	internal.InjectTraceContext(ctx, req.Header)
+
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		if resp.StatusCode >= http.StatusBadRequest {
+			span.SetStatus(codes.Error, resp.Status)
+		}
+	}
+	duration := time.Since(start)
+	internal.ObserveWebUIRequest(backend.Name, endpoint, status, duration)
+	internal.EndSpan(span, err)
+
+	logger := internal.Logger(ctx).WithFields(logrus.Fields{
+		"endpoint":    endpoint,
+		"status":      status,
+		"duration_ms": duration.Milliseconds(),
+	})
+	switch {
+	case err != nil:
+		s.errors.record(backend.Name, err.Error())
+		logger.WithError(err).Warn("WebUI 请求失败")
+	case resp.StatusCode >= http.StatusInternalServerError:
+		s.errors.record(backend.Name, fmt.Sprintf("%s %s 返回 %s", req.Method, req.URL.Path, resp.Status))
+		logger.Warn("WebUI 请求返回错误")
+	default:
+		logger.Debug("WebUI 请求")
+	}
+	return resp, err
+}
+
+// applyPreset 将预设参数合并到请求中，仅填充请求未设置的字段，零值视为未设置（见 internal.IsUnsetArg）
+func applyPreset(config *internal.Config, arg *TextToImageRequest) error {
+	preset, ok := config.Presets[arg.Preset]
+	if !ok {
+		return fmt.Errorf("预设不存在: %s", arg.Preset)
+	}
+
+	rawBytes, err := json.Marshal(arg)
+	if err != nil {
+		return fmt.Errorf("序列化请求参数失败: %v", err)
+	}
+	var merged map[string]interface{}
+	if err := json.Unmarshal(rawBytes, &merged); err != nil {
+		return fmt.Errorf("构建请求参数失败: %v", err)
+	}
+	for key, value := range preset.Params {
+		if internal.IsUnsetArg(merged[key]) {
+			merged[key] = value
+		}
+	}
+
+	mergedBytes, err := json.Marshal(merged)
+	if err != nil {
+		return fmt.Errorf("序列化预设参数失败: %v", err)
+	}
+	var result TextToImageRequest
+	if err := json.Unmarshal(mergedBytes, &result); err != nil {
+		return fmt.Errorf("预设 %s 参数无效: %v", arg.Preset, err)
+	}
+	*arg = result
+	return nil
+}
+
+// applyDefaults 为未设置的参数填充 internal.Txt2ImgDefaults 中的默认值
+func applyDefaults(arg *TextToImageRequest) error {
+	rawBytes, err := json.Marshal(arg)
+	if err != nil {
+		return fmt.Errorf("序列化请求参数失败: %v", err)
+	}
+	var merged map[string]interface{}
+	if err := json.Unmarshal(rawBytes, &merged); err != nil {
+		return fmt.Errorf("构建请求参数失败: %v", err)
+	}
+	internal.ApplyTxt2ImgDefaults(merged)
+
+	mergedBytes, err := json.Marshal(merged)
+	if err != nil {
+		return fmt.Errorf("序列化请求参数失败: %v", err)
+	}
+	var result TextToImageRequest
+	if err := json.Unmarshal(mergedBytes, &result); err != nil {
+		return fmt.Errorf("构建请求参数失败: %v", err)
+	}
+	*arg = result
+	return nil
+}
+
+// checkLimits 检查生成参数是否超出配置的上限
+func checkLimits(limits internal.LimitsConfig, arg TextToImageRequest) error {
+	if limits.MaxWidth > 0 && arg.Width > limits.MaxWidth {
+		return fmt.Errorf("图片宽度 %d 超出上限 %d", arg.Width, limits.MaxWidth)
+	}
+	if limits.MaxHeight > 0 && arg.Height > limits.MaxHeight {
+		return fmt.Errorf("图片高度 %d 超出上限 %d", arg.Height, limits.MaxHeight)
+	}
+	if limits.MaxSteps > 0 && arg.Steps > limits.MaxSteps {
+		return fmt.Errorf("采样步数 %d 超出上限 %d", arg.Steps, limits.MaxSteps)
+	}
+	if limits.MaxBatchSize > 0 && arg.BatchSize > limits.MaxBatchSize {
+		return fmt.Errorf("批次大小 %d 超出上限 %d", arg.BatchSize, limits.MaxBatchSize)
+	}
+	if limits.MaxNIter > 0 && arg.NIter > limits.MaxNIter {
+		return fmt.Errorf("批次数量 %d 超出上限 %d", arg.NIter, limits.MaxNIter)
+	}
+	return nil
+}
+
+// Presets 返回已配置的预设
+func (s *SdwebuiService) Presets() map[string]internal.PresetConfig {
+	return s.config.Get().Presets
+}
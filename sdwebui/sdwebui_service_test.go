@@ -0,0 +1,56 @@
+package sdwebui
+
+import (
+	"reflect"
+	"testing"
+
+	"qiuxs.com/stable-diffusion-webui-mcp/internal"
+)
+
+func TestApplyPreset(t *testing.T) {
+	config := &internal.Config{Presets: map[string]internal.PresetConfig{
+		"portrait": {Params: map[string]any{
+			"prompt":          "portrait photo",
+			"negative_prompt": "blurry",
+			"width":           512,
+			"height":          768,
+			"steps":           30,
+			"cfg_scale":       6.5,
+			"enable_hr":       true,
+			"tags":            []any{"preset"},
+		}},
+	}}
+
+	tests := []struct {
+		name string
+		arg  TextToImageRequest
+		want TextToImageRequest
+	}{
+		{
+			name: "未设置的字段使用预设",
+			arg:  TextToImageRequest{Preset: "portrait"},
+			want: TextToImageRequest{Preset: "portrait", Prompt: "portrait photo", NegativePrompt: "blurry", Width: 512, Height: 768, Steps: 30, CFGScale: 6.5, EnableHR: true, Tags: []string{"preset"}},
+		},
+		{
+			name: "显式传入的字段优先",
+			arg:  TextToImageRequest{Preset: "portrait", Prompt: "a cat", Width: 1024, CFGScale: 9, Tags: []string{"cat"}},
+			want: TextToImageRequest{Preset: "portrait", Prompt: "a cat", NegativePrompt: "blurry", Width: 1024, Height: 768, Steps: 30, CFGScale: 9, EnableHR: true, Tags: []string{"cat"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arg := tt.arg
+			if err := applyPreset(config, &arg); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(arg, tt.want) {
+				t.Errorf("applyPreset() = %+v, want %+v", arg, tt.want)
+			}
+		})
+	}
+
+	arg := TextToImageRequest{Preset: "missing"}
+	if err := applyPreset(config, &arg); err == nil {
+		t.Error("预设不存在时应返回错误")
+	}
+}
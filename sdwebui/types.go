@@ -1,5 +1,7 @@
 package sdwebui
 
+import "time"
+
 type TextToImageRequest struct {
 	Prompt              string                 `json:"prompt" jsonschema:"提示词,描述要生成的图片内容"`
 	NegativePrompt      string                 `json:"negative_prompt,omitempty" jsonschema:"负面提示词,不希望出现在图片中的内容"`
@@ -23,6 +25,14 @@ type TextToImageRequest struct {
 	ScriptArgs          []interface{}          `json:"script_args,omitempty" jsonschema:"脚本参数,脚本功能的参数列表"`
 	ScriptName          string                 `json:"script_name,omitempty" jsonschema:"脚本名称,要使用的脚本名称"`
 
+	// 以下为本服务扩展参数
+	Preset  string   `json:"preset,omitempty" jsonschema:"预设名称,使用服务端配置的参数预设,显式传入的参数优先"`
+	Backend string   `json:"backend,omitempty" jsonschema:"后端名称,指定使用的Stable Diffusion WebUI后端,默认使用第一个"`
+	Tags    []string `json:"tags,omitempty" jsonschema:"标签,记录在图片元数据中,可在list_images/search_images中按标签检索"`
+	// 图片在本服务中转换格式，WebUI 始终返回 PNG
+	OutputFormat string `json:"output_format,omitempty" jsonschema:"图片格式,png、jpeg或webp,默认使用服务端配置,jpeg和webp会在EXIF/XMP中保留生成参数"`
+	Quality      int    `json:"quality,omitempty" jsonschema:"图片质量,jpeg和webp的压缩质量1-100,默认使用服务端配置,webp为100时无损压缩"`
+
 	// ControlNet 相关参数
 	ControlNetEnabled bool             `json:"controlnet_enabled,omitempty" jsonschema:"是否启用ControlNet,是否启用ControlNet扩展"`
 	ControlNetUnits   []ControlNetUnit `json:"controlnet_units,omitempty" jsonschema:"ControlNet单元列表,一个或多个ControlNet配置单元"`
@@ -67,6 +77,10 @@ type ControlNetUnit struct {
 	InputImages []string `json:"input_images,omitempty" jsonschema:"多图输入,可选的多张条件图像列表"`
 }
 
+type SdModelsRequest struct {
+	Backend string `json:"backend,omitempty" jsonschema:"后端名称,默认使用第一个后端"`
+}
+
 type SdModelsResponse struct {
 	Models []SdModel `json:"models" jsonschema:"模型列表,模型列表"`
 }
@@ -93,9 +107,34 @@ type SdModel struct {
 
 type SwitchModelRequest struct {
 	SdModelCheckpoint string `json:"sd_model_checkpoint" jsonschema:"模型名称,模型名称"`
+	Backend           string `json:"backend,omitempty" jsonschema:"后端名称,默认使用第一个后端"`
 }
 
 type SwitchModelResponse struct {
 	Success bool   `json:"success" jsonschema:"是否成功,是否成功切换模型"`
 	Message string `json:"message,omitempty" jsonschema:"消息,操作结果消息"`
 }
+
+type ServerStatusRequest struct {
+	Backend string `json:"backend,omitempty" jsonschema:"后端名称,为空时返回所有后端的状态"`
+}
+
+type BackendStatus struct {
+	Name          string      `json:"name" jsonschema:"后端名称,后端名称"`
+	Reachable     bool        `json:"reachable" jsonschema:"是否可访问,本次检查时后端是否可以访问"`
+	Model         string      `json:"model,omitempty" jsonschema:"当前模型,后端当前加载的模型"`
+	VRAM          *VRAMStatus `json:"vram,omitempty" jsonschema:"显存,显存使用情况，后端没有可用的 CUDA 设备时为空"`
+	QueueLength   int         `json:"queue_length" jsonschema:"队列长度,已发送和排队中的生成请求数"`
+	MaxConcurrent int         `json:"max_concurrent,omitempty" jsonschema:"并发上限,同时进行的生成请求上限，0 表示不限制"`
+	LatencyMs     int64       `json:"latency_ms" jsonschema:"检查耗时,本次检查的耗时（毫秒）"`
+	Error         string      `json:"error,omitempty" jsonschema:"检查错误,本次检查失败的原因"`
+	// 包括生成请求和状态检查
+	LastError   string     `json:"last_error,omitempty" jsonschema:"最近错误,最近一次请求后端失败的原因"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty" jsonschema:"最近错误时间,最近一次请求后端失败的时间"`
+}
+
+type VRAMStatus struct {
+	TotalBytes int64 `json:"total_bytes" jsonschema:"显存总量,显存总量（字节）"`
+	UsedBytes  int64 `json:"used_bytes" jsonschema:"已用显存,已使用的显存（字节）"`
+	FreeBytes  int64 `json:"free_bytes" jsonschema:"空闲显存,空闲显存（字节）"`
+}
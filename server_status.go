@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"qiuxs.com/stable-diffusion-webui-mcp/internal"
+	"qiuxs.com/stable-diffusion-webui-mcp/sdwebui"
+)
+
+// 服务状态
+const (
+	StatusOK          = "ok"
+	StatusDegraded    = "degraded"
+	StatusUnavailable = "unavailable"
+)
+
+var startedAt = time.Now()
+
+// serverStatus 检查存储是否可写和后端状态，backend 不为空时只检查该后端
+func serverStatus(ctx context.Context, config *internal.Config, sdwebuiService *sdwebui.SdwebuiService, fileService *internal.FileService, backend string) (*ServerStatusResponse, error) {
+	backends, err := sdwebuiService.Status(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &ServerStatusResponse{
+		Status:        StatusOK,
+		UptimeSeconds: int64(time.Since(startedAt).Seconds()),
+		Storage:       StorageStatus{Type: config.Storage.Type, Writable: true},
+		Backends:      backends,
+	}
+	if err := fileService.CheckStorage(ctx); err != nil {
+		response.Storage.Writable = false
+		response.Storage.Error = err.Error()
+	}
+
+	reachable := 0
+	for _, status := range backends {
+		if status.Reachable {
+			reachable++
+		}
+	}
+	switch {
+	case !response.Storage.Writable || reachable == 0:
+		response.Status = StatusUnavailable
+	case reachable < len(backends):
+		response.Status = StatusDegraded
+	}
+	return response, nil
+}
@@ -1,5 +1,12 @@
 package main
 
+import (
+	"time"
+
+	"qiuxs.com/stable-diffusion-webui-mcp/internal"
+	"qiuxs.com/stable-diffusion-webui-mcp/sdwebui"
+)
+
 // MCPToolResult MCP 工具结果（内部使用）
 type MCPToolResult struct {
 	Content []MCPContent `json:"content"`
@@ -13,3 +20,181 @@ type MCPContent struct {
 	MimeType string `json:"mimeType"`
 	Data     string `json:"data"`
 }
+
+// SignImageUrlRequest 重新签名图片链接
+type SignImageUrlRequest struct {
+	Url        string `json:"url" jsonschema:"图片地址,txt2img返回的图片url或日期文件夹/文件名形式的相对路径"`
+	TTLSeconds int64  `json:"ttl_seconds,omitempty" jsonschema:"有效期,新链接的有效期（秒）,默认使用服务端配置"`
+}
+
+// MyUsageResponse 调用方的用量、配额和限流设置
+type MyUsageResponse struct {
+	Principal string                   `json:"principal"`
+	Role      string                   `json:"role,omitempty"`
+	Usage     internal.UsageRecord     `json:"usage"`
+	Quota     internal.QuotaConfig     `json:"quota"`
+	RateLimit internal.RateLimitConfig `json:"rate_limit"`
+}
+
+// ListImagesRequest 列出已生成的图片
+type ListImagesRequest struct {
+	DateFrom string `json:"date_from,omitempty" form:"date_from" jsonschema:"开始日期,YYYY-MM-DD或RFC3339格式,包含当天"`
+	DateTo   string `json:"date_to,omitempty" form:"date_to" jsonschema:"结束日期,YYYY-MM-DD或RFC3339格式,使用日期时包含当天"`
+	Limit    int    `json:"limit,omitempty" form:"limit" jsonschema:"每页数量,默认20,最大100"`
+	Offset   int    `json:"offset,omitempty" form:"offset" jsonschema:"分页偏移量,使用上一页返回的next_offset"`
+}
+
+// SearchImagesRequest 按条件检索已生成的图片
+type SearchImagesRequest struct {
+	Query    string   `json:"query,omitempty" form:"query" jsonschema:"全文检索关键词,空格分隔,所有关键词都需要出现在提示词、标签或模型名称中"`
+	Prompt   string   `json:"prompt,omitempty" form:"prompt" jsonschema:"提示词子串,不区分大小写"`
+	Model    string   `json:"model,omitempty" form:"model" jsonschema:"模型名称或哈希,支持*通配"`
+	Seed     *int64   `json:"seed,omitempty" form:"seed" jsonschema:"随机种子"`
+	Caller   string   `json:"caller,omitempty" form:"caller" jsonschema:"调用方标识,如api_key:alice,仅admin可查询其他调用方的图片"`
+	Tags     []string `json:"tags,omitempty" form:"tags" jsonschema:"标签,需要包含全部标签"`
+	DateFrom string   `json:"date_from,omitempty" form:"date_from" jsonschema:"开始日期,YYYY-MM-DD或RFC3339格式,包含当天"`
+	DateTo   string   `json:"date_to,omitempty" form:"date_to" jsonschema:"结束日期,YYYY-MM-DD或RFC3339格式,使用日期时包含当天"`
+	Limit    int      `json:"limit,omitempty" form:"limit" jsonschema:"每页数量,默认20,最大100"`
+	Offset   int      `json:"offset,omitempty" form:"offset" jsonschema:"分页偏移量,使用上一页返回的next_offset"`
+	Pinned   *bool    `json:"pinned,omitempty" form:"pinned" jsonschema:"是否只返回置顶（或未置顶）的图片"`
+}
+
+// PinImageRequest 置顶或取消置顶图片
+type PinImageRequest struct {
+	ID     string `json:"id,omitempty" jsonschema:"图片ID,与url二选一"`
+	Url    string `json:"url,omitempty" jsonschema:"图片地址,txt2img返回的图片url,与id二选一"`
+	Pinned *bool  `json:"pinned,omitempty" jsonschema:"是否置顶,默认true,传false取消置顶"`
+}
+
+// ImageSummary 图片列表中的图片信息
+type ImageSummary struct {
+	ID             string    `json:"id"`
+	Url            string    `json:"url"`
+	ThumbnailUrl   string    `json:"thumbnail_url"`
+	CreatedAt      time.Time `json:"created_at"`
+	Principal      string    `json:"principal"`
+	Backend        string    `json:"backend"`
+	Model          string    `json:"model,omitempty"`
+	Prompt         string    `json:"prompt"`
+	NegativePrompt string    `json:"negative_prompt,omitempty"`
+	Seed           int64     `json:"seed"`
+	Width          int       `json:"width"`
+	Height         int       `json:"height"`
+	Steps          int       `json:"steps"`
+	SamplerName    string    `json:"sampler_name,omitempty"`
+	Tags           []string  `json:"tags,omitempty"`
+	ParentID       string    `json:"parent_id,omitempty"`
+	Pinned         bool      `json:"pinned,omitempty"`
+}
+
+// ImageListResponse 图片列表
+type ImageListResponse struct {
+	Total  int            `json:"total"`
+	Offset int            `json:"offset"`
+	Images []ImageSummary `json:"images"`
+	// 下一页的偏移量，没有更多结果时为空
+	NextOffset int `json:"next_offset,omitempty"`
+}
+
+// ImageDetailResponse 图片的完整元数据
+type ImageDetailResponse struct {
+	*internal.ImageRecord
+	Url string `json:"url"`
+}
+
+// ExportImagesRequest 批量导出图片，指定 ids 时按 ID 导出，否则按检索条件导出
+type ExportImagesRequest struct {
+	IDs      []string `json:"ids,omitempty" form:"ids" jsonschema:"图片ID列表,指定后忽略其他检索条件"`
+	Query    string   `json:"query,omitempty" form:"query" jsonschema:"全文检索关键词,空格分隔,所有关键词都需要出现在提示词、标签或模型名称中"`
+	Prompt   string   `json:"prompt,omitempty" form:"prompt" jsonschema:"提示词子串,不区分大小写"`
+	Model    string   `json:"model,omitempty" form:"model" jsonschema:"模型名称或哈希,支持*通配"`
+	Caller   string   `json:"caller,omitempty" form:"caller" jsonschema:"调用方标识,如api_key:alice,仅admin可导出其他调用方的图片"`
+	Tags     []string `json:"tags,omitempty" form:"tags" jsonschema:"标签,需要包含全部标签"`
+	DateFrom string   `json:"date_from,omitempty" form:"date_from" jsonschema:"开始日期,YYYY-MM-DD或RFC3339格式,包含当天"`
+	DateTo   string   `json:"date_to,omitempty" form:"date_to" jsonschema:"结束日期,YYYY-MM-DD或RFC3339格式,使用日期时包含当天"`
+	Pinned   *bool    `json:"pinned,omitempty" form:"pinned" jsonschema:"是否只导出置顶（或未置顶）的图片"`
+	Manifest string   `json:"manifest,omitempty" form:"manifest" jsonschema:"清单格式,json或csv,默认json,包含完整的生成参数"`
+}
+
+// ExportManifest 导出压缩包中的 manifest.json
+type ExportManifest struct {
+	ExportedAt time.Time             `json:"exported_at"`
+	Count      int                   `json:"count"`
+	Images     []ExportManifestEntry `json:"images"`
+}
+
+// ExportManifestEntry 导出的图片及其完整元数据
+type ExportManifestEntry struct {
+	// 图片在压缩包中的路径
+	File string `json:"file"`
+	// 读取图片失败时的错误信息，此时压缩包中没有该图片
+	Error string `json:"error,omitempty"`
+	*internal.ImageRecord
+}
+
+// VerifyProvenanceRequest 验证图片的溯源清单，id、url、image_base64 三选一
+type VerifyProvenanceRequest struct {
+	ID          string `json:"id,omitempty" jsonschema:"已保存图片的ID"`
+	Url         string `json:"url,omitempty" jsonschema:"已保存图片的访问地址"`
+	ImageBase64 string `json:"image_base64,omitempty" jsonschema:"待验证图片的base64数据,用于验证从其他渠道获得的图片"`
+	Manifest    string `json:"manifest,omitempty" jsonschema:"旁路溯源清单(.provenance.json)的内容,不指定时使用图片中嵌入的清单或已保存的旁路清单"`
+}
+
+// DetectWatermarkRequest 检测图片中的隐形水印，id、url、image_base64 三选一
+type DetectWatermarkRequest struct {
+	ID          string `json:"id,omitempty" jsonschema:"已保存图片的ID"`
+	Url         string `json:"url,omitempty" jsonschema:"已保存图片的访问地址"`
+	ImageBase64 string `json:"image_base64,omitempty" jsonschema:"待检测图片的base64数据,用于检测从其他渠道获得的图片"`
+}
+
+// ServerStatusResponse 服务状态：ok 表示所有后端可以访问且存储可写，
+// degraded 表示部分后端不可访问，unavailable 表示没有可以访问的后端或存储不可写
+type ServerStatusResponse struct {
+	Status        string                  `json:"status"`
+	UptimeSeconds int64                   `json:"uptime_seconds"`
+	Storage       StorageStatus           `json:"storage"`
+	Backends      []sdwebui.BackendStatus `json:"backends"`
+}
+
+// StorageStatus 图片存储状态
+type StorageStatus struct {
+	Type     string `json:"type"`
+	Writable bool   `json:"writable"`
+	Error    string `json:"error,omitempty"`
+}
+
+// AuditQueryRequest 查询审计日志，按时间倒序返回
+type AuditQueryRequest struct {
+	DateFrom  string `form:"date_from"`
+	DateTo    string `form:"date_to"`
+	Principal string `form:"principal"`
+	Tool      string `form:"tool"`
+	Action    string `form:"action"`
+	Outcome   string `form:"outcome"`
+	ImageID   string `form:"image_id"`
+	JobID     string `form:"job_id"`
+	Prompt    string `form:"prompt"`
+	Admin     bool   `form:"admin"`
+	Limit     int    `form:"limit"`
+}
+
+// AuditQueryResponse 审计日志查询结果
+type AuditQueryResponse struct {
+	Entries []*internal.AuditEntry `json:"entries"`
+	Count   int                    `json:"count"`
+}
+
+// ModerationQueryRequest 查询内容审核记录，按时间倒序返回
+type ModerationQueryRequest struct {
+	Principal string `form:"principal"`
+	Policy    string `form:"policy"`
+	// 只返回被拒绝的记录
+	Rejected bool `form:"rejected"`
+	Limit    int  `form:"limit"`
+}
+
+// ModerationQueryResponse 内容审核记录查询结果
+type ModerationQueryResponse struct {
+	Events []*internal.ModerationEvent `json:"events"`
+	Count  int                         `json:"count"`
+}